@@ -71,12 +71,29 @@ func InitProxyController(ng engine.Engine, stats engine.StatsProvider, router *m
 	router.HandleFunc("/v2/backends/{backendId}/servers", handlerWithBody(c.upsertServer)).Methods("POST")
 	router.HandleFunc("/v2/backends/{backendId}/servers/{id}", handlerWithBody(c.getServer)).Methods("GET")
 	router.HandleFunc("/v2/backends/{backendId}/servers/{id}", handlerWithBody(c.deleteServer)).Methods("DELETE")
+	router.HandleFunc("/v2/backends/{backendId}/servers/{id}/heartbeat", handlerWithBody(c.heartbeatServer)).Methods("PUT")
+	router.HandleFunc("/v2/backends/{backendId}/ejections", handlerWithBody(c.getOutlierEjections)).Methods("GET")
 
 	// Middlewares
 	router.HandleFunc("/v2/frontends/{frontend}/middlewares", handlerWithBody(c.upsertMiddleware)).Methods("POST")
 	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}", handlerWithBody(c.getMiddleware)).Methods("GET")
 	router.HandleFunc("/v2/frontends/{frontend}/middlewares", handlerWithBody(c.getMiddlewares)).Methods("GET")
 	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}", handlerWithBody(c.deleteMiddleware)).Methods("DELETE")
+
+	// Snapshot
+	router.HandleFunc("/v2/snapshot", handlerWithBody(c.getSnapshot)).Methods("GET")
+
+	// History
+	router.HandleFunc("/v2/history", handlerWithBody(c.getHistory)).Methods("GET")
+	router.HandleFunc("/v2/history/hosts/{hostname}", handlerWithBody(c.getHistory)).Methods("GET")
+	router.HandleFunc("/v2/history/listeners/{listenerId}", handlerWithBody(c.getHistory)).Methods("GET")
+	router.HandleFunc("/v2/history/backends/{backendId}", handlerWithBody(c.getHistory)).Methods("GET")
+	router.HandleFunc("/v2/history/backends/{backendId}/servers/{serverId}", handlerWithBody(c.getHistory)).Methods("GET")
+	router.HandleFunc("/v2/history/frontends/{frontendId}", handlerWithBody(c.getHistory)).Methods("GET")
+	router.HandleFunc("/v2/history/frontends/{frontendId}/middlewares/{middlewareId}", handlerWithBody(c.getHistory)).Methods("GET")
+
+	// Transactions
+	router.HandleFunc("/v2/transactions", handlerWithBody(c.commitTransaction)).Methods("POST")
 }
 
 func (c *ProxyController) handleError(w http.ResponseWriter, r *http.Request) {
@@ -271,6 +288,58 @@ func (c *ProxyController) deleteFrontend(w http.ResponseWriter, r *http.Request,
 	return Response{"message": "Frontend deleted"}, nil
 }
 
+func (c *ProxyController) getSnapshot(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	if rev := r.Form.Get("revision"); rev != "" {
+		revision, err := strconv.ParseUint(rev, 10, 64)
+		if err != nil {
+			return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("invalid revision %q", rev)}
+		}
+		return formatResult(c.ng.GetSnapshotAt(revision))
+	}
+	return formatResult(c.ng.GetSnapshot())
+}
+
+func (c *ProxyController) getHistory(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	limit, err := strconv.Atoi(formGet(r.Form, "limit", "0"))
+	if err != nil {
+		return nil, err
+	}
+	q := engine.HistoryQuery{Limit: limit}
+	switch {
+	case params["hostname"] != "":
+		q.Key = engine.HostKey{Name: params["hostname"]}
+	case params["listenerId"] != "":
+		q.Key = engine.ListenerKey{Id: params["listenerId"]}
+	case params["serverId"] != "":
+		q.Key = engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["serverId"]}
+	case params["backendId"] != "":
+		q.Key = engine.BackendKey{Id: params["backendId"]}
+	case params["middlewareId"] != "":
+		q.Key = engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: params["frontendId"]}, Id: params["middlewareId"]}
+	case params["frontendId"] != "":
+		q.Key = engine.FrontendKey{Id: params["frontendId"]}
+	}
+	revisions, err := c.ng.GetHistory(q)
+	if err != nil {
+		return nil, err
+	}
+	return Response{
+		"Revisions": revisions,
+	}, nil
+}
+
+func (c *ProxyController) commitTransaction(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	tx, err := engine.TransactionFromJSON(c.ng.GetRegistry().GetRouter(), body, c.ng.GetRegistry().GetSpec)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Commit %s", tx)
+	if err := c.ng.Commit(*tx); err != nil {
+		return nil, err
+	}
+	return Response{"message": fmt.Sprintf("Transaction with %d changes committed", len(tx.Changes))}, nil
+}
+
 func (c *ProxyController) upsertServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	backendId := params["backendId"]
 	srv, ttl, err := parseServerPack(body)
@@ -289,19 +358,61 @@ func (c *ProxyController) getServer(w http.ResponseWriter, r *http.Request, para
 	if err != nil {
 		return nil, err
 	}
-	return formatResult(srv, err)
+	srvs := []engine.Server{*srv}
+	c.setServersHealth(sk.BackendKey, srvs)
+	return &srvs[0], nil
 }
 
 func (c *ProxyController) getServers(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
-	srvs, err := c.ng.GetServers(engine.BackendKey{Id: params["backendId"]})
+	bk := engine.BackendKey{Id: params["backendId"]}
+	srvs, err := c.ng.GetServers(bk)
 	if err != nil {
 		return nil, err
 	}
+	c.setServersHealth(bk, srvs)
 	return Response{
 		"Servers": srvs,
 	}, nil
 }
 
+// setServersHealth adds the health reported by the proxy to the servers, the servers
+// are returned as is if the proxy does not know the backend yet
+func (c *ProxyController) setServersHealth(bk engine.BackendKey, srvs []engine.Server) {
+	health, err := c.stats.ServersHealth(bk)
+	if err != nil {
+		log.Infof("no health of %v servers: %v", bk, err)
+		return
+	}
+	for i := range srvs {
+		if h, ok := health[srvs[i].Id]; ok {
+			srvs[i].Health = &h
+		}
+	}
+}
+
+func (c *ProxyController) getOutlierEjections(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	limit, err := strconv.Atoi(formGet(r.Form, "limit", "0"))
+	if err != nil {
+		return nil, err
+	}
+	bk := engine.BackendKey{Id: params["backendId"]}
+	if _, err := c.ng.GetBackend(bk); err != nil {
+		return nil, err
+	}
+	// The proxy may not know the backend yet, it has no ejections then
+	ejections, err := c.stats.OutlierEjections(bk)
+	if err != nil {
+		log.Infof("no ejections of %v servers: %v", bk, err)
+		ejections = []engine.OutlierEjection{}
+	}
+	if limit > 0 && limit < len(ejections) {
+		ejections = ejections[len(ejections)-limit:]
+	}
+	return Response{
+		"Ejections": ejections,
+	}, nil
+}
+
 func (c *ProxyController) deleteServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["id"]}
 	log.Infof("Delete %v", sk)
@@ -311,6 +422,18 @@ func (c *ProxyController) deleteServer(w http.ResponseWriter, r *http.Request, p
 	return Response{"message": "Server deleted"}, nil
 }
 
+func (c *ProxyController) heartbeatServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["id"]}
+	ttl, err := parseHeartbeatPack(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ng.HeartbeatServer(sk, ttl); err != nil {
+		return nil, err
+	}
+	return Response{"message": "Server heartbeat received"}, nil
+}
+
 func (c *ProxyController) upsertMiddleware(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	frontend := params["frontend"]
 	m, ttl, err := parseMiddlewarePack(body, c.ng.GetRegistry())
@@ -413,6 +536,10 @@ type serverPack struct {
 	TTL    string
 }
 
+type heartbeatPack struct {
+	TTL string
+}
+
 func parseListenerPack(v []byte) (*engine.Listener, error) {
 	var lp listenerReadPack
 	if err := json.Unmarshal(v, &lp); err != nil {
@@ -503,6 +630,8 @@ func parseServerPack(v []byte) (*engine.Server, time.Duration, error) {
 	if err != nil {
 		return nil, 0, err
 	}
+	// Health is reported by the proxy, it is never stored
+	s.Health = nil
 	var ttl time.Duration
 	if sp.TTL != "" {
 		ttl, err = time.ParseDuration(sp.TTL)
@@ -513,6 +642,24 @@ func parseServerPack(v []byte) (*engine.Server, time.Duration, error) {
 	return s, ttl, nil
 }
 
+func parseHeartbeatPack(v []byte) (time.Duration, error) {
+	var hp heartbeatPack
+	if err := json.Unmarshal(v, &hp); err != nil {
+		return 0, err
+	}
+	if hp.TTL == "" {
+		return 0, &errMissingField{Field: "TTL"}
+	}
+	ttl, err := time.ParseDuration(hp.TTL)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, &engine.InvalidFormatError{Message: "heartbeat TTL should be positive"}
+	}
+	return ttl, nil
+}
+
 // getHeapProfile responds with a pprof-formatted heap profile.
 func getHeapProfile(w http.ResponseWriter, r *http.Request) {
 	// Ensure up-to-date data.
@@ -552,6 +699,8 @@ func handlerWithBody(fn handlerWithBodyFn) http.HandlerFunc {
 				status = http.StatusNotFound
 			case *engine.AlreadyExistsError:
 				status = http.StatusConflict
+			case *engine.NotSupportedError:
+				status = http.StatusNotImplemented
 			default:
 				status = http.StatusInternalServerError
 			}
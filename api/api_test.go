@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -197,6 +198,56 @@ func (s *ApiSuite) TestServerCRUD(c *C) {
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
 }
 
+func (s *ApiSuite) TestServerWeight(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	bk := engine.BackendKey{Id: b.Id}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000", Weight: 3}
+	c.Assert(s.client.UpsertServer(bk, srv, 0), IsNil)
+
+	out, err := s.client.GetServer(engine.ServerKey{Id: srv.Id, BackendKey: bk})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &srv)
+
+	srv.Weight = -1
+	c.Assert(s.client.UpsertServer(bk, srv, 0), NotNil)
+}
+
+func (s *ApiSuite) TestOutlierEjections(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{
+		OutlierDetection: &engine.HTTPBackendOutlierDetection{}})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	out, err := s.client.GetOutlierEjections(b.Key(), 0)
+	c.Assert(err, IsNil)
+	c.Assert(out, HasLen, 0)
+
+	_, err = s.client.GetOutlierEjections(engine.BackendKey{Id: "missing"}, 0)
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *ApiSuite) TestServerHeartbeat(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	bk := engine.BackendKey{Id: b.Id}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	sk := engine.ServerKey{Id: srv.Id, BackendKey: bk}
+	c.Assert(s.client.Heartbeat(sk, 10*time.Second), FitsTypeOf, &engine.NotFoundError{})
+
+	c.Assert(s.client.UpsertServer(bk, srv, 10*time.Second), IsNil)
+	c.Assert(s.client.Heartbeat(sk, 10*time.Second), IsNil)
+	c.Assert(s.client.Heartbeat(sk, 0), NotNil)
+
+	out, err := s.client.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &srv)
+}
+
 func (s *ApiSuite) TestFrontendCRUD(c *C) {
 	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
 	c.Assert(err, IsNil)
@@ -284,6 +335,94 @@ func (s *ApiSuite) TestMiddlewareCRUD(c *C) {
 
 }
 
+func (s *ApiSuite) TestTransaction(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+
+	srv, err := engine.NewServer("srv1", "http://localhost:5000")
+	c.Assert(err, IsNil)
+
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+
+	cl := s.makeConnLimit("c1", 10, "client.ip", 2, f)
+
+	tx := engine.Transaction{Changes: []interface{}{
+		&engine.MiddlewareUpserted{FrontendKey: fk, Middleware: cl},
+		&engine.FrontendUpserted{Frontend: *f},
+		&engine.ServerUpserted{BackendKey: b.Key(), Server: *srv},
+		&engine.BackendUpserted{Backend: *b},
+	}}
+	c.Assert(s.client.Commit(tx), IsNil)
+
+	out, err := s.client.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+
+	m, err := s.client.GetMiddleware(engine.MiddlewareKey{Id: cl.Id, FrontendKey: fk})
+	c.Assert(err, IsNil)
+	c.Assert(m, DeepEquals, &cl)
+
+	servers, err := s.client.GetServers(b.Key())
+	c.Assert(err, IsNil)
+	c.Assert(servers, DeepEquals, []engine.Server{*srv})
+
+	// Backend is still in use by the frontend, the whole transaction is rejected
+	tx = engine.Transaction{Changes: []interface{}{
+		&engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: b.Key(), Id: srv.Id}},
+		&engine.BackendDeleted{BackendKey: b.Key()},
+	}}
+	c.Assert(s.client.Commit(tx), NotNil)
+
+	servers, err = s.client.GetServers(b.Key())
+	c.Assert(err, IsNil)
+	c.Assert(len(servers), Equals, 1)
+
+	// Missing objects are reported as not found
+	tx = engine.Transaction{Changes: []interface{}{
+		&engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: "missing"}},
+	}}
+	c.Assert(s.client.Commit(tx), FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *ApiSuite) TestHistory(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	srv, err := engine.NewServer("srv1", "http://localhost:5000")
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertServer(b.Key(), *srv, 0), IsNil)
+
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f1", b.Id, `Path("/v1")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+
+	cl := s.makeConnLimit("c1", 10, "client.ip", 2, f)
+	c.Assert(s.client.UpsertMiddleware(f.Key(), cl, 0), IsNil)
+
+	revisions, err := s.client.GetHistory(engine.HistoryQuery{})
+	c.Assert(err, IsNil)
+	c.Assert(len(revisions), Equals, 4)
+
+	for _, key := range []interface{}{b.Key(), engine.ServerKey{BackendKey: b.Key(), Id: srv.Id}, f.Key(), engine.MiddlewareKey{FrontendKey: f.Key(), Id: cl.Id}} {
+		out, err := s.client.GetHistory(engine.HistoryQuery{Key: key})
+		c.Assert(err, IsNil)
+		c.Assert(len(out), Equals, 1)
+		c.Assert(engine.ChangeKey(out[0].Change), Equals, key)
+	}
+
+	out, err := s.client.GetHistory(engine.HistoryQuery{Key: f.Key()})
+	c.Assert(err, IsNil)
+	c.Assert(out[0].Change, DeepEquals, &engine.FrontendUpserted{Frontend: *f})
+
+	snapshot, err := s.client.GetSnapshotAt(revisions[1].Index)
+	c.Assert(err, IsNil)
+	c.Assert(len(snapshot.BackendSpecs), Equals, 1)
+	c.Assert(len(snapshot.FrontendSpecs), Equals, 0)
+}
+
 func (s *ApiSuite) makeConnLimit(id string, connections int64, variable string, priority int, f *engine.Frontend) engine.Middleware {
 	cl, err := connlimit.NewConnLimit(connections, variable)
 	if err != nil {
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/vulcand/vulcand/engine"
@@ -178,6 +179,15 @@ func (c *Client) UpsertServer(bk engine.BackendKey, srv engine.Server, ttl time.
 	return err
 }
 
+// Heartbeat extends the registration of the server by the TTL without rewriting it
+func (c *Client) Heartbeat(sk engine.ServerKey, ttl time.Duration) error {
+	if sk.BackendKey.Id == "" || sk.Id == "" {
+		return fmt.Errorf("backend id and server id can not be empty")
+	}
+	_, err := c.Put(c.endpoint("backends", sk.BackendKey.Id, "servers", sk.Id, "heartbeat"), heartbeatPack{TTL: ttl.String()})
+	return err
+}
+
 func (c *Client) TopServers(bk *engine.BackendKey, limit int) ([]engine.Server, error) {
 	values := url.Values{
 		"limit": {fmt.Sprintf("%d", limit)},
@@ -215,6 +225,23 @@ func (c *Client) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
 	return engine.ServersFromJSON(data)
 }
 
+// GetOutlierEjections returns the most recent ejections of the backend servers by the outlier detection,
+// oldest first, 0 limit returns all ejections kept by the proxy
+func (c *Client) GetOutlierEjections(bk engine.BackendKey, limit int) ([]engine.OutlierEjection, error) {
+	if bk.Id == "" {
+		return nil, fmt.Errorf("backend id can not be empty")
+	}
+	data, err := c.Get(c.endpoint("backends", bk.Id, "ejections"), url.Values{"limit": {strconv.Itoa(limit)}})
+	if err != nil {
+		return nil, err
+	}
+	var re *EjectionsResponse
+	if err = json.Unmarshal(data, &re); err != nil {
+		return nil, err
+	}
+	return re.Ejections, nil
+}
+
 func (c *Client) DeleteServer(sk engine.ServerKey) error {
 	if sk.BackendKey.Id == "" {
 		return fmt.Errorf("backend id can not be empty")
@@ -266,6 +293,57 @@ func (c *Client) PutForm(endpoint string, values url.Values) error {
 	return nil
 }
 
+// GetSnapshot returns the complete configuration
+func (c *Client) GetSnapshot() (*engine.Snapshot, error) {
+	data, err := c.Get(c.endpoint("snapshot"), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	return engine.SnapshotFromJSON(c.Registry.GetRouter(), data, c.Registry.GetSpec)
+}
+
+// GetSnapshotAt returns the configuration as of the given revision
+func (c *Client) GetSnapshotAt(revision uint64) (*engine.Snapshot, error) {
+	data, err := c.Get(c.endpoint("snapshot"), url.Values{"revision": {strconv.FormatUint(revision, 10)}})
+	if err != nil {
+		return nil, err
+	}
+	return engine.SnapshotFromJSON(c.Registry.GetRouter(), data, c.Registry.GetSpec)
+}
+
+// GetHistory returns the configuration changes selected by the query, oldest first
+func (c *Client) GetHistory(q engine.HistoryQuery) ([]engine.Revision, error) {
+	path := []string{"history"}
+	switch key := q.Key.(type) {
+	case nil:
+	case engine.HostKey:
+		path = append(path, "hosts", key.Name)
+	case engine.ListenerKey:
+		path = append(path, "listeners", key.Id)
+	case engine.BackendKey:
+		path = append(path, "backends", key.Id)
+	case engine.ServerKey:
+		path = append(path, "backends", key.BackendKey.Id, "servers", key.Id)
+	case engine.FrontendKey:
+		path = append(path, "frontends", key.Id)
+	case engine.MiddlewareKey:
+		path = append(path, "frontends", key.FrontendKey.Id, "middlewares", key.Id)
+	default:
+		return nil, fmt.Errorf("unsupported key: %#v", q.Key)
+	}
+	data, err := c.Get(c.endpoint(path...), url.Values{"limit": {strconv.Itoa(q.Limit)}})
+	if err != nil {
+		return nil, err
+	}
+	return engine.RevisionsFromJSON(c.Registry.GetRouter(), data, c.Registry.GetSpec)
+}
+
+// Commit applies all changes of the transaction atomically
+func (c *Client) Commit(tx engine.Transaction) error {
+	_, err := c.Post(c.endpoint("transactions"), tx)
+	return err
+}
+
 func (c *Client) Post(endpoint string, in interface{}) ([]byte, error) {
 	return c.RoundTrip(func() (*http.Response, error) {
 		data, err := json.Marshal(in)
@@ -342,6 +420,9 @@ func (c *Client) RoundTrip(fn RoundTripFn) ([]byte, error) {
 		if response.StatusCode == http.StatusConflict {
 			return nil, &engine.AlreadyExistsError{Message: status.Message}
 		}
+		if response.StatusCode == http.StatusNotImplemented {
+			return nil, &engine.NotSupportedError{Message: status.Message}
+		}
 		return nil, status
 	}
 	return responseBody, nil
@@ -359,6 +440,10 @@ type ServersResponse struct {
 	Servers []engine.Server
 }
 
+type EjectionsResponse struct {
+	Ejections []engine.OutlierEjection
+}
+
 type StatusResponse struct {
 	Message string
 }
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Plan is a set of changes turning one configuration snapshot into another
+type Plan struct {
+	// Added contains upserts of the objects missing from the current snapshot
+	Added []interface{}
+	// Changed contains upserts of the objects that exist in both snapshots but differ
+	Changed []interface{}
+	// Removed contains deletes of the objects missing from the desired snapshot
+	Removed []interface{}
+}
+
+// Empty returns true if there are no changes to apply
+func (p *Plan) Empty() bool {
+	return len(p.Added) == 0 && len(p.Changed) == 0 && len(p.Removed) == 0
+}
+
+// Transaction returns the transaction applying all changes of the plan
+func (p *Plan) Transaction() Transaction {
+	var changes []interface{}
+	changes = append(changes, p.Added...)
+	changes = append(changes, p.Changed...)
+	changes = append(changes, p.Removed...)
+	return Transaction{Changes: changes}
+}
+
+// DiffSnapshots compares the current snapshot with the desired one and returns the plan turning current into desired.
+// Objects are compared by their JSON representation. Objects missing from the desired snapshot are removed only
+// if prune is set, otherwise they are left intact.
+func DiffSnapshots(current, desired *Snapshot, prune bool) (*Plan, error) {
+	p := &Plan{}
+
+	hosts := map[HostKey]Host{}
+	for _, h := range current.Hosts {
+		hosts[h.Key()] = h
+	}
+	for _, h := range desired.Hosts {
+		cur, ok := hosts[h.Key()]
+		if err := p.compare(cur, h, ok, &HostUpserted{Host: h}); err != nil {
+			return nil, err
+		}
+		delete(hosts, h.Key())
+	}
+
+	listeners := map[ListenerKey]Listener{}
+	for _, l := range current.Listeners {
+		listeners[l.Key()] = l
+	}
+	for _, l := range desired.Listeners {
+		cur, ok := listeners[l.Key()]
+		if err := p.compare(cur, l, ok, &ListenerUpserted{Listener: l}); err != nil {
+			return nil, err
+		}
+		delete(listeners, l.Key())
+	}
+
+	backends := map[BackendKey]BackendSpec{}
+	for _, bs := range current.BackendSpecs {
+		backends[bs.Backend.Key()] = bs
+	}
+	var servers []ServerKey
+	for _, bs := range desired.BackendSpecs {
+		bk := bs.Backend.Key()
+		cur, ok := backends[bk]
+		if err := p.compare(cur.Backend, bs.Backend, ok, &BackendUpserted{Backend: bs.Backend}); err != nil {
+			return nil, err
+		}
+		delete(backends, bk)
+
+		srvs := map[string]Server{}
+		for _, srv := range cur.Servers {
+			srvs[srv.Id] = srv
+		}
+		for _, srv := range bs.Servers {
+			old, ok := srvs[srv.Id]
+			if err := p.compare(old, srv, ok, &ServerUpserted{BackendKey: bk, Server: srv}); err != nil {
+				return nil, err
+			}
+			delete(srvs, srv.Id)
+		}
+		for _, srv := range cur.Servers {
+			if _, ok := srvs[srv.Id]; ok {
+				servers = append(servers, ServerKey{BackendKey: bk, Id: srv.Id})
+			}
+		}
+	}
+
+	frontends := map[FrontendKey]FrontendSpec{}
+	for _, fs := range current.FrontendSpecs {
+		frontends[fs.Frontend.Key()] = fs
+	}
+	var middlewares []MiddlewareKey
+	for _, fs := range desired.FrontendSpecs {
+		fk := fs.Frontend.Key()
+		cur, ok := frontends[fk]
+		if err := p.compare(cur.Frontend, fs.Frontend, ok, &FrontendUpserted{Frontend: fs.Frontend}); err != nil {
+			return nil, err
+		}
+		delete(frontends, fk)
+
+		ms := map[string]Middleware{}
+		for _, m := range cur.Middlewares {
+			ms[m.Id] = m
+		}
+		for _, m := range fs.Middlewares {
+			old, ok := ms[m.Id]
+			if err := p.compare(old, m, ok, &MiddlewareUpserted{FrontendKey: fk, Middleware: m}); err != nil {
+				return nil, err
+			}
+			delete(ms, m.Id)
+		}
+		for _, m := range cur.Middlewares {
+			if _, ok := ms[m.Id]; ok {
+				middlewares = append(middlewares, MiddlewareKey{FrontendKey: fk, Id: m.Id})
+			}
+		}
+	}
+
+	if !prune {
+		return p, nil
+	}
+
+	// Removals are collected in the order of the current snapshot to keep the plan stable
+	for _, fs := range current.FrontendSpecs {
+		if _, ok := frontends[fs.Frontend.Key()]; !ok {
+			continue
+		}
+		for _, m := range fs.Middlewares {
+			p.Removed = append(p.Removed, &MiddlewareDeleted{MiddlewareKey: MiddlewareKey{FrontendKey: fs.Frontend.Key(), Id: m.Id}})
+		}
+		p.Removed = append(p.Removed, &FrontendDeleted{FrontendKey: fs.Frontend.Key()})
+	}
+	for _, mk := range middlewares {
+		p.Removed = append(p.Removed, &MiddlewareDeleted{MiddlewareKey: mk})
+	}
+	for _, bs := range current.BackendSpecs {
+		if _, ok := backends[bs.Backend.Key()]; !ok {
+			continue
+		}
+		for _, srv := range bs.Servers {
+			p.Removed = append(p.Removed, &ServerDeleted{ServerKey: ServerKey{BackendKey: bs.Backend.Key(), Id: srv.Id}})
+		}
+		p.Removed = append(p.Removed, &BackendDeleted{BackendKey: bs.Backend.Key()})
+	}
+	for _, sk := range servers {
+		p.Removed = append(p.Removed, &ServerDeleted{ServerKey: sk})
+	}
+	for _, l := range current.Listeners {
+		if _, ok := listeners[l.Key()]; ok {
+			p.Removed = append(p.Removed, &ListenerDeleted{ListenerKey: l.Key()})
+		}
+	}
+	for _, h := range current.Hosts {
+		if _, ok := hosts[h.Key()]; ok {
+			p.Removed = append(p.Removed, &HostDeleted{HostKey: h.Key()})
+		}
+	}
+	return p, nil
+}
+
+// compare adds the upsert to the plan if the object is missing or differs from the current one
+func (p *Plan) compare(current, desired interface{}, exists bool, upsert interface{}) error {
+	if !exists {
+		p.Added = append(p.Added, upsert)
+		return nil
+	}
+	equal, err := jsonEquals(current, desired)
+	if err != nil {
+		return err
+	}
+	if !equal {
+		p.Changed = append(p.Changed, upsert)
+	}
+	return nil
+}
+
+func jsonEquals(a, b interface{}) (bool, error) {
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ab, bb), nil
+}
@@ -76,10 +76,24 @@ type Engine interface {
 	// UpsertServer updates or inserts a server. BackendKey.Id and Server.Id should not be empty.
 	// TTL provides time to expire, in case if it's 0 server is permanent.
 	UpsertServer(BackendKey, Server, time.Duration) error
+	// HeartbeatServer extends the registration of the server by the given TTL without changing the server,
+	// so it does not generate change events. Returns engine.NotFoundError if server not found, e.g. if it has expired.
+	HeartbeatServer(ServerKey, time.Duration) error
 	// DeleteServer deletes a server by given key. ServerKey.Id should not be empty.
 	// Returns engine.NotFoundError if server not found
 	DeleteServer(ServerKey) error
 
+	// Commit applies all changes of the transaction atomically, either all of them succeed or none.
+	// Subscribe should emit the committed changes as a single TransactionCommitted event.
+	Commit(Transaction) error
+
+	// GetHistory returns the recorded configuration changes selected by the query, oldest first.
+	// The history is bounded, the oldest revisions are eventually discarded.
+	GetHistory(HistoryQuery) ([]Revision, error)
+	// GetSnapshotAt returns the configuration as of the given revision,
+	// or engine.NotFoundError if the revision is no longer in the history.
+	GetSnapshotAt(revision uint64) (*Snapshot, error)
+
 	// Subscribe is an entry point for getting the configuration changes as well as the initial configuration.
 	// It should be a blocking function generating events from change.go to the changes channel.
 	// Each change should be an instance of the struct provided in events.go
@@ -145,7 +145,7 @@ func (n *ng) parseBackends(node *etcd.Node, skipServers ...bool) ([]engine.Backe
 		for _, node := range node.Nodes {
 			switch suffix(node.Key) {
 			case "backend":
-				backend, err := engine.BackendFromJSON([]byte(node.Value), backendId)
+				backend, err := n.parseBackend([]byte(node.Value), backendId)
 				if err != nil {
 					return nil, err
 				}
@@ -184,13 +184,7 @@ func (n *ng) parseHosts(node *etcd.Node) ([]engine.Host, error) {
 				if err := json.Unmarshal([]byte(node.Value), &sealedHost); err != nil {
 					return nil, err
 				}
-				var keyPair *engine.KeyPair
-				if len(sealedHost.Settings.KeyPair) != 0 {
-					if err := n.openSealedJSONVal(sealedHost.Settings.KeyPair, &keyPair); err != nil {
-						return nil, err
-					}
-				}
-				host, err := engine.NewHost(hostname, engine.HostSettings{Default: sealedHost.Settings.Default, KeyPair: keyPair, OCSP: sealedHost.Settings.OCSP})
+				host, err := n.openHost(hostname, &sealedHost)
 				if err != nil {
 					return nil, err
 				}
@@ -208,7 +202,7 @@ func (n *ng) parseListeners(node *etcd.Node) ([]engine.Listener, error) {
 	listeners := make([]engine.Listener, len(node.Nodes))
 	for idx, node := range node.Nodes {
 		listenerId := suffix(node.Key)
-		listener, err := engine.ListenerFromJSON([]byte(node.Value), listenerId)
+		listener, err := n.parseListener([]byte(node.Value), listenerId)
 		if err != nil {
 			return nil, err
 		}
@@ -327,15 +321,27 @@ func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
 	if err != nil {
 		return nil, err
 	}
+	return n.openHost(key.Name, host)
+}
 
+// openHost converts the stored representation of the host back, opening its sealed settings
+func (n *ng) openHost(name string, h *host) (*engine.Host, error) {
 	var keyPair *engine.KeyPair
-	if len(host.Settings.KeyPair) != 0 {
-		if err := n.openSealedJSONVal(host.Settings.KeyPair, &keyPair); err != nil {
+	if len(h.Settings.KeyPair) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.KeyPair, &keyPair); err != nil {
 			return nil, err
 		}
 	}
-
-	return engine.NewHost(key.Name, engine.HostSettings{Default: host.Settings.Default, KeyPair: keyPair, OCSP: host.Settings.OCSP})
+	if h.Settings.KeyPairRef != "" {
+		keyPair = &engine.KeyPair{Ref: h.Settings.KeyPairRef}
+	}
+	var clientAuth *engine.ClientAuthSettings
+	if len(h.Settings.ClientAuth) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.ClientAuth, &clientAuth); err != nil {
+			return nil, err
+		}
+	}
+	return engine.NewHost(name, engine.HostSettings{Default: h.Settings.Default, KeyPair: keyPair, OCSP: h.Settings.OCSP, ClientAuth: clientAuth})
 }
 
 func (n *ng) UpsertHost(h engine.Host) error {
@@ -352,13 +358,22 @@ func (n *ng) UpsertHost(h engine.Host) error {
 		},
 	}
 
-	if h.Settings.KeyPair != nil {
+	if h.Settings.KeyPair != nil && h.Settings.KeyPair.Ref != "" {
+		val.Settings.KeyPairRef = h.Settings.KeyPair.Ref
+	} else if h.Settings.KeyPair != nil {
 		bytes, err := n.sealJSONVal(h.Settings.KeyPair)
 		if err != nil {
 			return err
 		}
 		val.Settings.KeyPair = bytes
 	}
+	if h.Settings.ClientAuth != nil {
+		bytes, err := n.sealJSONVal(h.Settings.ClientAuth)
+		if err != nil {
+			return err
+		}
+		val.Settings.ClientAuth = bytes
+	}
 
 	return n.setJSONVal(hostKey, val, noTTL)
 }
@@ -392,7 +407,7 @@ func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	l, err := engine.ListenerFromJSON([]byte(bytes), key.Id)
+	l, err := n.parseListener([]byte(bytes), key.Id)
 	if err != nil {
 		return nil, err
 	}
@@ -403,7 +418,47 @@ func (n *ng) UpsertListener(listener engine.Listener) error {
 	if listener.Id == "" {
 		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
 	}
-	return n.setJSONVal(n.path("listeners", listener.Id), listener, noTTL)
+	val, err := n.sealListener(listener)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("listeners", listener.Id), val, noTTL)
+}
+
+// sealListener converts the listener to the stored representation with the client auth settings sealed
+func (n *ng) sealListener(l engine.Listener) (*listener, error) {
+	if l.Settings == nil || l.Settings.ClientAuth == nil {
+		return &listener{Listener: l}, nil
+	}
+	bytes, err := n.sealJSONVal(l.Settings.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	settings := *l.Settings
+	settings.ClientAuth = nil
+	l.Settings = &settings
+	return &listener{Listener: l, ClientAuth: bytes}, nil
+}
+
+// parseListener parses the stored representation of the listener, opening its sealed client auth settings
+func (n *ng) parseListener(val []byte, id string) (*engine.Listener, error) {
+	var sealed listener
+	if err := json.Unmarshal(val, &sealed); err != nil {
+		return nil, err
+	}
+	l, err := engine.ListenerFromJSON(val, id)
+	if err != nil || len(sealed.ClientAuth) == 0 {
+		return l, err
+	}
+	var clientAuth *engine.ClientAuthSettings
+	if err := n.openSealedJSONVal(sealed.ClientAuth, &clientAuth); err != nil {
+		return nil, err
+	}
+	if l.Settings == nil {
+		l.Settings = &engine.HTTPSListenerSettings{}
+	}
+	l.Settings.ClientAuth = clientAuth
+	return l, nil
 }
 
 func (n *ng) DeleteListener(key engine.ListenerKey) error {
@@ -417,8 +472,10 @@ func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
 	if f.Id == "" {
 		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
 	}
-	if _, err := n.GetBackend(engine.BackendKey{Id: f.BackendId}); err != nil {
-		return err
+	for _, bk := range f.BackendKeys() {
+		if _, err := n.GetBackend(bk); err != nil {
+			return err
+		}
 	}
 	if err := n.setJSONVal(n.path("frontends", f.Id, "frontend"), f, noTTL); err != nil {
 		return err
@@ -493,14 +550,65 @@ func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return engine.BackendFromJSON([]byte(bytes), key.Id)
+	return n.parseBackend([]byte(bytes), key.Id)
 }
 
 func (n *ng) UpsertBackend(b engine.Backend) error {
 	if b.Id == "" {
 		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
 	}
-	return n.setJSONVal(n.path("backends", b.Id, "backend"), b, noTTL)
+	val, err := n.sealBackend(b)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("backends", b.Id, "backend"), val, noTTL)
+}
+
+// sealBackend converts the backend to the stored representation with the TLS key pair sealed
+func (n *ng) sealBackend(b engine.Backend) (*backend, error) {
+	s, ok := b.Settings.(engine.HTTPBackendSettings)
+	if !ok || s.TLS == nil || s.TLS.KeyPair == nil {
+		return &backend{Backend: b}, nil
+	}
+	bytes, err := n.sealJSONVal(s.TLS.KeyPair)
+	if err != nil {
+		return nil, err
+	}
+	tlsSettings := *s.TLS
+	tlsSettings.KeyPair = nil
+	s.TLS = &tlsSettings
+	b.Settings = s
+	return &backend{Backend: b, KeyPair: bytes}, nil
+}
+
+// parseBackend parses the stored representation of the backend, opening its sealed TLS key pair
+func (n *ng) parseBackend(val []byte, id string) (*engine.Backend, error) {
+	var sealed struct {
+		KeyPair []byte
+	}
+	if err := json.Unmarshal(val, &sealed); err != nil {
+		return nil, err
+	}
+	b, err := engine.BackendFromJSON(val, id)
+	if err != nil || len(sealed.KeyPair) == 0 {
+		return b, err
+	}
+	var keyPair *engine.KeyPair
+	if err := n.openSealedJSONVal(sealed.KeyPair, &keyPair); err != nil {
+		return nil, err
+	}
+	s := b.HTTPSettings()
+	tlsSettings := engine.TLSSettings{}
+	if s.TLS != nil {
+		tlsSettings = *s.TLS
+	}
+	tlsSettings.KeyPair = keyPair
+	s.TLS = &tlsSettings
+	if _, err := s.TransportSettings(); err != nil {
+		return nil, err
+	}
+	b.Settings = s
+	return b, nil
 }
 
 func (n *ng) DeleteBackend(bk engine.BackendKey) error {
@@ -512,7 +620,7 @@ func (n *ng) DeleteBackend(bk engine.BackendKey) error {
 		return err
 	}
 	if len(fs) != 0 {
-		return fmt.Errorf("can not delete backend '%v', it is in use by %s", bk, fs)
+		return fmt.Errorf("can not delete backend '%v', it is in use by %v", bk, fs)
 	}
 	_, err = n.kapi.Delete(n.context, n.path("backends", bk.Id), &etcd.DeleteOptions{Recursive: true})
 	return convertErr(err)
@@ -603,6 +711,37 @@ func (n *ng) DeleteServer(sk engine.ServerKey) error {
 	return n.deleteKey(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
 }
 
+// HeartbeatServer refreshes the TTL of the server key, refresh does not change the value and does not notify watchers
+func (n *ng) HeartbeatServer(sk engine.ServerKey, ttl time.Duration) error {
+	if sk.Id == "" || sk.BackendKey.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	if ttl <= 0 {
+		return &engine.InvalidFormatError{Message: "heartbeat TTL should be positive"}
+	}
+	_, err := n.kapi.Set(n.context, n.path("backends", sk.BackendKey.Id, "servers", sk.Id), "", &etcd.SetOptions{
+		TTL:       ttl,
+		Refresh:   true,
+		PrevExist: etcd.PrevExist,
+	})
+	return convertErr(err)
+}
+
+// Commit is not supported, etcd v2 API has no multi-key transactions. Use etcd v3 engine instead.
+func (n *ng) Commit(tx engine.Transaction) error {
+	return &engine.NotSupportedError{Message: "transactions are not supported by etcd v2 engine, use etcd v3 API"}
+}
+
+// GetHistory is not supported, etcd v2 API keeps no revisions of deleted and overwritten keys. Use etcd v3 engine instead.
+func (n *ng) GetHistory(q engine.HistoryQuery) ([]engine.Revision, error) {
+	return nil, &engine.NotSupportedError{Message: "history is not supported by etcd v2 engine, use etcd v3 API"}
+}
+
+// GetSnapshotAt is not supported, see GetHistory for details
+func (n *ng) GetSnapshotAt(revision uint64) (*engine.Snapshot, error) {
+	return nil, &engine.NotSupportedError{Message: "history is not supported by etcd v2 engine, use etcd v3 API"}
+}
+
 func (n *ng) openSealedJSONVal(bytes []byte, val interface{}) error {
 	if n.options.Box == nil {
 		return errors.New("need secretbox to open sealed data")
@@ -640,7 +779,7 @@ func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
 		return nil, err
 	}
 	for _, f := range fs {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk) {
 			usedFs = append(usedFs, f)
 		}
 	}
@@ -1004,7 +1143,21 @@ type host struct {
 }
 
 type hostSettings struct {
-	Default bool
-	KeyPair []byte
-	OCSP    engine.OCSPSettings
+	Default    bool
+	KeyPair    []byte
+	KeyPairRef string `json:",omitempty"`
+	OCSP       engine.OCSPSettings
+	ClientAuth []byte `json:",omitempty"`
+}
+
+// listener is the stored representation of listeners, client auth settings are sealed as they carry CA bundles
+type listener struct {
+	engine.Listener
+	ClientAuth []byte `json:",omitempty"`
+}
+
+// backend is the stored representation of backends, TLS key pairs are sealed as they carry private keys
+type backend struct {
+	engine.Backend
+	KeyPair []byte `json:",omitempty"`
 }
@@ -112,6 +112,14 @@ func (s *EtcdSuite) TestHostWithKeyPair(c *C) {
 	s.suite.HostWithKeyPair(c)
 }
 
+func (s *EtcdSuite) TestHostWithKeyPairRef(c *C) {
+	s.suite.HostWithKeyPairRef(c)
+}
+
+func (s *EtcdSuite) TestHostWithClientAuth(c *C) {
+	s.suite.HostWithClientAuth(c)
+}
+
 func (s *EtcdSuite) TestHostUpsertKeyPair(c *C) {
 	s.suite.HostUpsertKeyPair(c)
 }
@@ -128,10 +136,18 @@ func (s *EtcdSuite) TestListenerSettingsCRUD(c *C) {
 	s.suite.ListenerSettingsCRUD(c)
 }
 
+func (s *EtcdSuite) TestListenerWithClientAuth(c *C) {
+	s.suite.ListenerWithClientAuth(c)
+}
+
 func (s *EtcdSuite) TestBackendCRUD(c *C) {
 	s.suite.BackendCRUD(c)
 }
 
+func (s *EtcdSuite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
 func (s *EtcdSuite) TestBackendDeleteUsed(c *C) {
 	s.suite.BackendDeleteUsed(c)
 }
@@ -148,6 +164,10 @@ func (s *EtcdSuite) TestServerExpire(c *C) {
 	s.suite.ServerExpire(c)
 }
 
+func (s *EtcdSuite) TestServerHeartbeat(c *C) {
+	s.suite.ServerHeartbeat(c)
+}
+
 func (s *EtcdSuite) TestFrontendCRUD(c *C) {
 	s.suite.FrontendCRUD(c)
 }
@@ -160,6 +180,14 @@ func (s *EtcdSuite) TestFrontendBadBackend(c *C) {
 	s.suite.FrontendBadBackend(c)
 }
 
+func (s *EtcdSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *EtcdSuite) TestFrontendFanOut(c *C) {
+	s.suite.FrontendFanOut(c)
+}
+
 func (s *EtcdSuite) TestMiddlewareCRUD(c *C) {
 	s.suite.MiddlewareCRUD(c)
 }
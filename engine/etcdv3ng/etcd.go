@@ -5,13 +5,16 @@ package etcdv3ng
 import (
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/mailgun/metrics"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/plugin"
@@ -30,6 +33,16 @@ type ng struct {
 	logsev        log.Level
 	options       Options
 	requireQuorum bool
+
+	leaseMu sync.Mutex
+	// leases are the leases shared by the keys registered with the same TTL, by TTL in seconds
+	leases map[int64]*sharedLease
+}
+
+// sharedLease is the lease of all keys registered with the same TTL
+type sharedLease struct {
+	id        etcd.LeaseID
+	renewedAt time.Time
 }
 
 type Options struct {
@@ -39,6 +52,8 @@ type Options struct {
 	EtcdKeyFile             string
 	EtcdSyncIntervalSeconds int64
 	Box                     *secret.Box
+	// MetricsClient receives the watch error and resync counters
+	MetricsClient metrics.Client
 }
 
 var (
@@ -51,11 +66,15 @@ var (
 )
 
 func New(nodes []string, etcdKey string, registry *plugin.Registry, options Options) (engine.Engine, error) {
+	if options.MetricsClient == nil {
+		options.MetricsClient = metrics.NewNop()
+	}
 	n := &ng{
 		nodes:    nodes,
 		registry: registry,
 		etcdKey:  "/" + etcdKey,
 		options:  options,
+		leases:   map[int64]*sharedLease{},
 	}
 	if err := n.connect(); err != nil {
 		return nil, err
@@ -70,10 +89,39 @@ func (n *ng) Close() {
 }
 
 func (n *ng) GetSnapshot() (*engine.Snapshot, error) {
-	response, err := n.client.Get(n.context, n.etcdKey, etcd.WithPrefix(), etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	return n.snapshot()
+}
+
+// GetSnapshotAt reads the configuration as of the etcd revision, revisions are available until compacted by etcd
+func (n *ng) GetSnapshotAt(revision uint64) (*engine.Snapshot, error) {
+	s, err := n.snapshot(etcd.WithRev(int64(revision)))
 	if err != nil {
-		return nil, err
+		return nil, convertErr(err)
 	}
+	return s, nil
+}
+
+func (n *ng) snapshot(opts ...etcd.OpOption) (*engine.Snapshot, error) {
+	s, _, err := n.read(opts...)
+	return s, err
+}
+
+// read reads the whole configuration and returns it along with the keys it has been read from
+func (n *ng) read(opts ...etcd.OpOption) (*engine.Snapshot, []*mvccpb.KeyValue, error) {
+	opts = append([]etcd.OpOption{etcd.WithPrefix(), etcd.WithSort(etcd.SortByKey, etcd.SortAscend)}, opts...)
+	response, err := n.client.Get(n.context, n.etcdKey, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := n.parseSnapshot(response)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, response.Kvs, nil
+}
+
+func (n *ng) parseSnapshot(response *etcd.GetResponse) (*engine.Snapshot, error) {
+	var err error
 	s := &engine.Snapshot{Index: uint64(response.Header.Revision)}
 
 	s.FrontendSpecs, err = n.parseFrontends(filterByPrefix(response.Kvs, n.etcdKey+"/frontends"))
@@ -140,7 +188,7 @@ func (n *ng) parseBackends(keyValues []*mvccpb.KeyValue, skipServers ...bool) ([
 	for _, keyValue := range keyValues {
 		if backendIds := backendIdRegex.FindStringSubmatch(string(keyValue.Key)); len(backendIds) == 2 {
 			backendId := backendIds[1]
-			backend, err := engine.BackendFromJSON([]byte(keyValue.Value), backendId)
+			backend, err := n.parseBackend([]byte(keyValue.Value), backendId)
 			if err != nil {
 				return nil, err
 			}
@@ -184,13 +232,7 @@ func (n *ng) parseHosts(keyValues []*mvccpb.KeyValue) ([]engine.Host, error) {
 			if err := json.Unmarshal([]byte(keyValue.Value), &sealedHost); err != nil {
 				return nil, err
 			}
-			var keyPair *engine.KeyPair
-			if len(sealedHost.Settings.KeyPair) != 0 {
-				if err := n.openSealedJSONVal(sealedHost.Settings.KeyPair, &keyPair); err != nil {
-					return nil, err
-				}
-			}
-			host, err := engine.NewHost(hostname, engine.HostSettings{Default: sealedHost.Settings.Default, KeyPair: keyPair, OCSP: sealedHost.Settings.OCSP})
+			host, err := n.openHost(hostname, &sealedHost)
 			if err != nil {
 				return nil, err
 			}
@@ -209,7 +251,7 @@ func (n *ng) parseListeners(keyValues []*mvccpb.KeyValue) ([]engine.Listener, er
 		if listenerIds := listenerIdRegex.FindStringSubmatch(string(keyValue.Key)); len(listenerIds) == 2 {
 			listenerId := listenerIds[1]
 
-			listener, err := engine.ListenerFromJSON([]byte(keyValue.Value), listenerId)
+			listener, err := n.parseListener([]byte(keyValue.Value), listenerId)
 			if err != nil {
 				return nil, err
 			}
@@ -279,40 +321,67 @@ func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
 	if err != nil {
 		return nil, err
 	}
+	return n.openHost(key.Name, host)
+}
 
+// openHost converts the stored representation of the host back, opening its sealed settings
+func (n *ng) openHost(name string, h *host) (*engine.Host, error) {
 	var keyPair *engine.KeyPair
-	if len(host.Settings.KeyPair) != 0 {
-		if err := n.openSealedJSONVal(host.Settings.KeyPair, &keyPair); err != nil {
+	if len(h.Settings.KeyPair) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.KeyPair, &keyPair); err != nil {
 			return nil, err
 		}
 	}
-
-	return engine.NewHost(key.Name, engine.HostSettings{Default: host.Settings.Default, KeyPair: keyPair, OCSP: host.Settings.OCSP})
+	if h.Settings.KeyPairRef != "" {
+		keyPair = &engine.KeyPair{Ref: h.Settings.KeyPairRef}
+	}
+	var clientAuth *engine.ClientAuthSettings
+	if len(h.Settings.ClientAuth) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.ClientAuth, &clientAuth); err != nil {
+			return nil, err
+		}
+	}
+	return engine.NewHost(name, engine.HostSettings{Default: h.Settings.Default, KeyPair: keyPair, OCSP: h.Settings.OCSP, ClientAuth: clientAuth})
 }
 
 func (n *ng) UpsertHost(h engine.Host) error {
 	if h.Name == "" {
 		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
 	}
-	hostKey := n.path("hosts", h.Name, "host")
+	val, err := n.sealHost(h)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("hosts", h.Name, "host"), val, noTTL)
+}
 
-	val := host{
+// sealHost converts the host to the stored representation with the key pair and the client auth settings sealed
+func (n *ng) sealHost(h engine.Host) (*host, error) {
+	val := &host{
 		Name: h.Name,
 		Settings: hostSettings{
 			Default: h.Settings.Default,
 			OCSP:    h.Settings.OCSP,
 		},
 	}
-
-	if h.Settings.KeyPair != nil {
+	if h.Settings.KeyPair != nil && h.Settings.KeyPair.Ref != "" {
+		// References to the key pairs kept elsewhere are not secret and are stored as is
+		val.Settings.KeyPairRef = h.Settings.KeyPair.Ref
+	} else if h.Settings.KeyPair != nil {
 		bytes, err := n.sealJSONVal(h.Settings.KeyPair)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		val.Settings.KeyPair = bytes
 	}
-
-	return n.setJSONVal(hostKey, val, noTTL)
+	if h.Settings.ClientAuth != nil {
+		bytes, err := n.sealJSONVal(h.Settings.ClientAuth)
+		if err != nil {
+			return nil, err
+		}
+		val.Settings.ClientAuth = bytes
+	}
+	return val, nil
 }
 
 func (n *ng) DeleteHost(key engine.HostKey) error {
@@ -344,7 +413,7 @@ func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	l, err := engine.ListenerFromJSON([]byte(bytes), key.Id)
+	l, err := n.parseListener([]byte(bytes), key.Id)
 	if err != nil {
 		return nil, err
 	}
@@ -355,7 +424,47 @@ func (n *ng) UpsertListener(listener engine.Listener) error {
 	if listener.Id == "" {
 		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
 	}
-	return n.setJSONVal(n.path("listeners", listener.Id), listener, noTTL)
+	val, err := n.sealListener(listener)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("listeners", listener.Id), val, noTTL)
+}
+
+// sealListener converts the listener to the stored representation with the client auth settings sealed
+func (n *ng) sealListener(l engine.Listener) (*listener, error) {
+	if l.Settings == nil || l.Settings.ClientAuth == nil {
+		return &listener{Listener: l}, nil
+	}
+	bytes, err := n.sealJSONVal(l.Settings.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	settings := *l.Settings
+	settings.ClientAuth = nil
+	l.Settings = &settings
+	return &listener{Listener: l, ClientAuth: bytes}, nil
+}
+
+// parseListener parses the stored representation of the listener, opening its sealed client auth settings
+func (n *ng) parseListener(val []byte, id string) (*engine.Listener, error) {
+	var sealed listener
+	if err := json.Unmarshal(val, &sealed); err != nil {
+		return nil, err
+	}
+	l, err := engine.ListenerFromJSON(val, id)
+	if err != nil || len(sealed.ClientAuth) == 0 {
+		return l, err
+	}
+	var clientAuth *engine.ClientAuthSettings
+	if err := n.openSealedJSONVal(sealed.ClientAuth, &clientAuth); err != nil {
+		return nil, err
+	}
+	if l.Settings == nil {
+		l.Settings = &engine.HTTPSListenerSettings{}
+	}
+	l.Settings.ClientAuth = clientAuth
+	return l, nil
 }
 
 func (n *ng) DeleteListener(key engine.ListenerKey) error {
@@ -369,8 +478,10 @@ func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
 	if f.Id == "" {
 		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
 	}
-	if _, err := n.GetBackend(engine.BackendKey{Id: f.BackendId}); err != nil {
-		return err
+	for _, bk := range f.BackendKeys() {
+		if _, err := n.GetBackend(bk); err != nil {
+			return err
+		}
 	}
 
 	return n.setJSONVal(n.path("frontends", f.Id, "frontend"), f, ttl)
@@ -433,14 +544,65 @@ func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return engine.BackendFromJSON([]byte(bytes), key.Id)
+	return n.parseBackend([]byte(bytes), key.Id)
 }
 
 func (n *ng) UpsertBackend(b engine.Backend) error {
 	if b.Id == "" {
 		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
 	}
-	return n.setJSONVal(n.path("backends", b.Id, "backend"), b, noTTL)
+	val, err := n.sealBackend(b)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("backends", b.Id, "backend"), val, noTTL)
+}
+
+// sealBackend converts the backend to the stored representation with the TLS key pair sealed
+func (n *ng) sealBackend(b engine.Backend) (*backend, error) {
+	s, ok := b.Settings.(engine.HTTPBackendSettings)
+	if !ok || s.TLS == nil || s.TLS.KeyPair == nil {
+		return &backend{Backend: b}, nil
+	}
+	bytes, err := n.sealJSONVal(s.TLS.KeyPair)
+	if err != nil {
+		return nil, err
+	}
+	tlsSettings := *s.TLS
+	tlsSettings.KeyPair = nil
+	s.TLS = &tlsSettings
+	b.Settings = s
+	return &backend{Backend: b, KeyPair: bytes}, nil
+}
+
+// parseBackend parses the stored representation of the backend, opening its sealed TLS key pair
+func (n *ng) parseBackend(val []byte, id string) (*engine.Backend, error) {
+	var sealed struct {
+		KeyPair []byte
+	}
+	if err := json.Unmarshal(val, &sealed); err != nil {
+		return nil, err
+	}
+	b, err := engine.BackendFromJSON(val, id)
+	if err != nil || len(sealed.KeyPair) == 0 {
+		return b, err
+	}
+	var keyPair *engine.KeyPair
+	if err := n.openSealedJSONVal(sealed.KeyPair, &keyPair); err != nil {
+		return nil, err
+	}
+	s := b.HTTPSettings()
+	tlsSettings := engine.TLSSettings{}
+	if s.TLS != nil {
+		tlsSettings = *s.TLS
+	}
+	tlsSettings.KeyPair = keyPair
+	s.TLS = &tlsSettings
+	if _, err := s.TransportSettings(); err != nil {
+		return nil, err
+	}
+	b.Settings = s
+	return b, nil
 }
 
 func (n *ng) DeleteBackend(bk engine.BackendKey) error {
@@ -452,7 +614,7 @@ func (n *ng) DeleteBackend(bk engine.BackendKey) error {
 		return err
 	}
 	if len(fs) != 0 {
-		return fmt.Errorf("can not delete backend '%v', it is in use by %s", bk, fs)
+		return fmt.Errorf("can not delete backend '%v', it is in use by %v", bk, fs)
 	}
 	_, err = n.client.Delete(n.context, n.path("backends", bk.Id), etcd.WithPrefix())
 	return convertErr(err)
@@ -501,6 +663,8 @@ func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
 	return n.deleteKey(n.path("frontends", mk.FrontendKey.Id, "middlewares", mk.Id))
 }
 
+// UpsertServer attaches the servers registered with TTL to the lease shared by all keys with the same TTL, so
+// registrations do not grant a lease each.
 func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
 	if s.Id == "" || bk.Id == "" {
 		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
@@ -511,6 +675,76 @@ func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Durati
 	return n.setJSONVal(n.path("backends", bk.Id, "servers", s.Id), s, ttl)
 }
 
+// HeartbeatServer renews the lease of the server key. Keep-alive does not rewrite the key, so heartbeats
+// create no revisions and generate no watch events. A server registered without TTL or with a different one
+// is moved to the lease of the TTL, which is the only case the key is rewritten. The lease is shared by all
+// keys with the same TTL, so a heartbeat keeps alive the servers registered with the same TTL as well.
+func (n *ng) HeartbeatServer(sk engine.ServerKey, ttl time.Duration) error {
+	if sk.Id == "" || sk.BackendKey.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	if ttl <= 0 {
+		return &engine.InvalidFormatError{Message: "heartbeat TTL should be positive"}
+	}
+	key := n.path("backends", sk.BackendKey.Id, "servers", sk.Id)
+	response, err := n.client.Get(n.context, key)
+	if err != nil {
+		return convertErr(err)
+	}
+	if len(response.Kvs) == 0 {
+		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", sk)}
+	}
+	kv := response.Kvs[0]
+	lease, err := n.lease(ttl)
+	if err != nil || etcd.LeaseID(kv.Lease) == lease {
+		return err
+	}
+	// Do not bring the server back if it has been deleted or changed meanwhile
+	txn, err := n.client.Txn(n.context).
+		If(etcd.Compare(etcd.ModRevision(key), "=", kv.ModRevision)).
+		Then(etcd.OpPut(key, string(kv.Value), etcd.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return convertErr(err)
+	}
+	if !txn.Succeeded {
+		return &engine.AlreadyExistsError{Message: fmt.Sprintf("%v has been changed concurrently, retry", sk)}
+	}
+	return nil
+}
+
+// lease returns the lease shared by the keys with the TTL, kept alive for at least two thirds of the TTL from
+// now. The lease is renewed at most once per third of the TTL, so the heartbeats of many servers result in a
+// few keep-alives. TTLs are rounded up to whole seconds, the granularity of etcd leases.
+func (n *ng) lease(ttl time.Duration) (etcd.LeaseID, error) {
+	seconds := int64(math.Ceil(ttl.Seconds()))
+	n.leaseMu.Lock()
+	defer n.leaseMu.Unlock()
+
+	now := time.Now()
+	if l, ok := n.leases[seconds]; ok {
+		if now.Sub(l.renewedAt) < time.Duration(seconds)*time.Second/3 {
+			return l.id, nil
+		}
+		_, err := n.client.KeepAliveOnce(n.context, l.id)
+		if err == nil {
+			l.renewedAt = now
+			return l.id, nil
+		}
+		if err != rpctypes.ErrLeaseNotFound {
+			return etcd.NoLease, convertErr(err)
+		}
+		// The lease has expired along with its keys
+		delete(n.leases, seconds)
+	}
+	lgr, err := n.client.Grant(n.context, seconds)
+	if err != nil {
+		return etcd.NoLease, convertErr(err)
+	}
+	n.leases[seconds] = &sharedLease{id: lgr.ID, renewedAt: now}
+	return lgr.ID, nil
+}
+
 func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
 	svs := []engine.Server{}
 	keys, err := n.getVals(n.etcdKey, "backends", bk.Id, "servers")
@@ -543,6 +777,120 @@ func (n *ng) DeleteServer(sk engine.ServerKey) error {
 	return n.deleteKey(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
 }
 
+// Commit writes all changes of the transaction in a single etcd transaction. The transaction also updates
+// the transaction marker key, so Subscribe can group the resulting events into one TransactionCommitted.
+func (n *ng) Commit(tx engine.Transaction) error {
+	snapshot, kvs, err := n.read()
+	if err != nil {
+		return convertErr(err)
+	}
+	if err := tx.Check(snapshot); err != nil {
+		return err
+	}
+	revision := int64(snapshot.Index)
+	ops := []etcd.Op{}
+	cmps := []etcd.Cmp{etcd.Compare(etcd.ModRevision(n.path(transactionKey)), "<", revision+1)}
+	compared := map[string]bool{}
+	for _, change := range tx.Ordered() {
+		op, key, err := n.changeOp(change)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, op)
+
+		// Fail if any key the operation writes or deletes has been changed since the snapshot was validated
+		if !compared[key] {
+			compared[key] = true
+			cmps = append(cmps, etcd.Compare(etcd.ModRevision(key), "<", revision+1))
+		}
+		for _, kv := range kvs {
+			if k := string(kv.Key); strings.HasPrefix(k, key) && !compared[k] {
+				compared[k] = true
+				cmps = append(cmps, etcd.Compare(etcd.ModRevision(k), "=", kv.ModRevision))
+			}
+		}
+	}
+	ops = append(ops, etcd.OpPut(n.path(transactionKey), time.Now().UTC().Format(time.RFC3339Nano)))
+
+	response, err := n.client.Txn(n.context).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return convertErr(err)
+	}
+	if !response.Succeeded {
+		return &engine.AlreadyExistsError{Message: "the configuration has been changed concurrently, retry"}
+	}
+	return nil
+}
+
+// changeOp returns the operation applying the change and the key it writes, deletes remove all keys with this prefix
+func (n *ng) changeOp(change interface{}) (etcd.Op, string, error) {
+	switch ch := change.(type) {
+	case *engine.HostUpserted:
+		val, err := n.sealHost(ch.Host)
+		if err != nil {
+			return etcd.Op{}, "", err
+		}
+		key := n.path("hosts", ch.Host.Name, "host")
+		op, err := n.putJSONOp(key, val)
+		return op, key, err
+	case *engine.HostDeleted:
+		key := n.path("hosts", ch.HostKey.Name)
+		return etcd.OpDelete(key, etcd.WithPrefix()), key, nil
+	case *engine.ListenerUpserted:
+		val, err := n.sealListener(ch.Listener)
+		if err != nil {
+			return etcd.Op{}, "", err
+		}
+		key := n.path("listeners", ch.Listener.Id)
+		op, err := n.putJSONOp(key, val)
+		return op, key, err
+	case *engine.ListenerDeleted:
+		key := n.path("listeners", ch.ListenerKey.Id)
+		return etcd.OpDelete(key, etcd.WithPrefix()), key, nil
+	case *engine.BackendUpserted:
+		val, err := n.sealBackend(ch.Backend)
+		if err != nil {
+			return etcd.Op{}, "", err
+		}
+		key := n.path("backends", ch.Backend.Id, "backend")
+		op, err := n.putJSONOp(key, val)
+		return op, key, err
+	case *engine.BackendDeleted:
+		key := n.path("backends", ch.BackendKey.Id)
+		return etcd.OpDelete(key, etcd.WithPrefix()), key, nil
+	case *engine.ServerUpserted:
+		key := n.path("backends", ch.BackendKey.Id, "servers", ch.Server.Id)
+		op, err := n.putJSONOp(key, ch.Server)
+		return op, key, err
+	case *engine.ServerDeleted:
+		key := n.path("backends", ch.ServerKey.BackendKey.Id, "servers", ch.ServerKey.Id)
+		return etcd.OpDelete(key, etcd.WithPrefix()), key, nil
+	case *engine.FrontendUpserted:
+		key := n.path("frontends", ch.Frontend.Id, "frontend")
+		op, err := n.putJSONOp(key, ch.Frontend)
+		return op, key, err
+	case *engine.FrontendDeleted:
+		key := n.path("frontends", ch.FrontendKey.Id)
+		return etcd.OpDelete(key, etcd.WithPrefix()), key, nil
+	case *engine.MiddlewareUpserted:
+		key := n.path("frontends", ch.FrontendKey.Id, "middlewares", ch.Middleware.Id)
+		op, err := n.putJSONOp(key, ch.Middleware)
+		return op, key, err
+	case *engine.MiddlewareDeleted:
+		key := n.path("frontends", ch.MiddlewareKey.FrontendKey.Id, "middlewares", ch.MiddlewareKey.Id)
+		return etcd.OpDelete(key, etcd.WithPrefix()), key, nil
+	}
+	return etcd.Op{}, "", &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported change: %#v", change)}
+}
+
+func (n *ng) putJSONOp(key string, v interface{}) (etcd.Op, error) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return etcd.Op{}, err
+	}
+	return etcd.OpPut(key, string(bytes)), nil
+}
+
 func (n *ng) openSealedJSONVal(bytes []byte, val interface{}) error {
 	if n.options.Box == nil {
 		return errors.New("need secretbox to open sealed data")
@@ -580,7 +928,7 @@ func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
 		return nil, err
 	}
 	for _, f := range fs {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk) {
 			usedFs = append(usedFs, f)
 		}
 	}
@@ -589,42 +937,319 @@ func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
 
 // Subscribe watches etcd changes and generates structured events telling vulcand to add or delete frontends, hosts etc.
 // It is a blocking function.
+//
+// If the watch fails, e.g. because the revision it is watching from has been compacted, Subscribe reads a fresh
+// snapshot, emits the differences from the configuration it has emitted so far as one TransactionCommitted
+// and resumes watching after the snapshot, so the subscriber is reconciled without having to start over.
 func (n *ng) Subscribe(changes chan interface{}, afterIdx uint64, cancelC chan struct{}) error {
+	// state is the configuration as seen by the subscriber, it is compared with the fresh snapshot on resync
+	state, err := n.subscribedState(afterIdx)
+	if err != nil {
+		return err
+	}
+
 	watcher := etcd.NewWatcher(n.client)
 	defer watcher.Close()
 
-	log.Infof("Begin watching: etcd revision %d", afterIdx)
-	watchChan := watcher.Watch(n.context, n.etcdKey, etcd.WithRev(int64(afterIdx)), etcd.WithPrefix())
+	watchRev := int64(afterIdx)
+	failures := 0
+	for {
+		log.Infof("Begin watching: etcd revision %d", watchRev)
+		seen := state.Index
+		stopped, err := n.watch(watcher, watchRev, state, changes, cancelC)
+		if stopped {
+			return nil
+		}
+		if state.Index != seen {
+			// The watch has made progress since the last resync
+			failures = 0
+		}
+		failures++
+		n.options.MetricsClient.Inc(n.options.MetricsClient.Metric("etcd", "watch", "errors"), 1, 1)
+		if failures > maxResyncAttempts {
+			log.Errorf("Stop watching: error: %v, giving up after %d resync attempts", err, maxResyncAttempts)
+			return err
+		}
+		log.Warningf("Watch failed: %v, resyncing", err)
 
-	for response := range watchChan {
+		fresh, stopped, err := n.resync(state, changes, cancelC)
+		if err != nil {
+			log.Errorf("Stop watching: resync failed: %v", err)
+			return err
+		}
+		if stopped {
+			return nil
+		}
+		state = fresh
+		watchRev = int64(fresh.Index) + 1
+	}
+}
+
+// watch emits the changes from the given revision until the watch fails or the subscription is cancelled,
+// in which case it returns true. Emitted changes are applied to the state and its index is advanced to the watched revision.
+func (n *ng) watch(watcher etcd.Watcher, rev int64, state *engine.Snapshot, changes chan interface{}, cancelC chan struct{}) (bool, error) {
+	ctx, cancel := context.WithCancel(n.context)
+	defer cancel()
+
+	emit := func(change interface{}) bool {
+		engine.ApplyChange(state, change)
+		return n.emit(changes, change, cancelC)
+	}
+
+	for response := range watcher.Watch(ctx, n.etcdKey, etcd.WithRev(rev), etcd.WithPrefix()) {
+		// Compaction cancels the watch as well, so it has to be checked first
+		if response.CompactRevision != 0 {
+			return false, response.Err()
+		}
 		if response.Canceled {
 			log.Infof("Stop watching: graceful shutdown")
-			return nil
+			return true, nil
 		}
 		if err := response.Err(); err != nil {
-			log.Errorf("Stop watching: error: %v", err)
-			return err
+			return false, err
 		}
 
+		// Events written by a transaction share the revision of the transaction marker key
+		txRevisions := map[int64]bool{}
 		for _, event := range response.Events {
+			if string(event.Kv.Key) == n.path(transactionKey) {
+				txRevisions[event.Kv.ModRevision] = true
+			}
+		}
+		var committed *engine.TransactionCommitted
+		for i, event := range response.Events {
 			log.Infof("%s", eventToString(event))
 			change, err := n.parseChange(event)
+			if err != nil {
+				log.Warningf("Ignore '%s', error: %s", eventToString(event), err)
+			} else if change != nil {
+				if txRevisions[event.Kv.ModRevision] {
+					if committed == nil {
+						committed = &engine.TransactionCommitted{}
+					}
+					committed.Changes = append(committed.Changes, change)
+				} else if !emit(change) {
+					return true, nil
+				}
+			}
+			last := i == len(response.Events)-1 || response.Events[i+1].Kv.ModRevision != event.Kv.ModRevision
+			if committed != nil && last {
+				if !emit(committed) {
+					return true, nil
+				}
+				committed = nil
+			}
+		}
+		state.Index = uint64(response.Header.Revision)
+	}
+
+	// The watch channel is closed when the engine is closed
+	select {
+	case <-n.context.Done():
+		return true, nil
+	default:
+	}
+	return false, fmt.Errorf("watch channel closed unexpectedly")
+}
+
+// resync reads the current configuration and emits the changes turning the state into it as one transaction.
+// It returns the fresh snapshot and true if the subscription has been cancelled.
+func (n *ng) resync(state *engine.Snapshot, changes chan interface{}, cancelC chan struct{}) (*engine.Snapshot, bool, error) {
+	fresh, err := n.snapshot()
+	if err != nil {
+		return nil, false, err
+	}
+	plan, err := engine.DiffSnapshots(state, fresh, true)
+	if err != nil {
+		return nil, false, err
+	}
+	tx := plan.Transaction()
+	log.Infof("Resync: etcd revision %d -> %d, %d changes", state.Index, fresh.Index, len(tx.Changes))
+
+	m := n.options.MetricsClient
+	m.Inc(m.Metric("etcd", "resync", "count"), 1, 1)
+	m.Inc(m.Metric("etcd", "resync", "changes"), int64(len(tx.Changes)), 1)
+
+	if plan.Empty() {
+		return fresh, false, nil
+	}
+	if !n.emit(changes, &engine.TransactionCommitted{Changes: tx.Changes}, cancelC) {
+		return nil, true, nil
+	}
+	return fresh, false, nil
+}
+
+// subscribedState returns the configuration the subscriber has before the changes after the given revision.
+// Subscribers pass the revision of their snapshot, which etcd may have compacted in the meantime, so the state is
+// read at that revision then rather than the one before. The changes of that revision are watched again,
+// applying them to the state does not change it.
+func (n *ng) subscribedState(afterIdx uint64) (*engine.Snapshot, error) {
+	switch afterIdx {
+	case 0:
+		// Watching from the current revision
+		return n.snapshot()
+	case 1:
+		// Watching from the very first revision
+		return &engine.Snapshot{}, nil
+	}
+	s, err := n.snapshot(etcd.WithRev(int64(afterIdx) - 1))
+	if err == rpctypes.ErrCompacted {
+		s, err = n.snapshot(etcd.WithRev(int64(afterIdx)))
+	}
+	if err != nil {
+		// If the revision of the subscriber is compacted too, it has to subscribe again with a fresh snapshot
+		return nil, convertErr(err)
+	}
+	return s, nil
+}
+
+// emit sends the change to the channel, returns false if the subscription has been cancelled
+func (n *ng) emit(changes chan interface{}, change interface{}, cancelC chan struct{}) bool {
+	log.Infof("%v", change)
+	select {
+	case changes <- change:
+		return true
+	case <-cancelC:
+		return false
+	}
+}
+
+// GetHistory replays the changes of the configuration keys from the etcd revision history, bounded by etcd compaction.
+// Upserts carry the objects as of their revision rather than the current ones. The history ends at the current
+// revision of the cluster. With a limit, the revisions are read in growing windows going back from it until enough
+// changes are found.
+func (n *ng) GetHistory(q engine.HistoryQuery) ([]engine.Revision, error) {
+	response, err := n.client.Get(n.context, n.etcdKey, etcd.WithPrefix(), etcd.WithCountOnly())
+	if err != nil {
+		return nil, convertErr(err)
+	}
+	end := response.Header.Revision
+
+	matching := engine.HistoryQuery{Key: q.Key}
+	found := []engine.Revision{}
+	// Revision 1 is the empty store, the first change has revision 2
+	for window := int64(historyWindow); end > 1; window *= 2 {
+		start := end - window + 1
+		if start < 2 || q.Limit <= 0 {
+			start = 2
+		}
+		revisions, compacted, err := n.readHistory(start, end)
+		if err != nil {
+			return nil, err
+		}
+		found = append(matching.Filter(revisions), found...)
+		if compacted || (q.Limit > 0 && len(found) >= q.Limit) {
+			break
+		}
+		end = start - 1
+	}
+	return q.Filter(found), nil
+}
+
+// readHistory collects the changes of the configuration keys from the start revision up to the end revision.
+// Every etcd revision is made by some change, but not necessarily by a change of the configuration keys,
+// so the watch covers all keys and stops once it has got the events of the end revision, the events of other keys
+// are skipped. If the start revision has been compacted, the changes are read from the oldest available revision
+// and compacted is true.
+func (n *ng) readHistory(start, end int64) (revisions []engine.Revision, compacted bool, err error) {
+	ctx, cancel := context.WithCancel(n.context)
+	defer cancel()
+	watcher := etcd.NewWatcher(n.client)
+	defer watcher.Close()
+
+	revisions = []engine.Revision{}
+	watchC := watcher.Watch(ctx, "\x00", etcd.WithFromKey(), etcd.WithRev(start))
+	for {
+		response, ok := <-watchC
+		if !ok {
+			if err := n.context.Err(); err != nil {
+				return nil, false, err
+			}
+			return nil, false, fmt.Errorf("watch closed before reaching revision %d", end)
+		}
+		if response.CompactRevision != 0 {
+			compacted = true
+			// The events of the compacted revision itself may be gone
+			if response.CompactRevision >= end {
+				return revisions, compacted, nil
+			}
+			// The oldest revisions have been compacted, start over from the oldest available one
+			watchC = watcher.Watch(ctx, "\x00", etcd.WithFromKey(), etcd.WithRev(response.CompactRevision))
+			continue
+		}
+		if err := response.Err(); err != nil {
+			return nil, false, err
+		}
+		for _, event := range response.Events {
+			if event.Kv.ModRevision > end {
+				return revisions, compacted, nil
+			}
+			if !strings.HasPrefix(string(event.Kv.Key), n.etcdKey) {
+				continue
+			}
+			change, err := n.parseRevision(event)
 			if err != nil {
 				log.Warningf("Ignore '%s', error: %s", eventToString(event), err)
 				continue
 			}
 			if change != nil {
-				log.Infof("%v", change)
-				select {
-				case changes <- change:
-				case <-cancelC:
-					return nil
-				}
+				revisions = append(revisions, engine.Revision{Index: uint64(event.Kv.ModRevision), Change: change})
 			}
 		}
+		// All events of a revision come in one response
+		if len(response.Events) != 0 && response.Events[len(response.Events)-1].Kv.ModRevision >= end {
+			return revisions, compacted, nil
+		}
 	}
+}
 
-	return nil
+// parseRevision converts the event to the change using the value stored in the event, unlike parseChange,
+// that reads the current value of the key
+func (n *ng) parseRevision(e *etcd.Event) (interface{}, error) {
+	if e.Type != etcd.EventTypePut {
+		return n.parseChange(e)
+	}
+	kvs := []*mvccpb.KeyValue{e.Kv}
+	key := string(e.Kv.Key)
+	if out := serverRegex.FindStringSubmatch(key); len(out) == 3 {
+		srv, err := engine.ServerFromJSON(e.Kv.Value, out[2])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: out[1]}, Server: *srv}, nil
+	}
+	if out := middlewareRegex.FindStringSubmatch(key); len(out) == 3 {
+		m, err := engine.MiddlewareFromJSON(e.Kv.Value, n.registry.GetSpec, out[2])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.MiddlewareUpserted{FrontendKey: engine.FrontendKey{Id: out[1]}, Middleware: *m}, nil
+	}
+	if bs, err := n.parseBackends(kvs, true); err != nil || len(bs) != 0 {
+		if err != nil {
+			return nil, err
+		}
+		return &engine.BackendUpserted{Backend: bs[0].Backend}, nil
+	}
+	if fs, err := n.parseFrontends(kvs, true); err != nil || len(fs) != 0 {
+		if err != nil {
+			return nil, err
+		}
+		return &engine.FrontendUpserted{Frontend: fs[0].Frontend}, nil
+	}
+	if hs, err := n.parseHosts(kvs); err != nil || len(hs) != 0 {
+		if err != nil {
+			return nil, err
+		}
+		return &engine.HostUpserted{Host: hs[0]}, nil
+	}
+	if ls, err := n.parseListeners(kvs); err != nil || len(ls) != 0 {
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ListenerUpserted{Listener: ls[0]}, nil
+	}
+	return nil, nil
 }
 
 type MatcherFn func(*etcd.Event) (interface{}, error)
@@ -798,7 +1423,7 @@ func (n *ng) parseBackendServerChange(e *etcd.Event) (interface{}, error) {
 	return nil, fmt.Errorf("unsupported action on the server: %s", e.Type)
 }
 
-func (n ng) path(keys ...string) string {
+func (n *ng) path(keys ...string) string {
 	return strings.Join(append([]string{n.etcdKey}, keys...), "/")
 }
 
@@ -813,11 +1438,11 @@ func (n *ng) setJSONVal(key string, v interface{}, ttl time.Duration) error {
 func (n *ng) setVal(key string, val []byte, ttl time.Duration) error {
 	ops := []etcd.OpOption{}
 	if ttl > 0 {
-		lgr, err := n.client.Grant(n.context, int64(ttl.Seconds()))
+		lease, err := n.lease(ttl)
 		if err != nil {
 			return err
 		}
-		ops = append(ops, etcd.WithLease(lgr.ID))
+		ops = append(ops, etcd.WithLease(lease))
 	}
 
 	_, err := n.client.Put(n.context, key, string(val), ops...)
@@ -929,6 +1554,9 @@ func convertErr(e error) error {
 
 	case rpctypes.ErrDuplicateKey:
 		return &engine.AlreadyExistsError{Message: e.Error()}
+
+	case rpctypes.ErrCompacted, rpctypes.ErrFutureRev:
+		return &engine.NotFoundError{Message: e.Error()}
 	}
 	return e
 }
@@ -957,13 +1585,35 @@ const (
 	noTTL   = 0
 )
 
+const transactionKey = "transaction"
+
+// historyWindow is the number of revisions GetHistory reads first when the number of changes is limited
+const historyWindow = 1000
+
+// maxResyncAttempts is the number of consecutive watch failures Subscribe recovers from by resyncing, after that it gives up
+const maxResyncAttempts = 3
+
 type host struct {
 	Name     string
 	Settings hostSettings
 }
 
 type hostSettings struct {
-	Default bool
-	KeyPair []byte
-	OCSP    engine.OCSPSettings
+	Default    bool
+	KeyPair    []byte
+	KeyPairRef string `json:",omitempty"`
+	OCSP       engine.OCSPSettings
+	ClientAuth []byte `json:",omitempty"`
+}
+
+// listener is the stored representation of listeners, client auth settings are sealed as they carry CA bundles
+type listener struct {
+	engine.Listener
+	ClientAuth []byte `json:",omitempty"`
+}
+
+// backend is the stored representation of backends, TLS key pairs are sealed as they carry private keys
+type backend struct {
+	engine.Backend
+	KeyPair []byte `json:",omitempty"`
 }
@@ -4,8 +4,11 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/engine/test"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/secret"
@@ -117,6 +120,14 @@ func (s *EtcdSuite) TestHostWithKeyPair(c *C) {
 	s.suite.HostWithKeyPair(c)
 }
 
+func (s *EtcdSuite) TestHostWithKeyPairRef(c *C) {
+	s.suite.HostWithKeyPairRef(c)
+}
+
+func (s *EtcdSuite) TestHostWithClientAuth(c *C) {
+	s.suite.HostWithClientAuth(c)
+}
+
 func (s *EtcdSuite) TestHostUpsertKeyPair(c *C) {
 	s.suite.HostUpsertKeyPair(c)
 }
@@ -133,10 +144,18 @@ func (s *EtcdSuite) TestListenerSettingsCRUD(c *C) {
 	s.suite.ListenerSettingsCRUD(c)
 }
 
+func (s *EtcdSuite) TestListenerWithClientAuth(c *C) {
+	s.suite.ListenerWithClientAuth(c)
+}
+
 func (s *EtcdSuite) TestBackendCRUD(c *C) {
 	s.suite.BackendCRUD(c)
 }
 
+func (s *EtcdSuite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
 func (s *EtcdSuite) TestBackendDeleteUsed(c *C) {
 	s.suite.BackendDeleteUsed(c)
 }
@@ -153,6 +172,10 @@ func (s *EtcdSuite) TestServerExpire(c *C) {
 	s.suite.ServerExpire(c)
 }
 
+func (s *EtcdSuite) TestServerHeartbeat(c *C) {
+	s.suite.ServerHeartbeat(c)
+}
+
 func (s *EtcdSuite) TestFrontendCRUD(c *C) {
 	s.suite.FrontendCRUD(c)
 }
@@ -165,6 +188,14 @@ func (s *EtcdSuite) TestFrontendBadBackend(c *C) {
 	s.suite.FrontendBadBackend(c)
 }
 
+func (s *EtcdSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *EtcdSuite) TestFrontendFanOut(c *C) {
+	s.suite.FrontendFanOut(c)
+}
+
 func (s *EtcdSuite) TestMiddlewareCRUD(c *C) {
 	s.suite.MiddlewareCRUD(c)
 }
@@ -181,3 +212,105 @@ func (s *EtcdSuite) TestMiddlewareBadFrontend(c *C) {
 func (s *EtcdSuite) TestMiddlewareBadType(c *C) {
 	s.suite.MiddlewareBadType(c)
 }
+
+func (s *EtcdSuite) TestTransactionCommit(c *C) {
+	s.suite.TransactionCommit(c)
+}
+
+func (s *EtcdSuite) TestTransactionRollback(c *C) {
+	s.suite.TransactionRollback(c)
+}
+
+func (s *EtcdSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
+
+func (s *EtcdSuite) TestCompactionResync(c *C) {
+	b1 := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b1), IsNil)
+	srv := engine.Server{Id: "s1", URL: "http://localhost:5000"}
+	c.Assert(s.ng.UpsertServer(b1.Key(), srv, 0), IsNil)
+	s.expectChanges(c, 2)
+
+	state, err := s.ng.GetSnapshot()
+	c.Assert(err, IsNil)
+
+	b2 := engine.Backend{Id: "b2", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b2), IsNil)
+	c.Assert(s.ng.DeleteServer(engine.ServerKey{BackendKey: b1.Key(), Id: srv.Id}), IsNil)
+	s.expectChanges(c, 2)
+
+	fresh, err := s.ng.GetSnapshot()
+	c.Assert(err, IsNil)
+	_, err = s.client.Compact(s.context, int64(fresh.Index), etcd.WithCompactPhysical())
+	c.Assert(err, IsNil)
+
+	// Watching from the compacted revision fails instead of silently stopping
+	watcher := etcd.NewWatcher(s.client)
+	defer watcher.Close()
+	changesC := make(chan interface{}, 1)
+	stopped, err := s.ng.watch(watcher, int64(state.Index)+1, state, changesC, s.stopC)
+	c.Assert(stopped, Equals, false)
+	c.Assert(err, Equals, rpctypes.ErrCompacted)
+
+	// Resync emits the differences from the state as one transaction
+	resynced, stopped, err := s.ng.resync(state, changesC, s.stopC)
+	c.Assert(err, IsNil)
+	c.Assert(stopped, Equals, false)
+	c.Assert(resynced.Index, Equals, fresh.Index)
+	c.Assert(<-changesC, DeepEquals, &engine.TransactionCommitted{Changes: []interface{}{
+		&engine.BackendUpserted{Backend: b2},
+		&engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: b1.Key(), Id: srv.Id}},
+	}})
+
+	// Nothing is emitted if the state is up to date
+	_, _, err = s.ng.resync(resynced, changesC, s.stopC)
+	c.Assert(err, IsNil)
+	c.Assert(len(changesC), Equals, 0)
+}
+
+func (s *EtcdSuite) TestSubscribeAfterCompaction(c *C) {
+	b1 := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b1), IsNil)
+	s.expectChanges(c, 1)
+
+	// The subscriber takes a snapshot, then etcd compacts up to its revision
+	snapshot, err := s.ng.GetSnapshot()
+	c.Assert(err, IsNil)
+	_, err = s.client.Compact(s.context, int64(snapshot.Index), etcd.WithCompactPhysical())
+	c.Assert(err, IsNil)
+
+	changesC := make(chan interface{}, 10)
+	stopC := make(chan struct{})
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.ng.Subscribe(changesC, snapshot.Index, stopC)
+	}()
+	defer close(stopC)
+
+	b2 := engine.Backend{Id: "b2", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b2), IsNil)
+	for {
+		select {
+		case change := <-changesC:
+			// The change of the snapshot revision is watched again
+			if change, ok := change.(*engine.BackendUpserted); ok && change.Backend.Id == b2.Id {
+				return
+			}
+		case err := <-errC:
+			c.Fatalf("subscription failed: %v", err)
+		case <-time.After(time.Second):
+			c.Fatalf("timeout waiting for %v", b2.Id)
+		}
+	}
+}
+
+func (s *EtcdSuite) expectChanges(c *C, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-s.changesC:
+		case <-time.After(time.Second):
+			c.Fatalf("timeout waiting for change %d of %d", i+1, count)
+		}
+	}
+}
@@ -100,3 +100,12 @@ type ServerDeleted struct {
 func (s *ServerDeleted) String() string {
 	return fmt.Sprintf("ServerDeleted(serverKey=%v)", &s.ServerKey)
 }
+
+// TransactionCommitted groups the changes committed in one transaction, they should be applied in one step.
+type TransactionCommitted struct {
+	Changes []interface{}
+}
+
+func (t *TransactionCommitted) String() string {
+	return fmt.Sprintf("TransactionCommitted(changes=%v)", t.Changes)
+}
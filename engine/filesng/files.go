@@ -0,0 +1,1272 @@
+// package filesng provides the engine implementation that keeps configuration in a directory of JSON or YAML files.
+// Every object is stored in a separate file, the directory layout mirrors the etcd key layout:
+//
+//	hosts/<name>.json
+//	listeners/<id>.json
+//	backends/<id>/backend.json
+//	backends/<id>/servers/<id>.json
+//	frontends/<id>/frontend.json
+//	frontends/<id>/middlewares/<id>.json
+//
+// Files with .yaml or .yml extensions are accepted in place of .json ones. The directory is polled for changes made
+// by external tools, e.g. configuration management, and the changes are emitted the same way as changes made via API.
+// TTLs are not supported and are ignored. With a seal key, the key pairs and the client auth settings written by the
+// engine are sealed, the plain ones in the files written by hand are accepted as well.
+package filesng
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+	"github.com/vulcand/vulcand/utils/json"
+)
+
+type ng struct {
+	dir      string
+	registry *plugin.Registry
+	options  Options
+	logsev   log.Level
+
+	mu sync.Mutex
+	// files holds the last seen contents of the configuration files converted to JSON, keyed by object key,
+	// e.g. backends/b1/servers/s1
+	files map[string]file
+	// index is incremented on every emitted change
+	index   uint64
+	changes []change
+	// notifyC is closed and replaced every time a new change is emitted
+	notifyC chan struct{}
+	history *engine.History
+
+	closeOnce sync.Once
+	closeC    chan struct{}
+	wg        sync.WaitGroup
+}
+
+type Options struct {
+	// PollInterval specifies how often the directory is checked for external changes
+	PollInterval time.Duration
+	// HistorySize is the number of revisions kept in the history, the history starts when the engine is created
+	HistorySize int
+	// Box seals the host and backend key pairs and the client auth settings written by the engine, the files keep
+	// them in plain text if it is not set
+	Box *secret.Box
+}
+
+// host, listener and backend are the stored representations of the objects written by the engine with a box, their
+// secrets are sealed and moved out of the settings, that keep the plain values in the files written by hand
+type host struct {
+	engine.Host
+	KeyPair    []byte `json:",omitempty"`
+	ClientAuth []byte `json:",omitempty"`
+}
+
+type listener struct {
+	engine.Listener
+	ClientAuth []byte `json:",omitempty"`
+}
+
+type backend struct {
+	engine.Backend
+	KeyPair []byte `json:",omitempty"`
+}
+
+type file struct {
+	path string
+	data []byte
+}
+
+type change struct {
+	index  uint64
+	change interface{}
+}
+
+var (
+	hostRegex       = regexp.MustCompile("^hosts/([^/]+)$")
+	listenerRegex   = regexp.MustCompile("^listeners/([^/]+)$")
+	backendRegex    = regexp.MustCompile("^backends/([^/]+)/backend$")
+	serverRegex     = regexp.MustCompile("^backends/([^/]+)/servers/([^/]+)$")
+	frontendRegex   = regexp.MustCompile("^frontends/([^/]+)/frontend$")
+	middlewareRegex = regexp.MustCompile("^frontends/([^/]+)/middlewares/([^/]+)$")
+
+	// keyRegexes are ordered by dependency: backends should be created before the servers and frontends that use them.
+	keyRegexes = []*regexp.Regexp{hostRegex, listenerRegex, backendRegex, serverRegex, frontendRegex, middlewareRegex}
+)
+
+func New(dir string, registry *plugin.Registry, options Options) (engine.Engine, error) {
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultPollInterval
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	n := &ng{
+		dir:      dir,
+		registry: registry,
+		options:  options,
+		notifyC:  make(chan struct{}),
+		closeC:   make(chan struct{}),
+	}
+	// Staging directories are removed once a transaction is committed or rolled back, one left behind holds
+	// the files of a transaction interrupted by a crash
+	if leftover, _ := filepath.Glob(filepath.Join(dir, stagingPrefix+"*")); len(leftover) != 0 {
+		log.Warningf("Found files of interrupted transactions in %v, the configuration may be partially updated", leftover)
+	}
+	files, err := n.readDir()
+	if err != nil {
+		return nil, err
+	}
+	n.files = files
+	snapshot, err := n.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	n.history = engine.NewHistory(snapshot, options.HistorySize)
+
+	n.wg.Add(1)
+	go n.watch()
+	return n, nil
+}
+
+func (n *ng) Close() {
+	n.closeOnce.Do(func() {
+		close(n.closeC)
+	})
+	n.wg.Wait()
+}
+
+func (n *ng) GetRegistry() *plugin.Registry {
+	return n.registry
+}
+
+func (n *ng) GetLogSeverity() log.Level {
+	return n.logsev
+}
+
+func (n *ng) SetLogSeverity(sev log.Level) {
+	n.logsev = sev
+	log.SetLevel(n.logsev)
+}
+
+func (n *ng) GetSnapshot() (*engine.Snapshot, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Pick up the external changes first, so the index matches the returned configuration
+	n.sync()
+	return n.snapshot()
+}
+
+func (n *ng) GetHistory(q engine.HistoryQuery) ([]engine.Revision, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.sync()
+	return n.history.Get(q), nil
+}
+
+func (n *ng) GetSnapshotAt(revision uint64) (*engine.Snapshot, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.sync()
+	return n.history.SnapshotAt(revision)
+}
+
+func (n *ng) snapshot() (*engine.Snapshot, error) {
+	s := &engine.Snapshot{Index: n.index}
+	s.Hosts = n.getHosts()
+	s.Listeners = n.getListeners()
+	for _, b := range n.getBackends() {
+		servers, err := n.getServers(b.Key())
+		if err != nil {
+			return nil, err
+		}
+		s.BackendSpecs = append(s.BackendSpecs, engine.BackendSpec{Backend: b, Servers: servers})
+	}
+	for _, f := range n.getFrontends() {
+		middlewares, err := n.getMiddlewares(f.Key())
+		if err != nil {
+			return nil, err
+		}
+		s.FrontendSpecs = append(s.FrontendSpecs, engine.FrontendSpec{Frontend: f, Middlewares: middlewares})
+	}
+	return s, nil
+}
+
+func (n *ng) GetHosts() ([]engine.Host, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getHosts(), nil
+}
+
+func (n *ng) getHosts() []engine.Host {
+	hosts := []engine.Host{}
+	for _, m := range n.matching(hostRegex) {
+		h, err := n.getHost(engine.HostKey{Name: m[1]})
+		if err != nil {
+			log.Warningf("Invalid host config for %v: %v\n", m[0], err)
+			continue
+		}
+		hosts = append(hosts, *h)
+	}
+	return hosts
+}
+
+func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getHost(key)
+}
+
+func (n *ng) getHost(key engine.HostKey) (*engine.Host, error) {
+	data, err := n.getVal("hosts", key.Name)
+	if err != nil {
+		return nil, err
+	}
+	return n.parseHost(data, key.Name)
+}
+
+// parseHost parses the stored representation of the host, opening its sealed key pair and client auth settings
+func (n *ng) parseHost(data []byte, name string) (*engine.Host, error) {
+	var sealed struct {
+		KeyPair    []byte
+		ClientAuth []byte
+	}
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, err
+	}
+	h, err := engine.HostFromJSON(data, name)
+	if err != nil || (len(sealed.KeyPair) == 0 && len(sealed.ClientAuth) == 0) {
+		return h, err
+	}
+	if len(sealed.KeyPair) != 0 {
+		if err := n.openSealedJSONVal(sealed.KeyPair, &h.Settings.KeyPair); err != nil {
+			return nil, err
+		}
+	}
+	if len(sealed.ClientAuth) != 0 {
+		if err := n.openSealedJSONVal(sealed.ClientAuth, &h.Settings.ClientAuth); err != nil {
+			return nil, err
+		}
+	}
+	return engine.NewHost(h.Name, h.Settings)
+}
+
+func (n *ng) UpsertHost(h engine.Host) error {
+	if h.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	val, err := n.sealHost(h)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.setJSONVal(val, "hosts", h.Name)
+}
+
+// sealHost converts the host to the stored representation with the key pair and the client auth settings sealed
+func (n *ng) sealHost(h engine.Host) (interface{}, error) {
+	if n.options.Box == nil {
+		return h, nil
+	}
+	val := &host{Host: h}
+	if h.Settings.KeyPair != nil && h.Settings.KeyPair.Ref == "" {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPair)
+		if err != nil {
+			return nil, err
+		}
+		val.KeyPair = bytes
+		val.Settings.KeyPair = nil
+	}
+	if h.Settings.ClientAuth != nil {
+		bytes, err := n.sealJSONVal(h.Settings.ClientAuth)
+		if err != nil {
+			return nil, err
+		}
+		val.ClientAuth = bytes
+		val.Settings.ClientAuth = nil
+	}
+	return val, nil
+}
+
+func (n *ng) DeleteHost(key engine.HostKey) error {
+	if key.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deleteVal("hosts", key.Name)
+}
+
+func (n *ng) GetListeners() ([]engine.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getListeners(), nil
+}
+
+func (n *ng) getListeners() []engine.Listener {
+	ls := []engine.Listener{}
+	for _, m := range n.matching(listenerRegex) {
+		l, err := n.getListener(engine.ListenerKey{Id: m[1]})
+		if err != nil {
+			log.Warningf("Invalid listener config for %v: %v\n", m[0], err)
+			continue
+		}
+		ls = append(ls, *l)
+	}
+	return ls
+}
+
+func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getListener(key)
+}
+
+func (n *ng) getListener(key engine.ListenerKey) (*engine.Listener, error) {
+	data, err := n.getVal("listeners", key.Id)
+	if err != nil {
+		return nil, err
+	}
+	return n.parseListener(data, key.Id)
+}
+
+// parseListener parses the stored representation of the listener, opening its sealed client auth settings
+func (n *ng) parseListener(data []byte, id string) (*engine.Listener, error) {
+	var sealed struct {
+		ClientAuth []byte
+	}
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, err
+	}
+	l, err := engine.ListenerFromJSON(data, id)
+	if err != nil || len(sealed.ClientAuth) == 0 {
+		return l, err
+	}
+	var clientAuth *engine.ClientAuthSettings
+	if err := n.openSealedJSONVal(sealed.ClientAuth, &clientAuth); err != nil {
+		return nil, err
+	}
+	if l.Settings == nil {
+		l.Settings = &engine.HTTPSListenerSettings{}
+	}
+	l.Settings.ClientAuth = clientAuth
+	return l, nil
+}
+
+func (n *ng) UpsertListener(l engine.Listener) error {
+	if l.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	val, err := n.sealListener(l)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.setJSONVal(val, "listeners", l.Id)
+}
+
+// sealListener converts the listener to the stored representation with the client auth settings sealed
+func (n *ng) sealListener(l engine.Listener) (interface{}, error) {
+	if n.options.Box == nil || l.Settings == nil || l.Settings.ClientAuth == nil {
+		return l, nil
+	}
+	bytes, err := n.sealJSONVal(l.Settings.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	settings := *l.Settings
+	settings.ClientAuth = nil
+	l.Settings = &settings
+	return &listener{Listener: l, ClientAuth: bytes}, nil
+}
+
+func (n *ng) DeleteListener(key engine.ListenerKey) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deleteVal("listeners", key.Id)
+}
+
+func (n *ng) GetFrontends() ([]engine.Frontend, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getFrontends(), nil
+}
+
+func (n *ng) getFrontends() []engine.Frontend {
+	fs := []engine.Frontend{}
+	for _, m := range n.matching(frontendRegex) {
+		f, err := n.getFrontend(engine.FrontendKey{Id: m[1]})
+		if err != nil {
+			log.Warningf("Invalid frontend config for %v: %v\n", m[0], err)
+			continue
+		}
+		fs = append(fs, *f)
+	}
+	return fs
+}
+
+func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getFrontend(key)
+}
+
+func (n *ng) getFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	data, err := n.getVal("frontends", key.Id, "frontend")
+	if err != nil {
+		return nil, err
+	}
+	return engine.FrontendFromJSON(n.registry.GetRouter(), data, key.Id)
+}
+
+func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	if f.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, bk := range f.BackendKeys() {
+		if _, err := n.getVal("backends", bk.Id, "backend"); err != nil {
+			return &engine.NotFoundError{Message: fmt.Sprintf("backend: %v not found", bk.Id)}
+		}
+	}
+	return n.setJSONVal(f, "frontends", f.Id, "frontend")
+}
+
+func (n *ng) DeleteFrontend(key engine.FrontendKey) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.getVal("frontends", key.Id, "frontend"); err != nil {
+		return err
+	}
+	return n.deleteDir("frontends", key.Id)
+}
+
+func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getMiddlewares(fk)
+}
+
+func (n *ng) getMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error) {
+	ms := []engine.Middleware{}
+	for _, m := range n.matching(middlewareRegex) {
+		if m[1] != fk.Id {
+			continue
+		}
+		mw, err := n.getMiddleware(engine.MiddlewareKey{FrontendKey: fk, Id: m[2]})
+		if err != nil {
+			log.Warningf("Invalid middleware config for %v (frontend: %v): %v\n", m[0], fk, err)
+			continue
+		}
+		ms = append(ms, *mw)
+	}
+	return ms, nil
+}
+
+func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getMiddleware(key)
+}
+
+func (n *ng) getMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
+	data, err := n.getVal("frontends", key.FrontendKey.Id, "middlewares", key.Id)
+	if err != nil {
+		return nil, err
+	}
+	return engine.MiddlewareFromJSON(data, n.registry.GetSpec, key.Id)
+}
+
+func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	if fk.Id == "" || m.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.getVal("frontends", fk.Id, "frontend"); err != nil {
+		return err
+	}
+	return n.setJSONVal(m, "frontends", fk.Id, "middlewares", m.Id)
+}
+
+func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
+	if mk.FrontendKey.Id == "" || mk.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deleteVal("frontends", mk.FrontendKey.Id, "middlewares", mk.Id)
+}
+
+func (n *ng) GetBackends() ([]engine.Backend, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getBackends(), nil
+}
+
+func (n *ng) getBackends() []engine.Backend {
+	bs := []engine.Backend{}
+	for _, m := range n.matching(backendRegex) {
+		b, err := n.getBackend(engine.BackendKey{Id: m[1]})
+		if err != nil {
+			log.Warningf("Invalid backend config for %v: %v\n", m[0], err)
+			continue
+		}
+		bs = append(bs, *b)
+	}
+	return bs
+}
+
+func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getBackend(key)
+}
+
+func (n *ng) getBackend(key engine.BackendKey) (*engine.Backend, error) {
+	data, err := n.getVal("backends", key.Id, "backend")
+	if err != nil {
+		return nil, err
+	}
+	return n.parseBackend(data, key.Id)
+}
+
+// parseBackend parses the stored representation of the backend, opening its sealed TLS key pair
+func (n *ng) parseBackend(data []byte, id string) (*engine.Backend, error) {
+	var sealed struct {
+		KeyPair []byte
+	}
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, err
+	}
+	b, err := engine.BackendFromJSON(data, id)
+	if err != nil || len(sealed.KeyPair) == 0 {
+		return b, err
+	}
+	var keyPair *engine.KeyPair
+	if err := n.openSealedJSONVal(sealed.KeyPair, &keyPair); err != nil {
+		return nil, err
+	}
+	s := b.HTTPSettings()
+	tlsSettings := engine.TLSSettings{}
+	if s.TLS != nil {
+		tlsSettings = *s.TLS
+	}
+	tlsSettings.KeyPair = keyPair
+	s.TLS = &tlsSettings
+	if _, err := s.TransportSettings(); err != nil {
+		return nil, err
+	}
+	b.Settings = s
+	return b, nil
+}
+
+func (n *ng) UpsertBackend(b engine.Backend) error {
+	if b.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	val, err := n.sealBackend(b)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.setJSONVal(val, "backends", b.Id, "backend")
+}
+
+// sealBackend converts the backend to the stored representation with the TLS key pair sealed
+func (n *ng) sealBackend(b engine.Backend) (interface{}, error) {
+	s, ok := b.Settings.(engine.HTTPBackendSettings)
+	if n.options.Box == nil || !ok || s.TLS == nil || s.TLS.KeyPair == nil {
+		return b, nil
+	}
+	bytes, err := n.sealJSONVal(s.TLS.KeyPair)
+	if err != nil {
+		return nil, err
+	}
+	tlsSettings := *s.TLS
+	tlsSettings.KeyPair = nil
+	s.TLS = &tlsSettings
+	b.Settings = s
+	return &backend{Backend: b, KeyPair: bytes}, nil
+}
+
+func (n *ng) DeleteBackend(bk engine.BackendKey) error {
+	if bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.getVal("backends", bk.Id, "backend"); err != nil {
+		return err
+	}
+	usedFs := []engine.Frontend{}
+	for _, f := range n.getFrontends() {
+		if f.UsesBackend(bk) {
+			usedFs = append(usedFs, f)
+		}
+	}
+	if len(usedFs) != 0 {
+		return fmt.Errorf("can not delete backend '%v', it is in use by %v", bk, usedFs)
+	}
+	return n.deleteDir("backends", bk.Id)
+}
+
+func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getServers(bk)
+}
+
+func (n *ng) getServers(bk engine.BackendKey) ([]engine.Server, error) {
+	srvs := []engine.Server{}
+	for _, m := range n.matching(serverRegex) {
+		if m[1] != bk.Id {
+			continue
+		}
+		srv, err := n.getServer(engine.ServerKey{BackendKey: bk, Id: m[2]})
+		if err != nil {
+			log.Warningf("Invalid server config for %v (backend: %v): %v\n", m[0], bk, err)
+			continue
+		}
+		srvs = append(srvs, *srv)
+	}
+	return srvs, nil
+}
+
+func (n *ng) GetServer(key engine.ServerKey) (*engine.Server, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getServer(key)
+}
+
+func (n *ng) getServer(key engine.ServerKey) (*engine.Server, error) {
+	data, err := n.getVal("backends", key.BackendKey.Id, "servers", key.Id)
+	if err != nil {
+		return nil, err
+	}
+	return engine.ServerFromJSON(data, key.Id)
+}
+
+func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	if s.Id == "" || bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.getVal("backends", bk.Id, "backend"); err != nil {
+		return err
+	}
+	return n.setJSONVal(s, "backends", bk.Id, "servers", s.Id)
+}
+
+// HeartbeatServer only checks that the server exists, servers stored in files never expire
+func (n *ng) HeartbeatServer(sk engine.ServerKey, ttl time.Duration) error {
+	_, err := n.GetServer(sk)
+	return err
+}
+
+func (n *ng) DeleteServer(sk engine.ServerKey) error {
+	if sk.Id == "" || sk.BackendKey.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deleteVal("backends", sk.BackendKey.Id, "servers", sk.Id)
+}
+
+// Subscribe emits the changes recorded after the given index and then keeps emitting new changes
+// until the cancel channel is closed. It is a blocking function.
+func (n *ng) Subscribe(changes chan interface{}, afterIdx uint64, cancelC chan struct{}) error {
+	log.Infof("Begin watching %v: index %d", n.dir, afterIdx)
+	for {
+		n.mu.Lock()
+		pending, err := n.changesAfter(afterIdx)
+		notifyC := n.notifyC
+		n.mu.Unlock()
+		if err != nil {
+			log.Errorf("Stop watching: error: %v", err)
+			return err
+		}
+
+		for _, ch := range pending {
+			log.Infof("%v", ch.change)
+			select {
+			case changes <- ch.change:
+				afterIdx = ch.index
+			case <-cancelC:
+				return nil
+			}
+		}
+
+		select {
+		case <-notifyC:
+		case <-cancelC:
+			return nil
+		case <-n.closeC:
+			log.Infof("Stop watching: graceful shutdown")
+			return nil
+		}
+	}
+}
+
+func (n *ng) changesAfter(afterIdx uint64) ([]change, error) {
+	if afterIdx >= n.index {
+		return nil, nil
+	}
+	if len(n.changes) == 0 || n.changes[0].index > afterIdx+1 {
+		return nil, fmt.Errorf("changes after index %d are no longer available", afterIdx)
+	}
+	first := afterIdx + 1 - n.changes[0].index
+	pending := make([]change, len(n.changes)-int(first))
+	copy(pending, n.changes[first:])
+	return pending, nil
+}
+
+func (n *ng) watch() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.mu.Lock()
+			n.sync()
+			n.mu.Unlock()
+		case <-n.closeC:
+			return
+		}
+	}
+}
+
+// sync re-reads the directory and emits changes for every object that has been added,
+// updated or deleted since the last time it was read. Should be called with the lock held.
+func (n *ng) sync() {
+	for _, ch := range n.diff() {
+		n.emit(ch)
+	}
+}
+
+// diff re-reads the directory and returns the changes made since the last time it was read.
+func (n *ng) diff() []interface{} {
+	files, err := n.readDir()
+	if err != nil {
+		log.Errorf("Failed to read %v: %v", n.dir, err)
+		return nil
+	}
+
+	upserted, deleted := []string{}, []string{}
+	for key, f := range files {
+		if old, ok := n.files[key]; !ok || !bytes.Equal(old.data, f.data) {
+			upserted = append(upserted, key)
+		}
+	}
+	for key := range n.files {
+		if _, ok := files[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+	n.files = files
+
+	// Upserts are applied in dependency order, deletes in reverse, so the proxy never sees
+	// a reference to an object that does not exist.
+	sort.Sort(&keySorter{keys: upserted})
+	sort.Sort(sort.Reverse(&keySorter{keys: deleted}))
+
+	changes := []interface{}{}
+	for _, key := range upserted {
+		ch, err := n.parseUpsert(key)
+		if err != nil {
+			log.Warningf("Ignore '%s', error: %s", files[key].path, err)
+			continue
+		}
+		changes = append(changes, ch)
+	}
+	for _, key := range deleted {
+		changes = append(changes, parseDelete(key))
+	}
+	return changes
+}
+
+func (n *ng) emit(ch interface{}) {
+	n.index++
+	n.changes = append(n.changes, change{index: n.index, change: ch})
+	n.history.Record(n.index, ch)
+	if len(n.changes) > changeLogSize {
+		n.changes = n.changes[len(n.changes)-changeLogSize:]
+	}
+	close(n.notifyC)
+	n.notifyC = make(chan struct{})
+}
+
+func (n *ng) parseUpsert(key string) (interface{}, error) {
+	if m := hostRegex.FindStringSubmatch(key); m != nil {
+		h, err := n.getHost(engine.HostKey{Name: m[1]})
+		if err != nil {
+			return nil, err
+		}
+		return &engine.HostUpserted{Host: *h}, nil
+	}
+	if m := listenerRegex.FindStringSubmatch(key); m != nil {
+		l, err := n.getListener(engine.ListenerKey{Id: m[1]})
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ListenerUpserted{Listener: *l}, nil
+	}
+	if m := backendRegex.FindStringSubmatch(key); m != nil {
+		b, err := n.getBackend(engine.BackendKey{Id: m[1]})
+		if err != nil {
+			return nil, err
+		}
+		return &engine.BackendUpserted{Backend: *b}, nil
+	}
+	if m := serverRegex.FindStringSubmatch(key); m != nil {
+		sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: m[1]}, Id: m[2]}
+		srv, err := n.getServer(sk)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ServerUpserted{BackendKey: sk.BackendKey, Server: *srv}, nil
+	}
+	if m := frontendRegex.FindStringSubmatch(key); m != nil {
+		f, err := n.getFrontend(engine.FrontendKey{Id: m[1]})
+		if err != nil {
+			return nil, err
+		}
+		return &engine.FrontendUpserted{Frontend: *f}, nil
+	}
+	if m := middlewareRegex.FindStringSubmatch(key); m != nil {
+		mk := engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: m[1]}, Id: m[2]}
+		mw, err := n.getMiddleware(mk)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.MiddlewareUpserted{FrontendKey: mk.FrontendKey, Middleware: *mw}, nil
+	}
+	return nil, fmt.Errorf("unsupported key: %v", key)
+}
+
+func parseDelete(key string) interface{} {
+	if m := hostRegex.FindStringSubmatch(key); m != nil {
+		return &engine.HostDeleted{HostKey: engine.HostKey{Name: m[1]}}
+	}
+	if m := listenerRegex.FindStringSubmatch(key); m != nil {
+		return &engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: m[1]}}
+	}
+	if m := backendRegex.FindStringSubmatch(key); m != nil {
+		return &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: m[1]}}
+	}
+	if m := serverRegex.FindStringSubmatch(key); m != nil {
+		return &engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: engine.BackendKey{Id: m[1]}, Id: m[2]}}
+	}
+	if m := frontendRegex.FindStringSubmatch(key); m != nil {
+		return &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: m[1]}}
+	}
+	m := middlewareRegex.FindStringSubmatch(key)
+	return &engine.MiddlewareDeleted{MiddlewareKey: engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: m[1]}, Id: m[2]}}
+}
+
+// readDir reads all configuration files from the directory and returns their contents converted to JSON.
+func (n *ng) readDir() (map[string]file, error) {
+	files := map[string]file{}
+	err := filepath.Walk(n.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p != n.dir && strings.HasPrefix(info.Name(), stagingPrefix) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		ext := filepath.Ext(p)
+		if ext != extJSON && ext != extYAML && ext != extYML {
+			return nil
+		}
+		rel, err := filepath.Rel(n.dir, p)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(filepath.ToSlash(rel), ext)
+		if rank(key) == -1 {
+			log.Debugf("Skipping unrecognized file %v", p)
+			return nil
+		}
+		if existing, ok := files[key]; ok {
+			log.Warningf("Skipping %v, %v already defines the same object", p, existing.path)
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if ext != extJSON {
+			// Keep the raw data in case of errors, the file will be reported as invalid once parsed
+			if converted, err := yaml.YAMLToJSON(data); err == nil {
+				data = converted
+			}
+		}
+		files[key] = file{path: p, data: data}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (n *ng) matching(re *regexp.Regexp) [][]string {
+	var out [][]string
+	for key := range n.files {
+		if m := re.FindStringSubmatch(key); m != nil {
+			out = append(out, m)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+func (n *ng) getVal(keys ...string) ([]byte, error) {
+	f, ok := n.files[path.Join(keys...)]
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", path.Join(keys...))}
+	}
+	return f.data, nil
+}
+
+// setJSONVal writes the value to the file backing the key, preserving the format of an existing file,
+// and emits the resulting change.
+func (n *ng) setJSONVal(v interface{}, keys ...string) error {
+	if err := n.apply(fileOp{key: path.Join(keys...), val: v}); err != nil {
+		return err
+	}
+	n.sync()
+	return nil
+}
+
+func (n *ng) deleteVal(keys ...string) error {
+	key := path.Join(keys...)
+	if _, ok := n.files[key]; !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", key)}
+	}
+	if err := n.apply(fileOp{key: key}); err != nil {
+		return err
+	}
+	n.sync()
+	return nil
+}
+
+func (n *ng) deleteDir(keys ...string) error {
+	if err := n.apply(fileOp{key: path.Join(keys...), dir: true}); err != nil {
+		return err
+	}
+	n.sync()
+	return nil
+}
+
+// fileOp is a single file system operation: writes the value to the file backing the key or deletes the file,
+// or the whole directory with nested objects if dir is set.
+type fileOp struct {
+	key string
+	val interface{}
+	dir bool
+}
+
+func (n *ng) apply(op fileOp) error {
+	p, data, err := n.resolve(op)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		if p == "" {
+			return nil
+		}
+		return os.RemoveAll(p)
+	}
+	return writeFile(p, data)
+}
+
+// resolve returns the path affected by the operation and the data to write there, nil for deletes. The path is
+// empty if the operation deletes the file that does not exist.
+func (n *ng) resolve(op fileOp) (string, []byte, error) {
+	if op.dir {
+		return filepath.Join(n.dir, filepath.FromSlash(op.key)), nil, nil
+	}
+	if op.val == nil {
+		f, ok := n.files[op.key]
+		if !ok {
+			return "", nil, nil
+		}
+		return f.path, nil, nil
+	}
+	if rank(op.key) == -1 {
+		return "", nil, &engine.InvalidFormatError{Message: fmt.Sprintf("invalid object key: %v", op.key)}
+	}
+	data, err := json.Marshal(op.val)
+	if err != nil {
+		return "", nil, err
+	}
+	p := filepath.Join(n.dir, filepath.FromSlash(op.key)+extJSON)
+	if f, ok := n.files[op.key]; ok {
+		p = f.path
+	}
+	if ext := filepath.Ext(p); ext == extYAML || ext == extYML {
+		if data, err = yaml.JSONToYAML(data); err != nil {
+			return "", nil, err
+		}
+	}
+	return p, data, nil
+}
+
+// Commit writes the files changed by the transaction and emits all changes as a single TransactionCommitted.
+// The new files are written to a staging directory first and renamed in place once all of them are written, the
+// replaced and deleted files are moved to the staging directory as well, so a failure restores them and leaves the
+// configuration as it was before the transaction.
+func (n *ng) Commit(tx engine.Transaction) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.sync()
+	s, err := n.snapshot()
+	if err != nil {
+		return err
+	}
+	if err := tx.Check(s); err != nil {
+		return err
+	}
+	ops := []fileOp{}
+	for _, change := range tx.Ordered() {
+		op, err := n.changeOp(change)
+		if err != nil {
+			return err
+		}
+		if !op.dir && rank(op.key) == -1 {
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("invalid object key: %v", op.key)}
+		}
+		ops = append(ops, op)
+	}
+	if err := n.applyAll(ops); err != nil {
+		n.sync()
+		return err
+	}
+	if changes := n.diff(); len(changes) != 0 {
+		n.emit(&engine.TransactionCommitted{Changes: changes})
+	}
+	return nil
+}
+
+// applyAll applies the operations all together: if any of them fails, the ones already applied are reverted.
+func (n *ng) applyAll(ops []fileOp) error {
+	staging, err := ioutil.TempDir(n.dir, stagingPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	// Stage the new files, so that marshalling or write errors happen before the configuration is touched
+	paths := make([]string, len(ops))
+	staged := make([]string, len(ops))
+	for i, op := range ops {
+		p, data, err := n.resolve(op)
+		if err != nil {
+			return err
+		}
+		paths[i] = p
+		if data == nil {
+			continue
+		}
+		staged[i] = filepath.Join(staging, fmt.Sprintf("new-%d", i))
+		if err := ioutil.WriteFile(staged[i], data, 0600); err != nil {
+			return err
+		}
+	}
+
+	var undo []func() error
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				log.Errorf("Failed to roll back the transaction in %v: %v", n.dir, err)
+			}
+		}
+	}
+	for i, p := range paths {
+		if p == "" {
+			continue
+		}
+		if _, err := os.Lstat(p); err == nil {
+			// Move the existing file or directory aside, it is restored in case of a failure
+			p, old := p, filepath.Join(staging, fmt.Sprintf("old-%d", i))
+			if err := os.Rename(p, old); err != nil {
+				rollback()
+				return err
+			}
+			undo = append(undo, func() error { return os.Rename(old, p) })
+		} else if !os.IsNotExist(err) {
+			rollback()
+			return err
+		}
+		if staged[i] == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			rollback()
+			return err
+		}
+		if err := os.Rename(staged[i], p); err != nil {
+			rollback()
+			return err
+		}
+		p := p
+		undo = append(undo, func() error { return os.Remove(p) })
+	}
+	return nil
+}
+
+func (n *ng) changeOp(change interface{}) (fileOp, error) {
+	switch ch := change.(type) {
+	case *engine.HostUpserted:
+		val, err := n.sealHost(ch.Host)
+		if err != nil {
+			return fileOp{}, err
+		}
+		return fileOp{key: path.Join("hosts", ch.Host.Name), val: val}, nil
+	case *engine.HostDeleted:
+		return fileOp{key: path.Join("hosts", ch.HostKey.Name)}, nil
+	case *engine.ListenerUpserted:
+		val, err := n.sealListener(ch.Listener)
+		if err != nil {
+			return fileOp{}, err
+		}
+		return fileOp{key: path.Join("listeners", ch.Listener.Id), val: val}, nil
+	case *engine.ListenerDeleted:
+		return fileOp{key: path.Join("listeners", ch.ListenerKey.Id)}, nil
+	case *engine.BackendUpserted:
+		val, err := n.sealBackend(ch.Backend)
+		if err != nil {
+			return fileOp{}, err
+		}
+		return fileOp{key: path.Join("backends", ch.Backend.Id, "backend"), val: val}, nil
+	case *engine.BackendDeleted:
+		return fileOp{key: path.Join("backends", ch.BackendKey.Id), dir: true}, nil
+	case *engine.ServerUpserted:
+		return fileOp{key: path.Join("backends", ch.BackendKey.Id, "servers", ch.Server.Id), val: ch.Server}, nil
+	case *engine.ServerDeleted:
+		return fileOp{key: path.Join("backends", ch.ServerKey.BackendKey.Id, "servers", ch.ServerKey.Id)}, nil
+	case *engine.FrontendUpserted:
+		return fileOp{key: path.Join("frontends", ch.Frontend.Id, "frontend"), val: ch.Frontend}, nil
+	case *engine.FrontendDeleted:
+		return fileOp{key: path.Join("frontends", ch.FrontendKey.Id), dir: true}, nil
+	case *engine.MiddlewareUpserted:
+		return fileOp{key: path.Join("frontends", ch.FrontendKey.Id, "middlewares", ch.Middleware.Id), val: ch.Middleware}, nil
+	case *engine.MiddlewareDeleted:
+		return fileOp{key: path.Join("frontends", ch.MiddlewareKey.FrontendKey.Id, "middlewares", ch.MiddlewareKey.Id)}, nil
+	}
+	return fileOp{}, &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported change: %#v", change)}
+}
+
+func (n *ng) openSealedJSONVal(bytes []byte, val interface{}) error {
+	if n.options.Box == nil {
+		return errors.New("need secretbox to open sealed data")
+	}
+	sv, err := secret.SealedValueFromJSON(bytes)
+	if err != nil {
+		return err
+	}
+	unsealed, err := n.options.Box.Open(sv)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(unsealed, val)
+}
+
+func (n *ng) sealJSONVal(val interface{}) ([]byte, error) {
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	v, err := n.options.Box.Seal(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return secret.SealedValueToJSON(v)
+}
+
+// writeFile writes the data to a temporary file first and renames it, so the watcher never reads a partially
+// written file.
+func writeFile(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// rank returns the position of the key type in the dependency order, or -1 if the key is not recognized.
+func rank(key string) int {
+	for i, re := range keyRegexes {
+		if re.MatchString(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+type keySorter struct {
+	keys []string
+}
+
+func (s *keySorter) Len() int {
+	return len(s.keys)
+}
+
+func (s *keySorter) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+func (s *keySorter) Less(i, j int) bool {
+	ri, rj := rank(s.keys[i]), rank(s.keys[j])
+	if ri != rj {
+		return ri < rj
+	}
+	return s.keys[i] < s.keys[j]
+}
+
+const (
+	extJSON             = ".json"
+	extYAML             = ".yaml"
+	extYML              = ".yml"
+	defaultPollInterval = time.Second
+	changeLogSize       = 1000
+	// stagingPrefix is the prefix of the hidden directories where transactions stage their files
+	stagingPrefix = ".tx-"
+)
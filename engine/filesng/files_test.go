@@ -0,0 +1,290 @@
+package filesng
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/test"
+	"github.com/vulcand/vulcand/plugin/registry"
+	"github.com/vulcand/vulcand/secret"
+	"github.com/vulcand/vulcand/testutils"
+	"github.com/vulcand/vulcand/utils/json"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestFiles(t *testing.T) { TestingT(t) }
+
+type FilesSuite struct {
+	suite test.EngineSuite
+	dir   string
+	box   *secret.Box
+	stopC chan struct{}
+}
+
+var _ = Suite(&FilesSuite{})
+
+func (s *FilesSuite) SetUpSuite(c *C) {
+	key, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	s.box, err = secret.NewBoxFromKeyString(key)
+	c.Assert(err, IsNil)
+}
+
+func (s *FilesSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	engine, err := New(s.dir, registry.GetRegistry(), Options{PollInterval: 10 * time.Millisecond, Box: s.box})
+	c.Assert(err, IsNil)
+
+	s.suite.ChangesC = make(chan interface{})
+	s.stopC = make(chan struct{})
+	go engine.Subscribe(s.suite.ChangesC, 0, s.stopC)
+	s.suite.Engine = engine
+}
+
+func (s *FilesSuite) TearDownTest(c *C) {
+	close(s.stopC)
+	s.suite.Engine.Close()
+}
+
+func (s *FilesSuite) TestEmptyParams(c *C) {
+	s.suite.EmptyParams(c)
+}
+
+func (s *FilesSuite) TestHostCRUD(c *C) {
+	s.suite.HostCRUD(c)
+}
+
+func (s *FilesSuite) TestHostWithKeyPair(c *C) {
+	s.suite.HostWithKeyPair(c)
+}
+
+func (s *FilesSuite) TestHostWithKeyPairRef(c *C) {
+	s.suite.HostWithKeyPairRef(c)
+}
+
+func (s *FilesSuite) TestHostWithClientAuth(c *C) {
+	s.suite.HostWithClientAuth(c)
+}
+
+func (s *FilesSuite) TestHostUpsertKeyPair(c *C) {
+	s.suite.HostUpsertKeyPair(c)
+}
+
+func (s *FilesSuite) TestHostWithOCSP(c *C) {
+	s.suite.HostWithOCSP(c)
+}
+
+func (s *FilesSuite) TestListenerCRUD(c *C) {
+	s.suite.ListenerCRUD(c)
+}
+
+func (s *FilesSuite) TestListenerSettingsCRUD(c *C) {
+	s.suite.ListenerSettingsCRUD(c)
+}
+
+func (s *FilesSuite) TestListenerWithClientAuth(c *C) {
+	s.suite.ListenerWithClientAuth(c)
+}
+
+func (s *FilesSuite) TestBackendCRUD(c *C) {
+	s.suite.BackendCRUD(c)
+}
+
+func (s *FilesSuite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
+func (s *FilesSuite) TestBackendDeleteUsed(c *C) {
+	s.suite.BackendDeleteUsed(c)
+}
+
+func (s *FilesSuite) TestBackendDeleteUnused(c *C) {
+	s.suite.BackendDeleteUnused(c)
+}
+
+func (s *FilesSuite) TestServerCRUD(c *C) {
+	s.suite.ServerCRUD(c)
+}
+
+func (s *FilesSuite) TestFrontendCRUD(c *C) {
+	s.suite.FrontendCRUD(c)
+}
+
+func (s *FilesSuite) TestFrontendBadBackend(c *C) {
+	s.suite.FrontendBadBackend(c)
+}
+
+func (s *FilesSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *FilesSuite) TestFrontendFanOut(c *C) {
+	s.suite.FrontendFanOut(c)
+}
+
+func (s *FilesSuite) TestMiddlewareCRUD(c *C) {
+	s.suite.MiddlewareCRUD(c)
+}
+
+func (s *FilesSuite) TestMiddlewareBadFrontend(c *C) {
+	s.suite.MiddlewareBadFrontend(c)
+}
+
+func (s *FilesSuite) TestMiddlewareBadType(c *C) {
+	s.suite.MiddlewareBadType(c)
+}
+
+func (s *FilesSuite) TestTransactionCommit(c *C) {
+	s.suite.TransactionCommit(c)
+}
+
+func (s *FilesSuite) TestTransactionRollback(c *C) {
+	s.suite.TransactionRollback(c)
+}
+
+func (s *FilesSuite) TestTransactionCommitFailure(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP}
+	c.Assert(s.suite.Engine.UpsertBackend(b), IsNil)
+	s.expectChange(c)
+	c.Assert(s.suite.Engine.UpsertHost(engine.Host{Name: "h1"}), IsNil)
+	s.expectChange(c)
+
+	// A plain file in place of the servers directory makes the server write fail after the host file is replaced
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "backends", "b1", "servers"), nil, 0644), IsNil)
+
+	tx := engine.Transaction{Changes: []interface{}{
+		&engine.HostUpserted{Host: engine.Host{Name: "h1", Settings: engine.HostSettings{Default: true}}},
+		&engine.HostUpserted{Host: engine.Host{Name: "h2"}},
+		&engine.ServerUpserted{BackendKey: b.Key(), Server: engine.Server{Id: "s1", URL: "http://localhost:5000"}},
+	}}
+	c.Assert(s.suite.Engine.Commit(tx), NotNil)
+
+	hosts, err := s.suite.Engine.GetHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts, DeepEquals, []engine.Host{{Name: "h1"}})
+
+	entries, err := ioutil.ReadDir(s.dir)
+	c.Assert(err, IsNil)
+	for _, e := range entries {
+		c.Assert(e.Name(), Not(Matches), stagingPrefix+".*")
+	}
+	select {
+	case ch := <-s.suite.ChangesC:
+		c.Fatalf("unexpected change: %#v", ch)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *FilesSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
+
+func (s *FilesSuite) TestExternalChanges(c *C) {
+	backend := []byte("Type: http\n")
+	c.Assert(os.MkdirAll(filepath.Join(s.dir, "backends", "b1"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "backends", "b1", "backend.yaml"), backend, 0644), IsNil)
+
+	server := []byte(`{"URL": "http://localhost:5000"}`)
+	c.Assert(os.MkdirAll(filepath.Join(s.dir, "backends", "b1", "servers"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "backends", "b1", "servers", "s1.json"), server, 0644), IsNil)
+
+	b := s.expectChange(c).(*engine.BackendUpserted)
+	c.Assert(b.Backend.Id, Equals, "b1")
+
+	srv := s.expectChange(c).(*engine.ServerUpserted)
+	c.Assert(srv.BackendKey, Equals, engine.BackendKey{Id: "b1"})
+	c.Assert(srv.Server, Equals, engine.Server{Id: "s1", URL: "http://localhost:5000"})
+
+	// Files edited via API keep their format
+	srv.Server.URL = "http://localhost:5001"
+	c.Assert(s.suite.Engine.UpsertServer(srv.BackendKey, srv.Server, 0), IsNil)
+	s.expectChange(c)
+
+	c.Assert(s.suite.Engine.UpsertBackend(b.Backend), IsNil)
+	s.expectChange(c)
+	_, err := os.Stat(filepath.Join(s.dir, "backends", "b1", "backend.yaml"))
+	c.Assert(err, IsNil)
+
+	c.Assert(os.RemoveAll(filepath.Join(s.dir, "backends", "b1")), IsNil)
+	c.Assert(s.expectChange(c), DeepEquals, &engine.ServerDeleted{
+		ServerKey: engine.ServerKey{BackendKey: engine.BackendKey{Id: "b1"}, Id: "s1"}})
+	c.Assert(s.expectChange(c), DeepEquals, &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: "b1"}})
+}
+
+func (s *FilesSuite) TestInvalidFile(c *C) {
+	c.Assert(os.MkdirAll(filepath.Join(s.dir, "hosts"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "hosts", "bad.json"), []byte("{"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "hosts", "good.json"), []byte("{}"), 0644), IsNil)
+
+	c.Assert(s.expectChange(c), DeepEquals, &engine.HostUpserted{Host: engine.Host{Name: "good"}})
+
+	hosts, err := s.suite.Engine.GetHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts, DeepEquals, []engine.Host{{Name: "good"}})
+}
+
+func (s *FilesSuite) TestSealedKeyPairs(c *C) {
+	keyPair := testutils.NewTestKeyPair()
+	h := engine.Host{Name: "localhost", Settings: engine.HostSettings{
+		KeyPair:    keyPair,
+		ClientAuth: &engine.ClientAuthSettings{Type: engine.ClientAuthRequire, CA: keyPair.Cert},
+	}}
+	c.Assert(s.suite.Engine.UpsertHost(h), IsNil)
+	c.Assert(s.expectChange(c), DeepEquals, &engine.HostUpserted{Host: h})
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "hosts", "localhost.json"))
+	c.Assert(err, IsNil)
+	var stored host
+	c.Assert(json.Unmarshal(data, &stored), IsNil)
+	c.Assert(stored.Settings.KeyPair, IsNil)
+	c.Assert(stored.Settings.ClientAuth, IsNil)
+	c.Assert(len(stored.KeyPair), Not(Equals), 0)
+	c.Assert(len(stored.ClientAuth), Not(Equals), 0)
+
+	// Key pairs in files written by hand are kept in plain text
+	plain := []byte("Settings:\n  KeyPair:\n    Cert: " + base64.StdEncoding.EncodeToString(keyPair.Cert) +
+		"\n    Key: " + base64.StdEncoding.EncodeToString(keyPair.Key) + "\n")
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "hosts", "example.com.yaml"), plain, 0644), IsNil)
+	c.Assert(s.expectChange(c), DeepEquals, &engine.HostUpserted{Host: engine.Host{
+		Name: "example.com", Settings: engine.HostSettings{KeyPair: keyPair}}})
+}
+
+func (s *FilesSuite) TestSubscribeReplay(c *C) {
+	c.Assert(s.suite.Engine.UpsertHost(engine.Host{Name: "h1"}), IsNil)
+	c.Assert(s.suite.Engine.UpsertHost(engine.Host{Name: "h2"}), IsNil)
+	s.expectChange(c)
+	s.expectChange(c)
+
+	snapshot, err := s.suite.Engine.GetSnapshot()
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Index, Equals, uint64(2))
+	c.Assert(len(snapshot.Hosts), Equals, 2)
+
+	changesC := make(chan interface{}, 1)
+	stopC := make(chan struct{})
+	defer close(stopC)
+	go s.suite.Engine.Subscribe(changesC, 1, stopC)
+
+	select {
+	case ch := <-changesC:
+		c.Assert(ch, DeepEquals, &engine.HostUpserted{Host: engine.Host{Name: "h2"}})
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for replayed change")
+	}
+}
+
+func (s *FilesSuite) expectChange(c *C) interface{} {
+	select {
+	case ch := <-s.suite.ChangesC:
+		return ch
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timeout waiting for change")
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultHistorySize is the default number of revisions kept by the engines without native revision history
+const DefaultHistorySize = 1000
+
+// Revision is a single configuration change recorded in the history. All changes of a transaction share the same index.
+type Revision struct {
+	Index uint64
+	// Time is the time the change has been observed, it is zero if the engine does not track it
+	Time time.Time
+	// Change is one of the upsert or delete events, e.g. &FrontendUpserted{...}, upserts carry the complete object
+	Change interface{}
+}
+
+func (r Revision) String() string {
+	return fmt.Sprintf("Revision(index=%d, change=%v)", r.Index, r.Change)
+}
+
+// MarshalJSON encodes the change in the format of the transaction changes
+func (r Revision) MarshalJSON() ([]byte, error) {
+	change, err := Transaction{Changes: []interface{}{r.Change}}.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var tx struct {
+		Changes []json.RawMessage
+	}
+	if err := json.Unmarshal(change, &tx); err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Index  uint64
+		Time   time.Time
+		Change json.RawMessage
+	}{Index: r.Index, Time: r.Time, Change: tx.Changes[0]})
+}
+
+// HistoryQuery selects the revisions returned by the engine
+type HistoryQuery struct {
+	// Key limits the history to the changes of a single object, e.g. FrontendKey{Id: "f1"}
+	// or ServerKey{BackendKey: BackendKey{Id: "b1"}, Id: "s1"}, all changes are returned if nil
+	Key interface{}
+	// Limit is the maximum number of the most recent revisions to return, 0 means no limit
+	Limit int
+}
+
+// Matches returns true if the change belongs to the history selected by the query
+func (q HistoryQuery) Matches(change interface{}) bool {
+	return q.Key == nil || ChangeKey(change) == q.Key
+}
+
+// Filter returns the revisions selected by the query
+func (q HistoryQuery) Filter(revisions []Revision) []Revision {
+	out := []Revision{}
+	for _, r := range revisions {
+		if q.Matches(r.Change) {
+			out = append(out, r)
+		}
+	}
+	if q.Limit > 0 && len(out) > q.Limit {
+		out = out[len(out)-q.Limit:]
+	}
+	return out
+}
+
+// ChangeKey returns the key of the object affected by the change, e.g. BackendKey for &BackendUpserted{...}
+func ChangeKey(change interface{}) interface{} {
+	switch ch := change.(type) {
+	case *HostUpserted:
+		return ch.Host.Key()
+	case *HostDeleted:
+		return ch.HostKey
+	case *ListenerUpserted:
+		return ch.Listener.Key()
+	case *ListenerDeleted:
+		return ch.ListenerKey
+	case *BackendUpserted:
+		return ch.Backend.Key()
+	case *BackendDeleted:
+		return ch.BackendKey
+	case *ServerUpserted:
+		return ServerKey{BackendKey: ch.BackendKey, Id: ch.Server.Id}
+	case *ServerDeleted:
+		return ch.ServerKey
+	case *FrontendUpserted:
+		return ch.Frontend.Key()
+	case *FrontendDeleted:
+		return ch.FrontendKey
+	case *MiddlewareUpserted:
+		return MiddlewareKey{FrontendKey: ch.FrontendKey, Id: ch.Middleware.Id}
+	case *MiddlewareDeleted:
+		return ch.MiddlewareKey
+	}
+	return nil
+}
+
+// History is a bounded in-memory log of configuration changes for the engines without native revisions.
+// It keeps the snapshot as of the oldest retained revision, so the configuration can be restored
+// as of any revision in the log.
+type History struct {
+	mtx       sync.Mutex
+	size      int
+	base      *Snapshot
+	revisions []Revision
+}
+
+// NewHistory returns history starting at the given snapshot and keeping up to size revisions
+func NewHistory(s *Snapshot, size int) *History {
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	return &History{size: size, base: copySnapshot(s)}
+}
+
+// Record adds the change to the history, transactions are recorded as multiple revisions with the same index
+func (h *History) Record(index uint64, change interface{}) {
+	h.RecordAt(index, time.Now(), change)
+}
+
+// RecordAt adds the change observed at the given time, it is used to restore the history from a persistent log
+func (h *History) RecordAt(index uint64, t time.Time, change interface{}) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	now := t.UTC()
+	changes := []interface{}{change}
+	if tx, ok := change.(*TransactionCommitted); ok {
+		changes = tx.Changes
+	}
+	for _, ch := range changes {
+		if ChangeKey(ch) == nil {
+			continue
+		}
+		h.revisions = append(h.revisions, Revision{Index: index, Time: now, Change: ch})
+	}
+	// Fold the revisions that do not fit into the base snapshot, keeping the changes with the same index together
+	for len(h.revisions) > h.size {
+		idx := h.revisions[0].Index
+		for len(h.revisions) > 0 && h.revisions[0].Index == idx {
+			ApplyChange(h.base, h.revisions[0].Change)
+			h.revisions = h.revisions[1:]
+		}
+		h.base.Index = idx
+	}
+}
+
+// Get returns the revisions selected by the query, oldest first
+func (h *History) Get(q HistoryQuery) []Revision {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return q.Filter(h.revisions)
+}
+
+// SnapshotAt returns the configuration as of the given revision
+func (h *History) SnapshotAt(index uint64) (*Snapshot, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if index < h.base.Index {
+		return nil, &NotFoundError{Message: fmt.Sprintf("revision %d is no longer in the history, the oldest one is %d", index, h.base.Index)}
+	}
+	s := copySnapshot(h.base)
+	for _, r := range h.revisions {
+		if r.Index > index {
+			break
+		}
+		ApplyChange(s, r.Change)
+		s.Index = r.Index
+	}
+	if s.Index < index {
+		s.Index = index
+	}
+	return s, nil
+}
+
+func copySnapshot(s *Snapshot) *Snapshot {
+	out := &Snapshot{Index: s.Index}
+	out.Hosts = append(out.Hosts, s.Hosts...)
+	out.Listeners = append(out.Listeners, s.Listeners...)
+	for _, bs := range s.BackendSpecs {
+		out.BackendSpecs = append(out.BackendSpecs, BackendSpec{Backend: bs.Backend, Servers: append([]Server{}, bs.Servers...)})
+	}
+	for _, fs := range s.FrontendSpecs {
+		out.FrontendSpecs = append(out.FrontendSpecs, FrontendSpec{Frontend: fs.Frontend, Middlewares: append([]Middleware{}, fs.Middlewares...)})
+	}
+	return out
+}
+
+// ApplyChange updates the snapshot in place, upserted objects replace existing ones or are appended to the end.
+// Changes of a transaction are applied in order.
+func ApplyChange(s *Snapshot, change interface{}) {
+	switch ch := change.(type) {
+	case *TransactionCommitted:
+		for _, c := range ch.Changes {
+			ApplyChange(s, c)
+		}
+	case *HostUpserted:
+		for i := range s.Hosts {
+			if s.Hosts[i].Name == ch.Host.Name {
+				s.Hosts[i] = ch.Host
+				return
+			}
+		}
+		s.Hosts = append(s.Hosts, ch.Host)
+	case *HostDeleted:
+		for i := range s.Hosts {
+			if s.Hosts[i].Key() == ch.HostKey {
+				s.Hosts = append(s.Hosts[:i], s.Hosts[i+1:]...)
+				return
+			}
+		}
+	case *ListenerUpserted:
+		for i := range s.Listeners {
+			if s.Listeners[i].Id == ch.Listener.Id {
+				s.Listeners[i] = ch.Listener
+				return
+			}
+		}
+		s.Listeners = append(s.Listeners, ch.Listener)
+	case *ListenerDeleted:
+		for i := range s.Listeners {
+			if s.Listeners[i].Key() == ch.ListenerKey {
+				s.Listeners = append(s.Listeners[:i], s.Listeners[i+1:]...)
+				return
+			}
+		}
+	case *BackendUpserted:
+		for i := range s.BackendSpecs {
+			if s.BackendSpecs[i].Backend.Id == ch.Backend.Id {
+				s.BackendSpecs[i].Backend = ch.Backend
+				return
+			}
+		}
+		s.BackendSpecs = append(s.BackendSpecs, BackendSpec{Backend: ch.Backend})
+	case *BackendDeleted:
+		for i := range s.BackendSpecs {
+			if s.BackendSpecs[i].Backend.Key() == ch.BackendKey {
+				s.BackendSpecs = append(s.BackendSpecs[:i], s.BackendSpecs[i+1:]...)
+				return
+			}
+		}
+	case *ServerUpserted:
+		for i := range s.BackendSpecs {
+			bs := &s.BackendSpecs[i]
+			if bs.Backend.Key() != ch.BackendKey {
+				continue
+			}
+			for j := range bs.Servers {
+				if bs.Servers[j].Id == ch.Server.Id {
+					bs.Servers[j] = ch.Server
+					return
+				}
+			}
+			bs.Servers = append(bs.Servers, ch.Server)
+			return
+		}
+	case *ServerDeleted:
+		for i := range s.BackendSpecs {
+			bs := &s.BackendSpecs[i]
+			if bs.Backend.Key() != ch.ServerKey.BackendKey {
+				continue
+			}
+			for j := range bs.Servers {
+				if bs.Servers[j].Id == ch.ServerKey.Id {
+					bs.Servers = append(bs.Servers[:j], bs.Servers[j+1:]...)
+					return
+				}
+			}
+		}
+	case *FrontendUpserted:
+		for i := range s.FrontendSpecs {
+			if s.FrontendSpecs[i].Frontend.Id == ch.Frontend.Id {
+				s.FrontendSpecs[i].Frontend = ch.Frontend
+				return
+			}
+		}
+		s.FrontendSpecs = append(s.FrontendSpecs, FrontendSpec{Frontend: ch.Frontend})
+	case *FrontendDeleted:
+		for i := range s.FrontendSpecs {
+			if s.FrontendSpecs[i].Frontend.Key() == ch.FrontendKey {
+				s.FrontendSpecs = append(s.FrontendSpecs[:i], s.FrontendSpecs[i+1:]...)
+				return
+			}
+		}
+	case *MiddlewareUpserted:
+		for i := range s.FrontendSpecs {
+			fs := &s.FrontendSpecs[i]
+			if fs.Frontend.Key() != ch.FrontendKey {
+				continue
+			}
+			for j := range fs.Middlewares {
+				if fs.Middlewares[j].Id == ch.Middleware.Id {
+					fs.Middlewares[j] = ch.Middleware
+					return
+				}
+			}
+			fs.Middlewares = append(fs.Middlewares, ch.Middleware)
+			return
+		}
+	case *MiddlewareDeleted:
+		for i := range s.FrontendSpecs {
+			fs := &s.FrontendSpecs[i]
+			if fs.Frontend.Key() != ch.MiddlewareKey.FrontendKey {
+				continue
+			}
+			for j := range fs.Middlewares {
+				if fs.Middlewares[j].Id == ch.MiddlewareKey.Id {
+					fs.Middlewares = append(fs.Middlewares[:j], fs.Middlewares[j+1:]...)
+					return
+				}
+			}
+		}
+	}
+}
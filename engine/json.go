@@ -3,6 +3,7 @@ package engine
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/router"
@@ -33,12 +34,16 @@ type rawListeners struct {
 }
 
 type rawFrontend struct {
-	Id        string
-	Route     string
-	Type      string
-	BackendId string
-	Settings  json.RawMessage
-	Stats     *RoundTripStats
+	Id          string
+	Route       string
+	Type        string
+	BackendId   string
+	Backends    []FrontendBackend
+	BackendPin  *BackendPin
+	Mirror      *FrontendMirror
+	Settings    json.RawMessage
+	Stats       *RoundTripStats
+	MirrorStats *RoundTripStats
 }
 
 type rawBackend struct {
@@ -145,6 +150,9 @@ func KeyPairFromJSON(in []byte) (*KeyPair, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.Ref != "" {
+		return NewKeyPairRef(c.Ref)
+	}
 	return NewKeyPair(c.Cert, c.Key)
 }
 
@@ -153,23 +161,53 @@ func FrontendFromJSON(router router.Router, in []byte, id ...string) (*Frontend,
 	if err := json.Unmarshal(in, &rf); err != nil {
 		return nil, err
 	}
-	if rf.Type != HTTP {
+	if rf.Type != HTTP && rf.Type != FanOut && rf.Type != TCP {
 		return nil, fmt.Errorf("Unsupported frontend type: %v", rf.Type)
 	}
-	var s HTTPFrontendSettings
-	if rf.Settings != nil {
-		if err := json.Unmarshal(rf.Settings, &s); err != nil {
-			return nil, err
-		}
-	}
 	if len(id) != 0 {
 		rf.Id = id[0]
 	}
-	f, err := NewHTTPFrontend(router, rf.Id, rf.BackendId, rf.Route, s)
+	var f *Frontend
+	var err error
+	if rf.Type == TCP {
+		var s TCPFrontendSettings
+		if rf.Settings != nil {
+			if err := json.Unmarshal(rf.Settings, &s); err != nil {
+				return nil, err
+			}
+		}
+		f, err = NewTCPFrontend(rf.Id, rf.BackendId, s)
+	} else if rf.Type == FanOut {
+		var s FanOutFrontendSettings
+		if rf.Settings != nil {
+			if err := json.Unmarshal(rf.Settings, &s); err != nil {
+				return nil, err
+			}
+		}
+		f, err = NewFanOutFrontend(router, rf.Id, rf.Route, s)
+	} else {
+		var s HTTPFrontendSettings
+		if rf.Settings != nil {
+			if err := json.Unmarshal(rf.Settings, &s); err != nil {
+				return nil, err
+			}
+		}
+		if rf.BackendId == "" && len(rf.Backends) != 0 {
+			rf.BackendId = rf.Backends[0].Id
+		}
+		f, err = NewHTTPFrontend(router, rf.Id, rf.BackendId, rf.Route, s)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err := f.SetBackends(rf.Backends, rf.BackendPin); err != nil {
+		return nil, err
+	}
+	if err := f.SetMirror(rf.Mirror); err != nil {
+		return nil, err
+	}
 	f.Stats = rf.Stats
+	f.MirrorStats = rf.MirrorStats
 	return f, nil
 }
 
@@ -223,7 +261,7 @@ func BackendFromJSON(in []byte, id ...string) (*Backend, error) {
 	if err := json.Unmarshal(in, &rb); err != nil {
 		return nil, err
 	}
-	if rb.Type != HTTP {
+	if rb.Type != HTTP && rb.Type != TCP {
 		return nil, fmt.Errorf("Unsupported backend type %v", rb.Type)
 	}
 
@@ -241,7 +279,13 @@ func BackendFromJSON(in []byte, id ...string) (*Backend, error) {
 	if len(id) != 0 {
 		rb.Id = id[0]
 	}
-	b, err := NewHTTPBackend(rb.Id, s)
+	var b *Backend
+	var err error
+	if rb.Type == TCP {
+		b, err = NewTCPBackend(rb.Id, s)
+	} else {
+		b, err = NewHTTPBackend(rb.Id, s)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -296,5 +340,227 @@ func ServerFromJSON(in []byte, id ...string) (*Server, error) {
 	if len(id) != 0 {
 		e.Id = id[0]
 	}
-	return NewServer(e.Id, e.URL)
+	s, err := NewWeightedServer(e.Id, e.URL, e.Weight)
+	if err != nil {
+		return nil, err
+	}
+	s.Health = e.Health
+	return s, nil
+}
+
+type rawSnapshot struct {
+	Index         uint64
+	FrontendSpecs []rawFrontendSpec
+	BackendSpecs  []rawBackendSpec
+	Hosts         []json.RawMessage
+	Listeners     []json.RawMessage
+}
+
+type rawFrontendSpec struct {
+	Frontend    json.RawMessage
+	Middlewares []json.RawMessage
+}
+
+type rawBackendSpec struct {
+	Backend json.RawMessage
+	Servers []json.RawMessage
+}
+
+func SnapshotFromJSON(router router.Router, in []byte, getter plugin.SpecGetter) (*Snapshot, error) {
+	var rs *rawSnapshot
+	if err := json.Unmarshal(in, &rs); err != nil {
+		return nil, err
+	}
+	if rs == nil {
+		return nil, &InvalidFormatError{Message: "snapshot is missing"}
+	}
+	s := &Snapshot{Index: rs.Index}
+	for _, raw := range rs.Hosts {
+		h, err := HostFromJSON(raw)
+		if err != nil {
+			return nil, err
+		}
+		s.Hosts = append(s.Hosts, *h)
+	}
+	for _, raw := range rs.Listeners {
+		l, err := ListenerFromJSON(raw)
+		if err != nil {
+			return nil, err
+		}
+		s.Listeners = append(s.Listeners, *l)
+	}
+	for _, rbs := range rs.BackendSpecs {
+		b, err := BackendFromJSON(rbs.Backend)
+		if err != nil {
+			return nil, err
+		}
+		bs := BackendSpec{Backend: *b}
+		for _, raw := range rbs.Servers {
+			srv, err := ServerFromJSON(raw)
+			if err != nil {
+				return nil, err
+			}
+			bs.Servers = append(bs.Servers, *srv)
+		}
+		s.BackendSpecs = append(s.BackendSpecs, bs)
+	}
+	for _, rfs := range rs.FrontendSpecs {
+		f, err := FrontendFromJSON(router, rfs.Frontend)
+		if err != nil {
+			return nil, err
+		}
+		fs := FrontendSpec{Frontend: *f}
+		for _, raw := range rfs.Middlewares {
+			m, err := MiddlewareFromJSON(raw, getter)
+			if err != nil {
+				return nil, err
+			}
+			fs.Middlewares = append(fs.Middlewares, *m)
+		}
+		s.FrontendSpecs = append(s.FrontendSpecs, fs)
+	}
+	return s, nil
+}
+
+type rawRevisions struct {
+	Revisions []rawRevision
+}
+
+type rawRevision struct {
+	Index  uint64
+	Time   time.Time
+	Change rawChange
+}
+
+func RevisionsFromJSON(router router.Router, in []byte, getter plugin.SpecGetter) ([]Revision, error) {
+	var rr *rawRevisions
+	if err := json.Unmarshal(in, &rr); err != nil {
+		return nil, err
+	}
+	out := []Revision{}
+	if rr == nil {
+		return out, nil
+	}
+	for _, r := range rr.Revisions {
+		ch, err := changeFromJSON(router, r.Change, getter)
+		if err != nil {
+			return nil, &InvalidFormatError{Message: fmt.Sprintf("revision %d: %v", r.Index, err)}
+		}
+		out = append(out, Revision{Index: r.Index, Time: r.Time, Change: ch})
+	}
+	return out, nil
+}
+
+type rawTransaction struct {
+	Changes []rawChange
+}
+
+type rawChange struct {
+	Op         string
+	Host       json.RawMessage
+	Listener   json.RawMessage
+	Backend    json.RawMessage
+	BackendId  string
+	Server     json.RawMessage
+	Frontend   json.RawMessage
+	FrontendId string
+	Middleware json.RawMessage
+}
+
+func TransactionFromJSON(router router.Router, in []byte, getter plugin.SpecGetter) (*Transaction, error) {
+	var rt *rawTransaction
+	if err := json.Unmarshal(in, &rt); err != nil {
+		return nil, err
+	}
+	if rt == nil {
+		return nil, &InvalidFormatError{Message: "transaction is missing"}
+	}
+	tx := &Transaction{}
+	for i, rc := range rt.Changes {
+		ch, err := changeFromJSON(router, rc, getter)
+		if err != nil {
+			return nil, &InvalidFormatError{Message: fmt.Sprintf("change %d: %v", i, err)}
+		}
+		tx.Changes = append(tx.Changes, ch)
+	}
+	return tx, nil
+}
+
+func changeFromJSON(router router.Router, rc rawChange, getter plugin.SpecGetter) (interface{}, error) {
+	switch rc.Op {
+	case OpUpsert:
+		switch {
+		case rc.Host != nil:
+			h, err := HostFromJSON(rc.Host)
+			if err != nil {
+				return nil, err
+			}
+			return &HostUpserted{Host: *h}, nil
+		case rc.Listener != nil:
+			l, err := ListenerFromJSON(rc.Listener)
+			if err != nil {
+				return nil, err
+			}
+			return &ListenerUpserted{Listener: *l}, nil
+		case rc.Backend != nil:
+			b, err := BackendFromJSON(rc.Backend)
+			if err != nil {
+				return nil, err
+			}
+			return &BackendUpserted{Backend: *b}, nil
+		case rc.Server != nil:
+			s, err := ServerFromJSON(rc.Server)
+			if err != nil {
+				return nil, err
+			}
+			return &ServerUpserted{BackendKey: BackendKey{Id: rc.BackendId}, Server: *s}, nil
+		case rc.Frontend != nil:
+			f, err := FrontendFromJSON(router, rc.Frontend)
+			if err != nil {
+				return nil, err
+			}
+			return &FrontendUpserted{Frontend: *f}, nil
+		case rc.Middleware != nil:
+			m, err := MiddlewareFromJSON(rc.Middleware, getter)
+			if err != nil {
+				return nil, err
+			}
+			return &MiddlewareUpserted{FrontendKey: FrontendKey{Id: rc.FrontendId}, Middleware: *m}, nil
+		}
+	case OpDelete:
+		var key struct {
+			Id   string
+			Name string
+		}
+		var raw json.RawMessage
+		for _, r := range []json.RawMessage{rc.Host, rc.Listener, rc.Backend, rc.Server, rc.Frontend, rc.Middleware} {
+			if r != nil {
+				raw = r
+				break
+			}
+		}
+		if raw == nil {
+			break
+		}
+		if err := json.Unmarshal(raw, &key); err != nil {
+			return nil, err
+		}
+		switch {
+		case rc.Host != nil:
+			return &HostDeleted{HostKey: HostKey{Name: key.Name}}, nil
+		case rc.Listener != nil:
+			return &ListenerDeleted{ListenerKey: ListenerKey{Id: key.Id}}, nil
+		case rc.Backend != nil:
+			return &BackendDeleted{BackendKey: BackendKey{Id: key.Id}}, nil
+		case rc.Server != nil:
+			return &ServerDeleted{ServerKey: ServerKey{BackendKey: BackendKey{Id: rc.BackendId}, Id: key.Id}}, nil
+		case rc.Frontend != nil:
+			return &FrontendDeleted{FrontendKey: FrontendKey{Id: key.Id}}, nil
+		case rc.Middleware != nil:
+			return &MiddlewareDeleted{MiddlewareKey: MiddlewareKey{FrontendKey: FrontendKey{Id: rc.FrontendId}, Id: key.Id}}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported operation %q, expected %q or %q", rc.Op, OpUpsert, OpDelete)
+	}
+	return nil, fmt.Errorf("%v operation is missing the object", rc.Op)
 }
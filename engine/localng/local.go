@@ -0,0 +1,1269 @@
+// package localng contains the implementation of the engine that keeps configuration in a local file, so it survives
+// restarts without requiring an etcd cluster. It is meant for single node deployments.
+//
+// The file is an append-only log of key-value operations laid out the same way as etcd keys. Replaying the log
+// restores the configuration, and the recent part of the log serves as a change log for Subscribe. The log is
+// compacted once it grows beyond the configured number of changes.
+package localng
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+	"github.com/vulcand/vulcand/utils/json"
+)
+
+type ng struct {
+	path     string
+	registry *plugin.Registry
+	options  Options
+	logsev   log.Level
+
+	mu   sync.Mutex
+	file *os.File
+	kv   map[string]entry
+	// index is the index of the last change written to the log
+	index uint64
+	// compactIdx is the index of the last change that has been compacted and can not be replayed anymore
+	compactIdx uint64
+	// base is the state of the keys as of compactIdx, replaying the changes on top of it restores the history
+	base    map[string]entry
+	changes []record
+	// notifyC is closed and replaced every time a new change is written
+	notifyC chan struct{}
+	history *engine.History
+
+	closeOnce sync.Once
+	closeC    chan struct{}
+	wg        sync.WaitGroup
+}
+
+type Options struct {
+	// ChangeLogSize is the number of recent changes kept available for Subscribe
+	ChangeLogSize int
+	// ExpiryCheckPeriod specifies how often expired frontends, servers and middlewares are removed
+	ExpiryCheckPeriod time.Duration
+	// HistorySize is the number of revisions kept in the history. The history is restored from the log on start,
+	// so it only reaches back as far as the changes retained in the log, see ChangeLogSize
+	HistorySize int
+	Box         *secret.Box
+}
+
+type entry struct {
+	val     []byte
+	expires int64
+}
+
+// record is a single operation in the log file
+type record struct {
+	Index uint64
+	Op    string
+	Key   string `json:",omitempty"`
+	Val   []byte `json:",omitempty"`
+	// Expires is a unix time in nanoseconds when the key expires, 0 means that the key never expires
+	Expires int64 `json:",omitempty"`
+	// Time is a unix time in nanoseconds when the change has been written
+	Time int64 `json:",omitempty"`
+	// Ops are the operations of a transaction
+	Ops []record `json:",omitempty"`
+}
+
+var (
+	frontendIdRegex = regexp.MustCompile("^frontends/([^/]+)(?:/frontend)?$")
+	backendIdRegex  = regexp.MustCompile("^backends/([^/]+)(?:/backend)?$")
+	hostnameRegex   = regexp.MustCompile("^hosts/([^/]+)(?:/host)?$")
+	listenerIdRegex = regexp.MustCompile("^listeners/([^/]+)$")
+	middlewareRegex = regexp.MustCompile("^frontends/([^/]+)/middlewares/([^/]+)$")
+	serverRegex     = regexp.MustCompile("^backends/([^/]+)/servers/([^/]+)$")
+)
+
+func New(path string, registry *plugin.Registry, options Options) (engine.Engine, error) {
+	if options.ChangeLogSize <= 0 {
+		options.ChangeLogSize = defaultChangeLogSize
+	}
+	if options.ExpiryCheckPeriod <= 0 {
+		options.ExpiryCheckPeriod = defaultExpiryCheckPeriod
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	n := &ng{
+		path:     path,
+		registry: registry,
+		options:  options,
+		file:     f,
+		kv:       map[string]entry{},
+		notifyC:  make(chan struct{}),
+		closeC:   make(chan struct{}),
+	}
+	if err := n.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	n.history = n.restoreHistory()
+
+	n.wg.Add(1)
+	go n.expireKeys()
+	return n, nil
+}
+
+func (n *ng) Close() {
+	n.closeOnce.Do(func() {
+		close(n.closeC)
+		n.wg.Wait()
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if err := n.file.Close(); err != nil {
+			log.Errorf("Failed to close %v: %v", n.path, err)
+		}
+	})
+}
+
+func (n *ng) GetRegistry() *plugin.Registry {
+	return n.registry
+}
+
+func (n *ng) GetLogSeverity() log.Level {
+	return n.logsev
+}
+
+func (n *ng) SetLogSeverity(sev log.Level) {
+	n.logsev = sev
+	log.SetLevel(n.logsev)
+}
+
+func (n *ng) GetSnapshot() (*engine.Snapshot, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.snapshot(), nil
+}
+
+func (n *ng) GetHistory(q engine.HistoryQuery) ([]engine.Revision, error) {
+	return n.history.Get(q), nil
+}
+
+func (n *ng) GetSnapshotAt(revision uint64) (*engine.Snapshot, error) {
+	return n.history.SnapshotAt(revision)
+}
+
+func (n *ng) snapshot() *engine.Snapshot {
+	s := &engine.Snapshot{Index: n.index}
+	s.Hosts = n.getHosts()
+	s.Listeners = n.getListeners()
+	for _, b := range n.getBackends() {
+		s.BackendSpecs = append(s.BackendSpecs, engine.BackendSpec{Backend: b, Servers: n.getServers(b.Key())})
+	}
+	for _, f := range n.getFrontends() {
+		s.FrontendSpecs = append(s.FrontendSpecs, engine.FrontendSpec{Frontend: f, Middlewares: n.getMiddlewares(f.Key())})
+	}
+	return s
+}
+
+func (n *ng) GetHosts() ([]engine.Host, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getHosts(), nil
+}
+
+func (n *ng) getHosts() []engine.Host {
+	hosts := []engine.Host{}
+	for _, key := range n.keys(hostnameRegex) {
+		host, err := n.getHost(engine.HostKey{Name: hostnameRegex.FindStringSubmatch(key)[1]})
+		if err != nil {
+			log.Warningf("Invalid host config for %v: %v\n", key, err)
+			continue
+		}
+		hosts = append(hosts, *host)
+	}
+	return hosts
+}
+
+func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getHost(key)
+}
+
+func (n *ng) getHost(key engine.HostKey) (*engine.Host, error) {
+	val, err := n.getVal("hosts", key.Name, "host")
+	if err != nil {
+		return nil, err
+	}
+	return n.parseHost(val, key.Name)
+}
+
+func (n *ng) parseHost(val []byte, name string) (*engine.Host, error) {
+	var h *host
+	if err := json.Unmarshal(val, &h); err != nil {
+		return nil, err
+	}
+	var keyPair *engine.KeyPair
+	if len(h.Settings.KeyPair) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.KeyPair, &keyPair); err != nil {
+			return nil, err
+		}
+	}
+	if h.Settings.KeyPairRef != "" {
+		keyPair = &engine.KeyPair{Ref: h.Settings.KeyPairRef}
+	}
+	var clientAuth *engine.ClientAuthSettings
+	if len(h.Settings.ClientAuth) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.ClientAuth, &clientAuth); err != nil {
+			return nil, err
+		}
+	}
+	return engine.NewHost(name, engine.HostSettings{Default: h.Settings.Default, KeyPair: keyPair, OCSP: h.Settings.OCSP, ClientAuth: clientAuth})
+}
+
+func (n *ng) UpsertHost(h engine.Host) error {
+	if h.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	val, err := n.sealHost(h)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.setJSONVal(path("hosts", h.Name, "host"), val, noTTL)
+}
+
+// sealHost converts the host to the stored representation with the key pair and the client auth settings sealed
+func (n *ng) sealHost(h engine.Host) (*host, error) {
+	val := &host{
+		Name: h.Name,
+		Settings: hostSettings{
+			Default: h.Settings.Default,
+			OCSP:    h.Settings.OCSP,
+		},
+	}
+	if h.Settings.KeyPair != nil && h.Settings.KeyPair.Ref != "" {
+		val.Settings.KeyPairRef = h.Settings.KeyPair.Ref
+	} else if h.Settings.KeyPair != nil {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPair)
+		if err != nil {
+			return nil, err
+		}
+		val.Settings.KeyPair = bytes
+	}
+	if h.Settings.ClientAuth != nil {
+		bytes, err := n.sealJSONVal(h.Settings.ClientAuth)
+		if err != nil {
+			return nil, err
+		}
+		val.Settings.ClientAuth = bytes
+	}
+	return val, nil
+}
+
+func (n *ng) DeleteHost(key engine.HostKey) error {
+	if key.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deleteKey(path("hosts", key.Name))
+}
+
+func (n *ng) GetListeners() ([]engine.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getListeners(), nil
+}
+
+func (n *ng) getListeners() []engine.Listener {
+	ls := []engine.Listener{}
+	for _, key := range n.keys(listenerIdRegex) {
+		l, err := n.parseListener(n.kv[key].val, listenerIdRegex.FindStringSubmatch(key)[1])
+		if err != nil {
+			log.Warningf("Invalid listener config for %v: %v\n", key, err)
+			continue
+		}
+		ls = append(ls, *l)
+	}
+	return ls
+}
+
+func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	val, err := n.getVal("listeners", key.Id)
+	if err != nil {
+		return nil, err
+	}
+	return n.parseListener(val, key.Id)
+}
+
+// parseListener parses the stored representation of the listener, opening its sealed client auth settings
+func (n *ng) parseListener(val []byte, id string) (*engine.Listener, error) {
+	var sealed listener
+	if err := json.Unmarshal(val, &sealed); err != nil {
+		return nil, err
+	}
+	l, err := engine.ListenerFromJSON(val, id)
+	if err != nil || len(sealed.ClientAuth) == 0 {
+		return l, err
+	}
+	var clientAuth *engine.ClientAuthSettings
+	if err := n.openSealedJSONVal(sealed.ClientAuth, &clientAuth); err != nil {
+		return nil, err
+	}
+	if l.Settings == nil {
+		l.Settings = &engine.HTTPSListenerSettings{}
+	}
+	l.Settings.ClientAuth = clientAuth
+	return l, nil
+}
+
+func (n *ng) UpsertListener(l engine.Listener) error {
+	if l.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	val, err := n.sealListener(l)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.setJSONVal(path("listeners", l.Id), val, noTTL)
+}
+
+// sealListener converts the listener to the stored representation with the client auth settings sealed
+func (n *ng) sealListener(l engine.Listener) (*listener, error) {
+	if l.Settings == nil || l.Settings.ClientAuth == nil {
+		return &listener{Listener: l}, nil
+	}
+	bytes, err := n.sealJSONVal(l.Settings.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	settings := *l.Settings
+	settings.ClientAuth = nil
+	l.Settings = &settings
+	return &listener{Listener: l, ClientAuth: bytes}, nil
+}
+
+func (n *ng) DeleteListener(key engine.ListenerKey) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deleteKey(path("listeners", key.Id))
+}
+
+func (n *ng) GetFrontends() ([]engine.Frontend, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getFrontends(), nil
+}
+
+func (n *ng) getFrontends() []engine.Frontend {
+	fs := []engine.Frontend{}
+	for _, key := range n.keys(frontendIdRegex) {
+		f, err := n.getFrontend(engine.FrontendKey{Id: frontendIdRegex.FindStringSubmatch(key)[1]})
+		if err != nil {
+			log.Warningf("Invalid frontend config for %v: %v\n", key, err)
+			continue
+		}
+		fs = append(fs, *f)
+	}
+	return fs
+}
+
+func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getFrontend(key)
+}
+
+func (n *ng) getFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	val, err := n.getVal("frontends", key.Id, "frontend")
+	if err != nil {
+		return nil, err
+	}
+	return engine.FrontendFromJSON(n.registry.GetRouter(), val, key.Id)
+}
+
+func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	if f.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, bk := range f.BackendKeys() {
+		if _, err := n.getVal("backends", bk.Id, "backend"); err != nil {
+			return err
+		}
+	}
+	return n.setJSONVal(path("frontends", f.Id, "frontend"), f, ttl)
+}
+
+func (n *ng) DeleteFrontend(key engine.FrontendKey) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deleteKey(path("frontends", key.Id))
+}
+
+func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getMiddlewares(fk), nil
+}
+
+func (n *ng) getMiddlewares(fk engine.FrontendKey) []engine.Middleware {
+	ms := []engine.Middleware{}
+	for _, key := range n.keys(middlewareRegex) {
+		ids := middlewareRegex.FindStringSubmatch(key)
+		if ids[1] != fk.Id {
+			continue
+		}
+		m, err := engine.MiddlewareFromJSON(n.kv[key].val, n.registry.GetSpec, ids[2])
+		if err != nil {
+			log.Warningf("Invalid middleware config for %v (frontend: %v): %v\n", key, fk, err)
+			continue
+		}
+		ms = append(ms, *m)
+	}
+	return ms
+}
+
+func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	val, err := n.getVal("frontends", key.FrontendKey.Id, "middlewares", key.Id)
+	if err != nil {
+		return nil, err
+	}
+	return engine.MiddlewareFromJSON(val, n.registry.GetSpec, key.Id)
+}
+
+func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	if fk.Id == "" || m.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.getVal("frontends", fk.Id, "frontend"); err != nil {
+		return err
+	}
+	return n.setJSONVal(path("frontends", fk.Id, "middlewares", m.Id), m, ttl)
+}
+
+func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
+	if mk.FrontendKey.Id == "" || mk.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deleteKey(path("frontends", mk.FrontendKey.Id, "middlewares", mk.Id))
+}
+
+func (n *ng) GetBackends() ([]engine.Backend, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getBackends(), nil
+}
+
+func (n *ng) getBackends() []engine.Backend {
+	bs := []engine.Backend{}
+	for _, key := range n.keys(backendIdRegex) {
+		b, err := n.parseBackend(n.kv[key].val, backendIdRegex.FindStringSubmatch(key)[1])
+		if err != nil {
+			log.Warningf("Invalid backend config for %v: %v\n", key, err)
+			continue
+		}
+		bs = append(bs, *b)
+	}
+	return bs
+}
+
+func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	val, err := n.getVal("backends", key.Id, "backend")
+	if err != nil {
+		return nil, err
+	}
+	return n.parseBackend(val, key.Id)
+}
+
+func (n *ng) UpsertBackend(b engine.Backend) error {
+	if b.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	val, err := n.sealBackend(b)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.setJSONVal(path("backends", b.Id, "backend"), val, noTTL)
+}
+
+// sealBackend converts the backend to the stored representation with the TLS key pair sealed
+func (n *ng) sealBackend(b engine.Backend) (*backend, error) {
+	s, ok := b.Settings.(engine.HTTPBackendSettings)
+	if !ok || s.TLS == nil || s.TLS.KeyPair == nil {
+		return &backend{Backend: b}, nil
+	}
+	bytes, err := n.sealJSONVal(s.TLS.KeyPair)
+	if err != nil {
+		return nil, err
+	}
+	tlsSettings := *s.TLS
+	tlsSettings.KeyPair = nil
+	s.TLS = &tlsSettings
+	b.Settings = s
+	return &backend{Backend: b, KeyPair: bytes}, nil
+}
+
+// parseBackend parses the stored representation of the backend, opening its sealed TLS key pair
+func (n *ng) parseBackend(val []byte, id string) (*engine.Backend, error) {
+	var sealed struct {
+		KeyPair []byte
+	}
+	if err := json.Unmarshal(val, &sealed); err != nil {
+		return nil, err
+	}
+	b, err := engine.BackendFromJSON(val, id)
+	if err != nil || len(sealed.KeyPair) == 0 {
+		return b, err
+	}
+	var keyPair *engine.KeyPair
+	if err := n.openSealedJSONVal(sealed.KeyPair, &keyPair); err != nil {
+		return nil, err
+	}
+	s := b.HTTPSettings()
+	tlsSettings := engine.TLSSettings{}
+	if s.TLS != nil {
+		tlsSettings = *s.TLS
+	}
+	tlsSettings.KeyPair = keyPair
+	s.TLS = &tlsSettings
+	if _, err := s.TransportSettings(); err != nil {
+		return nil, err
+	}
+	b.Settings = s
+	return b, nil
+}
+
+func (n *ng) DeleteBackend(bk engine.BackendKey) error {
+	if bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	usedFs := []engine.Frontend{}
+	for _, f := range n.getFrontends() {
+		if f.UsesBackend(bk) {
+			usedFs = append(usedFs, f)
+		}
+	}
+	if len(usedFs) != 0 {
+		return fmt.Errorf("can not delete backend '%v', it is in use by %v", bk, usedFs)
+	}
+	return n.deleteKey(path("backends", bk.Id))
+}
+
+func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.getServers(bk), nil
+}
+
+func (n *ng) getServers(bk engine.BackendKey) []engine.Server {
+	svs := []engine.Server{}
+	for _, key := range n.keys(serverRegex) {
+		ids := serverRegex.FindStringSubmatch(key)
+		if ids[1] != bk.Id {
+			continue
+		}
+		srv, err := engine.ServerFromJSON(n.kv[key].val, ids[2])
+		if err != nil {
+			log.Warningf("Invalid server config for %v (backend: %v): %v\n", key, bk, err)
+			continue
+		}
+		svs = append(svs, *srv)
+	}
+	return svs
+}
+
+func (n *ng) GetServer(sk engine.ServerKey) (*engine.Server, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	val, err := n.getVal("backends", sk.BackendKey.Id, "servers", sk.Id)
+	if err != nil {
+		return nil, err
+	}
+	return engine.ServerFromJSON(val, sk.Id)
+}
+
+func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	if s.Id == "" || bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.getVal("backends", bk.Id, "backend"); err != nil {
+		return err
+	}
+	return n.setJSONVal(path("backends", bk.Id, "servers", s.Id), s, ttl)
+}
+
+func (n *ng) HeartbeatServer(sk engine.ServerKey, ttl time.Duration) error {
+	if sk.Id == "" || sk.BackendKey.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	if ttl <= 0 {
+		return &engine.InvalidFormatError{Message: "heartbeat TTL should be positive"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := path("backends", sk.BackendKey.Id, "servers", sk.Id)
+	if _, err := n.getVal(key); err != nil {
+		return err
+	}
+	return n.write(record{Op: opRefresh, Key: key, Expires: time.Now().Add(ttl).UnixNano()})
+}
+
+func (n *ng) DeleteServer(sk engine.ServerKey) error {
+	if sk.Id == "" || sk.BackendKey.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.deleteKey(path("backends", sk.BackendKey.Id, "servers", sk.Id))
+}
+
+// Commit writes all changes of the transaction as a single record, so they are applied and replayed together.
+func (n *ng) Commit(tx engine.Transaction) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := tx.Check(n.snapshot()); err != nil {
+		return err
+	}
+	ops := []record{}
+	for _, change := range tx.Ordered() {
+		op, err := n.changeRecord(change)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, op)
+	}
+	return n.write(record{Op: opTransaction, Ops: ops})
+}
+
+func (n *ng) changeRecord(change interface{}) (record, error) {
+	switch ch := change.(type) {
+	case *engine.HostUpserted:
+		val, err := n.sealHost(ch.Host)
+		if err != nil {
+			return record{}, err
+		}
+		return setRecord(path("hosts", ch.Host.Name, "host"), val, noTTL)
+	case *engine.HostDeleted:
+		return record{Op: opDelete, Key: path("hosts", ch.HostKey.Name)}, nil
+	case *engine.ListenerUpserted:
+		val, err := n.sealListener(ch.Listener)
+		if err != nil {
+			return record{}, err
+		}
+		return setRecord(path("listeners", ch.Listener.Id), val, noTTL)
+	case *engine.ListenerDeleted:
+		return record{Op: opDelete, Key: path("listeners", ch.ListenerKey.Id)}, nil
+	case *engine.BackendUpserted:
+		val, err := n.sealBackend(ch.Backend)
+		if err != nil {
+			return record{}, err
+		}
+		return setRecord(path("backends", ch.Backend.Id, "backend"), val, noTTL)
+	case *engine.BackendDeleted:
+		return record{Op: opDelete, Key: path("backends", ch.BackendKey.Id)}, nil
+	case *engine.ServerUpserted:
+		return setRecord(path("backends", ch.BackendKey.Id, "servers", ch.Server.Id), ch.Server, noTTL)
+	case *engine.ServerDeleted:
+		return record{Op: opDelete, Key: path("backends", ch.ServerKey.BackendKey.Id, "servers", ch.ServerKey.Id)}, nil
+	case *engine.FrontendUpserted:
+		return setRecord(path("frontends", ch.Frontend.Id, "frontend"), ch.Frontend, noTTL)
+	case *engine.FrontendDeleted:
+		return record{Op: opDelete, Key: path("frontends", ch.FrontendKey.Id)}, nil
+	case *engine.MiddlewareUpserted:
+		return setRecord(path("frontends", ch.FrontendKey.Id, "middlewares", ch.Middleware.Id), ch.Middleware, noTTL)
+	case *engine.MiddlewareDeleted:
+		return record{Op: opDelete, Key: path("frontends", ch.MiddlewareKey.FrontendKey.Id, "middlewares", ch.MiddlewareKey.Id)}, nil
+	}
+	return record{}, &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported change: %#v", change)}
+}
+
+// Subscribe replays the changes written after the given index and then keeps emitting new changes
+// until the cancel channel is closed. It is a blocking function.
+func (n *ng) Subscribe(changes chan interface{}, afterIdx uint64, cancelC chan struct{}) error {
+	log.Infof("Begin watching %v: index %d", n.path, afterIdx)
+	for {
+		n.mu.Lock()
+		pending, err := n.changesAfter(afterIdx)
+		notifyC := n.notifyC
+		n.mu.Unlock()
+		if err != nil {
+			log.Errorf("Stop watching: error: %v", err)
+			return err
+		}
+
+		for _, r := range pending {
+			afterIdx = r.Index
+			change, err := n.parseChange(r)
+			if err != nil {
+				log.Warningf("Ignore '%s', error: %s", r, err)
+				continue
+			}
+			if change != nil {
+				log.Infof("%v", change)
+				select {
+				case changes <- change:
+				case <-cancelC:
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-notifyC:
+		case <-cancelC:
+			return nil
+		case <-n.closeC:
+			log.Infof("Stop watching: graceful shutdown")
+			return nil
+		}
+	}
+}
+
+func (n *ng) changesAfter(afterIdx uint64) ([]record, error) {
+	if afterIdx >= n.index {
+		return nil, nil
+	}
+	if afterIdx < n.compactIdx {
+		return nil, fmt.Errorf("changes after index %d have been compacted, oldest available index is %d", afterIdx, n.compactIdx)
+	}
+	first := sort.Search(len(n.changes), func(i int) bool { return n.changes[i].Index > afterIdx })
+	pending := make([]record, len(n.changes)-first)
+	copy(pending, n.changes[first:])
+	return pending, nil
+}
+
+func (n *ng) parseChange(r record) (interface{}, error) {
+	switch r.Op {
+	case opSet:
+		return n.parseSet(r)
+	case opDelete:
+		return parseDelete(r)
+	case opTransaction:
+		committed := &engine.TransactionCommitted{}
+		for _, op := range r.Ops {
+			change, err := n.parseChange(op)
+			if err != nil {
+				log.Warningf("Ignore '%s', error: %s", op, err)
+				continue
+			}
+			committed.Changes = append(committed.Changes, change)
+		}
+		return committed, nil
+	case opRefresh:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported operation: %v", r.Op)
+}
+
+func (n *ng) parseSet(r record) (interface{}, error) {
+	if ids := hostnameRegex.FindStringSubmatch(r.Key); ids != nil {
+		h, err := n.parseHost(r.Val, ids[1])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.HostUpserted{Host: *h}, nil
+	}
+	if ids := listenerIdRegex.FindStringSubmatch(r.Key); ids != nil {
+		l, err := n.parseListener(r.Val, ids[1])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ListenerUpserted{Listener: *l}, nil
+	}
+	if ids := backendIdRegex.FindStringSubmatch(r.Key); ids != nil {
+		b, err := n.parseBackend(r.Val, ids[1])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.BackendUpserted{Backend: *b}, nil
+	}
+	if ids := serverRegex.FindStringSubmatch(r.Key); ids != nil {
+		srv, err := engine.ServerFromJSON(r.Val, ids[2])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: ids[1]}, Server: *srv}, nil
+	}
+	if ids := frontendIdRegex.FindStringSubmatch(r.Key); ids != nil {
+		f, err := engine.FrontendFromJSON(n.registry.GetRouter(), r.Val, ids[1])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.FrontendUpserted{Frontend: *f}, nil
+	}
+	if ids := middlewareRegex.FindStringSubmatch(r.Key); ids != nil {
+		m, err := engine.MiddlewareFromJSON(r.Val, n.registry.GetSpec, ids[2])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.MiddlewareUpserted{FrontendKey: engine.FrontendKey{Id: ids[1]}, Middleware: *m}, nil
+	}
+	return nil, fmt.Errorf("unsupported key: %v", r.Key)
+}
+
+func parseDelete(r record) (interface{}, error) {
+	if ids := hostnameRegex.FindStringSubmatch(r.Key); ids != nil {
+		return &engine.HostDeleted{HostKey: engine.HostKey{Name: ids[1]}}, nil
+	}
+	if ids := listenerIdRegex.FindStringSubmatch(r.Key); ids != nil {
+		return &engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: ids[1]}}, nil
+	}
+	if ids := backendIdRegex.FindStringSubmatch(r.Key); ids != nil {
+		return &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: ids[1]}}, nil
+	}
+	if ids := serverRegex.FindStringSubmatch(r.Key); ids != nil {
+		return &engine.ServerDeleted{
+			ServerKey: engine.ServerKey{BackendKey: engine.BackendKey{Id: ids[1]}, Id: ids[2]},
+		}, nil
+	}
+	if ids := frontendIdRegex.FindStringSubmatch(r.Key); ids != nil {
+		return &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: ids[1]}}, nil
+	}
+	if ids := middlewareRegex.FindStringSubmatch(r.Key); ids != nil {
+		return &engine.MiddlewareDeleted{
+			MiddlewareKey: engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: ids[1]}, Id: ids[2]},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key: %v", r.Key)
+}
+
+// expireKeys periodically deletes the keys with expired TTLs, the deletes are written to the log
+// and emitted the same way as the deletes made via API.
+func (n *ng) expireKeys() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.options.ExpiryCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.mu.Lock()
+			if err := n.deleteExpired(time.Now()); err != nil {
+				log.Errorf("Failed to delete expired keys: %v", err)
+			}
+			n.mu.Unlock()
+		case <-n.closeC:
+			return
+		}
+	}
+}
+
+func (n *ng) deleteExpired(now time.Time) error {
+	expired := []string{}
+	for key, e := range n.kv {
+		if e.expires != 0 && e.expires <= now.UnixNano() {
+			expired = append(expired, key)
+		}
+	}
+	sort.Strings(expired)
+	for _, key := range expired {
+		if _, ok := n.kv[key]; !ok {
+			// already deleted together with the parent
+			continue
+		}
+		// Expired frontend takes its middlewares with it, the same way as DeleteFrontend does
+		if ids := frontendIdRegex.FindStringSubmatch(key); ids != nil {
+			key = path("frontends", ids[1])
+		}
+		if err := n.deleteKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *ng) keys(re *regexp.Regexp) []string {
+	keys := []string{}
+	for key := range n.kv {
+		if re.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (n *ng) getVal(keys ...string) ([]byte, error) {
+	key := path(keys...)
+	e, ok := n.kv[key]
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", key)}
+	}
+	return e.val, nil
+}
+
+func (n *ng) setJSONVal(key string, v interface{}, ttl time.Duration) error {
+	r, err := setRecord(key, v, ttl)
+	if err != nil {
+		return err
+	}
+	return n.write(r)
+}
+
+func setRecord(key string, v interface{}, ttl time.Duration) (record, error) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return record{}, err
+	}
+	r := record{Op: opSet, Key: key, Val: bytes}
+	if ttl > 0 {
+		r.Expires = time.Now().Add(ttl).UnixNano()
+	}
+	return r, nil
+}
+
+// deleteKey deletes the key and all the keys nested under it
+func (n *ng) deleteKey(key string) error {
+	found := false
+	for k := range n.kv {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", key)}
+	}
+	return n.write(record{Op: opDelete, Key: key})
+}
+
+// write appends the change to the log, applies it and notifies the subscribers. The change is synced
+// to disk before it is applied.
+func (n *ng) write(r record) error {
+	r.Index = n.index + 1
+	r.Time = time.Now().UnixNano()
+	if err := n.append(n.file, r); err != nil {
+		return err
+	}
+	if err := n.file.Sync(); err != nil {
+		return err
+	}
+	n.apply(r)
+	if change, err := n.parseChange(r); err == nil {
+		n.history.RecordAt(r.Index, time.Unix(0, r.Time), change)
+	}
+
+	close(n.notifyC)
+	n.notifyC = make(chan struct{})
+
+	if len(n.changes) >= 2*n.options.ChangeLogSize {
+		if err := n.compact(); err != nil {
+			log.Errorf("Failed to compact %v: %v", n.path, err)
+		}
+	}
+	return nil
+}
+
+func (n *ng) append(w io.Writer, r record) error {
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bytes)
+	return err
+}
+
+func (n *ng) apply(r record) {
+	applyOp(n.kv, r)
+	if r.Op == opCompact {
+		n.compactIdx = r.Index
+		n.changes = nil
+	}
+	if r.Index > n.index {
+		n.index = r.Index
+	}
+	if r.Op != opCompact && r.Index > n.compactIdx {
+		n.changes = append(n.changes, r)
+	}
+}
+
+// applyOp applies the operation to the key-value state
+func applyOp(kv map[string]entry, r record) {
+	switch r.Op {
+	case opSet:
+		kv[r.Key] = entry{val: r.Val, expires: r.Expires}
+	case opDelete:
+		for k := range kv {
+			if k == r.Key || strings.HasPrefix(k, r.Key+"/") {
+				delete(kv, k)
+			}
+		}
+	case opTransaction:
+		for _, op := range r.Ops {
+			applyOp(kv, op)
+		}
+	case opRefresh:
+		if e, ok := kv[r.Key]; ok {
+			e.expires = r.Expires
+			kv[r.Key] = e
+		}
+	}
+}
+
+func copyEntries(kv map[string]entry) map[string]entry {
+	out := make(map[string]entry, len(kv))
+	for k, e := range kv {
+		out[k] = e
+	}
+	return out
+}
+
+// restoreHistory replays the changes retained in the log on top of the state as of the last compaction
+func (n *ng) restoreHistory() *engine.History {
+	// snapshot reads the current keys, so the base state is swapped in for the time of the call
+	kv := n.kv
+	n.kv = n.base
+	base := n.snapshot()
+	n.kv = kv
+	base.Index = n.compactIdx
+
+	h := engine.NewHistory(base, n.options.HistorySize)
+	for _, r := range n.changes {
+		change, err := n.parseChange(r)
+		if err != nil {
+			continue
+		}
+		// records written by the older versions have no time
+		var t time.Time
+		if r.Time != 0 {
+			t = time.Unix(0, r.Time)
+		}
+		h.RecordAt(r.Index, t, change)
+	}
+	return h
+}
+
+// load replays the log file. A partially written record at the end of the file, e.g. left after a crash,
+// is discarded.
+func (n *ng) load() error {
+	reader := bufio.NewReader(n.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				log.Warningf("Discarding incomplete record at the end of %v", n.path)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var r record
+		if err := json.Unmarshal(bytes.TrimSpace(line), &r); err != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				log.Warningf("Discarding incomplete record at the end of %v", n.path)
+				break
+			}
+			return fmt.Errorf("%v is corrupted at offset %d: %v", n.path, offset, err)
+		}
+		if n.base == nil && r.Op != opCompact && r.Index > n.compactIdx {
+			n.base = copyEntries(n.kv)
+		}
+		n.apply(r)
+		offset += int64(len(line))
+	}
+	if n.base == nil {
+		n.base = copyEntries(n.kv)
+	}
+	if err := n.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := n.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// compact rewrites the log file, so it contains the state of the keys as of the oldest retained change followed
+// by the most recent changes. Replaying the recent changes on top of that state restores both the current state
+// and the history of the retained changes.
+func (n *ng) compact() error {
+	drop := len(n.changes) - n.options.ChangeLogSize
+	keep := n.changes[drop:]
+	compactIdx := keep[0].Index - 1
+	base := copyEntries(n.base)
+	for _, r := range n.changes[:drop] {
+		applyOp(base, r)
+	}
+
+	tmpPath := n.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = func() error {
+		if err := n.append(w, record{Index: compactIdx, Op: opCompact}); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(base))
+		for key := range base {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			e := base[key]
+			if err := n.append(w, record{Op: opSet, Key: key, Val: e.val, Expires: e.expires}); err != nil {
+				return err
+			}
+		}
+		for _, r := range keep {
+			if err := n.append(w, r); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return tmp.Sync()
+	}()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, n.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	n.file.Close()
+	n.file = tmp
+
+	n.compactIdx = compactIdx
+	n.base = base
+	n.changes = append([]record(nil), keep...)
+	// The rename is durable once the directory is synced, the log is replaced either way
+	return syncDir(filepath.Dir(n.path))
+}
+
+// syncDir flushes the directory entries, e.g. a renamed file, to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (n *ng) openSealedJSONVal(bytes []byte, val interface{}) error {
+	if n.options.Box == nil {
+		return errors.New("need secretbox to open sealed data")
+	}
+	sv, err := secret.SealedValueFromJSON([]byte(bytes))
+	if err != nil {
+		return err
+	}
+	unsealed, err := n.options.Box.Open(sv)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(unsealed, val)
+}
+
+func (n *ng) sealJSONVal(val interface{}) ([]byte, error) {
+	if n.options.Box == nil {
+		return nil, errors.New("this backend does not support encryption")
+	}
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	v, err := n.options.Box.Seal(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return secret.SealedValueToJSON(v)
+}
+
+func (r record) String() string {
+	return fmt.Sprintf("%v %v (index=%d)", r.Op, r.Key, r.Index)
+}
+
+func path(keys ...string) string {
+	return strings.Join(keys, "/")
+}
+
+type host struct {
+	Name     string
+	Settings hostSettings
+}
+
+type hostSettings struct {
+	Default    bool
+	KeyPair    []byte
+	KeyPairRef string `json:",omitempty"`
+	OCSP       engine.OCSPSettings
+	ClientAuth []byte `json:",omitempty"`
+}
+
+// listener is the stored representation of listeners, client auth settings are sealed as they carry CA bundles
+type listener struct {
+	engine.Listener
+	ClientAuth []byte `json:",omitempty"`
+}
+
+// backend is the stored representation of backends, TLS key pairs are sealed as they carry private keys
+type backend struct {
+	engine.Backend
+	KeyPair []byte `json:",omitempty"`
+}
+
+const (
+	opSet     = "set"
+	opDelete  = "delete"
+	opCompact = "compact"
+	// opTransaction groups set and delete operations applied atomically
+	opTransaction = "transaction"
+	// opRefresh updates the expiry time of the key leaving the value intact, it generates no changes
+	opRefresh = "refresh"
+
+	noTTL = 0
+
+	defaultChangeLogSize     = 10000
+	defaultExpiryCheckPeriod = 100 * time.Millisecond
+)
@@ -0,0 +1,337 @@
+package localng
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/test"
+	"github.com/vulcand/vulcand/plugin/registry"
+	"github.com/vulcand/vulcand/secret"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestLocal(t *testing.T) { TestingT(t) }
+
+type LocalSuite struct {
+	ng    *ng
+	suite test.EngineSuite
+	path  string
+	box   *secret.Box
+	stopC chan struct{}
+}
+
+var _ = Suite(&LocalSuite{})
+
+func (s *LocalSuite) SetUpSuite(c *C) {
+	key, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	s.box, err = secret.NewBoxFromKeyString(key)
+	c.Assert(err, IsNil)
+}
+
+func (s *LocalSuite) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "vulcand.db")
+	s.ng = s.open(c, Options{})
+
+	s.suite.ChangesC = make(chan interface{})
+	s.stopC = make(chan struct{})
+	go s.ng.Subscribe(s.suite.ChangesC, 0, s.stopC)
+	s.suite.Engine = s.ng
+}
+
+func (s *LocalSuite) TearDownTest(c *C) {
+	close(s.stopC)
+	s.ng.Close()
+}
+
+func (s *LocalSuite) open(c *C, options Options) *ng {
+	options.Box = s.box
+	engine, err := New(s.path, registry.GetRegistry(), options)
+	c.Assert(err, IsNil)
+	return engine.(*ng)
+}
+
+func (s *LocalSuite) TestEmptyParams(c *C) {
+	s.suite.EmptyParams(c)
+}
+
+func (s *LocalSuite) TestHostCRUD(c *C) {
+	s.suite.HostCRUD(c)
+}
+
+func (s *LocalSuite) TestHostWithKeyPair(c *C) {
+	s.suite.HostWithKeyPair(c)
+}
+
+func (s *LocalSuite) TestHostWithKeyPairRef(c *C) {
+	s.suite.HostWithKeyPairRef(c)
+}
+
+func (s *LocalSuite) TestHostWithClientAuth(c *C) {
+	s.suite.HostWithClientAuth(c)
+}
+
+func (s *LocalSuite) TestHostUpsertKeyPair(c *C) {
+	s.suite.HostUpsertKeyPair(c)
+}
+
+func (s *LocalSuite) TestHostWithOCSP(c *C) {
+	s.suite.HostWithOCSP(c)
+}
+
+func (s *LocalSuite) TestListenerCRUD(c *C) {
+	s.suite.ListenerCRUD(c)
+}
+
+func (s *LocalSuite) TestListenerSettingsCRUD(c *C) {
+	s.suite.ListenerSettingsCRUD(c)
+}
+
+func (s *LocalSuite) TestListenerWithClientAuth(c *C) {
+	s.suite.ListenerWithClientAuth(c)
+}
+
+func (s *LocalSuite) TestBackendCRUD(c *C) {
+	s.suite.BackendCRUD(c)
+}
+
+func (s *LocalSuite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
+func (s *LocalSuite) TestBackendDeleteUsed(c *C) {
+	s.suite.BackendDeleteUsed(c)
+}
+
+func (s *LocalSuite) TestBackendDeleteUnused(c *C) {
+	s.suite.BackendDeleteUnused(c)
+}
+
+func (s *LocalSuite) TestServerCRUD(c *C) {
+	s.suite.ServerCRUD(c)
+}
+
+func (s *LocalSuite) TestServerExpire(c *C) {
+	s.suite.ServerExpire(c)
+}
+
+func (s *LocalSuite) TestServerHeartbeat(c *C) {
+	s.suite.ServerHeartbeat(c)
+}
+
+func (s *LocalSuite) TestFrontendCRUD(c *C) {
+	s.suite.FrontendCRUD(c)
+}
+
+func (s *LocalSuite) TestFrontendExpire(c *C) {
+	s.suite.FrontendExpire(c)
+}
+
+func (s *LocalSuite) TestFrontendBadBackend(c *C) {
+	s.suite.FrontendBadBackend(c)
+}
+
+func (s *LocalSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *LocalSuite) TestFrontendFanOut(c *C) {
+	s.suite.FrontendFanOut(c)
+}
+
+func (s *LocalSuite) TestMiddlewareCRUD(c *C) {
+	s.suite.MiddlewareCRUD(c)
+}
+
+func (s *LocalSuite) TestMiddlewareExpire(c *C) {
+	s.suite.MiddlewareExpire(c)
+}
+
+func (s *LocalSuite) TestMiddlewareBadFrontend(c *C) {
+	s.suite.MiddlewareBadFrontend(c)
+}
+
+func (s *LocalSuite) TestMiddlewareBadType(c *C) {
+	s.suite.MiddlewareBadType(c)
+}
+
+func (s *LocalSuite) TestTransactionCommit(c *C) {
+	s.suite.TransactionCommit(c)
+}
+
+func (s *LocalSuite) TestTransactionRollback(c *C) {
+	s.suite.TransactionRollback(c)
+}
+
+func (s *LocalSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
+
+func (s *LocalSuite) TestPersistence(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	srv := engine.Server{Id: "s1", URL: "http://localhost:5000"}
+	c.Assert(s.ng.UpsertServer(b.Key(), srv, 0), IsNil)
+	host := engine.Host{Name: "localhost"}
+	host.Settings.KeyPair = &engine.KeyPair{Key: []byte("hello"), Cert: []byte("world")}
+	c.Assert(s.ng.UpsertHost(host), IsNil)
+	s.collect(c, 3)
+
+	before, err := s.ng.GetSnapshot()
+	c.Assert(err, IsNil)
+	s.ng.Close()
+
+	s.ng = s.open(c, Options{})
+	after, err := s.ng.GetSnapshot()
+	c.Assert(err, IsNil)
+	c.Assert(after, DeepEquals, before)
+	c.Assert(after.Index, Equals, uint64(3))
+}
+
+func (s *LocalSuite) TestReplayAfterRestart(c *C) {
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "h1"}), IsNil)
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "h2"}), IsNil)
+	c.Assert(s.ng.DeleteHost(engine.HostKey{Name: "h1"}), IsNil)
+	s.collect(c, 3)
+	s.ng.Close()
+
+	s.ng = s.open(c, Options{})
+	changesC := make(chan interface{}, 2)
+	stopC := make(chan struct{})
+	defer close(stopC)
+	go s.ng.Subscribe(changesC, 1, stopC)
+
+	c.Assert(s.expect(c, changesC), DeepEquals, &engine.HostUpserted{Host: engine.Host{Name: "h2"}})
+	c.Assert(s.expect(c, changesC), DeepEquals, &engine.HostDeleted{HostKey: engine.HostKey{Name: "h1"}})
+}
+
+func (s *LocalSuite) TestExpireAfterRestart(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	srv := engine.Server{Id: "s1", URL: "http://localhost:5000"}
+	c.Assert(s.ng.UpsertServer(b.Key(), srv, 100*time.Millisecond), IsNil)
+	s.collect(c, 2)
+	// Close right away, so the server expires while the engine is stopped
+	s.ng.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	s.ng = s.open(c, Options{})
+	changesC := make(chan interface{})
+	stopC := make(chan struct{})
+	defer close(stopC)
+	go s.ng.Subscribe(changesC, 2, stopC)
+
+	c.Assert(s.expect(c, changesC), DeepEquals, &engine.ServerDeleted{
+		ServerKey: engine.ServerKey{BackendKey: b.Key(), Id: srv.Id}})
+}
+
+func (s *LocalSuite) TestIncompleteRecord(c *C) {
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "h1"}), IsNil)
+	s.collect(c, 1)
+	s.ng.Close()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte(`{"Index":2,"Op":"set","Ke`))
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	s.ng = s.open(c, Options{})
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "h2"}), IsNil)
+	s.ng.Close()
+
+	s.ng = s.open(c, Options{})
+	hosts, err := s.ng.GetHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts, DeepEquals, []engine.Host{{Name: "h1"}, {Name: "h2"}})
+}
+
+func (s *LocalSuite) TestCorrupted(c *C) {
+	s.ng.Close()
+	c.Assert(ioutil.WriteFile(s.path, []byte("garbage\n{}\n"), 0600), IsNil)
+
+	_, err := New(s.path, registry.GetRegistry(), Options{})
+	c.Assert(err, NotNil)
+}
+
+func (s *LocalSuite) TestCompaction(c *C) {
+	close(s.stopC)
+	s.ng.Close()
+	c.Assert(os.Remove(s.path), IsNil)
+
+	s.ng = s.open(c, Options{ChangeLogSize: 2})
+	s.stopC = make(chan struct{})
+	for _, name := range []string{"h1", "h2", "h3", "h4"} {
+		c.Assert(s.ng.UpsertHost(engine.Host{Name: name}), IsNil)
+	}
+	c.Assert(s.ng.DeleteHost(engine.HostKey{Name: "h1"}), IsNil)
+	c.Assert(s.ng.compactIdx, Equals, uint64(2))
+
+	// Changes before the compacted index are no longer available
+	c.Assert(s.ng.Subscribe(make(chan interface{}), 1, s.stopC), NotNil)
+
+	s.ng.Close()
+	s.ng = s.open(c, Options{ChangeLogSize: 2})
+
+	hosts, err := s.ng.GetHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts, DeepEquals, []engine.Host{{Name: "h2"}, {Name: "h3"}, {Name: "h4"}})
+
+	changesC := make(chan interface{}, 3)
+	go s.ng.Subscribe(changesC, 2, s.stopC)
+	c.Assert(s.expect(c, changesC), DeepEquals, &engine.HostUpserted{Host: engine.Host{Name: "h3"}})
+	c.Assert(s.expect(c, changesC), DeepEquals, &engine.HostUpserted{Host: engine.Host{Name: "h4"}})
+	c.Assert(s.expect(c, changesC), DeepEquals, &engine.HostDeleted{HostKey: engine.HostKey{Name: "h1"}})
+}
+
+func (s *LocalSuite) TestHistoryAfterRestart(c *C) {
+	close(s.stopC)
+	s.ng.Close()
+	c.Assert(os.Remove(s.path), IsNil)
+
+	s.ng = s.open(c, Options{ChangeLogSize: 2})
+	s.stopC = make(chan struct{})
+	for _, name := range []string{"h1", "h2", "h3", "h4"} {
+		c.Assert(s.ng.UpsertHost(engine.Host{Name: name}), IsNil)
+	}
+	c.Assert(s.ng.DeleteHost(engine.HostKey{Name: "h1"}), IsNil)
+	before, err := s.ng.GetHistory(engine.HistoryQuery{})
+	c.Assert(err, IsNil)
+	c.Assert(len(before), Equals, 5)
+
+	s.ng.Close()
+	s.ng = s.open(c, Options{ChangeLogSize: 2})
+
+	// Only the changes retained in the log are restored, with the time they have been written
+	after, err := s.ng.GetHistory(engine.HistoryQuery{})
+	c.Assert(err, IsNil)
+	c.Assert(after, DeepEquals, before[2:])
+
+	snapshot, err := s.ng.GetSnapshotAt(2)
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Hosts, DeepEquals, []engine.Host{{Name: "h1"}, {Name: "h2"}})
+
+	_, err = s.ng.GetSnapshotAt(1)
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *LocalSuite) collect(c *C, count int) {
+	for i := 0; i < count; i++ {
+		s.expect(c, s.suite.ChangesC)
+	}
+}
+
+func (s *LocalSuite) expect(c *C, changesC chan interface{}) interface{} {
+	select {
+	case ch := <-changesC:
+		return ch
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timeout waiting for change")
+	}
+	return nil
+}
@@ -25,6 +25,12 @@ type Mem struct {
 	ChangesC    chan interface{}
 	ErrorsC     chan error
 	LogSeverity log.Level
+
+	// committed collects the changes of the transaction being committed
+	committed []interface{}
+	// index is incremented on every change recorded in the history
+	index   uint64
+	history *engine.History
 }
 
 func New(r *plugin.Registry) engine.Engine {
@@ -39,10 +45,17 @@ func New(r *plugin.Registry) engine.Engine {
 		Registry:    r,
 		ChangesC:    make(chan interface{}, 1000),
 		ErrorsC:     make(chan error),
+		history:     engine.NewHistory(&engine.Snapshot{}, engine.DefaultHistorySize),
 	}
 }
 
 func (m *Mem) emit(val interface{}) {
+	if m.committed != nil {
+		m.committed = append(m.committed, val)
+		return
+	}
+	m.index++
+	m.history.Record(m.index, val)
 	select {
 	case m.ChangesC <- val:
 	default:
@@ -193,8 +206,10 @@ func (m *Mem) GetFrontend(k engine.FrontendKey) (*engine.Frontend, error) {
 }
 
 func (m *Mem) UpsertFrontend(f engine.Frontend, d time.Duration) error {
-	if _, ok := m.Backends[engine.BackendKey{Id: f.BackendId}]; !ok {
-		return &engine.NotFoundError{Message: fmt.Sprintf("backend: %v not found", f.BackendId)}
+	for _, bk := range f.BackendKeys() {
+		if _, ok := m.Backends[bk]; !ok {
+			return &engine.NotFoundError{Message: fmt.Sprintf("backend: %v not found", bk.Id)}
+		}
 	}
 	m.Frontends[engine.FrontendKey{Id: f.Id}] = f
 	m.emit(&engine.FrontendUpserted{Frontend: f})
@@ -294,7 +309,7 @@ func (m *Mem) UpsertBackend(b engine.Backend) error {
 
 func (m *Mem) DeleteBackend(bk engine.BackendKey) error {
 	for _, f := range m.Frontends {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk) {
 			return fmt.Errorf("Backend is in use by %v", f)
 		}
 	}
@@ -346,6 +361,12 @@ func (m *Mem) UpsertServer(bk engine.BackendKey, srv engine.Server, d time.Durat
 	return nil
 }
 
+// HeartbeatServer only checks that the server exists, servers registered in memory never expire
+func (m *Mem) HeartbeatServer(sk engine.ServerKey, ttl time.Duration) error {
+	_, err := m.GetServer(sk)
+	return err
+}
+
 func (m *Mem) DeleteServer(sk engine.ServerKey) error {
 	vals, ok := m.Servers[sk.BackendKey]
 	if !ok {
@@ -362,6 +383,101 @@ func (m *Mem) DeleteServer(sk engine.ServerKey) error {
 	return &engine.NotFoundError{}
 }
 
+func (m *Mem) GetHistory(q engine.HistoryQuery) ([]engine.Revision, error) {
+	return m.history.Get(q), nil
+}
+
+func (m *Mem) GetSnapshotAt(revision uint64) (*engine.Snapshot, error) {
+	return m.history.SnapshotAt(revision)
+}
+
+func (m *Mem) Commit(tx engine.Transaction) error {
+	ss, err := m.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	if err := tx.Check(ss); err != nil {
+		return err
+	}
+	restore := m.save()
+	m.committed = []interface{}{}
+	for _, change := range tx.Ordered() {
+		if err := m.apply(change); err != nil {
+			// The transaction is committed entirely or not at all
+			restore()
+			m.committed = nil
+			return err
+		}
+	}
+	changes := m.committed
+	m.committed = nil
+	m.emit(&engine.TransactionCommitted{Changes: changes})
+	return nil
+}
+
+// save copies the configuration and returns the function putting the copy back.
+func (m *Mem) save() func() {
+	hosts := make(map[engine.HostKey]engine.Host, len(m.Hosts))
+	for k, v := range m.Hosts {
+		hosts[k] = v
+	}
+	frontends := make(map[engine.FrontendKey]engine.Frontend, len(m.Frontends))
+	for k, v := range m.Frontends {
+		frontends[k] = v
+	}
+	backends := make(map[engine.BackendKey]engine.Backend, len(m.Backends))
+	for k, v := range m.Backends {
+		backends[k] = v
+	}
+	listeners := make(map[engine.ListenerKey]engine.Listener, len(m.Listeners))
+	for k, v := range m.Listeners {
+		listeners[k] = v
+	}
+	// Middlewares and servers are updated in place, the slices are copied too
+	middlewares := make(map[engine.FrontendKey][]engine.Middleware, len(m.Middlewares))
+	for k, v := range m.Middlewares {
+		middlewares[k] = append([]engine.Middleware(nil), v...)
+	}
+	servers := make(map[engine.BackendKey][]engine.Server, len(m.Servers))
+	for k, v := range m.Servers {
+		servers[k] = append([]engine.Server(nil), v...)
+	}
+	return func() {
+		m.Hosts, m.Frontends, m.Backends, m.Listeners = hosts, frontends, backends, listeners
+		m.Middlewares, m.Servers = middlewares, servers
+	}
+}
+
+func (m *Mem) apply(change interface{}) error {
+	switch ch := change.(type) {
+	case *engine.HostUpserted:
+		return m.UpsertHost(ch.Host)
+	case *engine.HostDeleted:
+		return m.DeleteHost(ch.HostKey)
+	case *engine.ListenerUpserted:
+		return m.UpsertListener(ch.Listener)
+	case *engine.ListenerDeleted:
+		return m.DeleteListener(ch.ListenerKey)
+	case *engine.BackendUpserted:
+		return m.UpsertBackend(ch.Backend)
+	case *engine.BackendDeleted:
+		return m.DeleteBackend(ch.BackendKey)
+	case *engine.ServerUpserted:
+		return m.UpsertServer(ch.BackendKey, ch.Server, 0)
+	case *engine.ServerDeleted:
+		return m.DeleteServer(ch.ServerKey)
+	case *engine.FrontendUpserted:
+		return m.UpsertFrontend(ch.Frontend, 0)
+	case *engine.FrontendDeleted:
+		return m.DeleteFrontend(ch.FrontendKey)
+	case *engine.MiddlewareUpserted:
+		return m.UpsertMiddleware(ch.FrontendKey, ch.Middleware, 0)
+	case *engine.MiddlewareDeleted:
+		return m.DeleteMiddleware(ch.MiddlewareKey)
+	}
+	return fmt.Errorf("unsupported change: %#v", change)
+}
+
 func (m *Mem) Subscribe(changes chan interface{}, afterIdx uint64, cancelC chan struct{}) error {
 	for {
 		select {
@@ -40,6 +40,14 @@ func (s *MemSuite) TestHostWithKeyPair(c *C) {
 	s.suite.HostWithKeyPair(c)
 }
 
+func (s *MemSuite) TestHostWithKeyPairRef(c *C) {
+	s.suite.HostWithKeyPairRef(c)
+}
+
+func (s *MemSuite) TestHostWithClientAuth(c *C) {
+	s.suite.HostWithClientAuth(c)
+}
+
 func (s *MemSuite) TestHostUpsertKeyPair(c *C) {
 	s.suite.HostUpsertKeyPair(c)
 }
@@ -56,10 +64,18 @@ func (s *MemSuite) TestListenerSettingsCRUD(c *C) {
 	s.suite.ListenerSettingsCRUD(c)
 }
 
+func (s *MemSuite) TestListenerWithClientAuth(c *C) {
+	s.suite.ListenerWithClientAuth(c)
+}
+
 func (s *MemSuite) TestBackendCRUD(c *C) {
 	s.suite.BackendCRUD(c)
 }
 
+func (s *MemSuite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
 func (s *MemSuite) TestBackendDeleteUsed(c *C) {
 	s.suite.BackendDeleteUsed(c)
 }
@@ -76,6 +92,14 @@ func (s *MemSuite) TestFrontendBadBackend(c *C) {
 	s.suite.FrontendBadBackend(c)
 }
 
+func (s *MemSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *MemSuite) TestFrontendFanOut(c *C) {
+	s.suite.FrontendFanOut(c)
+}
+
 func (s *MemSuite) TestMiddlewareCRUD(c *C) {
 	s.suite.MiddlewareCRUD(c)
 }
@@ -87,3 +111,15 @@ func (s *MemSuite) TestMiddlewareBadFrontend(c *C) {
 func (s *MemSuite) TestMiddlewareBadType(c *C) {
 	s.suite.MiddlewareBadType(c)
 }
+
+func (s *MemSuite) TestTransactionCommit(c *C) {
+	s.suite.TransactionCommit(c)
+}
+
+func (s *MemSuite) TestTransactionRollback(c *C) {
+	s.suite.TransactionRollback(c)
+}
+
+func (s *MemSuite) TestHistory(c *C) {
+	s.suite.History(c)
+}
@@ -28,6 +28,14 @@ type StatsProvider interface {
 	// if hostname or backendId is present, will filter out locations for that host or backendId
 	TopFrontends(*BackendKey) ([]Frontend, error)
 
+	// ServersHealth returns the health of the servers of the backend by server id,
+	// the map is empty if the backend has no health checks
+	ServersHealth(BackendKey) (map[string]ServerHealth, error)
+
+	// OutlierEjections returns the recent ejections of the servers of the backend
+	// by the outlier detection, oldest first
+	OutlierEjections(BackendKey) ([]OutlierEjection, error)
+
 	// TopServers returns endpoints sorted by criteria (faulty, slow, mos used)
 	// if backendId is not empty, will filter out endpoints for that backendId
 	TopServers(*BackendKey) ([]Server, error)
@@ -36,6 +44,9 @@ type StatsProvider interface {
 type KeyPair struct {
 	Key  []byte
 	Cert []byte
+	// Ref references the key pair kept outside of the configuration, e.g. file:///etc/certs/x.pem
+	// or exec://helper get x. Key and Cert of such key pairs are empty until resolved by the proxy.
+	Ref string `json:",omitempty"`
 }
 
 func NewKeyPair(cert, key []byte) (*KeyPair, error) {
@@ -48,8 +59,17 @@ func NewKeyPair(cert, key []byte) (*KeyPair, error) {
 	return &KeyPair{Cert: cert, Key: key}, nil
 }
 
+// NewKeyPairRef returns the key pair referencing the certificate and the private key kept outside of the configuration
+func NewKeyPairRef(ref string) (*KeyPair, error) {
+	if !strings.Contains(ref, "://") {
+		return nil, fmt.Errorf("key pair reference %q should be in form scheme://location", ref)
+	}
+	return &KeyPair{Ref: ref}, nil
+}
+
 func (c *KeyPair) Equals(o *KeyPair) bool {
-	return (len(c.Cert) == len(o.Cert)) &&
+	return c.Ref == o.Ref &&
+		(len(c.Cert) == len(o.Cert)) &&
 		(len(c.Key) == len(o.Key)) &&
 		subtle.ConstantTimeCompare(c.Cert, o.Cert) == 1 &&
 		subtle.ConstantTimeCompare(c.Key, o.Key) == 1
@@ -71,7 +91,7 @@ func (l ListenerKey) String() string {
 // Listener specifies the listening point - the network and interface for each host. Host can have multiple interfaces.
 type Listener struct {
 	Id string
-	// HTTP or HTTPS
+	// HTTP, HTTPS or TCP, the connections of tcp listeners are proxied by a tcp frontend
 	Protocol string
 	// Adddress specifies network (tcp or unix) and address (ip:port or path to unix socket)
 	Address Address
@@ -116,11 +136,13 @@ func (l *Listener) SettingsEquals(o *Listener) bool {
 	if (ls == nil && os != nil) || (ls != nil && os == nil) {
 		return false
 	}
-	return (&os.TLS).Equals(&ls.TLS)
+	return (&os.TLS).Equals(&ls.TLS) && os.ClientAuth.Equals(ls.ClientAuth)
 }
 
 type HTTPSListenerSettings struct {
 	TLS TLSSettings
+	// ClientAuth authenticates the clients of the listener by their certificates, hosts can override it
+	ClientAuth *ClientAuthSettings `json:",omitempty"`
 }
 
 // Sets up OCSP stapling, see http://en.wikipedia.org/wiki/OCSP_stapling
@@ -174,6 +196,8 @@ type HostSettings struct {
 	KeyPair  *KeyPair
 	AutoCert *AutoCertSettings
 	OCSP     OCSPSettings
+	// ClientAuth overrides the client authentication of https listeners for the TLS connections to the host
+	ClientAuth *ClientAuthSettings `json:",omitempty"`
 }
 
 type AutoCertSettings struct {
@@ -226,6 +250,11 @@ func NewHost(name string, settings HostSettings) (*Host, error) {
 	if name == "" {
 		return nil, fmt.Errorf("Hostname can not be empty")
 	}
+	if settings.ClientAuth != nil {
+		if _, err := settings.ClientAuth.Parse(); err != nil {
+			return nil, fmt.Errorf("invalid client auth settings: %v", err)
+		}
+	}
 	return &Host{
 		Name:     name,
 		Settings: settings,
@@ -233,7 +262,8 @@ func NewHost(name string, settings HostSettings) (*Host, error) {
 }
 
 func (h *Host) String() string {
-	return fmt.Sprintf("Host(%s, keyPair=%t, ocsp=%t)", h.Name, h.Settings.KeyPair != nil, h.Settings.OCSP.Enabled)
+	return fmt.Sprintf("Host(%s, keyPair=%t, ocsp=%t, clientAuth=%t)",
+		h.Name, h.Settings.KeyPair != nil, h.Settings.OCSP.Enabled, h.Settings.ClientAuth != nil)
 }
 
 func (h *Host) GetId() string {
@@ -250,9 +280,83 @@ type Frontend struct {
 	Route     string
 	Type      string
 	BackendId string
+	// Backends split the traffic of the frontend between several backends by weight, e.g. between
+	// a stable release and a canary. BackendId is one of them, it is the only backend if Backends are empty
+	Backends []FrontendBackend `json:",omitempty"`
+	// BackendPin sends the requests that name one of the Backends in a header or a cookie to that backend
+	BackendPin *BackendPin `json:",omitempty"`
+	// Mirror sends copies of a share of the frontend requests to a shadow backend and drops its responses
+	Mirror *FrontendMirror `json:",omitempty"`
 
-	Stats    *RoundTripStats `json:",omitempty"`
-	Settings interface{}     `json:",omitempty"`
+	Stats *RoundTripStats `json:",omitempty"`
+	// MirrorStats are the round trip stats of the mirrored requests, they are not included in Stats
+	MirrorStats *RoundTripStats `json:",omitempty"`
+	Settings    interface{}     `json:",omitempty"`
+}
+
+// FrontendBackend is a backend getting a share of the frontend traffic
+type FrontendBackend struct {
+	Id string
+	// Weight is the relative share of the traffic, backends with 0 weight only get pinned requests
+	Weight int
+}
+
+// BackendPin names the header and the cookie pinning requests to a backend by its id, at least one should be set
+type BackendPin struct {
+	Header string `json:",omitempty"`
+	// Cookie is also set on the responses to the requests split by weight, so the client stays with the same backend
+	Cookie string `json:",omitempty"`
+}
+
+// FrontendMirror is a shadow backend getting copies of the frontend requests
+type FrontendMirror struct {
+	BackendId string
+	// Percent of the requests to mirror, in (0, 100]
+	Percent float64
+	// MaxBodyBytes is the largest request body to mirror, requests with bigger bodies are not mirrored
+	MaxBodyBytes int64 `json:",omitempty"`
+	// MaxInFlight is the maximum number of mirrored requests in flight, requests over the limit are not mirrored
+	MaxInFlight int `json:",omitempty"`
+}
+
+// FanOutFrontendSettings are the settings of a fanout frontend, that sends every request to several backends at
+// once and merges their responses
+type FanOutFrontendSettings struct {
+	HTTPFrontendSettings
+	// Branches are the backends the requests are sent to, at least two
+	Branches []FanOutBranch
+	// Merge is the way the responses are merged: json (default), first or quorum
+	Merge string `json:",omitempty"`
+	// Quorum is the number of the same successful responses the quorum merge returns, the majority by default
+	Quorum int `json:",omitempty"`
+	// OnPartialFailure is what the json merge does if some branches fail: fail (default) or ignore them
+	OnPartialFailure string `json:",omitempty"`
+	// MaxResponseBytes is the largest branch response kept in memory for merging, bigger responses fail the branch,
+	// DefaultFanOutMaxResponseBytes if zero
+	MaxResponseBytes int64 `json:",omitempty"`
+}
+
+// FanOutBranch is a backend getting copies of the fanout frontend requests
+type FanOutBranch struct {
+	BackendId string
+	// Timeout of the branch requests, e.g. 2s, only the backend timeouts apply if empty
+	Timeout string `json:",omitempty"`
+	// Key is the field of the merged JSON object holding the branch response, if empty the fields of the response
+	// object are merged into it
+	Key string `json:",omitempty"`
+}
+
+// TCPFrontendSettings are the settings of a tcp frontend, that proxies the connections accepted by a tcp listener
+// to the servers of its backend, or the TLS connections of an https listener to the server names matching SNI
+type TCPFrontendSettings struct {
+	// ListenerId is the tcp or https listener accepting the connections of the frontend
+	ListenerId string
+	// SNI is the server name of the TLS connections that are passed through, e.g. db.example.com or *.example.com,
+	// it is required on https listeners, frontends of tcp listeners have none
+	SNI string `json:",omitempty"`
+	// IdleTimeout closes the connections that have not sent data either way for that long, e.g. 1h, connections
+	// are not closed if empty
+	IdleTimeout string `json:",omitempty"`
 }
 
 // Limits contains various limits one can supply for a location.
@@ -277,6 +381,77 @@ type HTTPFrontendSettings struct {
 	Stream bool
 	// How frequently should we flush the stream?
 	StreamFlushIntervalNanoSecs int64
+	// Hedging sends slow idempotent requests to another server as well, the first response wins
+	Hedging *HTTPFrontendHedging `json:",omitempty"`
+	// Retry is the policy of retrying failed requests on other servers, it replaces FailoverPredicate
+	Retry *HTTPFrontendRetry `json:",omitempty"`
+	// Deadline limits the total time of a request and passes the time left to the servers
+	Deadline *HTTPFrontendDeadline `json:",omitempty"`
+}
+
+// HTTPFrontendHedging configures hedging of GET and HEAD requests: if a server has not responded within the
+// latency percentile of the backend, the request is sent to another server of the backend too
+type HTTPFrontendHedging struct {
+	// Percentile of the backend latency to wait for before hedging, 95 if 0
+	Percentile float64 `json:",omitempty"`
+	// MinDelay is the shortest wait before hedging, e.g. 10ms, no minimum if empty
+	MinDelay string `json:",omitempty"`
+	// BudgetPercent caps hedged requests at the percent of the frontend requests, 10 if 0
+	BudgetPercent int `json:",omitempty"`
+}
+
+// HTTPFrontendDeadline limits the total time of a request including the middlewares and the retries, requests that
+// run out of time get 504 responses
+type HTTPFrontendDeadline struct {
+	// Timeout of a request, e.g. 5s
+	Timeout string
+	// Header with the milliseconds left before the deadline, it is set on the requests to the servers and shortens
+	// the deadline of the incoming requests that have it. X-Request-Deadline if empty
+	Header string `json:",omitempty"`
+}
+
+// HTTPFrontendRetry configures retries of failed requests, every retry goes to a server of the backend that has not
+// been tried yet
+type HTTPFrontendRetry struct {
+	// Attempts is the maximum number of retries of a request, 2 if 0
+	Attempts int `json:",omitempty"`
+	// StatusCodes of the responses to retry, 502, 503 and 504 if empty. Network errors are reported as 502 and 504
+	StatusCodes []int `json:",omitempty"`
+	// Methods of the requests to retry, GET, HEAD and OPTIONS if empty
+	Methods []string `json:",omitempty"`
+	// PerTryTimeout limits every attempt, e.g. 1s, attempts that time out are retried. No limit if empty
+	PerTryTimeout string `json:",omitempty"`
+	// Backoff is the wait before the first retry, it doubles with every retry, 25ms if empty
+	Backoff string `json:",omitempty"`
+	// MaxBackoff caps the wait before a retry, 250ms if empty
+	MaxBackoff string `json:",omitempty"`
+	// BudgetPercent caps retries at the percent of the frontend requests, 20 if 0
+	BudgetPercent int `json:",omitempty"`
+}
+
+// Equals returns true if the retry policies are the same.
+func (r *HTTPFrontendRetry) Equals(o *HTTPFrontendRetry) bool {
+	if r == nil || o == nil {
+		return r == o
+	}
+	if len(r.StatusCodes) != len(o.StatusCodes) || len(r.Methods) != len(o.Methods) {
+		return false
+	}
+	for i := range r.StatusCodes {
+		if r.StatusCodes[i] != o.StatusCodes[i] {
+			return false
+		}
+	}
+	for i := range r.Methods {
+		if r.Methods[i] != o.Methods[i] {
+			return false
+		}
+	}
+	return (r.Attempts == o.Attempts &&
+		r.PerTryTimeout == o.PerTryTimeout &&
+		r.Backoff == o.Backoff &&
+		r.MaxBackoff == o.MaxBackoff &&
+		r.BudgetPercent == o.BudgetPercent)
 }
 
 func NewAddress(network, address string) (*Address, error) {
@@ -294,8 +469,8 @@ func NewAddress(network, address string) (*Address, error) {
 
 func NewListener(id, protocol, network, address, scope, proxyHeader string, settings *HTTPSListenerSettings) (*Listener, error) {
 	protocol = strings.ToLower(protocol)
-	if protocol != HTTP && protocol != HTTPS {
-		return nil, fmt.Errorf("unsupported protocol '%s', supported protocols are http and https", protocol)
+	if protocol != HTTP && protocol != HTTPS && protocol != TCP {
+		return nil, fmt.Errorf("unsupported protocol '%s', supported protocols are http, https and tcp", protocol)
 	}
 
 	if scope != "" {
@@ -304,6 +479,24 @@ func NewListener(id, protocol, network, address, scope, proxyHeader string, sett
 		}
 	}
 
+	// Connections of tcp listeners are passed to their frontends as they are
+	if protocol == TCP && (scope != "" || settings != nil) {
+		return nil, fmt.Errorf("tcp listeners can not have a scope or TLS settings")
+	}
+
+	if settings != nil && settings.TLS.BackendOnly() {
+		return nil, fmt.Errorf("client key pairs, root CAs, server names and SPKI pins are backend TLS settings")
+	}
+
+	if settings != nil && settings.ClientAuth != nil {
+		if protocol != HTTPS {
+			return nil, fmt.Errorf("client auth is supported by https listeners only")
+		}
+		if _, err := settings.ClientAuth.Parse(); err != nil {
+			return nil, fmt.Errorf("invalid client auth settings: %v", err)
+		}
+	}
+
 	a, err := NewAddress(network, address)
 	if err != nil {
 		return nil, err
@@ -347,6 +540,18 @@ func NewHTTPFrontend(router router.Router, id, backendId string, routeExpr strin
 		return nil, fmt.Errorf("invalid failover predicate: %s", settings.FailoverPredicate)
 	}
 
+	if _, err := settings.HedgingSettings(); err != nil {
+		return nil, err
+	}
+
+	if _, err := settings.RetrySettings(); err != nil {
+		return nil, err
+	}
+
+	if _, err := settings.DeadlineSettings(); err != nil {
+		return nil, err
+	}
+
 	return &Frontend{
 		Id:        id,
 		BackendId: backendId,
@@ -356,16 +561,494 @@ func NewHTTPFrontend(router router.Router, id, backendId string, routeExpr strin
 	}, nil
 }
 
+// NewFanOutFrontend returns a frontend sending every request to all branch backends, BackendId is the first of them
+func NewFanOutFrontend(router router.Router, id string, routeExpr string, settings FanOutFrontendSettings) (*Frontend, error) {
+	if _, err := settings.FanOutSettings(); err != nil {
+		return nil, err
+	}
+	if settings.Stream {
+		return nil, fmt.Errorf("fanout frontends can not stream requests")
+	}
+	f, err := NewHTTPFrontend(router, id, settings.Branches[0].BackendId, routeExpr, settings.HTTPFrontendSettings)
+	if err != nil {
+		return nil, err
+	}
+	f.Type = FanOut
+	f.Settings = settings
+	return f, nil
+}
+
+// NewTCPFrontend returns a frontend proxying the connections accepted by the tcp listener to the backend servers,
+// tcp frontends have no route
+func NewTCPFrontend(id, backendId string, settings TCPFrontendSettings) (*Frontend, error) {
+	if len(id) == 0 || len(backendId) == 0 {
+		return nil, fmt.Errorf("supply valid id and backendId")
+	}
+	if _, err := settings.TCPSettings(); err != nil {
+		return nil, err
+	}
+	return &Frontend{
+		Id:        id,
+		BackendId: backendId,
+		Type:      TCP,
+		Settings:  settings,
+	}, nil
+}
+
+// SetBackends splits the frontend traffic between the weighted backends, BackendId of the frontend should be one of them
+func (f *Frontend) SetBackends(backends []FrontendBackend, pin *BackendPin) error {
+	if len(backends) == 0 {
+		if pin != nil {
+			return fmt.Errorf("backend pin requires several backends")
+		}
+		f.Backends, f.BackendPin = nil, nil
+		return nil
+	}
+	if f.Type != HTTP {
+		return fmt.Errorf("%v frontends can not split traffic", f.Type)
+	}
+	seen := make(map[string]bool, len(backends))
+	total := 0
+	for _, b := range backends {
+		if b.Id == "" {
+			return fmt.Errorf("backend id can not be empty")
+		}
+		if seen[b.Id] {
+			return fmt.Errorf("backend %v is listed twice", b.Id)
+		}
+		if b.Weight < 0 {
+			return fmt.Errorf("backend %v weight should be >= 0, got %d", b.Id, b.Weight)
+		}
+		seen[b.Id] = true
+		total += b.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("at least one backend should have non-zero weight")
+	}
+	if !seen[f.BackendId] {
+		return fmt.Errorf("backend %v is not one of the frontend backends", f.BackendId)
+	}
+	if pin != nil && pin.Header == "" && pin.Cookie == "" {
+		return fmt.Errorf("backend pin requires a header or a cookie")
+	}
+	f.Backends, f.BackendPin = backends, pin
+	return nil
+}
+
+// SetMirror sets the shadow backend of the frontend, it should not be one of the backends serving the traffic
+func (f *Frontend) SetMirror(m *FrontendMirror) error {
+	if m == nil {
+		f.Mirror = nil
+		return nil
+	}
+	if f.Type != HTTP {
+		return fmt.Errorf("%v frontends can not mirror traffic", f.Type)
+	}
+	if m.BackendId == "" {
+		return fmt.Errorf("mirror backend id can not be empty")
+	}
+	if m.BackendId == f.BackendId {
+		return fmt.Errorf("backend %v can not mirror its own traffic", m.BackendId)
+	}
+	for _, b := range f.Backends {
+		if b.Id == m.BackendId {
+			return fmt.Errorf("backend %v can not mirror its own traffic", m.BackendId)
+		}
+	}
+	if m.Percent <= 0 || m.Percent > 100 {
+		return fmt.Errorf("mirror percent should be in (0, 100], got %v", m.Percent)
+	}
+	if m.MaxBodyBytes < 0 {
+		return fmt.Errorf("mirror max body bytes should be >= 0, got %d", m.MaxBodyBytes)
+	}
+	if m.MaxInFlight < 0 {
+		return fmt.Errorf("mirror max in flight should be >= 0, got %d", m.MaxInFlight)
+	}
+	f.Mirror = m
+	return nil
+}
+
+// BackendKeys returns the keys of all backends referenced by the frontend, BackendId goes first and the mirror
+// backend, if any, goes last
+func (f *Frontend) BackendKeys() []BackendKey {
+	keys := []BackendKey{f.BackendKey()}
+	for _, b := range f.Backends {
+		if b.Id != f.BackendId {
+			keys = append(keys, BackendKey{Id: b.Id})
+		}
+	}
+	if s, ok := f.Settings.(FanOutFrontendSettings); ok {
+		for _, b := range s.Branches {
+			if b.BackendId != f.BackendId {
+				keys = append(keys, BackendKey{Id: b.BackendId})
+			}
+		}
+	}
+	if f.Mirror != nil {
+		keys = append(keys, BackendKey{Id: f.Mirror.BackendId})
+	}
+	return keys
+}
+
+// UsesBackend returns true if the frontend references the backend
+func (f *Frontend) UsesBackend(bk BackendKey) bool {
+	for _, k := range f.BackendKeys() {
+		if k == bk {
+			return true
+		}
+	}
+	return false
+}
+
+// BackendsEqual returns true if both frontends split and mirror the traffic the same way
+func (f *Frontend) BackendsEqual(o Frontend) bool {
+	if f.BackendId != o.BackendId || len(f.Backends) != len(o.Backends) {
+		return false
+	}
+	for i := range f.Backends {
+		if f.Backends[i] != o.Backends[i] {
+			return false
+		}
+	}
+	if (f.Mirror == nil) != (o.Mirror == nil) || (f.Mirror != nil && *f.Mirror != *o.Mirror) {
+		return false
+	}
+	return (f.BackendPin == nil && o.BackendPin == nil) ||
+		(f.BackendPin != nil && o.BackendPin != nil && *f.BackendPin == *o.BackendPin)
+}
+
+// HTTPSettings returns the HTTP settings of frontends of all types, tcp frontends have the default ones
 func (f *Frontend) HTTPSettings() HTTPFrontendSettings {
+	switch s := f.Settings.(type) {
+	case FanOutFrontendSettings:
+		return s.HTTPFrontendSettings
+	case TCPFrontendSettings:
+		return HTTPFrontendSettings{}
+	}
 	return (f.Settings).(HTTPFrontendSettings)
 }
 
+// TCPSettings returns the parsed tcp settings, it returns nil for frontends of other types
+func (f *Frontend) TCPSettings() (*TCPSettings, error) {
+	s, ok := f.Settings.(TCPFrontendSettings)
+	if !ok {
+		return nil, nil
+	}
+	return s.TCPSettings()
+}
+
+// TCPSettings validates the settings and parses the idle timeout
+func (s *TCPFrontendSettings) TCPSettings() (*TCPSettings, error) {
+	if s.ListenerId == "" {
+		return nil, fmt.Errorf("tcp frontends require a listener")
+	}
+	t := &TCPSettings{ListenerKey: ListenerKey{Id: s.ListenerId}, SNI: strings.ToLower(s.SNI)}
+	if t.SNI != "" && !isSNIPattern(t.SNI) {
+		return nil, fmt.Errorf("invalid SNI %q, expected a host name, optionally with a *. prefix", s.SNI)
+	}
+	if s.IdleTimeout != "" {
+		var err error
+		if t.IdleTimeout, err = time.ParseDuration(s.IdleTimeout); err != nil {
+			return nil, errors.Wrap(err, "invalid idle timeout")
+		}
+		if t.IdleTimeout <= 0 {
+			return nil, fmt.Errorf("idle timeout should be > 0, got %v", s.IdleTimeout)
+		}
+	}
+	return t, nil
+}
+
+// TCPSettings are the parsed settings of tcp frontends
+type TCPSettings struct {
+	ListenerKey ListenerKey
+	// SNI is the lower case server name pattern, the wildcard of *.example.com matches one label
+	SNI string
+	// IdleTimeout is 0 if idle connections are not closed
+	IdleTimeout time.Duration
+}
+
+func isSNIPattern(p string) bool {
+	p = strings.TrimPrefix(p, "*.")
+	for _, label := range strings.Split(p, ".") {
+		if label == "" || strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// FanOutSettings returns the parsed fanout settings, it returns nil for frontends of other types
+func (f *Frontend) FanOutSettings() (*FanOutSettings, error) {
+	s, ok := f.Settings.(FanOutFrontendSettings)
+	if !ok {
+		return nil, nil
+	}
+	return s.FanOutSettings()
+}
+
+// FanOutSettings validates the settings, applies the defaults and parses the branch timeouts
+func (s *FanOutFrontendSettings) FanOutSettings() (*FanOutSettings, error) {
+	if len(s.Branches) < 2 {
+		return nil, fmt.Errorf("fanout requires at least two branches, got %d", len(s.Branches))
+	}
+	out := &FanOutSettings{
+		Branches:         make([]FanOutBranchSettings, len(s.Branches)),
+		Merge:            s.Merge,
+		Quorum:           s.Quorum,
+		OnPartialFailure: s.OnPartialFailure,
+		MaxResponseBytes: s.MaxResponseBytes,
+	}
+	seen := make(map[string]bool, len(s.Branches))
+	keys := make(map[string]bool, len(s.Branches))
+	for i, b := range s.Branches {
+		if b.BackendId == "" {
+			return nil, fmt.Errorf("fanout branch backend id can not be empty")
+		}
+		if seen[b.BackendId] {
+			return nil, fmt.Errorf("backend %v is listed twice", b.BackendId)
+		}
+		seen[b.BackendId] = true
+		if b.Key != "" {
+			if keys[b.Key] {
+				return nil, fmt.Errorf("key %v is used by several branches", b.Key)
+			}
+			keys[b.Key] = true
+		}
+		out.Branches[i] = FanOutBranchSettings{BackendId: b.BackendId, Key: b.Key}
+		if len(b.Timeout) != 0 {
+			d, err := time.ParseDuration(b.Timeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid timeout %q of branch %v", b.Timeout, b.BackendId)
+			}
+			out.Branches[i].Timeout = d
+		}
+	}
+	switch out.Merge {
+	case "":
+		out.Merge = FanOutMergeJSON
+	case FanOutMergeJSON, FanOutMergeFirst, FanOutMergeQuorum:
+	default:
+		return nil, fmt.Errorf("unsupported fanout merge %q", s.Merge)
+	}
+	if out.Merge != FanOutMergeQuorum && out.Quorum != 0 {
+		return nil, fmt.Errorf("quorum requires %v merge", FanOutMergeQuorum)
+	}
+	if out.Quorum < 0 || out.Quorum > len(s.Branches) {
+		return nil, fmt.Errorf("quorum should be in range 1-%d, got %d", len(s.Branches), out.Quorum)
+	}
+	if out.Merge == FanOutMergeQuorum && out.Quorum == 0 {
+		out.Quorum = len(s.Branches)/2 + 1
+	}
+	switch out.OnPartialFailure {
+	case "":
+		out.OnPartialFailure = FanOutFail
+	case FanOutFail, FanOutIgnore:
+	default:
+		return nil, fmt.Errorf("unsupported partial failure policy %q", s.OnPartialFailure)
+	}
+	if out.MaxResponseBytes < 0 {
+		return nil, fmt.Errorf("fanout max response bytes should be >= 0, got %d", out.MaxResponseBytes)
+	}
+	if out.MaxResponseBytes == 0 {
+		out.MaxResponseBytes = DefaultFanOutMaxResponseBytes
+	}
+	return out, nil
+}
+
+// Equals returns true if the settings are the same, including the HTTP ones
+func (s *FanOutFrontendSettings) Equals(o FanOutFrontendSettings) bool {
+	if len(s.Branches) != len(o.Branches) {
+		return false
+	}
+	for i := range s.Branches {
+		if s.Branches[i] != o.Branches[i] {
+			return false
+		}
+	}
+	return (s.HTTPFrontendSettings.Equals(o.HTTPFrontendSettings) &&
+		s.Merge == o.Merge &&
+		s.Quorum == o.Quorum &&
+		s.OnPartialFailure == o.OnPartialFailure &&
+		s.MaxResponseBytes == o.MaxResponseBytes)
+}
+
 func (l HTTPFrontendSettings) Equals(o HTTPFrontendSettings) bool {
 	return (l.Limits.MaxMemBodyBytes == o.Limits.MaxMemBodyBytes &&
 		l.Limits.MaxBodyBytes == o.Limits.MaxBodyBytes &&
 		l.FailoverPredicate == o.FailoverPredicate &&
 		l.Hostname == o.Hostname &&
-		l.TrustForwardHeader == o.TrustForwardHeader)
+		l.TrustForwardHeader == o.TrustForwardHeader &&
+		((l.Hedging == nil && o.Hedging == nil) || (l.Hedging != nil && o.Hedging != nil && *l.Hedging == *o.Hedging)) &&
+		l.Retry.Equals(o.Retry) &&
+		((l.Deadline == nil && o.Deadline == nil) || (l.Deadline != nil && o.Deadline != nil && *l.Deadline == *o.Deadline)))
+}
+
+// HedgingSettings returns the parsed hedging settings with defaults applied, it returns nil if hedging is disabled
+func (l *HTTPFrontendSettings) HedgingSettings() (*HedgingSettings, error) {
+	h := l.Hedging
+	if h == nil {
+		return nil, nil
+	}
+	if l.Stream {
+		return nil, fmt.Errorf("streaming frontends can not hedge requests")
+	}
+	out := &HedgingSettings{
+		Percentile:    DefaultHedgingPercentile,
+		BudgetPercent: DefaultHedgingBudgetPercent,
+	}
+	if h.Percentile < 0 || h.Percentile >= 100 {
+		return nil, fmt.Errorf("hedging percentile should be in range 0-100, got %v", h.Percentile)
+	}
+	if h.Percentile != 0 {
+		out.Percentile = h.Percentile
+	}
+	if len(h.MinDelay) != 0 {
+		var err error
+		if out.MinDelay, err = time.ParseDuration(h.MinDelay); err != nil || out.MinDelay < 0 {
+			return nil, fmt.Errorf("invalid hedging min delay %q", h.MinDelay)
+		}
+	}
+	if h.BudgetPercent < 0 || h.BudgetPercent > 100 {
+		return nil, fmt.Errorf("hedging budget percent should be in range 0-100, got %d", h.BudgetPercent)
+	}
+	if h.BudgetPercent != 0 {
+		out.BudgetPercent = h.BudgetPercent
+	}
+	return out, nil
+}
+
+// Hedging defaults
+const (
+	DefaultHedgingPercentile    = 95
+	DefaultHedgingBudgetPercent = 10
+)
+
+// HedgingSettings are the parsed hedging settings
+type HedgingSettings struct {
+	Percentile    float64
+	MinDelay      time.Duration
+	BudgetPercent int
+}
+
+// RetrySettings returns the parsed retry policy with defaults applied, it returns nil if there is no policy
+func (l *HTTPFrontendSettings) RetrySettings() (*RetrySettings, error) {
+	r := l.Retry
+	if r == nil {
+		return nil, nil
+	}
+	if l.FailoverPredicate != "" {
+		return nil, fmt.Errorf("failover predicate can not be used along with a retry policy")
+	}
+	out := &RetrySettings{
+		Attempts:      DefaultRetryAttempts,
+		StatusCodes:   map[int]bool{http.StatusBadGateway: true, http.StatusServiceUnavailable: true, http.StatusGatewayTimeout: true},
+		Methods:       map[string]bool{http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true},
+		Backoff:       DefaultRetryBackoff,
+		MaxBackoff:    DefaultRetryMaxBackoff,
+		BudgetPercent: DefaultRetryBudgetPercent,
+	}
+	if r.Attempts < 0 || r.Attempts > MaxRetryAttempts {
+		return nil, fmt.Errorf("retry attempts should be in range 0-%d, got %d", MaxRetryAttempts, r.Attempts)
+	}
+	if r.Attempts != 0 {
+		out.Attempts = r.Attempts
+	}
+	if len(r.StatusCodes) != 0 {
+		out.StatusCodes = make(map[int]bool, len(r.StatusCodes))
+		for _, code := range r.StatusCodes {
+			if code < 100 || code > 599 {
+				return nil, fmt.Errorf("invalid retry status code %d", code)
+			}
+			out.StatusCodes[code] = true
+		}
+	}
+	if len(r.Methods) != 0 {
+		out.Methods = make(map[string]bool, len(r.Methods))
+		for _, method := range r.Methods {
+			if method == "" {
+				return nil, fmt.Errorf("retry methods can not be empty")
+			}
+			out.Methods[strings.ToUpper(method)] = true
+		}
+	}
+	var err error
+	if len(r.PerTryTimeout) != 0 {
+		if out.PerTryTimeout, err = time.ParseDuration(r.PerTryTimeout); err != nil || out.PerTryTimeout <= 0 {
+			return nil, fmt.Errorf("invalid retry per try timeout %q", r.PerTryTimeout)
+		}
+	}
+	if len(r.Backoff) != 0 {
+		if out.Backoff, err = time.ParseDuration(r.Backoff); err != nil || out.Backoff < 0 {
+			return nil, fmt.Errorf("invalid retry backoff %q", r.Backoff)
+		}
+	}
+	if len(r.MaxBackoff) != 0 {
+		if out.MaxBackoff, err = time.ParseDuration(r.MaxBackoff); err != nil || out.MaxBackoff < 0 {
+			return nil, fmt.Errorf("invalid retry max backoff %q", r.MaxBackoff)
+		}
+	} else if out.MaxBackoff < out.Backoff {
+		out.MaxBackoff = out.Backoff
+	}
+	if out.MaxBackoff < out.Backoff {
+		return nil, fmt.Errorf("retry max backoff %v is shorter than the backoff %v", out.MaxBackoff, out.Backoff)
+	}
+	if r.BudgetPercent < 0 || r.BudgetPercent > 100 {
+		return nil, fmt.Errorf("retry budget percent should be in range 0-100, got %d", r.BudgetPercent)
+	}
+	if r.BudgetPercent != 0 {
+		out.BudgetPercent = r.BudgetPercent
+	}
+	return out, nil
+}
+
+// Retry policy defaults and limits
+const (
+	DefaultRetryAttempts      = 2
+	DefaultRetryBackoff       = 25 * time.Millisecond
+	DefaultRetryMaxBackoff    = 250 * time.Millisecond
+	DefaultRetryBudgetPercent = 20
+	MaxRetryAttempts          = 10
+)
+
+// DeadlineSettings returns the parsed request deadline settings with defaults applied, it returns nil if there is
+// no deadline
+func (l *HTTPFrontendSettings) DeadlineSettings() (*DeadlineSettings, error) {
+	d := l.Deadline
+	if d == nil {
+		return nil, nil
+	}
+	timeout, err := time.ParseDuration(d.Timeout)
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid request timeout %q", d.Timeout)
+	}
+	out := &DeadlineSettings{Timeout: timeout, Header: DefaultDeadlineHeader}
+	if d.Header != "" {
+		if strings.ContainsAny(d.Header, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid deadline header %q", d.Header)
+		}
+		out.Header = http.CanonicalHeaderKey(d.Header)
+	}
+	return out, nil
+}
+
+// DefaultDeadlineHeader carries the milliseconds left before the request deadline
+const DefaultDeadlineHeader = "X-Request-Deadline"
+
+// DeadlineSettings are the parsed request deadline settings
+type DeadlineSettings struct {
+	Timeout time.Duration
+	Header  string
+}
+
+// RetrySettings are the parsed retry policy
+type RetrySettings struct {
+	Attempts      int
+	StatusCodes   map[int]bool
+	Methods       map[string]bool
+	PerTryTimeout time.Duration
+	Backoff       time.Duration
+	MaxBackoff    time.Duration
+	BudgetPercent int
 }
 
 func (f *Frontend) String() string {
@@ -385,8 +1068,20 @@ func (f *Frontend) BackendKey() BackendKey {
 }
 
 func (f *Frontend) Equals(o Frontend) bool {
+	if s, ok := f.Settings.(FanOutFrontendSettings); ok {
+		os, ok := o.Settings.(FanOutFrontendSettings)
+		if !ok || !s.Equals(os) {
+			return false
+		}
+	}
+	if s, ok := f.Settings.(TCPFrontendSettings); ok {
+		os, ok := o.Settings.(TCPFrontendSettings)
+		if !ok || s != os {
+			return false
+		}
+	}
 	return (f.Id == o.Id &&
-		f.BackendId == o.BackendId &&
+		f.BackendsEqual(o) &&
 		f.Route == o.Route &&
 		f.Type == o.Type &&
 		f.HTTPSettings().Equals(o.HTTPSettings()))
@@ -408,6 +1103,69 @@ type HTTPBackendKeepAlive struct {
 	MaxIdleConnsPerHost int
 }
 
+// Load balancing algorithms supported by HTTP backends
+const (
+	// LBRoundRobin sends requests to the servers in turn, adjusting weights of the failing servers
+	LBRoundRobin = "roundrobin"
+	// LBLeastConn sends requests to the server with the fewest requests in flight
+	LBLeastConn = "leastconn"
+	// LBLeastLatency sends requests to the server with the lowest latency accounting for requests in flight
+	LBLeastLatency = "leastlatency"
+	// LBTwoRandomChoices picks two random servers and sends the request to the one with fewer requests in flight
+	LBTwoRandomChoices = "tworandom"
+	// LBConsistentHash sends requests with the same value of the variable to the same server, unless it is overloaded
+	LBConsistentHash = "consistenthash"
+	// LBStickySession pins clients to servers with a cookie
+	LBStickySession = "sticky"
+)
+
+// HTTPBackendLoadBalancer selects the algorithm distributing requests between the backend servers
+type HTTPBackendLoadBalancer struct {
+	// Type is one of the LB* constants, round robin is used if empty
+	Type string `json:",omitempty"`
+	// Variable is the request property hashed by the consistent hash load balancer, one of
+	// client.ip, request.host, request.header.<name> or request.cookie.<name>
+	Variable string `json:",omitempty"`
+	// LoadFactor caps requests in flight to every server by the consistent hash load balancer
+	// at LoadFactor times the average, 0 means the default of 1.25
+	LoadFactor float64 `json:",omitempty"`
+	// Cookie is the name of the sticky session cookie, vulcand_sticky is used if empty
+	Cookie string `json:",omitempty"`
+}
+
+func (l *HTTPBackendLoadBalancer) Check() error {
+	switch l.Type {
+	case "", LBRoundRobin, LBLeastConn, LBLeastLatency, LBTwoRandomChoices, LBStickySession:
+		return nil
+	case LBConsistentHash:
+		if l.LoadFactor != 0 && l.LoadFactor < 1 {
+			return fmt.Errorf("load factor should be >= 1, got %v", l.LoadFactor)
+		}
+		return checkHashVariable(l.Variable)
+	}
+	return fmt.Errorf("unsupported load balancer %q, use one of %v, %v, %v, %v, %v or %v",
+		l.Type, LBRoundRobin, LBLeastConn, LBLeastLatency, LBTwoRandomChoices, LBConsistentHash, LBStickySession)
+}
+
+func (l *HTTPBackendLoadBalancer) Equals(o HTTPBackendLoadBalancer) bool {
+	return l.Type == o.Type &&
+		l.Variable == o.Variable &&
+		l.LoadFactor == o.LoadFactor &&
+		l.Cookie == o.Cookie
+}
+
+func checkHashVariable(v string) error {
+	switch {
+	case v == "client.ip", v == "request.host":
+		return nil
+	case strings.HasPrefix(v, "request.header.") && len(v) > len("request.header."):
+		return nil
+	case strings.HasPrefix(v, "request.cookie.") && len(v) > len("request.cookie."):
+		return nil
+	}
+	return fmt.Errorf("unsupported variable %q, use client.ip, request.host, request.header.<name> or request.cookie.<name>", v)
+}
+
 type HTTPBackendSettings struct {
 	// Timeouts provides timeout settings for backend servers
 	Timeouts HTTPBackendTimeouts
@@ -415,14 +1173,43 @@ type HTTPBackendSettings struct {
 	KeepAlive HTTPBackendKeepAlive
 	// TLS provides optional TLS settings for HTTP backend
 	TLS *TLSSettings `json:",omitempty"`
+	// LoadBalancer selects the load balancing algorithm
+	LoadBalancer HTTPBackendLoadBalancer
+	// HealthCheck enables active health checks of the backend servers
+	HealthCheck *HTTPBackendHealthCheck `json:",omitempty"`
+	// OutlierDetection enables temporary ejection of the servers whose latency or error rates stand out
+	OutlierDetection *HTTPBackendOutlierDetection `json:",omitempty"`
+	// Protocol spoken to the backend servers: http/1.1 if empty, h2 over TLS or h2c, HTTP/2 over cleartext
+	Protocol string `json:",omitempty"`
 }
 
 func (s *HTTPBackendSettings) Equals(o HTTPBackendSettings) bool {
+	return s.LoadBalancer.Equals(o.LoadBalancer) &&
+		s.HealthCheckEquals(o) &&
+		s.OutlierDetectionEquals(o) &&
+		s.TransportEquals(o)
+}
+
+// OutlierDetectionEquals returns true if both settings have the same outlier detection or none
+func (s *HTTPBackendSettings) OutlierDetectionEquals(o HTTPBackendSettings) bool {
+	return (s.OutlierDetection == nil && o.OutlierDetection == nil) ||
+		(s.OutlierDetection != nil && o.OutlierDetection != nil && *s.OutlierDetection == *o.OutlierDetection)
+}
+
+// HealthCheckEquals returns true if both settings have the same health check or none
+func (s *HTTPBackendSettings) HealthCheckEquals(o HTTPBackendSettings) bool {
+	return (s.HealthCheck == nil && o.HealthCheck == nil) ||
+		(s.HealthCheck != nil && o.HealthCheck != nil && *s.HealthCheck == *o.HealthCheck)
+}
+
+// TransportEquals returns true if the settings result in the same transport, ignoring the load balancer
+func (s *HTTPBackendSettings) TransportEquals(o HTTPBackendSettings) bool {
 	return s.Timeouts.Read == o.Timeouts.Read &&
 		s.Timeouts.Dial == o.Timeouts.Dial &&
 		s.Timeouts.TLSHandshake == o.Timeouts.TLSHandshake &&
 		s.KeepAlive.Period == o.KeepAlive.Period &&
 		s.KeepAlive.MaxIdleConnsPerHost == o.KeepAlive.MaxIdleConnsPerHost &&
+		s.Protocol == o.Protocol &&
 		((s.TLS == nil && o.TLS == nil) ||
 			((s.TLS != nil && o.TLS != nil) && s.TLS.Equals(o.TLS)))
 }
@@ -455,6 +1242,16 @@ func (s *HTTPBackendSettings) TransportSettings() (TransportSettings, error) {
 	}
 	t.KeepAlive.MaxIdleConnsPerHost = s.KeepAlive.MaxIdleConnsPerHost
 
+	switch s.Protocol {
+	case "", BackendHTTP1:
+		t.Protocol = BackendHTTP1
+	case BackendH2, BackendH2C:
+		t.Protocol = s.Protocol
+	default:
+		return TransportSettings{}, fmt.Errorf("unsupported backend protocol %q, supported protocols are %s, %s and %s",
+			s.Protocol, BackendHTTP1, BackendH2, BackendH2C)
+	}
+
 	if s.TLS != nil {
 		config, err := NewTLSConfig(s.TLS)
 		if err != nil {
@@ -465,6 +1262,186 @@ func (s *HTTPBackendSettings) TransportSettings() (TransportSettings, error) {
 	return t, nil
 }
 
+// HealthCheckSettings returns the parsed health check settings with defaults applied,
+// it returns nil if the health checks are disabled
+func (s *HTTPBackendSettings) HealthCheckSettings() (*HealthCheckSettings, error) {
+	hc := s.HealthCheck
+	if hc == nil {
+		return nil, nil
+	}
+	if !strings.HasPrefix(hc.Path, "/") {
+		return nil, fmt.Errorf("health check path should start with /, got %q", hc.Path)
+	}
+	out := &HealthCheckSettings{
+		Path:               hc.Path,
+		Interval:           DefaultHealthCheckInterval,
+		Timeout:            DefaultHealthCheckTimeout,
+		ExpectedStatus:     http.StatusOK,
+		HealthyThreshold:   DefaultHealthyThreshold,
+		UnhealthyThreshold: DefaultUnhealthyThreshold,
+	}
+	var err error
+	if len(hc.Interval) != 0 {
+		if out.Interval, err = time.ParseDuration(hc.Interval); err != nil || out.Interval <= 0 {
+			return nil, fmt.Errorf("invalid health check interval %q", hc.Interval)
+		}
+	}
+	if len(hc.Timeout) != 0 {
+		if out.Timeout, err = time.ParseDuration(hc.Timeout); err != nil || out.Timeout <= 0 {
+			return nil, fmt.Errorf("invalid health check timeout %q", hc.Timeout)
+		}
+	}
+	if hc.ExpectedStatus != 0 {
+		if hc.ExpectedStatus < 100 || hc.ExpectedStatus > 599 {
+			return nil, fmt.Errorf("invalid health check expected status %d", hc.ExpectedStatus)
+		}
+		out.ExpectedStatus = hc.ExpectedStatus
+	}
+	if hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		return nil, fmt.Errorf("health check thresholds should be >= 0")
+	}
+	if hc.HealthyThreshold != 0 {
+		out.HealthyThreshold = hc.HealthyThreshold
+	}
+	if hc.UnhealthyThreshold != 0 {
+		out.UnhealthyThreshold = hc.UnhealthyThreshold
+	}
+	return out, nil
+}
+
+// Health check defaults
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthyThreshold    = 2
+	DefaultUnhealthyThreshold  = 3
+)
+
+// HTTPBackendHealthCheck configures active health checks of the backend servers,
+// servers failing the checks are taken out of rotation until they pass them again
+type HTTPBackendHealthCheck struct {
+	// Path requested on every server, e.g. /health
+	Path string
+	// Interval between the checks, 10s if empty
+	Interval string `json:",omitempty"`
+	// Timeout of a single check, 2s if empty
+	Timeout string `json:",omitempty"`
+	// ExpectedStatus is the response code of a healthy server, 200 if 0
+	ExpectedStatus int `json:",omitempty"`
+	// HealthyThreshold is the number of consecutive passed checks that make an unhealthy server healthy, 2 if 0
+	HealthyThreshold int `json:",omitempty"`
+	// UnhealthyThreshold is the number of consecutive failed checks that make a server unhealthy, 3 if 0
+	UnhealthyThreshold int `json:",omitempty"`
+}
+
+// HealthCheckSettings are the parsed health check settings
+type HealthCheckSettings struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	ExpectedStatus     int
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// OutlierDetectionSettings returns the parsed outlier detection settings with defaults applied,
+// it returns nil if the outlier detection is disabled
+func (s *HTTPBackendSettings) OutlierDetectionSettings() (*OutlierDetectionSettings, error) {
+	od := s.OutlierDetection
+	if od == nil {
+		return nil, nil
+	}
+	out := &OutlierDetectionSettings{
+		Interval:          DefaultOutlierDetectionInterval,
+		BaseEjectionTime:  DefaultBaseEjectionTime,
+		MaxEjectionTime:   DefaultMaxEjectionTime,
+		MaxEjectedPercent: DefaultMaxEjectedPercent,
+		MinRequests:       DefaultOutlierMinRequests,
+	}
+	var err error
+	if len(od.Interval) != 0 {
+		if out.Interval, err = time.ParseDuration(od.Interval); err != nil || out.Interval <= 0 {
+			return nil, fmt.Errorf("invalid outlier detection interval %q", od.Interval)
+		}
+	}
+	if len(od.BaseEjectionTime) != 0 {
+		if out.BaseEjectionTime, err = time.ParseDuration(od.BaseEjectionTime); err != nil || out.BaseEjectionTime <= 0 {
+			return nil, fmt.Errorf("invalid base ejection time %q", od.BaseEjectionTime)
+		}
+	}
+	if len(od.MaxEjectionTime) != 0 {
+		if out.MaxEjectionTime, err = time.ParseDuration(od.MaxEjectionTime); err != nil || out.MaxEjectionTime <= 0 {
+			return nil, fmt.Errorf("invalid max ejection time %q", od.MaxEjectionTime)
+		}
+	}
+	if out.MaxEjectionTime < out.BaseEjectionTime {
+		return nil, fmt.Errorf("max ejection time %v is less than base ejection time %v", out.MaxEjectionTime, out.BaseEjectionTime)
+	}
+	if od.MaxEjectedPercent < 0 || od.MaxEjectedPercent > 100 {
+		return nil, fmt.Errorf("max ejected percent should be in range 0-100, got %d", od.MaxEjectedPercent)
+	}
+	if od.MaxEjectedPercent != 0 {
+		out.MaxEjectedPercent = od.MaxEjectedPercent
+	}
+	if od.MinRequests < 0 {
+		return nil, fmt.Errorf("outlier detection min requests should be >= 0, got %d", od.MinRequests)
+	}
+	if od.MinRequests != 0 {
+		out.MinRequests = od.MinRequests
+	}
+	return out, nil
+}
+
+// Outlier detection defaults
+const (
+	DefaultOutlierDetectionInterval = 10 * time.Second
+	DefaultBaseEjectionTime         = 30 * time.Second
+	DefaultMaxEjectionTime          = 5 * time.Minute
+	DefaultMaxEjectedPercent        = 10
+	DefaultOutlierMinRequests       = 10
+)
+
+// HTTPBackendOutlierDetection configures passive outlier detection: servers whose latency or error rates
+// stand out from the rest of the backend are ejected from load balancing for a while
+type HTTPBackendOutlierDetection struct {
+	// Interval between the detections, 10s if empty
+	Interval string `json:",omitempty"`
+	// BaseEjectionTime is the time of the first ejection of a server, it doubles with every repeated ejection, 30s if empty
+	BaseEjectionTime string `json:",omitempty"`
+	// MaxEjectionTime caps the ejection time, 5m if empty
+	MaxEjectionTime string `json:",omitempty"`
+	// MaxEjectedPercent is the share of the backend servers that can be ejected at the same time,
+	// at least one server can always be ejected, 10 if 0
+	MaxEjectedPercent int `json:",omitempty"`
+	// MinRequests is the number of recent requests a server needs to be evaluated, 10 if 0
+	MinRequests int `json:",omitempty"`
+}
+
+// OutlierDetectionSettings are the parsed outlier detection settings
+// FanOutSettings are the parsed settings of a fanout frontend
+type FanOutSettings struct {
+	Branches         []FanOutBranchSettings
+	Merge            string
+	Quorum           int
+	OnPartialFailure string
+	MaxResponseBytes int64
+}
+
+type FanOutBranchSettings struct {
+	BackendId string
+	// Timeout is zero if the branch has no timeout of its own
+	Timeout time.Duration
+	Key     string
+}
+
+type OutlierDetectionSettings struct {
+	Interval          time.Duration
+	BaseEjectionTime  time.Duration
+	MaxEjectionTime   time.Duration
+	MaxEjectedPercent int
+	MinRequests       int
+}
+
 type MiddlewareKey struct {
 	FrontendKey FrontendKey
 	Id          string
@@ -496,6 +1473,15 @@ func NewHTTPBackend(id string, s HTTPBackendSettings) (*Backend, error) {
 	if _, err := s.TransportSettings(); err != nil {
 		return nil, err
 	}
+	if err := s.LoadBalancer.Check(); err != nil {
+		return nil, err
+	}
+	if _, err := s.HealthCheckSettings(); err != nil {
+		return nil, err
+	}
+	if _, err := s.OutlierDetectionSettings(); err != nil {
+		return nil, err
+	}
 	return &Backend{
 		Id:       id,
 		Type:     HTTP,
@@ -503,6 +1489,34 @@ func NewHTTPBackend(id string, s HTTPBackendSettings) (*Backend, error) {
 	}, nil
 }
 
+// NewTCPBackend creates a backend of tcp frontends, its servers have tcp://host:port URLs. Of the HTTP backend
+// settings tcp backends use the dial timeout, the keep-alive period, the load balancer and the outlier detection
+func NewTCPBackend(id string, s HTTPBackendSettings) (*Backend, error) {
+	b, err := NewHTTPBackend(id, s)
+	if err != nil {
+		return nil, err
+	}
+	t, _ := s.TransportSettings()
+	if t.Timeouts.Read != 0 || t.Timeouts.TLSHandshake != 0 || t.KeepAlive.MaxIdleConnsPerHost != 0 ||
+		t.TLS != nil || s.Protocol != "" {
+		return nil, fmt.Errorf("tcp backends support dial timeouts and keep-alive periods only")
+	}
+	if s.HealthCheck != nil {
+		return nil, fmt.Errorf("tcp backends do not support health checks")
+	}
+	switch s.LoadBalancer.Type {
+	case LBStickySession:
+		return nil, fmt.Errorf("tcp backends do not support sticky sessions")
+	case LBConsistentHash:
+		if s.LoadBalancer.Variable != "client.ip" {
+			return nil, fmt.Errorf("tcp backends can hash client.ip only, got %q", s.LoadBalancer.Variable)
+		}
+	}
+	b.Type = TCP
+	return b, nil
+}
+
+// HTTPSettings returns the settings of backends of all types
 func (b *Backend) HTTPSettings() HTTPBackendSettings {
 	return b.Settings.(HTTPBackendSettings)
 }
@@ -526,9 +1540,33 @@ func (b *Backend) TransportSettings() (TransportSettings, error) {
 
 // Server is a final destination of the request
 type Server struct {
-	Id    string
-	URL   string
-	Stats *RoundTripStats `json:",omitempty"`
+	Id  string
+	URL string
+	// Weight is the relative share of requests the server gets, 0 means the default weight of 1
+	Weight int             `json:",omitempty"`
+	Stats  *RoundTripStats `json:",omitempty"`
+	// Health is reported for the servers of backends with health checks, it is not stored
+	Health *ServerHealth `json:",omitempty"`
+}
+
+// ServerHealth is the state of the server according to the active health checks
+type ServerHealth struct {
+	Healthy bool
+	// CheckedAt is the time of the last check, zero if the server has not been checked yet
+	CheckedAt time.Time
+	// Error describes the last failed check
+	Error string `json:",omitempty"`
+}
+
+// OutlierEjection is an ejection of a server from load balancing by the outlier detection
+type OutlierEjection struct {
+	ServerId  string
+	URL       string
+	EjectedAt time.Time
+	// Until is the time the server returns to load balancing
+	Until time.Time
+	// Reason lists the anomalies detected
+	Reason string
 }
 
 func NewServer(id, u string) (*Server, error) {
@@ -541,8 +1579,21 @@ func NewServer(id, u string) (*Server, error) {
 	}, nil
 }
 
+// NewWeightedServer returns the server getting the given share of requests relative to other servers of the backend
+func NewWeightedServer(id, u string, weight int) (*Server, error) {
+	if weight < 0 {
+		return nil, fmt.Errorf("weight should be >= 0, got %d", weight)
+	}
+	s, err := NewServer(id, u)
+	if err != nil {
+		return nil, err
+	}
+	s.Weight = weight
+	return s, nil
+}
+
 func (e *Server) String() string {
-	return fmt.Sprintf("HTTPServer(%s, %s, %s)", e.Id, e.URL, e.Stats)
+	return fmt.Sprintf("HTTPServer(%s, %s, weight=%d, %s)", e.Id, e.URL, e.Weight, e.Stats)
 }
 
 func (e *Server) GetId() string {
@@ -691,6 +1742,19 @@ func (n *AlreadyExistsError) Error() string {
 	return n.Message
 }
 
+// NotSupportedError is returned by engines that do not implement the requested operation
+type NotSupportedError struct {
+	Message string
+}
+
+func (n *NotSupportedError) Error() string {
+	if n.Message != "" {
+		return n.Message
+	} else {
+		return "operation not supported"
+	}
+}
+
 type Counters struct {
 	Period      time.Duration
 	NetErrors   int64
@@ -764,6 +1828,7 @@ func (u BackendKey) String() string {
 
 const (
 	HTTP           = "http"
+	FanOut         = "fanout"
 	HTTPS          = "https"
 	TCP            = "tcp"
 	UNIX           = "unix"
@@ -771,6 +1836,23 @@ const (
 	NoTTL          = 0
 )
 
+const (
+	// FanOutMergeJSON concatenates JSON arrays returned by the branches, or merges JSON objects
+	FanOutMergeJSON = "json"
+	// FanOutMergeFirst returns the first successful response
+	FanOutMergeFirst = "first"
+	// FanOutMergeQuorum returns the response once enough branches have returned the same one
+	FanOutMergeQuorum = "quorum"
+
+	// FanOutFail fails the request if any branch fails
+	FanOutFail = "fail"
+	// FanOutIgnore merges the responses of the branches that have not failed
+	FanOutIgnore = "ignore"
+)
+
+// DefaultFanOutMaxResponseBytes is the default size of the largest branch response a fanout frontend buffers
+const DefaultFanOutMaxResponseBytes = 10 << 20
+
 type TransportTimeouts struct {
 	// Socket read timeout (before we receive the first reply header)
 	Read time.Duration
@@ -791,8 +1873,17 @@ type TransportSettings struct {
 	Timeouts  TransportTimeouts
 	KeepAlive TransportKeepAlive
 	TLS       *tls.Config
+	// Protocol is one of BackendHTTP1, BackendH2 and BackendH2C
+	Protocol string
 }
 
+// Protocols spoken to the backend servers
+const (
+	BackendHTTP1 = "http/1.1"
+	BackendH2    = "h2"
+	BackendH2C   = "h2c"
+)
+
 // FrontendSpec fully specifies a particular frontend.
 type FrontendSpec struct {
 	Frontend    Frontend
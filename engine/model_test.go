@@ -1,8 +1,17 @@
 package engine
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"testing"
 	"time"
 
@@ -33,6 +42,107 @@ func (s *BackendSuite) TestHostBad(c *C) {
 	c.Assert(h, IsNil)
 }
 
+func (s *BackendSuite) TestHostKeyPairRef(c *C) {
+	_, err := NewHost("localhost", HostSettings{KeyPair: &KeyPair{Ref: "file:///etc/certs/x.pem"}})
+	c.Assert(err, IsNil)
+
+}
+
+func (s *BackendSuite) TestHostClientAuth(c *C) {
+	_, err := NewHost("localhost", HostSettings{ClientAuth: &ClientAuthSettings{Type: ClientAuthRequire, CA: newTestCA(c)}})
+	c.Assert(err, IsNil)
+
+	_, err = NewHost("localhost", HostSettings{ClientAuth: &ClientAuthSettings{Type: ClientAuthRequire}})
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestClientAuthSettings(c *C) {
+	ca := newTestCA(c)
+
+	out, err := (&ClientAuthSettings{Type: ClientAuthRequest, CA: ca}).Parse()
+	c.Assert(err, IsNil)
+	c.Assert(out.Type, Equals, tls.VerifyClientCertIfGiven)
+	c.Assert(out.CAs, NotNil)
+	c.Assert(out.Headers, Equals, ClientCertHeaders{
+		Subject:     DefaultClientCertSubjectHeader,
+		SANs:        DefaultClientCertSANsHeader,
+		Fingerprint: DefaultClientCertFingerprintHeader,
+	})
+
+	out, err = (&ClientAuthSettings{
+		Type:    ClientAuthRequire,
+		CA:      ca,
+		CRL:     "/etc/crl.pem",
+		Headers: ClientCertHeaders{Subject: "x-ssl-client-dn"},
+	}).Parse()
+	c.Assert(err, IsNil)
+	c.Assert(out.Type, Equals, tls.RequireAndVerifyClientCert)
+	c.Assert(out.CRL, Equals, "/etc/crl.pem")
+	c.Assert(out.Headers.Subject, Equals, "X-Ssl-Client-Dn")
+	c.Assert(out.Headers.SANs, Equals, DefaultClientCertSANsHeader)
+
+	out, err = (&ClientAuthSettings{Type: ClientAuthNone}).Parse()
+	c.Assert(err, IsNil)
+	c.Assert(out.Type, Equals, tls.NoClientCert)
+
+	bad := []ClientAuthSettings{
+		{},
+		{Type: "optional", CA: ca},
+		{Type: ClientAuthRequire},
+		{Type: ClientAuthRequire, CA: []byte("not a certificate")},
+		{Type: ClientAuthRequire, CA: ca, Headers: ClientCertHeaders{Fingerprint: "X-Client: Cert"}},
+	}
+	for _, b := range bad {
+		_, err := b.Parse()
+		c.Assert(err, NotNil, Commentf("%+v", b))
+	}
+}
+
+// newTestCA returns the PEM of a self-signed CA certificate.
+func newTestCA(c *C) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// newTestKeyPair generates a self-signed ECDSA key pair
+func newTestKeyPair(c *C) *KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "backend.example.com"},
+		DNSNames:     []string{"backend.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return &KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func pemDER(c *C, in []byte) []byte {
+	block, _ := pem.Decode(in)
+	c.Assert(block, NotNil)
+	return block.Bytes
+}
+
 func (s *BackendSuite) TestFrontendDefaults(c *C) {
 	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{})
 	c.Assert(err, IsNil)
@@ -88,6 +198,323 @@ func (s *BackendSuite) TestFrontendBadOptions(c *C) {
 	}
 }
 
+func (s *BackendSuite) TestFrontendSplitBackends(c *C) {
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(f.BackendKeys(), DeepEquals, []BackendKey{{Id: "b1"}})
+
+	backends := []FrontendBackend{{Id: "b2", Weight: 5}, {Id: "b1", Weight: 95}}
+	c.Assert(f.SetBackends(backends, &BackendPin{Header: "X-Backend"}), IsNil)
+	c.Assert(f.BackendKeys(), DeepEquals, []BackendKey{{Id: "b1"}, {Id: "b2"}})
+	c.Assert(f.UsesBackend(BackendKey{Id: "b2"}), Equals, true)
+	c.Assert(f.UsesBackend(BackendKey{Id: "b3"}), Equals, false)
+
+	o := *f
+	c.Assert(o.SetBackends([]FrontendBackend{{Id: "b1", Weight: 90}, {Id: "b2", Weight: 10}}, o.BackendPin), IsNil)
+	c.Assert(f.Equals(o), Equals, false)
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+
+	// BackendId defaults to the first backend of the split
+	out, err = FrontendFromJSON(route.NewMux(),
+		[]byte(`{"Type": "http", "Id": "f2", "Route": "Path(\"/\")", "Backends": [{"Id": "b2", "Weight": 1}]}`))
+	c.Assert(err, IsNil)
+	c.Assert(out.BackendId, Equals, "b2")
+
+	for _, bad := range [][]FrontendBackend{
+		{{Id: "b2", Weight: 1}},
+		{{Id: "b1", Weight: 1}, {Id: "b1", Weight: 1}},
+		{{Id: "b1", Weight: 1}, {Id: "", Weight: 1}},
+		{{Id: "b1", Weight: -1}, {Id: "b2", Weight: 2}},
+		{{Id: "b1", Weight: 0}, {Id: "b2", Weight: 0}},
+	} {
+		c.Assert(f.SetBackends(bad, nil), NotNil, Commentf("%v", bad))
+	}
+	c.Assert(f.SetBackends(backends, &BackendPin{}), NotNil)
+	c.Assert(f.SetBackends(nil, &BackendPin{Cookie: "c"}), NotNil)
+}
+
+func (s *BackendSuite) TestFrontendMirror(c *C) {
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(f.SetBackends([]FrontendBackend{{Id: "b1", Weight: 1}, {Id: "b2", Weight: 1}}, nil), IsNil)
+
+	o := *f
+	c.Assert(f.SetMirror(&FrontendMirror{BackendId: "shadow", Percent: 12.5, MaxInFlight: 10}), IsNil)
+	c.Assert(f.BackendKeys(), DeepEquals, []BackendKey{{Id: "b1"}, {Id: "b2"}, {Id: "shadow"}})
+	c.Assert(f.UsesBackend(BackendKey{Id: "shadow"}), Equals, true)
+	c.Assert(f.Equals(o), Equals, false)
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+	c.Assert(out.Equals(*f), Equals, true)
+
+	for _, bad := range []FrontendMirror{
+		{Percent: 10},
+		{BackendId: "b1", Percent: 10},
+		{BackendId: "b2", Percent: 10},
+		{BackendId: "shadow"},
+		{BackendId: "shadow", Percent: 101},
+		{BackendId: "shadow", Percent: 10, MaxBodyBytes: -1},
+		{BackendId: "shadow", Percent: 10, MaxInFlight: -1},
+	} {
+		c.Assert(f.SetMirror(&bad), NotNil, Commentf("%v", bad))
+	}
+	c.Assert(f.SetMirror(nil), IsNil)
+	c.Assert(f.Mirror, IsNil)
+}
+
+func (s *BackendSuite) TestFrontendHedging(c *C) {
+	settings := HTTPFrontendSettings{Hedging: &HTTPFrontendHedging{MinDelay: "10ms"}}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+
+	parsed, err := settings.HedgingSettings()
+	c.Assert(err, IsNil)
+	c.Assert(*parsed, DeepEquals, HedgingSettings{
+		Percentile: DefaultHedgingPercentile, MinDelay: 10 * time.Millisecond, BudgetPercent: DefaultHedgingBudgetPercent})
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+
+	other := settings
+	other.Hedging = &HTTPFrontendHedging{MinDelay: "10ms", BudgetPercent: 5}
+	c.Assert(settings.Equals(other), Equals, false)
+	other.Hedging = nil
+	c.Assert(settings.Equals(other), Equals, false)
+
+	none := HTTPFrontendSettings{}
+	parsed, err = none.HedgingSettings()
+	c.Assert(err, IsNil)
+	c.Assert(parsed, IsNil)
+
+	for _, bad := range []HTTPFrontendSettings{
+		{Hedging: &HTTPFrontendHedging{Percentile: 100}},
+		{Hedging: &HTTPFrontendHedging{Percentile: -1}},
+		{Hedging: &HTTPFrontendHedging{MinDelay: "soon"}},
+		{Hedging: &HTTPFrontendHedging{MinDelay: "-1s"}},
+		{Hedging: &HTTPFrontendHedging{BudgetPercent: 101}},
+		{Hedging: &HTTPFrontendHedging{}, Stream: true},
+	} {
+		_, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, bad)
+		c.Assert(err, NotNil, Commentf("%v", bad.Hedging))
+	}
+}
+
+func (s *BackendSuite) TestFrontendRetry(c *C) {
+	settings := HTTPFrontendSettings{Retry: &HTTPFrontendRetry{StatusCodes: []int{503}, Methods: []string{"get", "put"}, Backoff: "1s"}}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+
+	parsed, err := settings.RetrySettings()
+	c.Assert(err, IsNil)
+	c.Assert(*parsed, DeepEquals, RetrySettings{
+		Attempts:      DefaultRetryAttempts,
+		StatusCodes:   map[int]bool{503: true},
+		Methods:       map[string]bool{"GET": true, "PUT": true},
+		Backoff:       time.Second,
+		MaxBackoff:    time.Second,
+		BudgetPercent: DefaultRetryBudgetPercent,
+	})
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+	c.Assert(out.Equals(*f), Equals, true)
+
+	other := settings
+	other.Retry = &HTTPFrontendRetry{StatusCodes: []int{502}, Methods: []string{"get", "put"}, Backoff: "1s"}
+	c.Assert(settings.Equals(other), Equals, false)
+	other.Retry = nil
+	c.Assert(settings.Equals(other), Equals, false)
+
+	for _, bad := range []HTTPFrontendSettings{
+		{Retry: &HTTPFrontendRetry{Attempts: -1}},
+		{Retry: &HTTPFrontendRetry{Attempts: MaxRetryAttempts + 1}},
+		{Retry: &HTTPFrontendRetry{StatusCodes: []int{600}}},
+		{Retry: &HTTPFrontendRetry{Methods: []string{""}}},
+		{Retry: &HTTPFrontendRetry{PerTryTimeout: "0s"}},
+		{Retry: &HTTPFrontendRetry{Backoff: "later"}},
+		{Retry: &HTTPFrontendRetry{Backoff: "1s", MaxBackoff: "10ms"}},
+		{Retry: &HTTPFrontendRetry{BudgetPercent: 101}},
+		{Retry: &HTTPFrontendRetry{}, FailoverPredicate: "IsNetworkError()"},
+	} {
+		_, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, bad)
+		c.Assert(err, NotNil, Commentf("%v", bad.Retry))
+	}
+}
+
+func (s *BackendSuite) TestFrontendDeadline(c *C) {
+	settings := HTTPFrontendSettings{Deadline: &HTTPFrontendDeadline{Timeout: "5s", Header: "x-deadline"}}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+
+	parsed, err := settings.DeadlineSettings()
+	c.Assert(err, IsNil)
+	c.Assert(*parsed, DeepEquals, DeadlineSettings{Timeout: 5 * time.Second, Header: "X-Deadline"})
+
+	settings.Deadline.Header = ""
+	parsed, err = settings.DeadlineSettings()
+	c.Assert(err, IsNil)
+	c.Assert(parsed.Header, Equals, DefaultDeadlineHeader)
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+	c.Assert(settings.Equals(HTTPFrontendSettings{}), Equals, false)
+
+	for _, bad := range []HTTPFrontendDeadline{
+		{},
+		{Timeout: "0s"},
+		{Timeout: "soon"},
+		{Timeout: "1s", Header: "X Deadline"},
+	} {
+		_, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{Deadline: &bad})
+		c.Assert(err, NotNil, Commentf("%v", bad))
+	}
+}
+
+func (s *BackendSuite) TestFanOutFrontend(c *C) {
+	settings := FanOutFrontendSettings{
+		Branches: []FanOutBranch{{BackendId: "b1", Key: "users", Timeout: "2s"}, {BackendId: "b2"}, {BackendId: "b3"}},
+		Merge:    FanOutMergeQuorum,
+	}
+	f, err := NewFanOutFrontend(route.NewMux(), "f1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+	c.Assert(f.Type, Equals, FanOut)
+	c.Assert(f.BackendId, Equals, "b1")
+	c.Assert(f.BackendKeys(), DeepEquals, []BackendKey{{Id: "b1"}, {Id: "b2"}, {Id: "b3"}})
+	c.Assert(f.HTTPSettings(), DeepEquals, HTTPFrontendSettings{})
+
+	parsed, err := f.FanOutSettings()
+	c.Assert(err, IsNil)
+	c.Assert(parsed, DeepEquals, &FanOutSettings{
+		Branches: []FanOutBranchSettings{
+			{BackendId: "b1", Key: "users", Timeout: 2 * time.Second}, {BackendId: "b2"}, {BackendId: "b3"}},
+		Merge:            FanOutMergeQuorum,
+		Quorum:           2,
+		OnPartialFailure: FanOutFail,
+		MaxResponseBytes: DefaultFanOutMaxResponseBytes,
+	})
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+	c.Assert(out.Equals(*f), Equals, true)
+
+	o := *f
+	settings.Quorum = 3
+	o.Settings = settings
+	c.Assert(f.Equals(o), Equals, false)
+
+	// Fanout frontends neither split nor mirror the traffic
+	c.Assert(f.SetBackends([]FrontendBackend{{Id: "b1", Weight: 1}, {Id: "b4", Weight: 1}}, nil), NotNil)
+	c.Assert(f.SetMirror(&FrontendMirror{BackendId: "b4", Percent: 10}), NotNil)
+
+	for _, bad := range []FanOutFrontendSettings{
+		{Branches: []FanOutBranch{{BackendId: "b1"}}},
+		{Branches: []FanOutBranch{{BackendId: "b1"}, {BackendId: "b1"}}},
+		{Branches: []FanOutBranch{{BackendId: "b1"}, {BackendId: ""}}},
+		{Branches: []FanOutBranch{{BackendId: "b1", Key: "k"}, {BackendId: "b2", Key: "k"}}},
+		{Branches: []FanOutBranch{{BackendId: "b1", Timeout: "soon"}, {BackendId: "b2"}}},
+		{Branches: []FanOutBranch{{BackendId: "b1"}, {BackendId: "b2"}}, Merge: "concat"},
+		{Branches: []FanOutBranch{{BackendId: "b1"}, {BackendId: "b2"}}, Quorum: 1},
+		{Branches: []FanOutBranch{{BackendId: "b1"}, {BackendId: "b2"}}, Merge: FanOutMergeQuorum, Quorum: 3},
+		{Branches: []FanOutBranch{{BackendId: "b1"}, {BackendId: "b2"}}, OnPartialFailure: "retry"},
+		{Branches: []FanOutBranch{{BackendId: "b1"}, {BackendId: "b2"}}, MaxResponseBytes: -1},
+		{Branches: []FanOutBranch{{BackendId: "b1"}, {BackendId: "b2"}}, HTTPFrontendSettings: HTTPFrontendSettings{Stream: true}},
+	} {
+		_, err := NewFanOutFrontend(route.NewMux(), "f1", `Path("/home")`, bad)
+		c.Assert(err, NotNil, Commentf("%v", bad))
+	}
+}
+
+func (s *BackendSuite) TestTCPFrontend(c *C) {
+	f, err := NewTCPFrontend("f1", "b1", TCPFrontendSettings{ListenerId: "l1", IdleTimeout: "1h"})
+	c.Assert(err, IsNil)
+	c.Assert(f.Type, Equals, TCP)
+	c.Assert(f.Route, Equals, "")
+	c.Assert(f.BackendKeys(), DeepEquals, []BackendKey{{Id: "b1"}})
+	c.Assert(f.HTTPSettings(), DeepEquals, HTTPFrontendSettings{})
+
+	parsed, err := f.TCPSettings()
+	c.Assert(err, IsNil)
+	c.Assert(parsed, DeepEquals, &TCPSettings{ListenerKey: ListenerKey{Id: "l1"}, IdleTimeout: time.Hour})
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+	c.Assert(out.Equals(*f), Equals, true)
+
+	o := *f
+	o.Settings = TCPFrontendSettings{ListenerId: "l2", IdleTimeout: "1h"}
+	c.Assert(f.Equals(o), Equals, false)
+
+	// TCP frontends neither split nor mirror the traffic
+	c.Assert(f.SetBackends([]FrontendBackend{{Id: "b1", Weight: 1}, {Id: "b2", Weight: 1}}, nil), NotNil)
+	c.Assert(f.SetMirror(&FrontendMirror{BackendId: "b2", Percent: 10}), NotNil)
+
+	// HTTP frontends have no tcp settings
+	h, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/")`, HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	parsed, err = h.TCPSettings()
+	c.Assert(err, IsNil)
+	c.Assert(parsed, IsNil)
+	c.Assert(h.Equals(*f), Equals, false)
+
+	for _, bad := range []TCPFrontendSettings{
+		{},
+		{ListenerId: "l1", IdleTimeout: "forever"},
+		{ListenerId: "l1", IdleTimeout: "-1s"},
+	} {
+		_, err := NewTCPFrontend("f1", "b1", bad)
+		c.Assert(err, NotNil, Commentf("%v", bad))
+	}
+	_, err = NewTCPFrontend("f1", "", TCPFrontendSettings{ListenerId: "l1"})
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestTCPFrontendSNI(c *C) {
+	f, err := NewTCPFrontend("f1", "b1", TCPFrontendSettings{ListenerId: "l1", SNI: "*.Example.com"})
+	c.Assert(err, IsNil)
+	parsed, err := f.TCPSettings()
+	c.Assert(err, IsNil)
+	c.Assert(parsed, DeepEquals, &TCPSettings{ListenerKey: ListenerKey{Id: "l1"}, SNI: "*.example.com"})
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+
+	for _, sni := range []string{"db.example.com", "db-1.example.com", "localhost"} {
+		_, err := NewTCPFrontend("f1", "b1", TCPFrontendSettings{ListenerId: "l1", SNI: sni})
+		c.Assert(err, IsNil, Commentf("%v", sni))
+	}
+	for _, sni := range []string{"*", "*.", "db.*.com", "db..example.com", "example.com.", "db example.com", "db.example.com:443"} {
+		_, err := NewTCPFrontend("f1", "b1", TCPFrontendSettings{ListenerId: "l1", SNI: sni})
+		c.Assert(err, NotNil, Commentf("%v", sni))
+	}
+}
+
 func (s *BackendSuite) TestBackendNew(c *C) {
 	b, err := NewHTTPBackend("b1", HTTPBackendSettings{})
 	c.Assert(err, IsNil)
@@ -121,6 +548,55 @@ func (s *BackendSuite) TestNewBackendWithOptions(c *C) {
 
 	c.Assert(o.KeepAlive.Period, Equals, 4*time.Second)
 	c.Assert(o.KeepAlive.MaxIdleConnsPerHost, Equals, 3)
+	c.Assert(o.Protocol, Equals, BackendHTTP1)
+}
+
+func (s *BackendSuite) TestBackendProtocol(c *C) {
+	for _, p := range []string{BackendHTTP1, BackendH2, BackendH2C} {
+		b, err := NewHTTPBackend("b1", HTTPBackendSettings{Protocol: p})
+		c.Assert(err, IsNil)
+		o, err := b.TransportSettings()
+		c.Assert(err, IsNil)
+		c.Assert(o.Protocol, Equals, p)
+	}
+	h1 := HTTPBackendSettings{}
+	c.Assert(h1.TransportEquals(HTTPBackendSettings{Protocol: BackendH2C}), Equals, false)
+
+	_, err := NewHTTPBackend("b1", HTTPBackendSettings{Protocol: "spdy"})
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestTCPBackend(c *C) {
+	settings := HTTPBackendSettings{
+		Timeouts:         HTTPBackendTimeouts{Dial: "2s"},
+		KeepAlive:        HTTPBackendKeepAlive{Period: "30s"},
+		LoadBalancer:     HTTPBackendLoadBalancer{Type: LBConsistentHash, Variable: "client.ip"},
+		OutlierDetection: &HTTPBackendOutlierDetection{},
+	}
+	b, err := NewTCPBackend("b1", settings)
+	c.Assert(err, IsNil)
+	c.Assert(b.Type, Equals, TCP)
+	c.Assert(b.HTTPSettings(), DeepEquals, settings)
+
+	bytes, err := json.Marshal(b)
+	c.Assert(err, IsNil)
+	out, err := BackendFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, b)
+
+	for _, bad := range []HTTPBackendSettings{
+		{Timeouts: HTTPBackendTimeouts{Read: "1s"}},
+		{Timeouts: HTTPBackendTimeouts{TLSHandshake: "1s"}},
+		{KeepAlive: HTTPBackendKeepAlive{MaxIdleConnsPerHost: 2}},
+		{TLS: &TLSSettings{}},
+		{Protocol: BackendH2C},
+		{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}},
+		{LoadBalancer: HTTPBackendLoadBalancer{Type: LBStickySession}},
+		{LoadBalancer: HTTPBackendLoadBalancer{Type: LBConsistentHash, Variable: "request.host"}},
+	} {
+		_, err := NewTCPBackend("b1", bad)
+		c.Assert(err, NotNil, Commentf("%v", bad))
+	}
 }
 
 func (s *BackendSuite) TestBackendSettingsEq(c *C) {
@@ -177,10 +653,33 @@ func (s *BackendSuite) TestBackendSettingsEq(c *C) {
 			b: HTTPBackendSettings{TLS: &TLSSettings{SessionTicketsDisabled: true}},
 			e: false,
 		},
+
+		{
+			a: HTTPBackendSettings{LoadBalancer: HTTPBackendLoadBalancer{Type: LBLeastConn}},
+			b: HTTPBackendSettings{LoadBalancer: HTTPBackendLoadBalancer{Type: LBLeastConn}},
+			e: true,
+		},
+		{
+			a: HTTPBackendSettings{LoadBalancer: HTTPBackendLoadBalancer{Type: LBLeastConn}},
+			b: HTTPBackendSettings{},
+			e: false,
+		},
 	}
 	for _, o := range options {
 		c.Assert(o.a.Equals(o.b), Equals, o.e)
 	}
+
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{
+		LoadBalancer: HTTPBackendLoadBalancer{Type: LBConsistentHash, Variable: "request.header.X-User", LoadFactor: 2},
+	})
+	c.Assert(err, IsNil)
+	settings := b.HTTPSettings()
+	c.Assert(settings.Equals(HTTPBackendSettings{
+		LoadBalancer: HTTPBackendLoadBalancer{Type: LBConsistentHash, Variable: "request.header.X-User"},
+	}), Equals, false)
+
+	a := HTTPBackendSettings{LoadBalancer: HTTPBackendLoadBalancer{Type: LBLeastLatency}}
+	c.Assert(a.TransportEquals(HTTPBackendSettings{}), Equals, true)
 }
 
 func (s *BackendSuite) TestOCSPSettingsEq(c *C) {
@@ -253,6 +752,24 @@ func (s *BackendSuite) TestListenerSettingsEq(c *C) {
 			e: false,
 			c: "session tickets",
 		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{ClientAuth: &ClientAuthSettings{Type: ClientAuthRequire, CA: []byte("a")}}},
+			b: Listener{Settings: &HTTPSListenerSettings{ClientAuth: &ClientAuthSettings{Type: ClientAuthRequire, CA: []byte("a")}}},
+			e: true,
+			c: "same client auth",
+		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{ClientAuth: &ClientAuthSettings{Type: ClientAuthRequire, CA: []byte("a")}}},
+			b: Listener{Settings: &HTTPSListenerSettings{ClientAuth: &ClientAuthSettings{Type: ClientAuthRequire, CA: []byte("b")}}},
+			e: false,
+			c: "client auth CA",
+		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{ClientAuth: &ClientAuthSettings{Type: ClientAuthNone}}},
+			b: Listener{Settings: &HTTPSListenerSettings{}},
+			e: false,
+			c: "client auth",
+		},
 	}
 	for _, o := range options {
 		c.Assert((&o.a).SettingsEquals(&o.b), Equals, o.e, Commentf("TC: %v", o.c))
@@ -281,6 +798,29 @@ func (s *BackendSuite) TestNewBackendWithBadOptions(c *C) {
 				Period: "1what?",
 			},
 		},
+		HTTPBackendSettings{
+			LoadBalancer: HTTPBackendLoadBalancer{
+				Type: "random",
+			},
+		},
+		HTTPBackendSettings{
+			LoadBalancer: HTTPBackendLoadBalancer{
+				Type: LBConsistentHash,
+			},
+		},
+		HTTPBackendSettings{
+			LoadBalancer: HTTPBackendLoadBalancer{
+				Type:     LBConsistentHash,
+				Variable: "request.cookie.",
+			},
+		},
+		HTTPBackendSettings{
+			LoadBalancer: HTTPBackendLoadBalancer{
+				Type:       LBConsistentHash,
+				Variable:   "client.ip",
+				LoadFactor: 0.5,
+			},
+		},
 	}
 	for _, o := range options {
 		b, err := NewHTTPBackend("b1", o)
@@ -289,6 +829,77 @@ func (s *BackendSuite) TestNewBackendWithBadOptions(c *C) {
 	}
 }
 
+func (s *BackendSuite) TestHealthCheckSettings(c *C) {
+	b := HTTPBackendSettings{}
+	hc, err := b.HealthCheckSettings()
+	c.Assert(err, IsNil)
+	c.Assert(hc, IsNil)
+
+	b.HealthCheck = &HTTPBackendHealthCheck{Path: "/health", Timeout: "1s", UnhealthyThreshold: 5}
+	hc, err = b.HealthCheckSettings()
+	c.Assert(err, IsNil)
+	c.Assert(hc, DeepEquals, &HealthCheckSettings{
+		Path:               "/health",
+		Interval:           DefaultHealthCheckInterval,
+		Timeout:            time.Second,
+		ExpectedStatus:     200,
+		HealthyThreshold:   DefaultHealthyThreshold,
+		UnhealthyThreshold: 5,
+	})
+
+	for _, bad := range []HTTPBackendHealthCheck{
+		{Path: "health"},
+		{Path: "/", Interval: "0s"},
+		{Path: "/", Timeout: "what?"},
+		{Path: "/", ExpectedStatus: 1000},
+		{Path: "/", HealthyThreshold: -1},
+	} {
+		b.HealthCheck = &bad
+		_, err := NewHTTPBackend("b1", b)
+		c.Assert(err, NotNil)
+	}
+
+	a := HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/"}}
+	c.Assert(a.Equals(HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/"}}), Equals, true)
+	c.Assert(a.Equals(HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/status"}}), Equals, false)
+	c.Assert(a.Equals(HTTPBackendSettings{}), Equals, false)
+}
+
+func (s *BackendSuite) TestOutlierDetectionSettings(c *C) {
+	b := HTTPBackendSettings{}
+	od, err := b.OutlierDetectionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(od, IsNil)
+
+	b.OutlierDetection = &HTTPBackendOutlierDetection{BaseEjectionTime: "1m", MaxEjectedPercent: 50}
+	od, err = b.OutlierDetectionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(od, DeepEquals, &OutlierDetectionSettings{
+		Interval:          DefaultOutlierDetectionInterval,
+		BaseEjectionTime:  time.Minute,
+		MaxEjectionTime:   DefaultMaxEjectionTime,
+		MaxEjectedPercent: 50,
+		MinRequests:       DefaultOutlierMinRequests,
+	})
+
+	for _, bad := range []HTTPBackendOutlierDetection{
+		{Interval: "-1s"},
+		{BaseEjectionTime: "what?"},
+		{BaseEjectionTime: "1m", MaxEjectionTime: "10s"},
+		{MaxEjectedPercent: 101},
+		{MinRequests: -1},
+	} {
+		b.OutlierDetection = &bad
+		_, err := NewHTTPBackend("b1", b)
+		c.Assert(err, NotNil)
+	}
+
+	a := HTTPBackendSettings{OutlierDetection: &HTTPBackendOutlierDetection{}}
+	c.Assert(a.Equals(HTTPBackendSettings{OutlierDetection: &HTTPBackendOutlierDetection{}}), Equals, true)
+	c.Assert(a.Equals(HTTPBackendSettings{OutlierDetection: &HTTPBackendOutlierDetection{Interval: "1s"}}), Equals, false)
+	c.Assert(a.Equals(HTTPBackendSettings{}), Equals, false)
+}
+
 func (s *BackendSuite) TestNewServer(c *C) {
 	sv, err := NewServer("s1", "http://falhost")
 	c.Assert(err, IsNil)
@@ -310,6 +921,10 @@ func (s *BackendSuite) TestNewListener(c *C) {
 
 	_, err = NewListener("id", "http", "tcp", "127.0.0.1:4000", "", "PROXY_V1", nil)
 	c.Assert(err, IsNil)
+
+	l, err := NewListener("id", "TCP", "tcp", "127.0.0.1:4000", "", "PROXY_V1", nil)
+	c.Assert(err, IsNil)
+	c.Assert(l.Protocol, Equals, TCP)
 }
 
 func (s *BackendSuite) TestNewListenerBadParams(c *C) {
@@ -324,6 +939,20 @@ func (s *BackendSuite) TestNewListenerBadParams(c *C) {
 
 	_, err = NewListener("id", "http", "tcp", "127.0.0.1:4000", "", "NOT_VALID", nil)
 	c.Assert(err, NotNil)
+
+	_, err = NewListener("id", "tcp", "tcp", "127.0.0.1:4000", `Host("localhost")`, "", nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewListener("id", "tcp", "tcp", "127.0.0.1:4000", "", "", &HTTPSListenerSettings{})
+	c.Assert(err, NotNil)
+
+	_, err = NewListener("id", "http", "tcp", "127.0.0.1:4000", "", "",
+		&HTTPSListenerSettings{ClientAuth: &ClientAuthSettings{Type: ClientAuthNone}})
+	c.Assert(err, NotNil)
+
+	_, err = NewListener("id", "https", "tcp", "127.0.0.1:4000", "", "",
+		&HTTPSListenerSettings{ClientAuth: &ClientAuthSettings{Type: ClientAuthRequire}})
+	c.Assert(err, NotNil)
 }
 
 func (s *BackendSuite) TestFrontendsFromJSON(c *C) {
@@ -388,6 +1017,21 @@ func (s *BackendSuite) TestServerFromJSON(c *C) {
 	c.Assert(out, DeepEquals, e)
 }
 
+func (s *BackendSuite) TestWeightedServerFromJSON(c *C) {
+	e, err := NewWeightedServer("sv1", "http://localhost", 5)
+	c.Assert(err, IsNil)
+
+	bytes, err := json.Marshal(e)
+	c.Assert(err, IsNil)
+
+	out, err := ServerFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, e)
+
+	_, err = ServerFromJSON([]byte(`{"Id": "sv1", "URL": "http://localhost", "Weight": -1}`))
+	c.Assert(err, NotNil)
+}
+
 func (s *BackendSuite) TestNewTLSSettings(c *C) {
 	tcs := []struct {
 		S TLSSettings
@@ -707,3 +1351,208 @@ func (s *BackendSuite) TestTLSSettingsEq(c *C) {
 		c.Assert(tc.A.Equals(&tc.B), Equals, tc.R, Commentf("TC: %v", tc.TC))
 	}
 }
+
+func (s *BackendSuite) TestBackendTLSSettings(c *C) {
+	keyPair := newTestKeyPair(c)
+	cert, err := tls.X509KeyPair(keyPair.Cert, keyPair.Key)
+	c.Assert(err, IsNil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, IsNil)
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(spki[:])
+
+	settings := &TLSSettings{
+		KeyPair:    keyPair,
+		RootCAs:    keyPair.Cert,
+		ServerName: "backend.example.com",
+		PinnedSPKI: []string{pin},
+	}
+	cfg, err := NewTLSConfig(settings)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Certificates, HasLen, 1)
+	c.Assert(cfg.RootCAs, NotNil)
+	c.Assert(cfg.ServerName, Equals, "backend.example.com")
+
+	c.Assert(cfg.VerifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}), IsNil)
+	c.Assert(cfg.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}), IsNil)
+	other, err := x509.ParseCertificate(pemDER(c, newTestCA(c)))
+	c.Assert(err, IsNil)
+	c.Assert(cfg.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{other, leaf}}), NotNil)
+
+	_, err = NewHTTPBackend("b1", HTTPBackendSettings{TLS: settings})
+	c.Assert(err, IsNil)
+
+	_, err = NewListener("l1", "https", "tcp", "127.0.0.1:4000", "", "",
+		&HTTPSListenerSettings{TLS: TLSSettings{ServerName: "backend.example.com"}})
+	c.Assert(err, NotNil)
+
+	bad := []TLSSettings{
+		{KeyPair: &KeyPair{Ref: "kp1"}},
+		{KeyPair: &KeyPair{Cert: keyPair.Cert, Key: []byte("bad")}},
+		{RootCAs: []byte("bad")},
+		{PinnedSPKI: []string{"bad"}},
+		{PinnedSPKI: []string{base64.StdEncoding.EncodeToString([]byte("short"))}},
+	}
+	for _, tc := range bad {
+		cfg, err := NewTLSConfig(&tc)
+		c.Assert(err, NotNil)
+		c.Assert(cfg, IsNil)
+	}
+
+	c.Assert(settings.Equals(&TLSSettings{
+		KeyPair:    &KeyPair{Cert: keyPair.Cert, Key: keyPair.Key},
+		RootCAs:    keyPair.Cert,
+		ServerName: "backend.example.com",
+		PinnedSPKI: []string{pin},
+	}), Equals, true)
+	for _, o := range []TLSSettings{
+		{RootCAs: keyPair.Cert, ServerName: "backend.example.com", PinnedSPKI: []string{pin}},
+		{KeyPair: keyPair, ServerName: "backend.example.com", PinnedSPKI: []string{pin}},
+		{KeyPair: keyPair, RootCAs: keyPair.Cert, PinnedSPKI: []string{pin}},
+		{KeyPair: keyPair, RootCAs: keyPair.Cert, ServerName: "backend.example.com"},
+	} {
+		c.Assert(settings.Equals(&o), Equals, false)
+	}
+}
+
+func (s *BackendSuite) TestTransactionFromJSON(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", b.Id, `Path("/home")`, HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+
+	tx := Transaction{Changes: []interface{}{
+		&BackendUpserted{Backend: *b},
+		&ServerUpserted{BackendKey: b.Key(), Server: Server{Id: "s1", URL: "http://localhost:5000"}},
+		&FrontendUpserted{Frontend: *f},
+		&ServerDeleted{ServerKey: ServerKey{BackendKey: b.Key(), Id: "s0"}},
+		&HostDeleted{HostKey: HostKey{Name: "localhost"}},
+	}}
+	bytes, err := json.Marshal(tx)
+	c.Assert(err, IsNil)
+
+	out, err := TransactionFromJSON(route.NewMux(), bytes, plugin.NewRegistry().GetSpec)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &tx)
+}
+
+func (s *BackendSuite) TestTransactionFromJSONBad(c *C) {
+	for _, in := range []string{
+		``,
+		`{"Changes": [{"Op": "merge", "Host": {"Name": "localhost"}}]}`,
+		`{"Changes": [{"Op": "upsert"}]}`,
+	} {
+		_, err := TransactionFromJSON(route.NewMux(), []byte(in), plugin.NewRegistry().GetSpec)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *BackendSuite) TestTransactionCheck(c *C) {
+	b := Backend{Id: "b1", Type: HTTP}
+	f := Frontend{Id: "f1", BackendId: b.Id, Type: HTTP}
+	snapshot := &Snapshot{FrontendSpecs: []FrontendSpec{{Frontend: f}}, BackendSpecs: []BackendSpec{{Backend: b}}}
+
+	// Backend can be deleted together with the frontend using it
+	tx := Transaction{Changes: []interface{}{
+		&BackendDeleted{BackendKey: b.Key()},
+		&FrontendDeleted{FrontendKey: f.Key()},
+	}}
+	c.Assert(tx.Check(snapshot), IsNil)
+	c.Assert(tx.Ordered(), DeepEquals, []interface{}{tx.Changes[1], tx.Changes[0]})
+
+	tx = Transaction{Changes: []interface{}{&BackendDeleted{BackendKey: b.Key()}}}
+	c.Assert(tx.Check(snapshot), NotNil)
+
+	// Deleted and re-created objects are replaced, while created and deleted ones are deleted
+	tx = Transaction{Changes: []interface{}{
+		&BackendDeleted{BackendKey: b.Key()},
+		&BackendUpserted{Backend: b},
+		&FrontendUpserted{Frontend: Frontend{Id: "f2", BackendId: b.Id, Type: HTTP}},
+		&FrontendDeleted{FrontendKey: FrontendKey{Id: "f2"}},
+	}}
+	c.Assert(tx.Check(snapshot), IsNil)
+	c.Assert(tx.Ordered(), DeepEquals, []interface{}{tx.Changes[1], tx.Changes[2], tx.Changes[3]})
+
+	tx = Transaction{Changes: []interface{}{&FrontendUpserted{Frontend: Frontend{Id: "f2", BackendId: "b2"}}}}
+	c.Assert(tx.Check(snapshot), FitsTypeOf, &NotFoundError{})
+
+	// Every backend of a split frontend is in use
+	split := Frontend{Id: "f2", BackendId: b.Id, Backends: []FrontendBackend{{Id: b.Id, Weight: 1}, {Id: "b2", Weight: 1}}}
+	tx = Transaction{Changes: []interface{}{&FrontendUpserted{Frontend: split}}}
+	c.Assert(tx.Check(snapshot), FitsTypeOf, &NotFoundError{})
+	tx = Transaction{Changes: []interface{}{
+		&BackendUpserted{Backend: Backend{Id: "b2", Type: HTTP}},
+		&FrontendUpserted{Frontend: split},
+		&FrontendDeleted{FrontendKey: f.Key()},
+		&BackendDeleted{BackendKey: BackendKey{Id: "b2"}},
+	}}
+	c.Assert(tx.Check(snapshot), NotNil)
+
+	c.Assert(Transaction{}.Check(snapshot), FitsTypeOf, &InvalidFormatError{})
+}
+
+func (s *BackendSuite) TestDiffSnapshots(c *C) {
+	b1 := Backend{Id: "b1", Type: HTTP, Settings: HTTPBackendSettings{}}
+	b2 := Backend{Id: "b2", Type: HTTP, Settings: HTTPBackendSettings{}}
+	srv := Server{Id: "s1", URL: "http://localhost:5000"}
+	f := Frontend{Id: "f1", BackendId: b1.Id, Type: HTTP, Route: `Path("/")`, Settings: HTTPFrontendSettings{}}
+
+	current := &Snapshot{
+		Hosts:         []Host{{Name: "h1"}},
+		BackendSpecs:  []BackendSpec{{Backend: b1, Servers: []Server{srv}}, {Backend: b2}},
+		FrontendSpecs: []FrontendSpec{{Frontend: f}},
+	}
+
+	changed := f
+	changed.Route = `Path("/v2")`
+	desired := &Snapshot{
+		Hosts:         []Host{{Name: "h1"}, {Name: "h2"}},
+		BackendSpecs:  []BackendSpec{{Backend: b1}},
+		FrontendSpecs: []FrontendSpec{{Frontend: changed}},
+	}
+
+	p, err := DiffSnapshots(current, current, true)
+	c.Assert(err, IsNil)
+	c.Assert(p.Empty(), Equals, true)
+
+	p, err = DiffSnapshots(current, desired, false)
+	c.Assert(err, IsNil)
+	c.Assert(p.Added, DeepEquals, []interface{}{&HostUpserted{Host: Host{Name: "h2"}}})
+	c.Assert(p.Changed, DeepEquals, []interface{}{&FrontendUpserted{Frontend: changed}})
+	c.Assert(p.Removed, IsNil)
+
+	p, err = DiffSnapshots(current, desired, true)
+	c.Assert(err, IsNil)
+	c.Assert(p.Removed, DeepEquals, []interface{}{
+		&BackendDeleted{BackendKey: b2.Key()},
+		&ServerDeleted{ServerKey: ServerKey{BackendKey: b1.Key(), Id: srv.Id}},
+	})
+	c.Assert(p.Transaction().Check(current), IsNil)
+}
+
+func (s *BackendSuite) TestHistoryBounded(c *C) {
+	h := NewHistory(&Snapshot{Hosts: []Host{{Name: "h0"}}}, 2)
+	h.Record(1, &HostUpserted{Host: Host{Name: "h1"}})
+	h.Record(2, &TransactionCommitted{Changes: []interface{}{
+		&HostDeleted{HostKey: HostKey{Name: "h0"}},
+		&HostUpserted{Host: Host{Name: "h2"}},
+	}})
+
+	// Changes of the transaction are kept together, so the first revision is folded into the base snapshot
+	revisions := h.Get(HistoryQuery{})
+	c.Assert(len(revisions), Equals, 2)
+	c.Assert(revisions[0].Index, Equals, uint64(2))
+
+	_, err := h.SnapshotAt(0)
+	c.Assert(err, FitsTypeOf, &NotFoundError{})
+
+	snapshot, err := h.SnapshotAt(1)
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Hosts, DeepEquals, []Host{{Name: "h0"}, {Name: "h1"}})
+
+	snapshot, err = h.SnapshotAt(2)
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Hosts, DeepEquals, []Host{{Name: "h1"}, {Name: "h2"}})
+
+	c.Assert(h.Get(HistoryQuery{Key: HostKey{Name: "h0"}}), DeepEquals, []Revision{revisions[0]})
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/plugin/connlimit"
+	"github.com/vulcand/vulcand/testutils"
 
 	. "gopkg.in/check.v1"
 )
@@ -108,6 +109,18 @@ func (s *EngineSuite) HostWithKeyPair(c *C) {
 	})
 }
 
+func (s *EngineSuite) HostWithKeyPairRef(c *C) {
+	host := engine.Host{Name: "localhost"}
+	host.Settings.KeyPair = &engine.KeyPair{Ref: "file:///etc/certs/localhost.pem"}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	out, err := s.Engine.GetHost(host.Key())
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &host)
+}
+
 func (s *EngineSuite) HostWithOCSP(c *C) {
 	host := engine.Host{Name: "localhost"}
 
@@ -152,6 +165,23 @@ func (s *EngineSuite) HostUpsertKeyPair(c *C) {
 		&engine.HostUpserted{Host: host})
 }
 
+func (s *EngineSuite) HostWithClientAuth(c *C) {
+	host := engine.Host{Name: "localhost"}
+	host.Settings.ClientAuth = &engine.ClientAuthSettings{
+		Type:    engine.ClientAuthRequire,
+		CA:      testutils.NewTestKeyPair().Cert,
+		CRL:     "/etc/vulcand/clients.crl",
+		Headers: engine.ClientCertHeaders{Subject: "X-Client-Dn"},
+	}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	out, err := s.Engine.GetHost(host.Key())
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &host)
+}
+
 func (s *EngineSuite) ListenerCRUD(c *C) {
 	listener := engine.Listener{
 		Id:       "l1",
@@ -221,6 +251,37 @@ func (s *EngineSuite) ListenerSettingsCRUD(c *C) {
 	)
 }
 
+func (s *EngineSuite) ListenerWithClientAuth(c *C) {
+	listener := engine.Listener{
+		Id:       "l1",
+		Protocol: "https",
+		Address: engine.Address{
+			Network: "tcp",
+			Address: "127.0.0.1:9000",
+		},
+		Settings: &engine.HTTPSListenerSettings{
+			ClientAuth: &engine.ClientAuthSettings{
+				Type: engine.ClientAuthRequest,
+				CA:   testutils.NewTestKeyPair().Cert,
+			},
+		},
+	}
+	c.Assert(s.Engine.UpsertListener(listener), IsNil)
+	lk := engine.ListenerKey{Id: listener.Id}
+
+	out, err := s.Engine.GetListener(lk)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &listener)
+
+	ls, err := s.Engine.GetListeners()
+	c.Assert(err, IsNil)
+	c.Assert(ls, DeepEquals, []engine.Listener{listener})
+
+	s.expectChanges(c,
+		&engine.ListenerUpserted{Listener: listener},
+	)
+}
+
 func (s *EngineSuite) BackendCRUD(c *C) {
 	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
 
@@ -259,6 +320,28 @@ func (s *EngineSuite) BackendCRUD(c *C) {
 	})
 }
 
+func (s *EngineSuite) BackendWithTLSKeyPair(c *C) {
+	keyPair := testutils.NewTestKeyPair()
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{
+		TLS: &engine.TLSSettings{
+			KeyPair:    keyPair,
+			RootCAs:    keyPair.Cert,
+			ServerName: "backend.example.com",
+		},
+	}}
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+
+	s.expectChanges(c, &engine.BackendUpserted{Backend: b})
+
+	out, err := s.Engine.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &b)
+
+	bs, err := s.Engine.GetBackends()
+	c.Assert(err, IsNil)
+	c.Assert(bs, DeepEquals, []engine.Backend{b})
+}
+
 func (s *EngineSuite) BackendDeleteUsed(c *C) {
 	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
 	c.Assert(s.Engine.UpsertBackend(b), IsNil)
@@ -352,6 +435,38 @@ func (s *EngineSuite) ServerExpire(c *C) {
 		})
 }
 
+func (s *EngineSuite) ServerHeartbeat(c *C) {
+	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+	s.collectChanges(c, 1)
+
+	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000"}
+	bk := engine.BackendKey{Id: b.Id}
+	sk := engine.ServerKey{BackendKey: bk, Id: srv.Id}
+	c.Assert(s.Engine.HeartbeatServer(sk, 2*time.Second), FitsTypeOf, &engine.NotFoundError{})
+
+	c.Assert(s.Engine.UpsertServer(bk, srv, 2*time.Second), IsNil)
+	s.expectChanges(c, &engine.ServerUpserted{BackendKey: bk, Server: srv})
+
+	// Heartbeats keep the server alive past the original TTL without generating changes
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Second)
+		c.Assert(s.Engine.HeartbeatServer(sk, 2*time.Second), IsNil)
+	}
+	select {
+	case change := <-s.ChangesC:
+		c.Fatalf("unexpected change: %v", change)
+	default:
+	}
+	out, err := s.Engine.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &srv)
+
+	// The server expires once the heartbeats stop
+	s.expectChanges(c, &engine.ServerDeleted{ServerKey: sk})
+}
+
 func (s *EngineSuite) FrontendCRUD(c *C) {
 	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
 	c.Assert(s.Engine.UpsertBackend(b), IsNil)
@@ -437,6 +552,69 @@ func (s *EngineSuite) FrontendBadBackend(c *C) {
 		NotNil)
 }
 
+func (s *EngineSuite) FrontendSplitBackends(c *C) {
+	b0 := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	b1 := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.Engine.UpsertBackend(b0), IsNil)
+	c.Assert(s.Engine.UpsertBackend(b1), IsNil)
+
+	f := engine.Frontend{
+		Id:         "f1",
+		Route:      `Path("/hello")`,
+		BackendId:  b0.Id,
+		Backends:   []engine.FrontendBackend{{Id: b0.Id, Weight: 95}, {Id: b1.Id, Weight: 5}},
+		BackendPin: &engine.BackendPin{Cookie: "backend"},
+		Type:       engine.HTTP,
+		Settings:   engine.HTTPFrontendSettings{},
+	}
+	c.Assert(s.Engine.UpsertFrontend(f, 0), IsNil)
+	s.expectChanges(c,
+		&engine.BackendUpserted{Backend: b0},
+		&engine.BackendUpserted{Backend: b1},
+		&engine.FrontendUpserted{Frontend: f})
+
+	out, err := s.Engine.GetFrontend(f.Key())
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &f)
+
+	// None of the split backends can be deleted while in use
+	c.Assert(s.Engine.DeleteBackend(b0.Key()), NotNil)
+	c.Assert(s.Engine.DeleteBackend(b1.Key()), NotNil)
+
+	f.Backends = append(f.Backends, engine.FrontendBackend{Id: "Nonexistent", Weight: 1})
+	c.Assert(s.Engine.UpsertFrontend(f, 0), NotNil)
+}
+
+func (s *EngineSuite) FrontendFanOut(c *C) {
+	b0 := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	b1 := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.Engine.UpsertBackend(b0), IsNil)
+	c.Assert(s.Engine.UpsertBackend(b1), IsNil)
+
+	f := engine.Frontend{
+		Id:        "f1",
+		Route:     `Path("/hello")`,
+		BackendId: b0.Id,
+		Type:      engine.FanOut,
+		Settings: engine.FanOutFrontendSettings{
+			Branches: []engine.FanOutBranch{{BackendId: b0.Id, Key: "a", Timeout: "1s"}, {BackendId: b1.Id, Key: "b"}},
+			Merge:    engine.FanOutMergeJSON,
+		},
+	}
+	c.Assert(s.Engine.UpsertFrontend(f, 0), IsNil)
+	s.expectChanges(c,
+		&engine.BackendUpserted{Backend: b0},
+		&engine.BackendUpserted{Backend: b1},
+		&engine.FrontendUpserted{Frontend: f})
+
+	out, err := s.Engine.GetFrontend(f.Key())
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &f)
+
+	// None of the fanout backends can be deleted while in use
+	c.Assert(s.Engine.DeleteBackend(b1.Key()), NotNil)
+}
+
 func (s *EngineSuite) MiddlewareCRUD(c *C) {
 	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
 	c.Assert(s.Engine.UpsertBackend(b), IsNil)
@@ -536,3 +714,110 @@ func (s *EngineSuite) MiddlewareBadType(c *C) {
 	m.Type = "blabla"
 	c.Assert(s.Engine.UpsertMiddleware(fk, m, 0), NotNil)
 }
+
+func (s *EngineSuite) TransactionCommit(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	srv := engine.Server{Id: "s1", URL: "http://localhost:5000"}
+	f := engine.Frontend{
+		Id:        "f1",
+		Route:     `Path("/hello")`,
+		Type:      engine.HTTP,
+		BackendId: b.Id,
+		Settings:  engine.HTTPFrontendSettings{},
+	}
+
+	// Changes are applied in the dependency order regardless of the order in the transaction
+	tx := engine.Transaction{Changes: []interface{}{
+		&engine.FrontendUpserted{Frontend: f},
+		&engine.ServerUpserted{BackendKey: b.Key(), Server: srv},
+		&engine.BackendUpserted{Backend: b},
+	}}
+	c.Assert(s.Engine.Commit(tx), IsNil)
+	s.expectChanges(c, &engine.TransactionCommitted{Changes: []interface{}{
+		&engine.BackendUpserted{Backend: b},
+		&engine.ServerUpserted{BackendKey: b.Key(), Server: srv},
+		&engine.FrontendUpserted{Frontend: f},
+	}})
+
+	out, err := s.Engine.GetFrontend(f.Key())
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &f)
+
+	tx = engine.Transaction{Changes: []interface{}{
+		&engine.BackendDeleted{BackendKey: b.Key()},
+		&engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: b.Key(), Id: srv.Id}},
+		&engine.FrontendDeleted{FrontendKey: f.Key()},
+	}}
+	c.Assert(s.Engine.Commit(tx), IsNil)
+	s.expectChanges(c, &engine.TransactionCommitted{Changes: []interface{}{
+		&engine.FrontendDeleted{FrontendKey: f.Key()},
+		&engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: b.Key(), Id: srv.Id}},
+		&engine.BackendDeleted{BackendKey: b.Key()},
+	}})
+
+	_, err = s.Engine.GetBackend(b.Key())
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *EngineSuite) TransactionRollback(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	f := engine.Frontend{
+		Id:        "f1",
+		Route:     `Path("/hello")`,
+		Type:      engine.HTTP,
+		BackendId: "missing",
+		Settings:  engine.HTTPFrontendSettings{},
+	}
+
+	// Frontend references a missing backend, so none of the changes should be applied
+	tx := engine.Transaction{Changes: []interface{}{
+		&engine.BackendUpserted{Backend: b},
+		&engine.FrontendUpserted{Frontend: f},
+	}}
+	c.Assert(s.Engine.Commit(tx), FitsTypeOf, &engine.NotFoundError{})
+
+	_, err := s.Engine.GetBackend(b.Key())
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	c.Assert(s.Engine.Commit(engine.Transaction{}), NotNil)
+}
+
+func (s *EngineSuite) History(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+	f := engine.Frontend{
+		Id:        "f1",
+		Route:     `Path("/v1")`,
+		Type:      engine.HTTP,
+		BackendId: b.Id,
+		Settings:  engine.HTTPFrontendSettings{},
+	}
+	c.Assert(s.Engine.UpsertFrontend(f, 0), IsNil)
+	updated := f
+	updated.Route = `Path("/v2")`
+	c.Assert(s.Engine.UpsertFrontend(updated, 0), IsNil)
+	c.Assert(s.Engine.DeleteFrontend(f.Key()), IsNil)
+	s.collectChanges(c, 4)
+
+	revisions, err := s.Engine.GetHistory(engine.HistoryQuery{Key: f.Key()})
+	c.Assert(err, IsNil)
+	c.Assert(len(revisions), Equals, 3)
+	c.Assert(revisions[0].Change, DeepEquals, &engine.FrontendUpserted{Frontend: f})
+	c.Assert(revisions[1].Change, DeepEquals, &engine.FrontendUpserted{Frontend: updated})
+	c.Assert(revisions[2].Change, DeepEquals, &engine.FrontendDeleted{FrontendKey: f.Key()})
+
+	last, err := s.Engine.GetHistory(engine.HistoryQuery{Limit: 1})
+	c.Assert(err, IsNil)
+	c.Assert(last, DeepEquals, revisions[2:])
+
+	// The frontend is restored as it was before the update
+	snapshot, err := s.Engine.GetSnapshotAt(revisions[0].Index)
+	c.Assert(err, IsNil)
+	c.Assert(len(snapshot.FrontendSpecs), Equals, 1)
+	c.Assert(snapshot.FrontendSpecs[0].Frontend, DeepEquals, f)
+	c.Assert(len(snapshot.BackendSpecs), Equals, 1)
+
+	snapshot, err = s.Engine.GetSnapshotAt(revisions[2].Index)
+	c.Assert(err, IsNil)
+	c.Assert(len(snapshot.FrontendSpecs), Equals, 0)
+}
@@ -1,8 +1,14 @@
 package engine
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"strings"
 )
 
 // TLSSettings is a JSON and API friendly version of some of the tls.Config parameters
@@ -36,6 +42,22 @@ type TLSSettings struct {
 	// TLS_RSA_WITH_AES_256_CBC_SHA
 	// TLS_RSA_WITH_AES_128_CBC_SHA
 	CipherSuites []string
+
+	// The settings below are supported by backends only.
+
+	// KeyPair is the client certificate presented to the servers, it is sealed when stored
+	KeyPair *KeyPair `json:",omitempty"`
+
+	// RootCAs is the PEM bundle of the CAs server certificates are verified against instead of the system ones
+	RootCAs []byte `json:",omitempty"`
+
+	// ServerName overrides the server name sent in SNI and verified in server certificates, the host of the
+	// server URL by default
+	ServerName string `json:",omitempty"`
+
+	// PinnedSPKI are the base64 encoded SHA-256 hashes of the subject public key info, one of which
+	// the verified certificate chains of the servers have to have, or the leaf certificates if verification is skipped
+	PinnedSPKI []string `json:",omitempty"`
 }
 
 // TLSSessionCache sets up parameters for TLS session cache
@@ -102,7 +124,7 @@ func NewTLSConfig(s *TLSSettings) (*tls.Config, error) {
 		}
 	}
 
-	return &tls.Config{
+	config := &tls.Config{
 		MinVersion: min,
 		MaxVersion: max,
 
@@ -113,7 +135,75 @@ func NewTLSConfig(s *TLSSettings) (*tls.Config, error) {
 		CipherSuites:             css,
 
 		InsecureSkipVerify: s.InsecureSkipVerify,
-	}, nil
+		ServerName:         s.ServerName,
+	}
+
+	if s.KeyPair != nil {
+		if s.KeyPair.Ref != "" {
+			return nil, fmt.Errorf("TLS key pairs can not be references")
+		}
+		cert, err := tls.X509KeyPair(s.KeyPair.Cert, s.KeyPair.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS key pair: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(s.RootCAs) != 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(s.RootCAs) {
+			return nil, fmt.Errorf("root CAs should be a PEM bundle of certificates")
+		}
+	}
+
+	if len(s.PinnedSPKI) != 0 {
+		pins, err := parseSPKIPins(s.PinnedSPKI)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyConnection = pins.verify
+	}
+
+	return config, nil
+}
+
+// spkiPins are the SHA-256 hashes of the pinned subject public key infos
+type spkiPins map[[sha256.Size]byte]bool
+
+func parseSPKIPins(in []string) (spkiPins, error) {
+	pins := spkiPins{}
+	for _, pin := range in {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("SPKI pin %q should be a base64 encoded SHA-256 hash", pin)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], hash)
+		pins[key] = true
+	}
+	return pins, nil
+}
+
+// verify fails the handshakes with the servers none of whose verified certificates has a pinned public key. If
+// the certificates are not verified, only the leaf certificate the server has proven to own is checked.
+func (p spkiPins) verify(cs tls.ConnectionState) error {
+	chains := cs.VerifiedChains
+	if len(chains) == 0 && len(cs.PeerCertificates) != 0 {
+		chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if p[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no pinned public key in the certificates of %v", cs.ServerName)
+}
+
+// BackendOnly returns true if any of the settings only backends support is set
+func (s *TLSSettings) BackendOnly() bool {
+	return s.KeyPair != nil || len(s.RootCAs) != 0 || s.ServerName != "" || len(s.PinnedSPKI) != 0
 }
 
 // NewTLSSessionCache validates parameters and creates a new TLS session cache
@@ -217,6 +307,21 @@ func (s *TLSSettings) Equals(other *TLSSettings) bool {
 		return false
 	}
 
+	if (s.KeyPair == nil) != (other.KeyPair == nil) || (s.KeyPair != nil && !s.KeyPair.Equals(other.KeyPair)) {
+		return false
+	}
+	if !bytes.Equal(s.RootCAs, other.RootCAs) || s.ServerName != other.ServerName {
+		return false
+	}
+	if len(s.PinnedSPKI) != len(other.PinnedSPKI) {
+		return false
+	}
+	for i := range s.PinnedSPKI {
+		if s.PinnedSPKI[i] != other.PinnedSPKI[i] {
+			return false
+		}
+	}
+
 	return true
 }
 
@@ -241,3 +346,96 @@ func (c *TLSSessionCache) Equals(o *TLSSessionCache) bool {
 
 	return cs.Capacity == os.Capacity
 }
+
+// ClientAuthSettings sets up the authentication of clients by their certificates on https listeners and hosts
+type ClientAuthSettings struct {
+	// Type is "none", "request" to verify the certificates clients send, or "require" to reject clients sending none
+	Type string
+	// CA is the PEM bundle of the certificate authorities client certificates are verified against
+	CA []byte `json:",omitempty"`
+	// CRL is the optional path to the local PEM or DER certificate revocation list, the proxy reads it again
+	// when it changes
+	CRL string `json:",omitempty"`
+	// Headers are the names of the request headers the verified client certificate is passed to backends in
+	Headers ClientCertHeaders
+}
+
+// ClientCertHeaders are the names of the headers carrying the verified client certificate, empty names are defaulted
+type ClientCertHeaders struct {
+	Subject     string `json:",omitempty"`
+	SANs        string `json:",omitempty"`
+	Fingerprint string `json:",omitempty"`
+}
+
+// Client authentication types
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// Default names of the headers carrying the verified client certificate
+const (
+	DefaultClientCertSubjectHeader     = "X-Client-Cert-Subject"
+	DefaultClientCertSANsHeader        = "X-Client-Cert-Sans"
+	DefaultClientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// ClientAuth are the parsed client authentication settings
+type ClientAuth struct {
+	Type    tls.ClientAuthType
+	CAs     *x509.CertPool
+	CRL     string
+	Headers ClientCertHeaders
+}
+
+// Parse validates the settings and returns them with the defaults applied
+func (c *ClientAuthSettings) Parse() (*ClientAuth, error) {
+	out := &ClientAuth{CRL: c.CRL}
+	switch c.Type {
+	case ClientAuthNone:
+		out.Type = tls.NoClientCert
+	case ClientAuthRequest:
+		out.Type = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		out.Type = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unsupported client auth type %q, use none, request or require", c.Type)
+	}
+	if out.Type != tls.NoClientCert {
+		out.CAs = x509.NewCertPool()
+		if !out.CAs.AppendCertsFromPEM(c.CA) {
+			return nil, fmt.Errorf("client auth %q needs a PEM bundle of CA certificates", c.Type)
+		}
+	}
+	headers := []struct {
+		name *string
+		def  string
+		out  *string
+	}{
+		{&c.Headers.Subject, DefaultClientCertSubjectHeader, &out.Headers.Subject},
+		{&c.Headers.SANs, DefaultClientCertSANsHeader, &out.Headers.SANs},
+		{&c.Headers.Fingerprint, DefaultClientCertFingerprintHeader, &out.Headers.Fingerprint},
+	}
+	for _, h := range headers {
+		if *h.name == "" {
+			*h.out = h.def
+			continue
+		}
+		if strings.ContainsAny(*h.name, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid client certificate header %q", *h.name)
+		}
+		*h.out = http.CanonicalHeaderKey(*h.name)
+	}
+	return out, nil
+}
+
+func (c *ClientAuthSettings) Equals(o *ClientAuthSettings) bool {
+	if c == nil || o == nil {
+		return c == o
+	}
+	return c.Type == o.Type &&
+		bytes.Equal(c.CA, o.CA) &&
+		c.CRL == o.CRL &&
+		c.Headers == o.Headers
+}
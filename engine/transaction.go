@@ -0,0 +1,315 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Transaction is a batch of upserts and deletes that is applied atomically: either all changes are applied or none.
+// Changes are expressed with the events from events.go, e.g. &BackendUpserted{...} or &FrontendDeleted{...},
+// TTLs are not supported for the objects created by transactions.
+type Transaction struct {
+	Changes []interface{}
+}
+
+// Ordered returns the changes ordered so that objects are created before the objects referencing them
+// and deleted after them: upserts of hosts, listeners, backends, servers, frontends and middlewares go first,
+// deletes follow in the reverse order. Changes of the same kind keep their relative order. A delete followed by
+// an upsert of the same object is dropped, so that the object is replaced rather than deleted in the end.
+func (tx Transaction) Ordered() []interface{} {
+	lastUpserts := map[interface{}]int{}
+	for i, ch := range tx.Changes {
+		if _, upsert := changeKind(ch); upsert {
+			lastUpserts[changeKey(ch)] = i
+		}
+	}
+	var upserts, deletes [len(changeKinds)][]interface{}
+	for i, ch := range tx.Changes {
+		kind, upsert := changeKind(ch)
+		if kind < 0 {
+			continue
+		}
+		if j, ok := lastUpserts[changeKey(ch)]; !upsert && ok && j > i {
+			continue
+		}
+		if upsert {
+			upserts[kind] = append(upserts[kind], ch)
+		} else {
+			deletes[kind] = append(deletes[kind], ch)
+		}
+	}
+	out := make([]interface{}, 0, len(tx.Changes))
+	for _, chs := range upserts {
+		out = append(out, chs...)
+	}
+	for i := len(deletes) - 1; i >= 0; i-- {
+		out = append(out, deletes[i]...)
+	}
+	return out
+}
+
+// Check validates the transaction against the configuration snapshot. Ordered changes are applied one by one
+// to make sure that all referenced objects exist, deleted objects exist and backends are not deleted while in use.
+func (tx Transaction) Check(s *Snapshot) error {
+	if len(tx.Changes) == 0 {
+		return &InvalidFormatError{Message: "transaction has no changes"}
+	}
+	hosts := map[HostKey]bool{}
+	for _, h := range s.Hosts {
+		hosts[h.Key()] = true
+	}
+	listeners := map[ListenerKey]bool{}
+	for _, l := range s.Listeners {
+		listeners[l.Key()] = true
+	}
+	backends := map[BackendKey]bool{}
+	servers := map[ServerKey]bool{}
+	for _, bs := range s.BackendSpecs {
+		backends[bs.Backend.Key()] = true
+		for _, srv := range bs.Servers {
+			servers[ServerKey{BackendKey: bs.Backend.Key(), Id: srv.Id}] = true
+		}
+	}
+	frontends := map[FrontendKey]Frontend{}
+	middlewares := map[MiddlewareKey]bool{}
+	for _, fs := range s.FrontendSpecs {
+		frontends[fs.Frontend.Key()] = fs.Frontend
+		for _, m := range fs.Middlewares {
+			middlewares[MiddlewareKey{FrontendKey: fs.Frontend.Key(), Id: m.Id}] = true
+		}
+	}
+
+	for _, change := range tx.Changes {
+		if kind, _ := changeKind(change); kind < 0 {
+			return &InvalidFormatError{Message: fmt.Sprintf("unsupported change: %#v", change)}
+		}
+	}
+
+	for _, change := range tx.Ordered() {
+		switch ch := change.(type) {
+		case *HostUpserted:
+			if ch.Host.Name == "" {
+				return &InvalidFormatError{Message: "hostname can not be empty"}
+			}
+			hosts[ch.Host.Key()] = true
+		case *HostDeleted:
+			if !hosts[ch.HostKey] {
+				return &NotFoundError{Message: fmt.Sprintf("%v not found", ch.HostKey)}
+			}
+			delete(hosts, ch.HostKey)
+
+		case *ListenerUpserted:
+			if ch.Listener.Id == "" {
+				return &InvalidFormatError{Message: "listener id can not be empty"}
+			}
+			listeners[ch.Listener.Key()] = true
+		case *ListenerDeleted:
+			if !listeners[ch.ListenerKey] {
+				return &NotFoundError{Message: fmt.Sprintf("%v not found", ch.ListenerKey)}
+			}
+			delete(listeners, ch.ListenerKey)
+
+		case *BackendUpserted:
+			if ch.Backend.Id == "" {
+				return &InvalidFormatError{Message: "backend id can not be empty"}
+			}
+			backends[ch.Backend.Key()] = true
+		case *BackendDeleted:
+			if !backends[ch.BackendKey] {
+				return &NotFoundError{Message: fmt.Sprintf("%v not found", ch.BackendKey)}
+			}
+			for fk, f := range frontends {
+				if f.UsesBackend(ch.BackendKey) {
+					return fmt.Errorf("can not delete backend '%v', it is in use by %v", ch.BackendKey, fk)
+				}
+			}
+			delete(backends, ch.BackendKey)
+			for sk := range servers {
+				if sk.BackendKey == ch.BackendKey {
+					delete(servers, sk)
+				}
+			}
+
+		case *ServerUpserted:
+			if ch.BackendKey.Id == "" || ch.Server.Id == "" {
+				return &InvalidFormatError{Message: "backend id and server id can not be empty"}
+			}
+			if !backends[ch.BackendKey] {
+				return &NotFoundError{Message: fmt.Sprintf("%v not found", ch.BackendKey)}
+			}
+			servers[ServerKey{BackendKey: ch.BackendKey, Id: ch.Server.Id}] = true
+		case *ServerDeleted:
+			if !servers[ch.ServerKey] {
+				return &NotFoundError{Message: fmt.Sprintf("%v not found", ch.ServerKey)}
+			}
+			delete(servers, ch.ServerKey)
+
+		case *FrontendUpserted:
+			if ch.Frontend.Id == "" {
+				return &InvalidFormatError{Message: "frontend id can not be empty"}
+			}
+			for _, bk := range ch.Frontend.BackendKeys() {
+				if !backends[bk] {
+					return &NotFoundError{Message: fmt.Sprintf("backend: %v not found", bk.Id)}
+				}
+			}
+			frontends[ch.Frontend.Key()] = ch.Frontend
+		case *FrontendDeleted:
+			if _, ok := frontends[ch.FrontendKey]; !ok {
+				return &NotFoundError{Message: fmt.Sprintf("%v not found", ch.FrontendKey)}
+			}
+			delete(frontends, ch.FrontendKey)
+			for mk := range middlewares {
+				if mk.FrontendKey == ch.FrontendKey {
+					delete(middlewares, mk)
+				}
+			}
+
+		case *MiddlewareUpserted:
+			if ch.FrontendKey.Id == "" || ch.Middleware.Id == "" {
+				return &InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+			}
+			if _, ok := frontends[ch.FrontendKey]; !ok {
+				return &NotFoundError{Message: fmt.Sprintf("%v not found", ch.FrontendKey)}
+			}
+			middlewares[MiddlewareKey{FrontendKey: ch.FrontendKey, Id: ch.Middleware.Id}] = true
+		case *MiddlewareDeleted:
+			if !middlewares[ch.MiddlewareKey] {
+				return &NotFoundError{Message: fmt.Sprintf("%v not found", ch.MiddlewareKey)}
+			}
+			delete(middlewares, ch.MiddlewareKey)
+		}
+	}
+	return nil
+}
+
+func (tx Transaction) String() string {
+	return fmt.Sprintf("Transaction(changes=%v)", tx.Changes)
+}
+
+// MarshalJSON encodes the transaction in the format accepted by TransactionFromJSON
+func (tx Transaction) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Changes []txChange
+	}{}
+	for _, change := range tx.Changes {
+		var c txChange
+		switch ch := change.(type) {
+		case *HostUpserted:
+			c = txChange{Op: OpUpsert, Host: ch.Host}
+		case *HostDeleted:
+			c = txChange{Op: OpDelete, Host: ch.HostKey}
+		case *ListenerUpserted:
+			c = txChange{Op: OpUpsert, Listener: ch.Listener}
+		case *ListenerDeleted:
+			c = txChange{Op: OpDelete, Listener: ch.ListenerKey}
+		case *BackendUpserted:
+			c = txChange{Op: OpUpsert, Backend: ch.Backend}
+		case *BackendDeleted:
+			c = txChange{Op: OpDelete, Backend: ch.BackendKey}
+		case *ServerUpserted:
+			c = txChange{Op: OpUpsert, BackendId: ch.BackendKey.Id, Server: ch.Server}
+		case *ServerDeleted:
+			c = txChange{Op: OpDelete, BackendId: ch.ServerKey.BackendKey.Id, Server: objectKey{Id: ch.ServerKey.Id}}
+		case *FrontendUpserted:
+			c = txChange{Op: OpUpsert, Frontend: ch.Frontend}
+		case *FrontendDeleted:
+			c = txChange{Op: OpDelete, Frontend: ch.FrontendKey}
+		case *MiddlewareUpserted:
+			c = txChange{Op: OpUpsert, FrontendId: ch.FrontendKey.Id, Middleware: ch.Middleware}
+		case *MiddlewareDeleted:
+			c = txChange{Op: OpDelete, FrontendId: ch.MiddlewareKey.FrontendKey.Id, Middleware: objectKey{Id: ch.MiddlewareKey.Id}}
+		default:
+			return nil, fmt.Errorf("unsupported change: %#v", change)
+		}
+		out.Changes = append(out.Changes, c)
+	}
+	return json.Marshal(out)
+}
+
+// txChange is a JSON representation of a single transaction change, exactly one of the object fields is set.
+// Upserts carry the complete object, deletes only the object key.
+type txChange struct {
+	Op         string
+	Host       interface{} `json:",omitempty"`
+	Listener   interface{} `json:",omitempty"`
+	Backend    interface{} `json:",omitempty"`
+	BackendId  string      `json:",omitempty"`
+	Server     interface{} `json:",omitempty"`
+	Frontend   interface{} `json:",omitempty"`
+	FrontendId string      `json:",omitempty"`
+	Middleware interface{} `json:",omitempty"`
+}
+
+type objectKey struct {
+	Id string
+}
+
+// changeKind returns the dependency rank of the change and whether it is an upsert, rank is -1 for unsupported changes
+func changeKind(ch interface{}) (int, bool) {
+	switch ch.(type) {
+	case *HostUpserted:
+		return 0, true
+	case *HostDeleted:
+		return 0, false
+	case *ListenerUpserted:
+		return 1, true
+	case *ListenerDeleted:
+		return 1, false
+	case *BackendUpserted:
+		return 2, true
+	case *BackendDeleted:
+		return 2, false
+	case *ServerUpserted:
+		return 3, true
+	case *ServerDeleted:
+		return 3, false
+	case *FrontendUpserted:
+		return 4, true
+	case *FrontendDeleted:
+		return 4, false
+	case *MiddlewareUpserted:
+		return 5, true
+	case *MiddlewareDeleted:
+		return 5, false
+	}
+	return -1, false
+}
+
+// changeKey returns the key of the object the change is about, nil for unsupported changes
+func changeKey(ch interface{}) interface{} {
+	switch ch := ch.(type) {
+	case *HostUpserted:
+		return ch.Host.Key()
+	case *HostDeleted:
+		return ch.HostKey
+	case *ListenerUpserted:
+		return ch.Listener.Key()
+	case *ListenerDeleted:
+		return ch.ListenerKey
+	case *BackendUpserted:
+		return ch.Backend.Key()
+	case *BackendDeleted:
+		return ch.BackendKey
+	case *ServerUpserted:
+		return ServerKey{BackendKey: ch.BackendKey, Id: ch.Server.Id}
+	case *ServerDeleted:
+		return ch.ServerKey
+	case *FrontendUpserted:
+		return ch.Frontend.Key()
+	case *FrontendDeleted:
+		return ch.FrontendKey
+	case *MiddlewareUpserted:
+		return MiddlewareKey{FrontendKey: ch.FrontendKey, Id: ch.Middleware.Id}
+	case *MiddlewareDeleted:
+		return ch.MiddlewareKey
+	}
+	return nil
+}
+
+var changeKinds = [...]string{"host", "listener", "backend", "server", "frontend", "middleware"}
+
+const (
+	OpUpsert = "upsert"
+	OpDelete = "delete"
+)
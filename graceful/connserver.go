@@ -0,0 +1,112 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ConnServer serves raw connections accepted by a graceful listener, e.g. the
+// ones of TCP proxies. When closed it stops accepting new connections, but
+// unlike Server it does not wait for the connections being served: just like
+// hijacked HTTP connections they are left to the handler.
+type ConnServer struct {
+	listener     *Listener
+	handler      func(net.Conn)
+	stateHandler StateHandler
+	shutdown     chan bool
+}
+
+// NewConnServer creates a ConnServer passing the connections accepted by the
+// listener to the handler, each one in its own goroutine. The state handler
+// is notified of the connections being served as if they were HTTP ones.
+func NewConnServer(listener net.Listener, handler func(net.Conn), stateHandler StateHandler) *ConnServer {
+	g, ok := listener.(*Listener)
+	if !ok {
+		g = NewListener(listener)
+	}
+	return &ConnServer{
+		listener:     g,
+		handler:      handler,
+		stateHandler: stateHandler,
+		shutdown:     make(chan bool),
+	}
+}
+
+// Close stops the server from accepting new connections. It returns true if
+// it's the first time Close is called.
+func (cs *ConnServer) Close() bool {
+	return <-cs.shutdown
+}
+
+// ListenAndServe accepts connections until the server is closed.
+func (cs *ConnServer) ListenAndServe() error {
+	go func() {
+		cs.shutdown <- true
+		close(cs.shutdown)
+		cs.listener.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := cs.listener.Accept()
+		if err != nil {
+			if cs.listener.isClosed() {
+				return nil
+			}
+			// Back off on temporary errors, e.g. running out of file
+			// descriptors, the same way net/http.Server does.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go cs.serve(conn)
+	}
+}
+
+func (cs *ConnServer) serve(conn net.Conn) {
+	serveConn(conn, cs.handler, cs.stateHandler)
+}
+
+// serveConn passes the connection to the handler, the state handler is
+// notified of it as if it was an HTTP connection.
+func serveConn(conn net.Conn, handler func(net.Conn), stateHandler StateHandler) {
+	setState := func(prev, cur http.ConnState) {
+		if stateHandler != nil {
+			stateHandler(conn, prev, cur)
+		}
+	}
+	setState(http.StateNew, http.StateNew)
+	setState(http.StateNew, http.StateActive)
+	defer setState(http.StateActive, http.StateClosed)
+	handler(conn)
+}
+
+// GetFile returns a duplicate of the listener file descriptor.
+func (cs *ConnServer) GetFile() (*os.File, error) {
+	return cs.listener.GetFile()
+}
+
+// HijackListener returns a new server with the same handlers that accepts
+// connections from a clone of the server listener mutated by fn.
+func (cs *ConnServer) HijackListener(fn ListenerMutateFunc) (*ConnServer, error) {
+	listener, err := cs.listener.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if fn != nil {
+		if listener, err = fn(listener); err != nil {
+			return nil, err
+		}
+	}
+	return NewConnServer(listener, cs.handler, cs.stateHandler), nil
+}
@@ -156,6 +156,8 @@ func getListenerFile(listener net.Listener) (*os.File, error) {
 		return getListenerFile(t.Listener)
 	case *TLSListener:
 		return getListenerFile(t.Listener)
+	case *SNIListener:
+		return getListenerFile(t.Listener)
 	}
 	return nil, fmt.Errorf("Unsupported listener: %T", listener)
 }
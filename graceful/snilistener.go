@@ -0,0 +1,208 @@
+package graceful
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// SNIRouteFunc returns the handler of the TLS connections to the server name
+// that are passed through as they are, or nil if they are terminated.
+type SNIRouteFunc func(serverName string) func(net.Conn)
+
+// SNIListener accepts TLS connections like TLSListener, except for the ones
+// the route function has a handler for: those are passed to the handler with
+// the ClientHello unread and are never returned by Accept. ClientHellos are
+// read in the background, so slow clients do not hold up others.
+type SNIListener struct {
+	net.Listener
+	config       *tls.Config
+	route        SNIRouteFunc
+	stateHandler StateHandler
+	// helloTimeout limits the time clients have to send the ClientHello, it
+	// is not limited if 0.
+	helloTimeout time.Duration
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	accepted  chan acceptResult
+	closed    chan struct{}
+
+	mu sync.Mutex
+	// hellos are the connections whose ClientHello is being read, it is nil
+	// once the listener is closed.
+	hellos map[net.Conn]struct{}
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// NewSNIListener creates a listener routing the TLS connections accepted by
+// the inner listener by the server name. The state handler is notified of the
+// connections that are passed through.
+func NewSNIListener(inner net.Listener, config *tls.Config, route SNIRouteFunc,
+	stateHandler StateHandler, helloTimeout time.Duration,
+) *SNIListener {
+	return &SNIListener{
+		Listener:     inner,
+		config:       config,
+		route:        route,
+		stateHandler: stateHandler,
+		helloTimeout: helloTimeout,
+		accepted:     make(chan acceptResult),
+		closed:       make(chan struct{}),
+		hellos:       make(map[net.Conn]struct{}),
+	}
+}
+
+// Accept waits for and returns the next TLS connection to terminate, the
+// returned connection is a *tls.Conn.
+func (l *SNIListener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() { go l.acceptLoop() })
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case <-l.closed:
+		return nil, errors.New("listener is closed")
+	}
+}
+
+// Close closes the inner listener. Connections whose ClientHello is being
+// read are closed too.
+func (l *SNIListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.mu.Lock()
+		for conn := range l.hellos {
+			conn.Close()
+		}
+		l.hellos = nil
+		l.mu.Unlock()
+	})
+	return l.Listener.Close()
+}
+
+// trackHello adds the connection to the ones whose ClientHello is being
+// read, it returns false if the listener is closed.
+func (l *SNIListener) trackHello(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.hellos == nil {
+		return false
+	}
+	l.hellos[conn] = struct{}{}
+	return true
+}
+
+// untrackHello removes the connection once its ClientHello is read, it
+// returns false if the listener has been closed in the meantime.
+func (l *SNIListener) untrackHello(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.hellos == nil {
+		return false
+	}
+	delete(l.hellos, conn)
+	return true
+}
+
+func (l *SNIListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.accepted <- acceptResult{err: err}:
+			case <-l.closed:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.routeConn(conn)
+	}
+}
+
+func (l *SNIListener) routeConn(raw net.Conn) {
+	if !l.trackHello(raw) {
+		raw.Close()
+		return
+	}
+	if l.helloTimeout != 0 {
+		raw.SetReadDeadline(time.Now().Add(l.helloTimeout))
+	}
+	serverName, conn := peekServerName(raw)
+	if !l.untrackHello(raw) {
+		// Close has closed the connection already.
+		return
+	}
+	if l.helloTimeout != 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	if handler := l.route(serverName); handler != nil {
+		serveConn(conn, handler, l.stateHandler)
+		return
+	}
+	select {
+	case l.accepted <- acceptResult{conn: tls.Server(conn, l.config)}:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// errHelloRead stops the handshake peekServerName uses to parse the
+// ClientHello.
+var errHelloRead = errors.New("ClientHello read")
+
+// peekServerName returns the server name of the ClientHello sent over the
+// connection, empty if there is none or if the client has not sent a valid
+// one, and a connection that replays the data read.
+func peekServerName(conn net.Conn) (string, net.Conn) {
+	var hello bytes.Buffer
+	var serverName string
+	tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	return serverName, &peekedConn{Conn: conn, r: io.MultiReader(&hello, conn)}
+}
+
+// helloConn is the read-only connection the ClientHello is parsed from, the
+// alert of the stopped handshake is not sent.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c helloConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                { return nil }
+
+// peekedConn reads the data peeked from the connection first.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite half-closes the connection if it supports that.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
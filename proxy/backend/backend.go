@@ -6,22 +6,45 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/proxy"
+	"golang.org/x/net/http2"
 )
 
 // T represents a backend type. It maintains a list of backend servers and
 // returns them via Snapshot() functions.
 type T struct {
-	mu          sync.Mutex
-	id          string
-	httpCfg     engine.HTTPBackendSettings
-	httpTp      *http.Transport
+	mu sync.Mutex
+	id string
+	// typ is the backend type, engine.HTTP or engine.TCP.
+	typ     string
+	httpCfg engine.HTTPBackendSettings
+	httpTp  *http.Transport
+	// h2Tp sends the requests of httpTp to h2 and h2c backends, it is nil
+	// for HTTP/1.1 ones.
+	h2Tp        *http2.Transport
 	srvCfgsSeen bool
 	srvs        []Srv
+	// hcCfg is nil if health checks are disabled.
+	hcCfg   *engine.HealthCheckSettings
+	checker *healthChecker
+	// health is the health check state of the servers by server id.
+	health map[string]*srvHealth
+	// odCfg is nil if outlier detection is disabled.
+	odCfg         *engine.OutlierDetectionSettings
+	nextDetection time.Time
+	// ejections is the outlier detection state of the servers by server id.
+	ejections      map[string]*srvEjection
+	ejectionEvents []engine.OutlierEjection
+	// healthGen is incremented every time a server becomes healthy or
+	// unhealthy, or is ejected or returned by outlier detection. It is
+	// accessed atomically.
+	healthGen int64
 }
 
 // Srv represents a backend server instance.
@@ -29,13 +52,15 @@ type Srv struct {
 	id        string
 	rawURL    string
 	parsedURL *url.URL
+	weight    int
 }
 
 // Cfg returns engine.Server config of the backend server instance.
 func (s *Srv) Cfg() engine.Server {
 	return engine.Server{
-		Id:  s.id,
-		URL: s.rawURL,
+		Id:     s.id,
+		URL:    s.rawURL,
+		Weight: s.weight,
 	}
 }
 
@@ -61,6 +86,7 @@ func NewServer(beSrvCfg engine.Server) (Srv, error) {
 		id:        beSrvCfg.Id,
 		rawURL:    beSrvCfg.URL,
 		parsedURL: parsedURL,
+		weight:    beSrvCfg.Weight,
 	}, nil
 }
 
@@ -69,6 +95,12 @@ func (s *Srv) URL() *url.URL {
 	return s.parsedURL
 }
 
+// Weight returns the load balancer weight of the backend server, 0 means the
+// default weight.
+func (s *Srv) Weight() int {
+	return s.weight
+}
+
 // URLKey returns the backend server SrvURLKey to be used as a key in maps.
 func (s *Srv) URLKey() SrvURLKey {
 	return NewSrvURLKey(s.parsedURL)
@@ -81,12 +113,30 @@ func New(beCfg engine.Backend, opts proxy.Options, beSrvs []Srv) (*T, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "bad config")
 	}
-	return &T{
-		id:      beCfg.Id,
-		httpCfg: beCfg.HTTPSettings(),
-		httpTp:  newTransport(tpCfg),
-		srvs:    beSrvs,
-	}, nil
+	httpCfg := beCfg.HTTPSettings()
+	hcCfg, err := httpCfg.HealthCheckSettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "bad health check config")
+	}
+	odCfg, err := httpCfg.OutlierDetectionSettings()
+	if err != nil {
+		return nil, errors.Wrap(err, "bad outlier detection config")
+	}
+	httpTp, h2Tp := newTransport(tpCfg)
+	be := &T{
+		id:        beCfg.Id,
+		typ:       beCfg.Type,
+		httpCfg:   httpCfg,
+		httpTp:    httpTp,
+		h2Tp:      h2Tp,
+		srvs:      beSrvs,
+		hcCfg:     hcCfg,
+		health:    make(map[string]*srvHealth),
+		odCfg:     odCfg,
+		ejections: make(map[string]*srvEjection),
+	}
+	be.startHealthChecks()
+	return be, nil
 }
 
 // Key returns storage backend key.
@@ -94,15 +144,32 @@ func (be *T) Key() engine.BackendKey {
 	return engine.BackendKey{Id: be.id}
 }
 
+// Type returns the backend type, engine.HTTP or engine.TCP.
+func (be *T) Type() string {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	return be.typ
+}
+
+// Cfg returns the backend storage config.
+func (be *T) Cfg() engine.Backend {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	return engine.Backend{Id: be.id, Type: be.typ, Settings: be.httpCfg}
+}
+
 // String returns string backend representation to be used in logs.
 func (be *T) String() string {
 	return fmt.Sprintf("backend(%v)", &be.id)
 }
 
-// Close closes all idle connections to backends.
+// Close stops health checks and closes all idle connections to backends.
 func (be *T) Close() error {
+	be.StopHealthChecks()
 	// FIXME should not we close all connections here?
-	be.httpTp.CloseIdleConnections()
+	be.closeIdleConnections()
 	return nil
 }
 
@@ -115,22 +182,54 @@ func (be *T) Update(beCfg engine.Backend, opts proxy.Options) (bool, error) {
 		return false, errors.Errorf("invalid key, want=%v, got=%v", be.Key(), beCfg.Key())
 	}
 
-	// Config has not changed.
-	if be.httpCfg.Equals(beCfg.HTTPSettings()) {
+	// Config has not changed, backends without a type are http ones.
+	if (be.typ == engine.TCP) == (beCfg.Type == engine.TCP) && be.httpCfg.Equals(beCfg.HTTPSettings()) {
 		return false, nil
 	}
+	be.typ = beCfg.Type
 
-	tpCfg, err := newTransportCfg(beCfg.HTTPSettings(), opts)
-	if err != nil {
-		return false, errors.Wrap(err, "bad config")
+	httpCfg := beCfg.HTTPSettings()
+	if !be.httpCfg.HealthCheckEquals(httpCfg) {
+		hcCfg, err := httpCfg.HealthCheckSettings()
+		if err != nil {
+			return false, errors.Wrap(err, "bad health check config")
+		}
+		// The stopped checker exits on its own, waiting for it here would
+		// block the checks in progress that need the lock.
+		be.stopHealthChecks()
+		be.hcCfg = hcCfg
+		be.health = make(map[string]*srvHealth)
+		atomic.AddInt64(&be.healthGen, 1)
+		be.startHealthChecks()
 	}
 
-	// FIXME: But what about active connections?
-	be.httpTp.CloseIdleConnections()
+	if !be.httpCfg.OutlierDetectionEquals(httpCfg) {
+		odCfg, err := httpCfg.OutlierDetectionSettings()
+		if err != nil {
+			return false, errors.Wrap(err, "bad outlier detection config")
+		}
+		// Ejected servers are returned right away, the detection starts
+		// over with the new settings.
+		be.odCfg = odCfg
+		be.nextDetection = time.Time{}
+		be.ejections = make(map[string]*srvEjection)
+		atomic.AddInt64(&be.healthGen, 1)
+	}
+
+	// Keep the transport if only the load balancer, the health check or the
+	// outlier detection have changed, so that requests in flight complete over their connections.
+	if !be.httpCfg.TransportEquals(httpCfg) {
+		tpCfg, err := newTransportCfg(httpCfg, opts)
+		if err != nil {
+			return false, errors.Wrap(err, "bad config")
+		}
 
-	be.httpCfg = beCfg.HTTPSettings()
-	httpTp := newTransport(tpCfg)
-	be.httpTp = httpTp
+		// FIXME: But what about active connections?
+		be.closeIdleConnections()
+		be.httpTp, be.h2Tp = newTransport(tpCfg)
+	}
+
+	be.httpCfg = httpCfg
 	return true, nil
 }
 
@@ -144,7 +243,7 @@ func (be *T) UpsertServer(beSrvCfg engine.Server) (bool, error) {
 		return false, errors.Wrapf(err, "bad config %v", beSrvCfg)
 	}
 	if i := be.indexOfServer(beSrvCfg.Id); i != -1 {
-		if be.srvs[i].URLKey() == beSrv.URLKey() {
+		if be.srvs[i].URLKey() == beSrv.URLKey() && be.srvs[i].weight == beSrv.weight {
 			return false, nil
 		}
 		be.cloneSrvCfgsIfSeen()
@@ -167,6 +266,8 @@ func (be *T) DeleteServer(beSrvKey engine.ServerKey) bool {
 		return false
 	}
 	be.cloneSrvCfgsIfSeen()
+	delete(be.health, beSrvKey.Id)
+	delete(be.ejections, beSrvKey.Id)
 	lastIdx := len(be.srvs) - 1
 	copy(be.srvs[i:], be.srvs[i+1:])
 	be.srvs[lastIdx] = Srv{}
@@ -175,15 +276,33 @@ func (be *T) DeleteServer(beSrvKey engine.ServerKey) bool {
 }
 
 // Snapshot returns configured HTTP transport instance and a list of backend
-// servers. Due to copy-on-write semantic it is the returned server list is
-// immutable from callers prospective and it is efficient to call this function
-// as frequently as you want for it won't make excessive allocations.
+// servers that have not failed health checks and are not ejected as outliers. Due to copy-on-write semantic it
+// is the returned server list is immutable from callers prospective and it is
+// efficient to call this function as frequently as you want for it won't make
+// excessive allocations.
 func (be *T) Snapshot() (*http.Transport, []Srv) {
 	be.mu.Lock()
 	defer be.mu.Unlock()
 
 	be.srvCfgsSeen = true
-	return be.httpTp, be.srvs
+	if len(be.health) == 0 && len(be.ejections) == 0 {
+		return be.httpTp, be.srvs
+	}
+	healthy := make([]Srv, 0, len(be.srvs))
+	for _, srv := range be.srvs {
+		if be.isHealthy(srv) && !be.isEjected(srv) {
+			healthy = append(healthy, srv)
+		}
+	}
+	return be.httpTp, healthy
+}
+
+// LoadBalancer returns the load balancer config of the backend.
+func (be *T) LoadBalancer() engine.HTTPBackendLoadBalancer {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	return be.httpCfg.LoadBalancer
 }
 
 // Server returns a backend server by a storage key if exists.
@@ -218,8 +337,17 @@ func (be *T) indexOfServer(beSrvID string) int {
 	return -1
 }
 
-func newTransport(s engine.TransportSettings) *http.Transport {
-	return &http.Transport{
+func (be *T) closeIdleConnections() {
+	be.httpTp.CloseIdleConnections()
+	if be.h2Tp != nil {
+		be.h2Tp.CloseIdleConnections()
+	}
+}
+
+// newTransport returns the transport to the backend servers. Requests to h2
+// and h2c backends are passed on to the returned HTTP/2 transport.
+func newTransport(s engine.TransportSettings) (*http.Transport, *http2.Transport) {
+	tp := &http.Transport{
 		Dial: (&net.Dialer{
 			Timeout:   s.Timeouts.Dial,
 			KeepAlive: s.KeepAlive.Period,
@@ -229,6 +357,14 @@ func newTransport(s engine.TransportSettings) *http.Transport {
 		MaxIdleConnsPerHost:   s.KeepAlive.MaxIdleConnsPerHost,
 		TLSClientConfig:       s.TLS,
 	}
+	h2Tp := newH2Transport(s)
+	switch s.Protocol {
+	case engine.BackendH2:
+		tp.RegisterProtocol("https", &h2RoundTripper{tp: h2Tp})
+	case engine.BackendH2C:
+		tp.RegisterProtocol("http", &h2RoundTripper{tp: h2Tp})
+	}
+	return tp, h2Tp
 }
 
 func newTransportCfg(httpCfg engine.HTTPBackendSettings, opts proxy.Options) (engine.TransportSettings, error) {
@@ -1,7 +1,22 @@
 package backend
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
 	"time"
 
 	"github.com/pkg/errors"
@@ -10,6 +25,8 @@ import (
 	. "gopkg.in/check.v1"
 )
 
+func TestBackend(t *testing.T) { TestingT(t) }
+
 var _ = Suite(&BackendSuite{})
 
 type BackendSuite struct {
@@ -37,7 +54,7 @@ func (s *BackendSuite) TestNewFailure(c *C) {
 	})
 
 	// Then
-	c.Assert(err.Error(), Equals, "invalid dial timeout: time: invalid duration bar")
+	c.Assert(err.Error(), Equals, `invalid dial timeout: time: invalid duration "bar"`)
 	c.Assert(beCfg, IsNil)
 }
 
@@ -65,9 +82,9 @@ func (s *BackendSuite) TestCopyOnRead(c *C) {
 	_, srvCfgs3 := be.Snapshot()
 
 	// Then
-	c.Assert(srvCfgs1, DeepEquals, []engine.Server{{Id: "1"}, {Id: "3"}, {Id: "2"}})
-	c.Assert(srvCfgs2, DeepEquals, []engine.Server{{Id: "1"}, {Id: "3"}, {Id: "2"}, {Id: "4"}})
-	c.Assert(srvCfgs3, DeepEquals, []engine.Server{{Id: "3"}, {Id: "4"}, {Id: "5"}, {Id: "1"}})
+	c.Assert(srvIds(srvCfgs1), DeepEquals, []string{"1", "3", "2"})
+	c.Assert(srvIds(srvCfgs2), DeepEquals, []string{"1", "3", "2", "4"})
+	c.Assert(srvIds(srvCfgs3), DeepEquals, []string{"3", "4", "5", "1"})
 }
 
 // Server Upsert/Delete functions report whether servers has actually been
@@ -101,7 +118,7 @@ func (s *BackendSuite) TestServerUpdates(c *C) {
 		// When
 		switch tc.operation {
 		case "ups":
-			mutated, err = be.UpsertServer(engine.Server{Id: tc.id})
+			mutated, err = be.UpsertServer(engine.Server{Id: tc.id, URL: newBeSrv(tc.id).rawURL})
 			c.Assert(err, IsNil)
 		case "del":
 			mutated = be.DeleteServer(engine.ServerKey{Id: tc.id})
@@ -111,7 +128,7 @@ func (s *BackendSuite) TestServerUpdates(c *C) {
 	}
 
 	_, srvCfgs := be.Snapshot()
-	c.Assert(srvCfgs, DeepEquals, []engine.Server{{Id: "3"}, {Id: "4"}, {Id: "1"}})
+	c.Assert(srvIds(srvCfgs), DeepEquals, []string{"3", "1"})
 }
 
 func (s *BackendSuite) TestUpdate(c *C) {
@@ -205,13 +222,117 @@ func (s *BackendSuite) TestUpdateBadConfig(c *C) {
 	mutated, err := be.Update(beCfg2, proxy.Options{})
 
 	// Then
-	c.Assert(err.Error(), Equals, "bad config: invalid HTTP cfg: invalid tls handshake timeout: time: invalid duration bar")
+	c.Assert(err.Error(), Equals, `bad config: invalid HTTP cfg: invalid tls handshake timeout: time: invalid duration "bar"`)
 	c.Assert(mutated, Equals, false)
 	tp, _ := be.Snapshot()
 	c.Assert(tp.ResponseHeaderTimeout, Equals, 3*time.Second)
 	c.Assert(tp.TLSHandshakeTimeout, Equals, 15*time.Second)
 }
 
+func (s *BackendSuite) TestTLS(c *C) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	rootCAs := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	spki := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(spki[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	keyPair := newClientKeyPair(c, "client")
+
+	for i, tc := range []struct {
+		settings engine.TLSSettings
+		body     string
+	}{
+		{settings: engine.TLSSettings{KeyPair: keyPair, RootCAs: rootCAs, ServerName: "example.com"}, body: "client"},
+		{settings: engine.TLSSettings{KeyPair: keyPair, RootCAs: rootCAs, ServerName: "example.com", PinnedSPKI: []string{otherPin, pin}}, body: "client"},
+		{settings: engine.TLSSettings{KeyPair: keyPair, InsecureSkipVerify: true, PinnedSPKI: []string{pin}}, body: "client"},
+		// Server certificates are verified against the system CAs by default
+		{settings: engine.TLSSettings{KeyPair: keyPair, ServerName: "example.com"}},
+		{settings: engine.TLSSettings{KeyPair: keyPair, RootCAs: rootCAs, ServerName: "example.org"}},
+		{settings: engine.TLSSettings{KeyPair: keyPair, InsecureSkipVerify: true, PinnedSPKI: []string{otherPin}}},
+		{settings: engine.TLSSettings{RootCAs: rootCAs, ServerName: "example.com"}},
+	} {
+		settings := tc.settings
+		beCfg, err := engine.NewHTTPBackend("foo", engine.HTTPBackendSettings{TLS: &settings})
+		c.Assert(err, IsNil)
+		be, err := New(*beCfg, proxy.Options{}, nil)
+		c.Assert(err, IsNil)
+		tp, _ := be.Snapshot()
+
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		rsp, err := tp.RoundTrip(req)
+		if tc.body == "" {
+			c.Assert(err, NotNil, Commentf("case %d", i))
+		} else {
+			c.Assert(err, IsNil, Commentf("case %d", i))
+			body, _ := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			c.Assert(string(body), Equals, tc.body, Commentf("case %d", i))
+		}
+		be.Close()
+	}
+}
+
+// newClientKeyPair generates a self-signed ECDSA client certificate
+func newClientKeyPair(c *C, commonName string) *engine.KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return &engine.KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// newTestBackend returns the http backend b1 with the servers at the given
+// URLs, identified by their hosts.
+func newTestBackend(c *C, settings engine.HTTPBackendSettings, urls ...string) *T {
+	beCfg, err := engine.NewHTTPBackend("b1", settings)
+	c.Assert(err, IsNil)
+	be, err := New(*beCfg, proxy.Options{}, nil)
+	c.Assert(err, IsNil)
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		c.Assert(err, IsNil)
+		_, err = be.UpsertServer(engine.Server{Id: parsed.Host, URL: u})
+		c.Assert(err, IsNil)
+	}
+	return be
+}
+
+// waitFor polls the condition until it is true, it fails the test after 5 seconds.
+func waitFor(c *C, what string, fn func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if fn() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("timeout waiting for %v", what)
+}
+
+func srvIds(srvs []Srv) []string {
+	var ids []string
+	for _, srv := range srvs {
+		ids = append(ids, srv.id)
+	}
+	return ids
+}
+
 func newBeSrv(id string) Srv {
 	beSrv, err := NewServer(engine.Server{
 		Id:  id,
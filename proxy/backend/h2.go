@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vulcand/vulcand/engine"
+	"golang.org/x/net/http2"
+)
+
+// newH2Transport returns the HTTP/2 transport for backends of the h2 and h2c
+// protocols, or nil for HTTP/1.1 backends. It does not support the read
+// timeout, frontend deadlines limit the requests instead.
+func newH2Transport(s engine.TransportSettings) *http2.Transport {
+	dialer := &net.Dialer{Timeout: s.Timeouts.Dial, KeepAlive: s.KeepAlive.Period}
+	switch s.Protocol {
+	case engine.BackendH2:
+		// The handshake is limited along with the dial.
+		tlsDialer := &net.Dialer{Timeout: s.Timeouts.Dial + s.Timeouts.TLSHandshake, KeepAlive: s.KeepAlive.Period}
+		return &http2.Transport{
+			TLSClientConfig: s.TLS,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := tls.DialWithDialer(tlsDialer, network, addr, cfg)
+				if err != nil {
+					return nil, err
+				}
+				if p := conn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+					conn.Close()
+					return nil, fmt.Errorf("server %v has negotiated protocol %q instead of h2", addr, p)
+				}
+				return conn, nil
+			},
+		}
+	case engine.BackendH2C:
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		}
+	}
+	return nil
+}
+
+// h2RoundTripper sends the requests of an HTTP/1.1 transport over HTTP/2.
+type h2RoundTripper struct {
+	tp *http2.Transport
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *h2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// gRPC servers expect the TE header that is dropped as a hop-by-hop one
+	// on the way from the client.
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") && req.Header.Get("Te") == "" {
+		req.Header.Set("Te", "trailers")
+	}
+	return rt.tp.RoundTrip(req)
+}
@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/vulcand/vulcand/engine"
+	"golang.org/x/net/http2"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BackendSuite) TestH2Transports(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto + " " + r.Header.Get("Te")))
+	})
+	h2Srv := httptest.NewUnstartedServer(handler)
+	h2Srv.EnableHTTP2 = true
+	h2Srv.StartTLS()
+	defer h2Srv.Close()
+	h1Srv := httptest.NewTLSServer(handler)
+	defer h1Srv.Close()
+	h2cURL, closeH2C := startH2CServer(c, handler)
+	defer closeH2C()
+
+	insecure := &engine.TLSSettings{InsecureSkipVerify: true}
+	for i, tc := range []struct {
+		settings engine.HTTPBackendSettings
+		url      string
+		grpc     bool
+		body     string
+	}{
+		{settings: engine.HTTPBackendSettings{TLS: insecure}, url: h2Srv.URL, body: "HTTP/1.1 "},
+		{settings: engine.HTTPBackendSettings{Protocol: engine.BackendH2, TLS: insecure}, url: h2Srv.URL, body: "HTTP/2.0 "},
+		{settings: engine.HTTPBackendSettings{Protocol: engine.BackendH2C}, url: h2cURL, body: "HTTP/2.0 "},
+		{settings: engine.HTTPBackendSettings{Protocol: engine.BackendH2C}, url: h2cURL, grpc: true, body: "HTTP/2.0 trailers"},
+		// Servers that do not speak h2 are errors rather than HTTP/1.1 ones
+		{settings: engine.HTTPBackendSettings{Protocol: engine.BackendH2, TLS: insecure}, url: h1Srv.URL},
+	} {
+		be := newTestBackend(c, tc.settings)
+		httpTp, _ := be.Snapshot()
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		if tc.grpc {
+			req.Header.Set("Content-Type", "application/grpc")
+		}
+		rsp, err := httpTp.RoundTrip(req)
+		if tc.body == "" {
+			c.Assert(err, NotNil, Commentf("case %d", i))
+		} else {
+			c.Assert(err, IsNil, Commentf("case %d", i))
+			body, _ := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			c.Assert(string(body), Equals, tc.body, Commentf("case %d", i))
+		}
+		be.Close()
+	}
+}
+
+// startH2CServer starts a server of HTTP/2 over cleartext with prior
+// knowledge.
+func startH2CServer(c *C, handler http.Handler) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+	return "http://" + l.Addr().String(), func() { l.Close() }
+}
@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// srvHealth is the health check state of a backend server.
+type srvHealth struct {
+	// rawURL is the URL of the server the state belongs to, the state is reset
+	// if the server URL changes.
+	rawURL    string
+	unhealthy bool
+	passed    int
+	failed    int
+	checkedAt time.Time
+	lastErr   string
+}
+
+// healthChecker represents a running health check loop.
+type healthChecker struct {
+	cfg    engine.HealthCheckSettings
+	cancel context.CancelFunc
+	doneC  chan struct{}
+}
+
+// HealthGeneration returns a number that changes every time a server becomes
+// healthy or unhealthy. A frontend should take a new Snapshot when it changes.
+func (be *T) HealthGeneration() int64 {
+	return atomic.LoadInt64(&be.healthGen)
+}
+
+// ServersHealth returns health of the backend servers by server id. It returns
+// an empty map if health checks are disabled.
+func (be *T) ServersHealth() map[string]engine.ServerHealth {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	out := make(map[string]engine.ServerHealth)
+	if be.hcCfg == nil {
+		return out
+	}
+	for _, srv := range be.srvs {
+		h := engine.ServerHealth{Healthy: true}
+		if st, ok := be.health[srv.id]; ok && st.rawURL == srv.rawURL {
+			h = engine.ServerHealth{Healthy: !st.unhealthy, CheckedAt: st.checkedAt, Error: st.lastErr}
+		}
+		out[srv.id] = h
+	}
+	return out
+}
+
+// StopHealthChecks stops health checks and waits for checks in progress to
+// complete.
+func (be *T) StopHealthChecks() {
+	be.mu.Lock()
+	c := be.stopHealthChecks()
+	be.mu.Unlock()
+
+	if c != nil {
+		<-c.doneC
+	}
+}
+
+// isHealthy returns true unless the server has failed health checks. Servers
+// that have not been checked yet are considered healthy.
+func (be *T) isHealthy(srv Srv) bool {
+	st, ok := be.health[srv.id]
+	return !ok || st.rawURL != srv.rawURL || !st.unhealthy
+}
+
+// startHealthChecks must be called with the backend lock held.
+func (be *T) startHealthChecks() {
+	if be.hcCfg == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &healthChecker{cfg: *be.hcCfg, cancel: cancel, doneC: make(chan struct{})}
+	be.checker = c
+	go be.runHealthChecks(ctx, c)
+}
+
+// stopHealthChecks must be called with the backend lock held. It returns the
+// stopped checker, if any.
+func (be *T) stopHealthChecks() *healthChecker {
+	c := be.checker
+	if c == nil {
+		return nil
+	}
+	c.cancel()
+	be.checker = nil
+	return c
+}
+
+func (be *T) runHealthChecks(ctx context.Context, c *healthChecker) {
+	defer close(c.doneC)
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		be.checkServers(ctx, c)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkServers checks all servers concurrently and records the results.
+func (be *T) checkServers(ctx context.Context, c *healthChecker) {
+	be.mu.Lock()
+	be.srvCfgsSeen = true
+	srvs, httpTp := be.srvs, be.httpTp
+	be.mu.Unlock()
+
+	results := make([]error, len(srvs))
+	var wg sync.WaitGroup
+	for i := range srvs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = checkServer(ctx, httpTp, &c.cfg, &srvs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	// The results of stopped checks are discarded, they may have failed
+	// because of the cancellation.
+	if ctx.Err() != nil || be.checker != c {
+		return
+	}
+	now := time.Now().UTC()
+	changed := false
+	for i, srv := range srvs {
+		if be.indexOfServer(srv.id) == -1 {
+			continue
+		}
+		if be.recordCheck(srv, &c.cfg, results[i], now) {
+			changed = true
+		}
+	}
+	if changed {
+		atomic.AddInt64(&be.healthGen, 1)
+	}
+}
+
+// recordCheck updates the server health state and returns true if the server
+// has become healthy or unhealthy.
+func (be *T) recordCheck(srv Srv, cfg *engine.HealthCheckSettings, err error, now time.Time) bool {
+	st, ok := be.health[srv.id]
+	if !ok || st.rawURL != srv.rawURL {
+		st = &srvHealth{rawURL: srv.rawURL}
+		be.health[srv.id] = st
+	}
+	st.checkedAt = now
+	if err != nil {
+		st.passed = 0
+		st.failed++
+		st.lastErr = err.Error()
+		if !st.unhealthy && st.failed >= cfg.UnhealthyThreshold {
+			log.Warnf("Server %v of backend %v is unhealthy: %v", srv.id, be.id, err)
+			st.unhealthy = true
+			return true
+		}
+		return false
+	}
+	st.failed = 0
+	st.passed++
+	st.lastErr = ""
+	if st.unhealthy && st.passed >= cfg.HealthyThreshold {
+		log.Infof("Server %v of backend %v is healthy again", srv.id, be.id)
+		st.unhealthy = false
+		return true
+	}
+	return false
+}
+
+func checkServer(ctx context.Context, httpTp http.RoundTripper, cfg *engine.HealthCheckSettings, srv *Srv) error {
+	u := *srv.parsedURL
+	u.Path, u.RawPath, u.RawQuery = cfg.Path, "", ""
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	re, err := httpTp.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+	io.Copy(ioutil.Discard, re.Body)
+	if re.StatusCode != cfg.ExpectedStatus {
+		return fmt.Errorf("got status %d, expected %d", re.StatusCode, cfg.ExpectedStatus)
+	}
+	return nil
+}
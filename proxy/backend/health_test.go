@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/proxy"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BackendSuite) TestHealthChecks(c *C) {
+	var status, checks int32 = http.StatusInternalServerError, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	be := newTestBackend(c, engine.HTTPBackendSettings{
+		HealthCheck: &engine.HTTPBackendHealthCheck{Path: "/health", Interval: "10ms"},
+	})
+	defer be.Close()
+	_, err := be.UpsertServer(engine.Server{Id: "s1", URL: srv.URL})
+	c.Assert(err, IsNil)
+	gen := be.HealthGeneration()
+
+	waitFor(c, "server to become unhealthy", func() bool {
+		_, srvs := be.Snapshot()
+		return len(srvs) == 0
+	})
+	c.Assert(be.HealthGeneration(), Not(Equals), gen)
+	h := be.ServersHealth()["s1"]
+	c.Assert(h.Healthy, Equals, false)
+	c.Assert(h.Error, Not(Equals), "")
+	c.Assert(h.CheckedAt.IsZero(), Equals, false)
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	waitFor(c, "server to recover", func() bool {
+		_, srvs := be.Snapshot()
+		return len(srvs) == 1
+	})
+	h = be.ServersHealth()["s1"]
+	c.Assert(h.Healthy, Equals, true)
+	c.Assert(h.Error, Equals, "")
+
+	// No checks are made once the backend is closed
+	be.Close()
+	n := atomic.LoadInt32(&checks)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&checks), Equals, n)
+}
+
+func (s *BackendSuite) TestHealthChecksDisabled(c *C) {
+	be := newTestBackend(c, engine.HTTPBackendSettings{})
+	defer be.Close()
+	_, err := be.UpsertServer(engine.Server{Id: "s1", URL: "http://localhost:1"})
+	c.Assert(err, IsNil)
+	c.Assert(be.ServersHealth(), HasLen, 0)
+
+	// Health checks are started on update and reset when disabled
+	beCfg, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{
+		HealthCheck: &engine.HTTPBackendHealthCheck{Path: "/", Interval: "10ms", UnhealthyThreshold: 1},
+	})
+	c.Assert(err, IsNil)
+	_, err = be.Update(*beCfg, proxy.Options{})
+	c.Assert(err, IsNil)
+	waitFor(c, "server to become unhealthy", func() bool {
+		_, srvs := be.Snapshot()
+		return len(srvs) == 0
+	})
+	beCfg, err = engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	_, err = be.Update(*beCfg, proxy.Options{})
+	c.Assert(err, IsNil)
+	_, srvs := be.Snapshot()
+	c.Assert(srvIds(srvs), DeepEquals, []string{"s1"})
+}
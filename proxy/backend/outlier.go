@@ -0,0 +1,170 @@
+package backend
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/anomaly"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// maxEjectionEvents is the number of the most recent ejections kept for the
+// API.
+const maxEjectionEvents = 100
+
+// srvEjection is the outlier detection state of a backend server.
+type srvEjection struct {
+	// rawURL is the URL of the server the state belongs to, the state is reset
+	// if the server URL changes.
+	rawURL string
+	// count is the number of recent ejections, every repeated ejection is
+	// twice as long as the previous one.
+	count int
+	// until is zero unless the server is ejected.
+	until time.Time
+}
+
+// OutlierEjections returns the most recent ejections of the backend servers,
+// oldest first.
+func (be *T) OutlierEjections() []engine.OutlierEjection {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	out := make([]engine.OutlierEjection, len(be.ejectionEvents))
+	copy(out, be.ejectionEvents)
+	return out
+}
+
+// OutlierDetectionDue returns true if the outlier detection is enabled and
+// it is time to call EjectOutliers.
+func (be *T) OutlierDetectionDue(now time.Time) bool {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	return be.odCfg != nil && !now.Before(be.nextDetection)
+}
+
+// ReleaseEjected returns the servers whose ejection time is over to load
+// balancing.
+func (be *T) ReleaseEjected(now time.Time) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	changed := false
+	for id, e := range be.ejections {
+		if e.until.IsZero() || now.Before(e.until) {
+			continue
+		}
+		log.Infof("Server %v of backend %v is returned to load balancing", id, be.id)
+		e.until = time.Time{}
+		changed = true
+	}
+	if changed {
+		atomic.AddInt64(&be.healthGen, 1)
+	}
+}
+
+// EjectOutliers ejects the servers whose round-trip stats stand out from the
+// rest. Stats are keyed by server URLs, servers without stats or with too few
+// requests are not evaluated.
+func (be *T) EjectOutliers(now time.Time, stats map[SrvURLKey]engine.RoundTripStats) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	cfg := be.odCfg
+	if cfg == nil {
+		return
+	}
+	be.nextDetection = now.Add(cfg.Interval)
+
+	ejected := 0
+	var candidates []engine.Server
+	var srvs []Srv
+	for _, srv := range be.srvs {
+		if be.isEjected(srv) {
+			ejected++
+			continue
+		}
+		s, ok := stats[srv.URLKey()]
+		if !ok || s.Counters.Total < int64(cfg.MinRequests) {
+			continue
+		}
+		srvCfg := srv.Cfg()
+		srvCfg.Stats = &s
+		candidates = append(candidates, srvCfg)
+		srvs = append(srvs, srv)
+	}
+	if err := anomaly.MarkServerAnomalies(candidates); err != nil {
+		log.Errorf("Failed to detect outliers of backend %v: %v", be.id, err)
+		return
+	}
+
+	maxEjected := len(be.srvs) * cfg.MaxEjectedPercent / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	changed := false
+	for i, srv := range srvs {
+		e, ok := be.ejections[srv.id]
+		if !ok || e.rawURL != srv.rawURL {
+			e = &srvEjection{rawURL: srv.rawURL}
+			be.ejections[srv.id] = e
+		}
+		verdict := candidates[i].Stats.Verdict
+		if !verdict.IsBad {
+			if e.count > 0 {
+				e.count--
+			}
+			continue
+		}
+		if ejected >= maxEjected {
+			log.Warnf("Server %v of backend %v is an outlier, but %d of %d servers are already ejected",
+				srv.id, be.id, ejected, len(be.srvs))
+			continue
+		}
+		e.count++
+		e.until = now.Add(ejectionTime(cfg, e.count))
+		ejected++
+		changed = true
+
+		reasons := make([]string, len(verdict.Anomalies))
+		for j, a := range verdict.Anomalies {
+			reasons[j] = a.Message
+		}
+		ev := engine.OutlierEjection{
+			ServerId:  srv.id,
+			URL:       srv.rawURL,
+			EjectedAt: now,
+			Until:     e.until,
+			Reason:    strings.Join(reasons, ", "),
+		}
+		log.Warnf("Server %v of backend %v is ejected until %v: %v", srv.id, be.id, ev.Until, ev.Reason)
+		if len(be.ejectionEvents) == maxEjectionEvents {
+			be.ejectionEvents = append(be.ejectionEvents[:0], be.ejectionEvents[1:]...)
+		}
+		be.ejectionEvents = append(be.ejectionEvents, ev)
+	}
+	if changed {
+		atomic.AddInt64(&be.healthGen, 1)
+	}
+}
+
+// isEjected must be called with the backend lock held.
+func (be *T) isEjected(srv Srv) bool {
+	e, ok := be.ejections[srv.id]
+	return ok && e.rawURL == srv.rawURL && !e.until.IsZero()
+}
+
+// ejectionTime returns the duration of the n-th consecutive ejection.
+func ejectionTime(cfg *engine.OutlierDetectionSettings, n int) time.Duration {
+	d := cfg.BaseEjectionTime
+	for i := 1; i < n && d < cfg.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	if d > cfg.MaxEjectionTime {
+		d = cfg.MaxEjectionTime
+	}
+	return d
+}
@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/proxy"
+	. "gopkg.in/check.v1"
+)
+
+func (s *BackendSuite) TestEjectOutliers(c *C) {
+	be := newTestBackend(c, engine.HTTPBackendSettings{
+		OutlierDetection: &engine.HTTPBackendOutlierDetection{BaseEjectionTime: "10s", MaxEjectionTime: "30s"},
+	}, "http://a", "http://b", "http://c")
+	now := time.Date(2016, 3, 4, 10, 0, 0, 0, time.UTC)
+	c.Assert(be.OutlierDetectionDue(now), Equals, true)
+
+	gen := be.HealthGeneration()
+	be.EjectOutliers(now, outlierStats(map[string]int64{"http://a": 0, "http://b": 0, "http://c": 50}))
+	c.Assert(be.OutlierDetectionDue(now.Add(time.Second)), Equals, false)
+	c.Assert(be.HealthGeneration(), Not(Equals), gen)
+	assertServers(c, be, "a", "b")
+	evs := be.OutlierEjections()
+	c.Assert(evs, HasLen, 1)
+	c.Assert(evs[0].ServerId, Equals, "c")
+	c.Assert(evs[0].Until, Equals, now.Add(10*time.Second))
+	c.Assert(evs[0].Reason, Not(Equals), "")
+
+	// The server returns once the ejection time is over
+	be.ReleaseEjected(now.Add(9 * time.Second))
+	assertServers(c, be, "a", "b")
+	be.ReleaseEjected(now.Add(10 * time.Second))
+	assertServers(c, be, "a", "b", "c")
+
+	// Repeated ejections are longer, up to the max ejection time
+	for i, d := range []time.Duration{20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		now = now.Add(time.Minute)
+		be.EjectOutliers(now, outlierStats(map[string]int64{"http://a": 0, "http://b": 0, "http://c": 50}))
+		evs = be.OutlierEjections()
+		c.Assert(evs[len(evs)-1].Until.Sub(now), Equals, d, Commentf("ejection %d", i+2))
+		be.ReleaseEjected(now.Add(d))
+	}
+}
+
+func (s *BackendSuite) TestEjectOutliersMaxEjected(c *C) {
+	be := newTestBackend(c, engine.HTTPBackendSettings{OutlierDetection: &engine.HTTPBackendOutlierDetection{}},
+		"http://a", "http://b", "http://c", "http://d", "http://e")
+	now := time.Now().UTC()
+
+	// 10% of 5 servers is less than one, but one server can always be ejected
+	be.EjectOutliers(now, outlierStats(map[string]int64{
+		"http://a": 0, "http://b": 0, "http://c": 0, "http://d": 50, "http://e": 50}))
+	assertServers(c, be, "a", "b", "c", "e")
+
+	// Servers with too few requests are not evaluated
+	be.ReleaseEjected(now.Add(time.Hour))
+	stats := outlierStats(map[string]int64{"http://a": 0, "http://b": 0, "http://c": 0, "http://d": 0, "http://e": 5})
+	e := stats[NewSrvURLKey(mustParseURL("http://e"))]
+	e.Counters.Total = 5
+	stats[NewSrvURLKey(mustParseURL("http://e"))] = e
+	be.EjectOutliers(now.Add(time.Hour), stats)
+	assertServers(c, be, "a", "b", "c", "d", "e")
+}
+
+func (s *BackendSuite) TestOutlierDetectionDisabled(c *C) {
+	be := newTestBackend(c, engine.HTTPBackendSettings{OutlierDetection: &engine.HTTPBackendOutlierDetection{}},
+		"http://a", "http://b", "http://c")
+	be.EjectOutliers(time.Now(), outlierStats(map[string]int64{"http://a": 0, "http://b": 0, "http://c": 50}))
+	assertServers(c, be, "a", "b")
+
+	// Disabling the detection returns the ejected servers
+	beCfg, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	_, err = be.Update(*beCfg, proxy.Options{})
+	c.Assert(err, IsNil)
+	assertServers(c, be, "a", "b", "c")
+	c.Assert(be.OutlierDetectionDue(time.Now()), Equals, false)
+}
+
+// outlierStats returns stats of 100 requests with the given number of network
+// errors by server URL.
+func outlierStats(netErrors map[string]int64) map[SrvURLKey]engine.RoundTripStats {
+	out := make(map[SrvURLKey]engine.RoundTripStats)
+	for u, n := range netErrors {
+		out[NewSrvURLKey(mustParseURL(u))] = engine.RoundTripStats{
+			LatencyBrackets: []engine.Bracket{{Quantile: 50, Value: time.Millisecond}},
+			Counters:        engine.Counters{Period: 10 * time.Second, NetErrors: n, Total: 100},
+		}
+	}
+	return out
+}
+
+func assertServers(c *C, be *T, ids ...string) {
+	_, srvs := be.Snapshot()
+	c.Assert(srvIds(srvs), DeepEquals, ids)
+}
+
+func mustParseURL(v string) *url.URL {
+	u, err := url.Parse(v)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
@@ -0,0 +1,326 @@
+package balancer
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// latencyRefreshPeriod is how long the least-latency balancer uses server
+// latencies before fetching them again.
+const latencyRefreshPeriod = time.Second
+
+// T represents a load balancer. It picks a backend server for every request,
+// rewrites the request URL to point to the server and passes the request to
+// the next handler.
+type T interface {
+	http.Handler
+	// Servers returns URLs of all servers in the pool.
+	Servers() []*url.URL
+	// UpsertServer adds a server to the pool or updates its weight, 0 weight
+	// means the default weight.
+	UpsertServer(u *url.URL, weight int) error
+	// RemoveServer removes a server from the pool.
+	RemoveServer(u *url.URL) error
+}
+
+// LatencySource provides round-trip latencies of backend servers.
+type LatencySource interface {
+	// ServerLatency returns false if there is no data for the server yet.
+	ServerLatency(u *url.URL) (time.Duration, bool)
+}
+
+// New creates a load balancer selected by the backend config. The latency
+// source is only used by the least-latency load balancer.
+func New(cfg engine.HTTPBackendLoadBalancer, next http.Handler, latencies LatencySource,
+	listeners plugin.FrontendListeners,
+) (T, error) {
+	switch cfg.Type {
+	case "", engine.LBRoundRobin:
+		return newRoundRobin(next, listeners)
+	case engine.LBLeastConn:
+		return newPool(next, listeners.RrRewriteListener, func(req *http.Request, srvs []*server, start int) *server {
+			return leastConn(srvs, start)
+		}), nil
+	case engine.LBLeastLatency:
+		ll := &leastLatency{source: latencies}
+		return newPool(next, listeners.RrRewriteListener, ll.pick), nil
+	case engine.LBTwoRandomChoices:
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		return newPool(next, listeners.RrRewriteListener, func(req *http.Request, srvs []*server, start int) *server {
+			return twoRandomChoices(srvs, rnd)
+		}), nil
+	case engine.LBConsistentHash:
+		return newConsistentHash(cfg, next, listeners.RrRewriteListener)
+	case engine.LBStickySession:
+		return newStickySession(cfg, next, listeners.RrRewriteListener), nil
+	}
+	return nil, errors.Errorf("unsupported load balancer %q", cfg.Type)
+}
+
+// roundRobin adapts the oxy weighted round robin load balancer wrapped into
+// a rebalancer, that readjusts weights based on error ratios.
+type roundRobin struct {
+	*roundrobin.Rebalancer
+}
+
+func newRoundRobin(next http.Handler, listeners plugin.FrontendListeners) (T, error) {
+	rr, err := roundrobin.New(next, roundrobin.RoundRobinRequestRewriteListener(listeners.RrRewriteListener))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create load balancer")
+	}
+	rb, err := roundrobin.NewRebalancer(rr, roundrobin.RebalancerRequestRewriteListener(listeners.RbRewriteListener))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create rebalancer")
+	}
+	return roundRobin{rb}, nil
+}
+
+// UpsertServer implements T.
+func (r roundRobin) UpsertServer(u *url.URL, weight int) error {
+	return r.Rebalancer.UpsertServer(u, roundrobin.Weight(weight))
+}
+
+type server struct {
+	// id is a hash of the URL, it does not reveal the server address to
+	// clients in sticky session cookies
+	id       string
+	url      *url.URL
+	weight   int
+	inFlight int
+}
+
+// load returns the number of requests in flight, including the one being
+// balanced, per unit of weight.
+func (s *server) load() float64 {
+	return float64(s.inFlight+1) / float64(s.weight)
+}
+
+// picker selects a server for the request from a non-empty list. It is called
+// with the pool lock held, start is an index rotated on every call that should
+// be used to break ties.
+type picker func(req *http.Request, srvs []*server, start int) *server
+
+// pool is a load balancer that keeps track of requests in flight to each
+// server and leaves the choice of the server to a picker.
+type pool struct {
+	mu       sync.Mutex
+	next     http.Handler
+	listener roundrobin.RequestRewriteListener
+	pick     picker
+	servers  []*server
+	start    int
+	// update is called with the pool lock held every time the servers change
+	update func(srvs []*server)
+	// cookie is set to the id of the picked server on responses, unless the
+	// request already has it
+	cookie string
+}
+
+func newPool(next http.Handler, listener roundrobin.RequestRewriteListener, pick picker) *pool {
+	return &pool{next: next, listener: listener, pick: pick}
+}
+
+// ServeHTTP implements http.Handler.
+func (p *pool) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	srv, u := p.acquire(req)
+	if srv == nil {
+		utils.DefaultHandler.ServeHTTP(w, req, fmt.Errorf("no servers in the pool"))
+		return
+	}
+	defer p.release(srv)
+
+	if p.cookie != "" {
+		if c, err := req.Cookie(p.cookie); err != nil || c.Value != srv.id {
+			http.SetCookie(w, &http.Cookie{Name: p.cookie, Value: srv.id, Path: "/", HttpOnly: true})
+		}
+	}
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	newReq.URL = u
+	if p.listener != nil {
+		p.listener(req, &newReq)
+	}
+	p.next.ServeHTTP(w, &newReq)
+}
+
+func (p *pool) acquire(req *http.Request) (*server, *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.servers) == 0 {
+		return nil, nil
+	}
+	p.start = (p.start + 1) % len(p.servers)
+	srv := p.pick(req, p.servers, p.start)
+	srv.inFlight++
+	return srv, utils.CopyURL(srv.url)
+}
+
+func (p *pool) release(srv *server) {
+	p.mu.Lock()
+	srv.inFlight--
+	p.mu.Unlock()
+}
+
+// Servers implements T.
+func (p *pool) Servers() []*url.URL {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]*url.URL, len(p.servers))
+	for i, srv := range p.servers {
+		out[i] = srv.url
+	}
+	return out
+}
+
+// UpsertServer implements T.
+func (p *pool) UpsertServer(u *url.URL, weight int) error {
+	if u == nil {
+		return errors.New("server URL can't be nil")
+	}
+	if weight < 0 {
+		return errors.Errorf("weight should be >= 0, got %d", weight)
+	}
+	if weight == 0 {
+		weight = 1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if i := p.indexOf(u); i != -1 {
+		p.servers[i].weight = weight
+	} else {
+		p.servers = append(p.servers, &server{id: serverID(u), url: utils.CopyURL(u), weight: weight})
+	}
+	if p.update != nil {
+		p.update(p.servers)
+	}
+	return nil
+}
+
+// RemoveServer implements T.
+func (p *pool) RemoveServer(u *url.URL) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := p.indexOf(u)
+	if i == -1 {
+		return errors.Errorf("%v not found", u)
+	}
+	p.servers = append(p.servers[:i], p.servers[i+1:]...)
+	if p.update != nil {
+		p.update(p.servers)
+	}
+	return nil
+}
+
+func (p *pool) indexOf(u *url.URL) int {
+	for i, srv := range p.servers {
+		if srv.url.String() == u.String() {
+			return i
+		}
+	}
+	return -1
+}
+
+// leastConn picks the server with the fewest requests in flight per unit of
+// weight.
+func leastConn(srvs []*server, start int) *server {
+	best := srvs[start]
+	for i := 1; i < len(srvs); i++ {
+		srv := srvs[(start+i)%len(srvs)]
+		if srv.load() < best.load() {
+			best = srv
+		}
+	}
+	return best
+}
+
+// twoRandomChoices picks two distinct random servers and returns the less
+// loaded one.
+func twoRandomChoices(srvs []*server, rnd *rand.Rand) *server {
+	if len(srvs) == 1 {
+		return srvs[0]
+	}
+	i := rnd.Intn(len(srvs))
+	j := rnd.Intn(len(srvs) - 1)
+	if j >= i {
+		j++
+	}
+	if srvs[j].load() < srvs[i].load() {
+		return srvs[j]
+	}
+	return srvs[i]
+}
+
+// leastLatency picks the server with the lowest latency multiplied by its
+// load, so that the fastest server does not get all requests. Servers without
+// latency data are assumed to be as fast as the fastest known server.
+type leastLatency struct {
+	source    LatencySource
+	latencies map[string]time.Duration
+	fallback  time.Duration
+	updatedAt time.Time
+}
+
+func (l *leastLatency) pick(req *http.Request, srvs []*server, start int) *server {
+	l.refresh(srvs)
+	best := srvs[start]
+	bestScore := l.score(best)
+	for i := 1; i < len(srvs); i++ {
+		srv := srvs[(start+i)%len(srvs)]
+		if score := l.score(srv); score < bestScore {
+			best, bestScore = srv, score
+		}
+	}
+	return best
+}
+
+func (l *leastLatency) score(srv *server) float64 {
+	latency, ok := l.latencies[srv.url.String()]
+	if !ok {
+		latency = l.fallback
+	}
+	return float64(latency) * srv.load()
+}
+
+func (l *leastLatency) refresh(srvs []*server) {
+	now := time.Now()
+	if l.latencies != nil && now.Sub(l.updatedAt) < latencyRefreshPeriod {
+		return
+	}
+	l.latencies = make(map[string]time.Duration, len(srvs))
+	l.fallback = 0
+	l.updatedAt = now
+	if l.source != nil {
+		for _, srv := range srvs {
+			latency, ok := l.source.ServerLatency(srv.url)
+			if !ok {
+				continue
+			}
+			// Zero latency would hide the load of the server.
+			if latency <= 0 {
+				latency = 1
+			}
+			l.latencies[srv.url.String()] = latency
+			if l.fallback == 0 || latency < l.fallback {
+				l.fallback = latency
+			}
+		}
+	}
+	if l.fallback == 0 {
+		l.fallback = 1
+	}
+}
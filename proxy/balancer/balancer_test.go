@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestBalancer(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&BalancerSuite{})
+
+type BalancerSuite struct {
+}
+
+func (s *BalancerSuite) TestUnsupported(c *C) {
+	_, err := New(engine.HTTPBackendLoadBalancer{Type: "random"}, http.NotFoundHandler(), nil, plugin.FrontendListeners{})
+	c.Assert(err, NotNil)
+}
+
+func (s *BalancerSuite) TestNoServers(c *C) {
+	for _, lb := range []string{engine.LBRoundRobin, engine.LBLeastConn, engine.LBLeastLatency, engine.LBTwoRandomChoices} {
+		b, err := New(engine.HTTPBackendLoadBalancer{Type: lb}, http.NotFoundHandler(), nil, plugin.FrontendListeners{})
+		c.Assert(err, IsNil)
+
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		c.Assert(w.Code, Not(Equals), http.StatusNotFound, Commentf("load balancer %v", lb))
+	}
+}
+
+func (s *BalancerSuite) TestWeights(c *C) {
+	for _, lb := range []string{engine.LBRoundRobin, engine.LBLeastConn, engine.LBLeastLatency} {
+		hits := map[string]int{}
+		next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			hits[req.URL.Host]++
+		})
+		b, err := New(engine.HTTPBackendLoadBalancer{Type: lb}, next, nil, plugin.FrontendListeners{})
+		c.Assert(err, IsNil)
+		c.Assert(b.UpsertServer(mustParse("http://a"), 0), IsNil)
+		c.Assert(b.UpsertServer(mustParse("http://b"), 0), IsNil)
+
+		for i := 0; i < 4; i++ {
+			b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+		}
+		c.Assert(hits, DeepEquals, map[string]int{"a": 2, "b": 2}, Commentf("load balancer %v", lb))
+
+		c.Assert(b.RemoveServer(mustParse("http://a")), IsNil)
+		c.Assert(b.Servers(), DeepEquals, []*url.URL{mustParse("http://b")})
+	}
+}
+
+func (s *BalancerSuite) TestLeastConn(c *C) {
+	srvs := []*server{
+		{url: mustParse("http://a"), weight: 1, inFlight: 2},
+		{url: mustParse("http://b"), weight: 1, inFlight: 1},
+		{url: mustParse("http://c"), weight: 4, inFlight: 8},
+	}
+	c.Assert(leastConn(srvs, 0), Equals, srvs[1])
+
+	srvs[2].inFlight = 2
+	c.Assert(leastConn(srvs, 0), Equals, srvs[2])
+}
+
+func (s *BalancerSuite) TestLeastConnReleasesServers(c *C) {
+	p := newPool(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), nil,
+		func(req *http.Request, srvs []*server, start int) *server { return leastConn(srvs, start) })
+	c.Assert(p.UpsertServer(mustParse("http://a"), 0), IsNil)
+
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	c.Assert(p.servers[0].inFlight, Equals, 0)
+}
+
+func (s *BalancerSuite) TestTwoRandomChoices(c *C) {
+	srvs := []*server{
+		{url: mustParse("http://a"), weight: 1, inFlight: 5},
+		{url: mustParse("http://b"), weight: 1, inFlight: 0},
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		c.Assert(twoRandomChoices(srvs, rnd), Equals, srvs[1])
+	}
+	c.Assert(twoRandomChoices(srvs[:1], rnd), Equals, srvs[0])
+}
+
+func (s *BalancerSuite) TestLeastLatency(c *C) {
+	src := latencies{"http://a": 10 * time.Millisecond, "http://b": 30 * time.Millisecond}
+	l := &leastLatency{source: src}
+	srvs := []*server{
+		{url: mustParse("http://a"), weight: 1},
+		{url: mustParse("http://b"), weight: 1},
+		{url: mustParse("http://c"), weight: 1, inFlight: 1},
+	}
+	c.Assert(l.pick(nil, srvs, 1), Equals, srvs[0])
+
+	// The fastest server is not picked once it has enough requests in flight
+	srvs[0].inFlight = 3
+	c.Assert(l.pick(nil, srvs, 0), Equals, srvs[2])
+}
+
+type latencies map[string]time.Duration
+
+func (l latencies) ServerLatency(u *url.URL) (time.Duration, bool) {
+	d, ok := l[u.String()]
+	return d, ok
+}
+
+func mustParse(v string) *url.URL {
+	u, err := url.Parse(v)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
@@ -0,0 +1,154 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	// DefaultLoadFactor is the default bound of requests in flight to a
+	// server relative to the average, used by the consistent hash balancer.
+	DefaultLoadFactor = 1.25
+	// DefaultStickyCookie is the default name of the sticky session cookie.
+	DefaultStickyCookie = "vulcand_sticky"
+
+	// replicas is the number of points every unit of server weight gets on
+	// the hash ring.
+	replicas = 100
+)
+
+// consistentHash maps requests to servers using a hash ring with bounded
+// loads: a request goes to the first server clockwise from the hash of its
+// variable that has less than the allowed number of requests in flight.
+// Changes to the servers only remap requests of the changed server.
+type consistentHash struct {
+	extract    utils.SourceExtractor
+	loadFactor float64
+	ring       []ringPoint
+	weights    int
+}
+
+type ringPoint struct {
+	hash uint64
+	srv  *server
+}
+
+func newConsistentHash(cfg engine.HTTPBackendLoadBalancer, next http.Handler, listener roundrobin.RequestRewriteListener) (T, error) {
+	extract, err := newExtractor(cfg.Variable)
+	if err != nil {
+		return nil, err
+	}
+	h := &consistentHash{extract: extract, loadFactor: cfg.LoadFactor}
+	if h.loadFactor == 0 {
+		h.loadFactor = DefaultLoadFactor
+	}
+	p := newPool(next, listener, h.pick)
+	p.update = h.update
+	return p, nil
+}
+
+func (h *consistentHash) update(srvs []*server) {
+	h.ring = h.ring[:0]
+	h.weights = 0
+	for _, srv := range srvs {
+		h.weights += srv.weight
+		for i := 0; i < srv.weight*replicas; i++ {
+			h.ring = append(h.ring, ringPoint{hash: hashString(fmt.Sprintf("%s-%d", srv.url, i)), srv: srv})
+		}
+	}
+	sort.Slice(h.ring, func(i, j int) bool { return h.ring[i].hash < h.ring[j].hash })
+}
+
+func (h *consistentHash) pick(req *http.Request, srvs []*server, start int) *server {
+	key, _, err := h.extract.Extract(req)
+	if err != nil || key == "" {
+		return leastConn(srvs, start)
+	}
+	total := 0
+	for _, srv := range srvs {
+		total += srv.inFlight
+	}
+	hash := hashString(key)
+	i := sort.Search(len(h.ring), func(i int) bool { return h.ring[i].hash >= hash })
+	for n := 0; n < len(h.ring); n++ {
+		srv := h.ring[(i+n)%len(h.ring)].srv
+		if srv.inFlight < h.capacity(srv, total) {
+			return srv
+		}
+	}
+	return leastConn(srvs, start)
+}
+
+// capacity returns the maximum number of requests in flight to the server,
+// including the one being balanced.
+func (h *consistentHash) capacity(srv *server, total int) int {
+	return int(math.Ceil(h.loadFactor * float64((total+1)*srv.weight) / float64(h.weights)))
+}
+
+// newStickySession returns the load balancer sending requests with the
+// session cookie to the server that has set it. Requests without the cookie,
+// or with the cookie of a server that has gone, go to the least loaded server.
+func newStickySession(cfg engine.HTTPBackendLoadBalancer, next http.Handler, listener roundrobin.RequestRewriteListener) T {
+	cookie := cfg.Cookie
+	if cookie == "" {
+		cookie = DefaultStickyCookie
+	}
+	p := newPool(next, listener, func(req *http.Request, srvs []*server, start int) *server {
+		if c, err := req.Cookie(cookie); err == nil {
+			for _, srv := range srvs {
+				if srv.id == c.Value {
+					return srv
+				}
+			}
+		}
+		return leastConn(srvs, start)
+	})
+	p.cookie = cookie
+	return p
+}
+
+// newExtractor extends the variables supported by oxy with request cookies.
+func newExtractor(variable string) (utils.SourceExtractor, error) {
+	if !strings.HasPrefix(variable, "request.cookie.") {
+		return utils.NewExtractor(variable)
+	}
+	name := strings.TrimPrefix(variable, "request.cookie.")
+	if name == "" {
+		return nil, errors.Errorf("wrong cookie: %s", variable)
+	}
+	return utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		c, err := req.Cookie(name)
+		if err != nil {
+			return "", 1, nil
+		}
+		return c.Value, 1, nil
+	}), nil
+}
+
+func serverID(u *url.URL) string {
+	return fmt.Sprintf("%016x", hashString(u.String()))
+}
+
+// hashString returns FNV-1a hash of the string passed through the murmur3
+// finalizer, that spreads hashes of similar strings over the ring.
+func hashString(v string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(v))
+	k := h.Sum64()
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
@@ -0,0 +1,144 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&HashSuite{})
+
+type HashSuite struct {
+}
+
+func (s *HashSuite) TestBadVariable(c *C) {
+	for _, v := range []string{"", "request.cookie.", "request.body"} {
+		_, err := New(engine.HTTPBackendLoadBalancer{Type: engine.LBConsistentHash, Variable: v}, http.NotFoundHandler(), nil, plugin.FrontendListeners{})
+		c.Assert(err, NotNil, Commentf("variable %q", v))
+	}
+}
+
+func (s *HashSuite) TestSameKeySameServer(c *C) {
+	b, hits := newHashBalancer(c, "request.header.X-User", "a", "b", "c")
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("X-User", "alice")
+		b.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	c.Assert(len(*hits), Equals, 1)
+}
+
+func (s *HashSuite) TestCookieVariable(c *C) {
+	b, hits := newHashBalancer(c, "request.cookie.session", "a", "b", "c")
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+		b.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	c.Assert(len(*hits), Equals, 1)
+}
+
+func (s *HashSuite) TestMinimalRemapping(c *C) {
+	b, _ := newHashBalancer(c, "request.header.X-User", "a", "b", "c")
+	h := b.(*pool)
+
+	before := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		before[fmt.Sprint(i)] = pickHost(h, fmt.Sprint(i))
+	}
+
+	c.Assert(b.UpsertServer(mustParse("http://d"), 0), IsNil)
+	moved := 0
+	for key, host := range before {
+		if after := pickHost(h, key); after != host {
+			c.Assert(after, Equals, "d")
+			moved++
+		}
+	}
+	// The new server takes about a quarter of the keys
+	c.Assert(moved > 100 && moved < 400, Equals, true, Commentf("moved %d", moved))
+
+	c.Assert(b.RemoveServer(mustParse("http://d")), IsNil)
+	for key, host := range before {
+		c.Assert(pickHost(h, key), Equals, host)
+	}
+}
+
+func (s *HashSuite) TestBoundedLoad(c *C) {
+	b, _ := newHashBalancer(c, "request.header.X-User", "a", "b")
+	h := b.(*pool)
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-User", "alice")
+	first, _ := h.acquire(req)
+	// With the default load factor of 1.25 the server of the key can hold
+	// 2 requests out of 3 in flight, the third one goes to the other server
+	second, _ := h.acquire(req)
+	third, _ := h.acquire(req)
+	c.Assert(second, Equals, first)
+	c.Assert(third, Not(Equals), first)
+}
+
+func (s *HashSuite) TestStickySession(c *C) {
+	hits := map[string]int{}
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits[req.URL.Host]++
+	})
+	b, err := New(engine.HTTPBackendLoadBalancer{Type: engine.LBStickySession}, next, nil, plugin.FrontendListeners{})
+	c.Assert(err, IsNil)
+	c.Assert(b.UpsertServer(mustParse("http://a"), 0), IsNil)
+	c.Assert(b.UpsertServer(mustParse("http://b"), 0), IsNil)
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	cookies := w.Result().Cookies()
+	c.Assert(len(cookies), Equals, 1)
+	c.Assert(cookies[0].Name, Equals, DefaultStickyCookie)
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, req)
+		c.Assert(len(w.Result().Cookies()), Equals, 0)
+	}
+	c.Assert(len(hits), Equals, 1)
+
+	// Clients of the removed server are moved to another one
+	for host := range hits {
+		c.Assert(b.RemoveServer(mustParse("http://"+host)), IsNil)
+	}
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	b.ServeHTTP(w, req)
+	c.Assert(len(hits), Equals, 2)
+	c.Assert(len(w.Result().Cookies()), Equals, 1)
+}
+
+func newHashBalancer(c *C, variable string, hosts ...string) (T, *map[string]int) {
+	hits := map[string]int{}
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits[req.URL.Host]++
+	})
+	b, err := New(engine.HTTPBackendLoadBalancer{Type: engine.LBConsistentHash, Variable: variable}, next, nil, plugin.FrontendListeners{})
+	c.Assert(err, IsNil)
+	for _, host := range hosts {
+		c.Assert(b.UpsertServer(mustParse("http://"+host), 0), IsNil)
+	}
+	return b, &hits
+}
+
+func pickHost(p *pool, user string) string {
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-User", user)
+	srv, u := p.acquire(req)
+	p.release(srv)
+	return u.Host
+}
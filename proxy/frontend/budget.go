@@ -0,0 +1,41 @@
+package frontend
+
+import "sync"
+
+// maxBudgetTokens is the number of extra requests a budget can save up so
+// that a quiet period is not followed by a burst of them.
+const maxBudgetTokens = 10
+
+// budget limits the extra requests, e.g. hedges or retries, to a share of
+// the frontend requests: every request adds the budget percent to the tokens
+// and every extra request takes a hundred of them.
+type budget struct {
+	mu      sync.Mutex
+	percent int
+	tokens  int
+}
+
+func newBudget(percent int) *budget {
+	return &budget{percent: percent}
+}
+
+func (b *budget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += b.percent
+	if b.tokens > maxBudgetTokens*100 {
+		b.tokens = maxBudgetTokens * 100
+	}
+}
+
+func (b *budget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 100 {
+		return false
+	}
+	b.tokens -= 100
+	return true
+}
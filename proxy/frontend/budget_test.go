@@ -0,0 +1,28 @@
+package frontend
+
+import "testing"
+
+func TestBudget(t *testing.T) {
+	b := newBudget(10)
+	for i := 0; i < 9; i++ {
+		b.request()
+		if b.take() {
+			t.Fatalf("unexpected extra request after %d requests", i+1)
+		}
+	}
+	b.request()
+	if !b.take() || b.take() {
+		t.Error("expected one extra request after 10 requests")
+	}
+	// Quiet periods do not save up more than a few extra requests
+	for i := 0; i < 1000; i++ {
+		b.request()
+	}
+	n := 0
+	for b.take() {
+		n++
+	}
+	if n != maxBudgetTokens {
+		t.Errorf("expected %d extra requests, got %d", maxBudgetTokens, n)
+	}
+}
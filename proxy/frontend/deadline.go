@@ -0,0 +1,183 @@
+package frontend
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// deadline is the top of the frontend handler chain, it cancels requests
+// that have run out of time and responds with 504 if the response has not
+// been started yet.
+type deadline struct {
+	next http.Handler
+	cfg  engine.DeadlineSettings
+}
+
+// ServeHTTP implements http.Handler.
+func (d *deadline) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if forward.IsWebsocketRequest(req) {
+		d.next.ServeHTTP(w, req)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), d.timeout(req))
+	defer cancel()
+
+	dw := &deadlineWriter{w: w, header: make(http.Header), ctx: ctx}
+	done := make(chan struct{})
+	panics := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panics <- p
+			}
+		}()
+		d.next.ServeHTTP(dw, req.WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case p := <-panics:
+		panic(p)
+	case <-ctx.Done():
+		if started := dw.expire(ctx.Err() == context.DeadlineExceeded); !started {
+			return
+		}
+		// The cancelled request ends soon, the response writer is still in
+		// use until then.
+		select {
+		case <-done:
+		case p := <-panics:
+			panic(p)
+		}
+	}
+}
+
+// timeout returns the time the request has got, incoming requests with the
+// deadline header can have less time than the frontend timeout.
+func (d *deadline) timeout(req *http.Request) time.Duration {
+	timeout := d.cfg.Timeout
+	if v := req.Header.Get(d.cfg.Header); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms >= 0 && time.Duration(ms)*time.Millisecond < timeout {
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return timeout
+}
+
+// deadlineWriter passes the response through until the deadline, the
+// writes after it fail.
+type deadlineWriter struct {
+	mu          sync.Mutex
+	w           http.ResponseWriter
+	ctx         context.Context
+	header      http.Header
+	wroteHeader bool
+	expired     bool
+}
+
+// Header returns the header of the response writer once the response has
+// started, so that trailers get there too.
+func (dw *deadlineWriter) Header() http.Header {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	if dw.wroteHeader {
+		return dw.w.Header()
+	}
+	return dw.header
+}
+
+func (dw *deadlineWriter) WriteHeader(code int) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	dw.writeHeader(code)
+}
+
+func (dw *deadlineWriter) writeHeader(code int) {
+	if dw.expired || dw.wroteHeader {
+		return
+	}
+	// Responses that start after the deadline are the errors of the
+	// cancelled requests.
+	if dw.ctx.Err() != nil {
+		dw.expireLocked(dw.ctx.Err() == context.DeadlineExceeded)
+		return
+	}
+	for k, v := range dw.header {
+		dw.w.Header()[k] = v
+	}
+	dw.w.WriteHeader(code)
+	dw.wroteHeader = true
+}
+
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	dw.writeHeader(http.StatusOK)
+	if dw.expired {
+		return 0, http.ErrHandlerTimeout
+	}
+	return dw.w.Write(b)
+}
+
+func (dw *deadlineWriter) Flush() {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	if f, ok := dw.w.(http.Flusher); ok && !dw.expired {
+		f.Flush()
+	}
+}
+
+// expire stops the response, if it has not been started yet and the request
+// has run out of time rather than been cancelled by the client, it responds
+// with 504. It returns true if the response has been started.
+func (dw *deadlineWriter) expire(exceeded bool) bool {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	dw.expireLocked(exceeded)
+	return dw.wroteHeader
+}
+
+func (dw *deadlineWriter) expireLocked(exceeded bool) {
+	if dw.expired {
+		return
+	}
+	if !dw.wroteHeader && exceeded {
+		writeResponse(dw.w, http.StatusGatewayTimeout, "text/plain", []byte("request deadline exceeded"))
+	}
+	dw.expired = true
+}
+
+// deadlineHeader sets the header with the milliseconds left before the
+// deadline on the requests to the servers.
+type deadlineHeader struct {
+	next   http.Handler
+	header string
+}
+
+// ServeHTTP implements http.Handler.
+func (d *deadlineHeader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	out := req.WithContext(req.Context())
+	out.Header = cloneHeader(req.Header)
+	if dl, ok := req.Context().Deadline(); ok {
+		left := time.Until(dl) / time.Millisecond
+		if left < 0 {
+			left = 0
+		}
+		out.Header.Set(d.header, strconv.FormatInt(int64(left), 10))
+	} else {
+		// Mirrored requests have no deadline.
+		out.Header.Del(d.header)
+	}
+	d.next.ServeHTTP(w, out)
+}
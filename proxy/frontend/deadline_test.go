@@ -0,0 +1,91 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/proxy/backend"
+)
+
+func TestDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte(r.Header.Get(engine.DefaultDeadlineHeader)))
+	}))
+	defer srv.Close()
+
+	for _, stream := range []bool{false, true} {
+		feCfg, err := engine.NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/")`, engine.HTTPFrontendSettings{
+			Stream: stream, Deadline: &engine.HTTPFrontendDeadline{Timeout: "200ms"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fe := New(*feCfg, []*backend.T{newTestBackend(t, "b1", srv.URL)}, proxy.Options{}, nil,
+			plugin.FrontendListeners{})
+
+		for i, tc := range []struct {
+			delay    string
+			deadline string
+			code     int
+			maxLeft  int64
+		}{
+			{delay: "0s", code: http.StatusOK, maxLeft: 200},
+			// Incoming requests can shorten the deadline but not extend it
+			{delay: "0s", deadline: "50", code: http.StatusOK, maxLeft: 50},
+			{delay: "0s", deadline: "5000", code: http.StatusOK, maxLeft: 200},
+			{delay: "100ms", deadline: "50", code: http.StatusGatewayTimeout},
+			{delay: "5s", code: http.StatusGatewayTimeout},
+		} {
+			req := httptest.NewRequest("GET", "http://localhost/?delay="+tc.delay, nil)
+			if tc.deadline != "" {
+				req.Header.Set(engine.DefaultDeadlineHeader, tc.deadline)
+			}
+			w := httptest.NewRecorder()
+			start := time.Now()
+			fe.ServeHTTP(w, req)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("stream %v, case %d: the request took %v", stream, i, elapsed)
+			}
+			if w.Code != tc.code {
+				t.Errorf("stream %v, case %d: expected %d, got %d %q", stream, i, tc.code, w.Code, w.Body.String())
+				continue
+			}
+			if tc.code != http.StatusOK {
+				if w.Body.String() != "request deadline exceeded" {
+					t.Errorf("stream %v, case %d: unexpected body %q", stream, i, w.Body.String())
+				}
+				continue
+			}
+			left, err := strconv.ParseInt(w.Body.String(), 10, 64)
+			if err != nil || left <= 0 || left > tc.maxLeft {
+				t.Errorf("stream %v, case %d: unexpected time left %q", stream, i, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestDeadlineHeaderMirror(t *testing.T) {
+	var got http.Header
+	d := &deadlineHeader{header: "X-Deadline", next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	})}
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Deadline", "100")
+	d.ServeHTTP(httptest.NewRecorder(), req)
+	// Requests without a deadline do not pass the one they have come with
+	if got.Get("X-Deadline") != "" || req.Header.Get("X-Deadline") != "100" {
+		t.Errorf("unexpected headers %v, original %v", got, req.Header)
+	}
+}
@@ -0,0 +1,276 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// fanOut sends every request to all branches in parallel and merges their
+// responses.
+type fanOut struct {
+	cfg      engine.FanOutSettings
+	branches []*fanOutBranch
+}
+
+type fanOutBranch struct {
+	*branch
+	engine.FanOutBranchSettings
+}
+
+// fanOutResult is the response of a branch.
+type fanOutResult struct {
+	index int
+	rec   *responseRecorder
+}
+
+func newFanOut(branches []*branch, cfg engine.FanOutSettings) (*fanOut, error) {
+	f := &fanOut{cfg: cfg}
+	for _, bs := range cfg.Branches {
+		var b *branch
+		for _, candidate := range branches {
+			if candidate.backend.Key().Id == bs.BackendId {
+				b = candidate
+			}
+		}
+		if b == nil {
+			return nil, fmt.Errorf("backend %v is missing", bs.BackendId)
+		}
+		f.branches = append(f.branches, &fanOutBranch{branch: b, FanOutBranchSettings: bs})
+	}
+	return f, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (f *fanOut) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// The body is sent to every branch, so it is kept in memory like the bodies of retried requests.
+	body, ok, err := peekBody(req, maxRetryBodyBytes)
+	if err != nil {
+		log.Errorf("Failed to read request body: %v", err)
+		writeResponse(w, http.StatusBadRequest, "text/plain", []byte(http.StatusText(http.StatusBadRequest)))
+		return
+	}
+	if !ok {
+		writeResponse(w, http.StatusRequestEntityTooLarge, "text/plain", []byte(http.StatusText(http.StatusRequestEntityTooLarge)))
+		return
+	}
+	// Cancel the requests still in flight once the response is merged.
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	results := make(chan fanOutResult, len(f.branches))
+	for i, b := range f.branches {
+		go func(i int, b *fanOutBranch) {
+			results <- fanOutResult{index: i, rec: b.serve(ctx, req, body, f.cfg.MaxResponseBytes)}
+		}(i, b)
+	}
+	switch f.cfg.Merge {
+	case engine.FanOutMergeFirst:
+		f.first(w, results)
+	case engine.FanOutMergeQuorum:
+		f.quorum(w, results)
+	default:
+		f.mergeJSON(w, results)
+	}
+}
+
+func (b *fanOutBranch) serve(ctx context.Context, req *http.Request, body []byte, maxResponseBytes int64) *responseRecorder {
+	if b.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+	out := req.WithContext(ctx)
+	out.Header = cloneHeader(req.Header)
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	rec := newResponseRecorder(maxResponseBytes)
+	b.handler.ServeHTTP(rec, out)
+	return rec
+}
+
+// first returns the first successful response.
+func (f *fanOut) first(w http.ResponseWriter, results <-chan fanOutResult) {
+	for range f.branches {
+		r := <-results
+		err := r.rec.err()
+		if err == nil {
+			r.rec.writeTo(w)
+			return
+		}
+		log.Warnf("Fanout branch %v failed: %v", f.branches[r.index].BackendId, err)
+	}
+	writeResponse(w, http.StatusBadGateway, "text/plain", []byte("all fanout branches failed"))
+}
+
+// quorum returns the successful response once enough branches have returned
+// it.
+func (f *fanOut) quorum(w http.ResponseWriter, results <-chan fanOutResult) {
+	votes := make(map[string]int)
+	top := 0
+	for n := len(f.branches); n > 0; n-- {
+		r := <-results
+		if err := r.rec.err(); err != nil {
+			log.Warnf("Fanout branch %v failed: %v", f.branches[r.index].BackendId, err)
+		} else {
+			vote := strconv.Itoa(r.rec.code) + " " + r.rec.body.String()
+			votes[vote]++
+			if votes[vote] == f.cfg.Quorum {
+				r.rec.writeTo(w)
+				return
+			}
+			if votes[vote] > top {
+				top = votes[vote]
+			}
+		}
+		// Give up once the remaining branches can not make the quorum.
+		if top+n-1 < f.cfg.Quorum {
+			break
+		}
+	}
+	writeResponse(w, http.StatusBadGateway, "text/plain", []byte("fanout branches have not reached quorum"))
+}
+
+// mergeJSON waits for all responses and merges them. Arrays are concatenated
+// if no branch has a key, otherwise the responses go to the keys of the
+// merged object or have their fields merged into it in the branch order.
+func (f *fanOut) mergeJSON(w http.ResponseWriter, results <-chan fanOutResult) {
+	bodies := make([]json.RawMessage, len(f.branches))
+	for range f.branches {
+		r := <-results
+		b := f.branches[r.index]
+		err := r.rec.err()
+		if err == nil && !json.Valid(r.rec.body.Bytes()) {
+			err = fmt.Errorf("response is not JSON")
+		}
+		if err != nil {
+			log.Warnf("Fanout branch %v failed: %v", b.BackendId, err)
+			if f.cfg.OnPartialFailure != engine.FanOutIgnore {
+				writeResponse(w, http.StatusBadGateway, "text/plain", []byte(fmt.Sprintf("fanout branch %v failed", b.BackendId)))
+				return
+			}
+			continue
+		}
+		bodies[r.index] = r.rec.body.Bytes()
+	}
+
+	merged, err := f.merge(bodies)
+	if err != nil {
+		log.Warnf("Failed to merge fanout responses: %v", err)
+		writeResponse(w, http.StatusBadGateway, "text/plain", []byte(err.Error()))
+		return
+	}
+	writeResponse(w, http.StatusOK, "application/json", merged)
+}
+
+// writeResponse writes a response of the known length, the frontend buffer
+// drops the bodies of responses without one.
+func writeResponse(w http.ResponseWriter, code int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func (f *fanOut) merge(bodies []json.RawMessage) ([]byte, error) {
+	var arrays []json.RawMessage
+	object := make(map[string]json.RawMessage)
+	succeeded := 0
+	for i, body := range bodies {
+		if body == nil {
+			continue
+		}
+		succeeded++
+		b := f.branches[i]
+		if b.Key != "" {
+			object[b.Key] = body
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err == nil {
+			for k, v := range fields {
+				object[k] = v
+			}
+			continue
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, fmt.Errorf("response of branch %v is neither a JSON object nor an array", b.BackendId)
+		}
+		if arrays == nil {
+			arrays = []json.RawMessage{}
+		}
+		arrays = append(arrays, items...)
+	}
+	if succeeded == 0 {
+		return nil, fmt.Errorf("all fanout branches failed")
+	}
+	if arrays != nil {
+		if len(object) != 0 {
+			return nil, fmt.Errorf("fanout branches have returned both JSON objects and arrays")
+		}
+		return json.Marshal(arrays)
+	}
+	return json.Marshal(object)
+}
+
+// responseRecorder keeps the response of a branch in memory. Writes past the
+// limit fail, so the response is cut short and the branch fails.
+type responseRecorder struct {
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+	limit       int64
+	tooLarge    bool
+}
+
+func newResponseRecorder(limit int64) *responseRecorder {
+	return &responseRecorder{header: make(http.Header), code: http.StatusOK, limit: limit}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	if int64(r.body.Len()+len(b)) > r.limit {
+		r.tooLarge = true
+		return 0, fmt.Errorf("response exceeds %d bytes", r.limit)
+	}
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.code, r.wroteHeader = code, true
+	}
+}
+
+// err returns the reason the branch has failed, or nil if it has returned
+// a successful response.
+func (r *responseRecorder) err() error {
+	if r.tooLarge {
+		return fmt.Errorf("response exceeds %d bytes", r.limit)
+	}
+	if r.code < 200 || r.code >= 300 {
+		return fmt.Errorf("status %d", r.code)
+	}
+	return nil
+}
+
+func (r *responseRecorder) writeTo(w http.ResponseWriter) {
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(r.code)
+	w.Write(r.body.Bytes())
+}
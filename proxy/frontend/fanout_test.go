@@ -0,0 +1,182 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/proxy/backend"
+)
+
+func TestFanOut(t *testing.T) {
+	users := newJSONServer(0, http.StatusOK, `{"name": "alice"}`)
+	defer users.Close()
+	orders := newJSONServer(0, http.StatusOK, `[1, 2]`)
+	defer orders.Close()
+	more := newJSONServer(0, http.StatusOK, `[3]`)
+	defer more.Close()
+	failing := newJSONServer(0, http.StatusInternalServerError, `{}`)
+	defer failing.Close()
+	slow := newJSONServer(time.Second, http.StatusOK, `{"slow": true}`)
+	defer slow.Close()
+
+	bes := map[string]*backend.T{
+		"users":   newTestBackend(t, "users", users.URL),
+		"orders":  newTestBackend(t, "orders", orders.URL),
+		"more":    newTestBackend(t, "more", more.URL),
+		"failing": newTestBackend(t, "failing", failing.URL),
+		"slow":    newTestBackend(t, "slow", slow.URL),
+	}
+	for i, tc := range []struct {
+		settings engine.FanOutFrontendSettings
+		code     int
+		body     string
+	}{
+		{
+			settings: engine.FanOutFrontendSettings{Branches: []engine.FanOutBranch{
+				{BackendId: "users", Key: "user"}, {BackendId: "orders", Key: "orders"}}},
+			code: http.StatusOK,
+			body: `{"orders":[1,2],"user":{"name":"alice"}}`,
+		},
+		{
+			settings: engine.FanOutFrontendSettings{Branches: []engine.FanOutBranch{
+				{BackendId: "orders"}, {BackendId: "more"}}},
+			code: http.StatusOK,
+			body: `[1,2,3]`,
+		},
+		{
+			settings: engine.FanOutFrontendSettings{Branches: []engine.FanOutBranch{
+				{BackendId: "users"}, {BackendId: "failing"}}},
+			code: http.StatusBadGateway,
+		},
+		{
+			settings: engine.FanOutFrontendSettings{Branches: []engine.FanOutBranch{
+				{BackendId: "users"}, {BackendId: "failing"}, {BackendId: "slow", Timeout: "50ms"}},
+				OnPartialFailure: engine.FanOutIgnore},
+			code: http.StatusOK,
+			body: `{"name":"alice"}`,
+		},
+		{
+			settings: engine.FanOutFrontendSettings{Branches: []engine.FanOutBranch{
+				{BackendId: "failing"}, {BackendId: "slow"}}, Merge: engine.FanOutMergeFirst},
+			code: http.StatusOK,
+			body: `{"slow": true}`,
+		},
+		{
+			settings: engine.FanOutFrontendSettings{Branches: []engine.FanOutBranch{
+				{BackendId: "orders"}, {BackendId: "failing"}, {BackendId: "more"}}, Merge: engine.FanOutMergeQuorum},
+			code: http.StatusBadGateway,
+		},
+		{
+			settings: engine.FanOutFrontendSettings{Branches: []engine.FanOutBranch{
+				{BackendId: "users"}, {BackendId: "failing"}, {BackendId: "users2"}}, Merge: engine.FanOutMergeQuorum},
+			code: http.StatusOK,
+			body: `{"name": "alice"}`,
+		},
+		{
+			// The users response is over the limit, so only the orders are merged
+			settings: engine.FanOutFrontendSettings{Branches: []engine.FanOutBranch{
+				{BackendId: "users", Key: "user"}, {BackendId: "orders", Key: "orders"}},
+				OnPartialFailure: engine.FanOutIgnore, MaxResponseBytes: 10},
+			code: http.StatusOK,
+			body: `{"orders":[1,2]}`,
+		},
+		{
+			settings: engine.FanOutFrontendSettings{Branches: []engine.FanOutBranch{
+				{BackendId: "users"}, {BackendId: "orders"}}, Merge: engine.FanOutMergeFirst, MaxResponseBytes: 1},
+			code: http.StatusBadGateway,
+		},
+	} {
+		feCfg, err := engine.NewFanOutFrontend(route.NewMux(), "f1", `Path("/")`, tc.settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var feBes []*backend.T
+		for _, beKey := range feCfg.BackendKeys() {
+			be, ok := bes[beKey.Id]
+			if !ok {
+				be = newTestBackend(t, beKey.Id, users.URL)
+			}
+			feBes = append(feBes, be)
+		}
+		fe := New(*feCfg, feBes, proxy.Options{}, nil, plugin.FrontendListeners{})
+
+		w := serve(fe, nil)
+		if w.Code != tc.code || (tc.body != "" && w.Body.String() != tc.body) {
+			t.Errorf("case %d: expected %d %s, got %d %s", i, tc.code, tc.body, w.Code, w.Body.String())
+		}
+		// Frontend stats count the incoming requests rather than the
+		// requests to the backends, failed requests may have been retried.
+		feCfgWithStats, _, err := fe.CfgWithStats()
+		if err != nil || (tc.code == http.StatusOK && feCfgWithStats.Stats.Counters.Total != 1) {
+			t.Errorf("case %d: unexpected stats %v, %v", i, feCfgWithStats.Stats, err)
+		}
+	}
+}
+
+func newJSONServer(delay time.Duration, code int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestFanOutRequestBody(t *testing.T) {
+	bodies := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 16)
+		n, _ := r.Body.Read(buf)
+		bodies <- string(buf[:n])
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	feCfg, err := engine.NewFanOutFrontend(route.NewMux(), "f1", `Path("/")`, engine.FanOutFrontendSettings{
+		Branches: []engine.FanOutBranch{{BackendId: "b1"}, {BackendId: "b2"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := New(*feCfg, []*backend.T{newTestBackend(t, "b1", srv.URL), newTestBackend(t, "b2", srv.URL)},
+		proxy.Options{}, nil, plugin.FrontendListeners{})
+	w := httptest.NewRecorder()
+	fe.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/", strings.NewReader("hello")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	for i := 0; i < 2; i++ {
+		if body := <-bodies; body != "hello" {
+			t.Errorf("unexpected request body %q", body)
+		}
+	}
+}
+
+func TestFanOutRequestBodyTooLarge(t *testing.T) {
+	srv := newJSONServer(0, http.StatusOK, `{}`)
+	defer srv.Close()
+
+	feCfg, err := engine.NewFanOutFrontend(route.NewMux(), "f1", `Path("/")`, engine.FanOutFrontendSettings{
+		Branches: []engine.FanOutBranch{{BackendId: "b1"}, {BackendId: "b2"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := New(*feCfg, []*backend.T{newTestBackend(t, "b1", srv.URL), newTestBackend(t, "b2", srv.URL)},
+		proxy.Options{}, nil, plugin.FrontendListeners{})
+	w := httptest.NewRecorder()
+	body := strings.NewReader(strings.Repeat("a", maxRetryBodyBytes+1))
+	fe.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/", body))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
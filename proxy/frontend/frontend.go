@@ -13,32 +13,77 @@ import (
 	"github.com/vulcand/oxy/buffer"
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/memmetrics"
-	"github.com/vulcand/oxy/roundrobin"
 	"github.com/vulcand/oxy/stream"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/proxy"
 	"github.com/vulcand/vulcand/proxy/backend"
+	"github.com/vulcand/vulcand/proxy/balancer"
 	"github.com/vulcand/vulcand/proxy/rtmcollect"
 )
 
 // T represents a frontend instance. It implements http.Handler interface to be
 // used with an http.Server. The implementation takes measures to collect round
-// trip metrics for the frontend and all servers of an associated backend.
+// trip metrics for the frontend and all servers of associated backends.
 type T struct {
-	mu         sync.Mutex
-	ready      bool
-	trustXFDH  bool
-	cfg        engine.Frontend
-	mwCfgs     map[engine.MiddlewareKey]engine.Middleware
+	mu        sync.Mutex
+	ready     bool
+	trustXFDH bool
+	cfg       engine.Frontend
+	mwCfgs    map[engine.MiddlewareKey]engine.Middleware
+	// backends are ordered as the keys returned by cfg.BackendKeys().
+	backends []*backend.T
+	handler  http.Handler
+	branches []*branch
+	// shadow is the branch of the mirror backend, it is nil unless the
+	// frontend mirrors requests.
+	shadow *branch
+	// feCollect collects round-trip metrics of the frontend requests when
+	// they are not the requests of the branches, e.g. of fanout frontends.
+	feCollect *rtmcollect.T
+	// hedges and retries are the budgets of hedged and retried requests,
+	// they are kept across rebuilds unless the budget percent changes.
+	hedges    *budget
+	retries   *budget
+	listeners plugin.FrontendListeners
+}
+
+// branch is the part of the handler chain sending requests to one backend.
+type branch struct {
 	backend    *backend.T
+	weight     int
 	handler    http.Handler
+	lb         balancer.T
 	rtmCollect *rtmcollect.T
-	listeners  plugin.FrontendListeners
+	hedger     *hedger
+	retrier    *retrier
+	// healthGen is the backend health generation the servers of the branch
+	// have been synced for.
+	healthGen int64
+}
+
+// syncHealth syncs the servers of the branch with the healthy servers of the
+// backend. The load balancer and the metrics collector are kept, so that
+// their state survives servers becoming healthy or unhealthy.
+func (b *branch) syncHealth() {
+	healthGen := b.backend.HealthGeneration()
+	if healthGen == b.healthGen {
+		return
+	}
+	_, beSrvs := b.backend.Snapshot()
+	syncServers(b.lb, beSrvs, b.rtmCollect)
+	if b.hedger != nil {
+		b.hedger.setServers(beSrvs)
+	}
+	if b.retrier != nil {
+		b.retrier.setServers(beSrvs)
+	}
+	b.healthGen = healthGen
 }
 
-// New returns a new frontend instance.
-func New(cfg engine.Frontend, be *backend.T, opts proxy.Options,
+// New returns a new frontend instance. Backends should be ordered as the keys
+// returned by cfg.BackendKeys().
+func New(cfg engine.Frontend, bes []*backend.T, opts proxy.Options,
 	mwCfgs map[engine.MiddlewareKey]engine.Middleware,
 	listeners plugin.FrontendListeners,
 ) *T {
@@ -49,7 +94,7 @@ func New(cfg engine.Frontend, be *backend.T, opts proxy.Options,
 		cfg:       cfg,
 		trustXFDH: opts.TrustForwardHeader,
 		mwCfgs:    mwCfgs,
-		backend:   be,
+		backends:  bes,
 		listeners: listeners,
 	}
 	return &fe
@@ -60,12 +105,16 @@ func (fe *T) Key() engine.FrontendKey {
 	return fe.cfg.Key()
 }
 
-// BackendKey returns the storage key of an associated backend.
-func (fe *T) BackendKey() engine.BackendKey {
+// BackendKeys returns the storage keys of associated backends.
+func (fe *T) BackendKeys() []engine.BackendKey {
 	fe.mu.Lock()
-	beKey := fe.backend.Key()
-	fe.mu.Unlock()
-	return beKey
+	defer fe.mu.Unlock()
+
+	beKeys := make([]engine.BackendKey, len(fe.backends))
+	for i, be := range fe.backends {
+		beKeys[i] = be.Key()
+	}
+	return beKeys
 }
 
 // Route returns HTTP path. It should be used to configure an HTTP router to
@@ -77,13 +126,39 @@ func (fe *T) Route() string {
 	return route
 }
 
+// Type returns the frontend type, tcp frontends have no route and serve the
+// connections of a listener instead.
+func (fe *T) Type() string {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	return fe.cfg.Type
+}
+
+// Cfg returns the frontend storage config.
+func (fe *T) Cfg() engine.Frontend {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	return fe.cfg
+}
+
+// Middleware returns a middleware by a storage key if exists.
+func (fe *T) Middleware(mwKey engine.MiddlewareKey) (engine.Middleware, bool) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	mwCfg, ok := fe.mwCfgs[mwKey]
+	return mwCfg, ok
+}
+
 // String returns a string representation of the instance to be used in logs.
 func (fe *T) String() string {
 	return fmt.Sprintf("frontend(%v)", fe.cfg.Id)
 }
 
-// Update updates the config and/or association with a backend.
-func (fe *T) Update(feCfg engine.Frontend, be *backend.T) error {
+// Update updates the config and/or association with backends.
+func (fe *T) Update(feCfg engine.Frontend, bes []*backend.T) error {
 	fe.mu.Lock()
 	defer fe.mu.Unlock()
 
@@ -95,8 +170,8 @@ func (fe *T) Update(feCfg engine.Frontend, be *backend.T) error {
 		fe.cfg = feCfg
 		fe.ready = false
 	}
-	if be != fe.backend {
-		fe.backend = be
+	if !sameBackends(bes, fe.backends) {
+		fe.backends = bes
 		fe.ready = false
 	}
 	return nil
@@ -134,60 +209,84 @@ func (fe *T) OnBackendMutated() {
 }
 
 // CfgWithStats returns the frontend storage config with associated round trip
-// stats.
+// stats of the requests to all its backends, and of the mirrored requests.
 func (fe *T) CfgWithStats() (engine.Frontend, bool, error) {
 	fe.mu.Lock()
-	rtmCollect := fe.rtmCollect
+	branches, shadow, feCollect := fe.branches, fe.shadow, fe.feCollect
 	feCfg := fe.cfg
 	fe.mu.Unlock()
 
-	if rtmCollect == nil {
+	if branches == nil {
 		return engine.Frontend{}, false, nil
 	}
 	var err error
-	if feCfg.Stats, err = rtmCollect.RTStats(); err != nil {
+	if feCollect != nil {
+		feCfg.Stats, err = feCollect.RTStats()
+	} else if len(branches) == 1 {
+		feCfg.Stats, err = branches[0].rtmCollect.RTStats()
+	} else {
+		aggregate := rtmcollect.NewRTMetrics()
+		for _, b := range branches {
+			b.rtmCollect.AppendFeRTMTo(aggregate)
+		}
+		feCfg.Stats, err = engine.NewRoundTripStats(aggregate)
+	}
+	if err != nil {
 		return engine.Frontend{}, false, errors.Wrap(err, "failed to get stats")
 	}
+	if shadow != nil {
+		if feCfg.MirrorStats, err = shadow.rtmCollect.RTStats(); err != nil {
+			return engine.Frontend{}, false, errors.Wrap(err, "failed to get mirror stats")
+		}
+	}
 	return feCfg, true, nil
 }
 
-// AppendRTMTo appends frontend round-trip metrics to an aggregate.
-func (fe *T) AppendRTMTo(aggregate *memmetrics.RTMetrics) {
-	fe.mu.Lock()
-	rtmCollect := fe.rtmCollect
-	fe.mu.Unlock()
-
-	if rtmCollect == nil {
-		return
+// AppendRTMTo appends round-trip metrics of the frontend requests sent to a
+// backend to an aggregate.
+func (fe *T) AppendRTMTo(aggregate *memmetrics.RTMetrics, beKey engine.BackendKey) {
+	for _, b := range fe.getBranches(&beKey) {
+		b.rtmCollect.AppendFeRTMTo(aggregate)
 	}
-	rtmCollect.AppendFeRTMTo(aggregate)
 }
 
 // AppendBeSrvRTMTo appends round-trip metrics of a backend server to aggregate.
 // It does nothing if a server if the specified URL key does not exist.
-func (fe *T) AppendBeSrvRTMTo(aggregate *memmetrics.RTMetrics, beSrvURLKey backend.SrvURLKey) {
-	fe.mu.Lock()
-	rtmCollect := fe.rtmCollect
-	fe.mu.Unlock()
-
-	if rtmCollect == nil {
-		return
+func (fe *T) AppendBeSrvRTMTo(aggregate *memmetrics.RTMetrics, beKey engine.BackendKey, beSrvURLKey backend.SrvURLKey) {
+	for _, b := range fe.getBranches(&beKey) {
+		b.rtmCollect.AppendBeSrvRTMTo(aggregate, beSrvURLKey)
 	}
-	rtmCollect.AppendBeSrvRTMTo(aggregate, beSrvURLKey)
 }
 
 // AppendAllBeSrvRTMsTo appends round-trip metrics of all backend servers of
-// the backend associated with the frontend to the respective aggregates. If an
-// aggregate for a server is missing from the map then a new one is created.
-func (fe *T) AppendAllBeSrvRTMsTo(aggregates map[backend.SrvURLKey]rtmcollect.BeSrvEntry) {
+// the backends associated with the frontend, or only the specified one, to
+// the respective aggregates. If an aggregate for a server is missing from the
+// map then a new one is created.
+func (fe *T) AppendAllBeSrvRTMsTo(aggregates map[backend.SrvURLKey]rtmcollect.BeSrvEntry, beKey *engine.BackendKey) {
+	for _, b := range fe.getBranches(beKey) {
+		b.rtmCollect.AppendAllBeSrvRTMsTo(aggregates)
+	}
+}
+
+// getBranches returns the branches of the current handler including the
+// shadow one, all of them if the backend key is nil.
+func (fe *T) getBranches(beKey *engine.BackendKey) []*branch {
 	fe.mu.Lock()
-	rtmCollect := fe.rtmCollect
-	fe.mu.Unlock()
+	defer fe.mu.Unlock()
 
-	if rtmCollect == nil {
-		return
+	branches := fe.branches
+	if fe.shadow != nil {
+		branches = append(branches[:len(branches):len(branches)], fe.shadow)
+	}
+	if beKey == nil {
+		return branches
+	}
+	for _, b := range branches {
+		if b.backend.Key() == *beKey {
+			return []*branch{b}
+		}
 	}
-	rtmCollect.AppendAllBeSrvRTMsTo(aggregates)
+	return nil
 }
 
 // ServeHTTP implements http.Handler.
@@ -205,6 +304,15 @@ func (fe *T) getHandler() http.Handler {
 			return proxy.DefaultNotFound
 		}
 		fe.ready = true
+		return fe.handler
+	}
+	// Servers of the backends that have become healthy or unhealthy since
+	// the handler has been built are synced into the existing branches.
+	for _, b := range fe.branches {
+		b.syncHealth()
+	}
+	if fe.shadow != nil {
+		fe.shadow.syncHealth()
 	}
 	return fe.handler
 }
@@ -219,93 +327,215 @@ func (fe *T) sortedMiddlewares() []engine.Middleware {
 }
 
 func (fe *T) rebuild() error {
+	if fe.cfg.Type == engine.TCP {
+		return fe.rebuildTCP()
+	}
 	httpCfg := fe.cfg.HTTPSettings()
-	httpTp, beSrvs := fe.backend.Snapshot()
+	bCfg := branchSettings{http: httpCfg}
+	var err error
+	if bCfg.hedging, err = httpCfg.HedgingSettings(); err != nil {
+		return errors.Wrap(err, "invalid hedging settings")
+	}
+	if bCfg.hedging == nil {
+		fe.hedges = nil
+	} else if fe.hedges == nil || fe.hedges.percent != bCfg.hedging.BudgetPercent {
+		fe.hedges = newBudget(bCfg.hedging.BudgetPercent)
+	}
+	if bCfg.retry, err = httpCfg.RetrySettings(); err != nil {
+		return errors.Wrap(err, "invalid retry policy")
+	}
+	if bCfg.retry == nil {
+		fe.retries = nil
+	} else if fe.retries == nil || fe.retries.percent != bCfg.retry.BudgetPercent {
+		fe.retries = newBudget(bCfg.retry.BudgetPercent)
+	}
+	if bCfg.deadline, err = httpCfg.DeadlineSettings(); err != nil {
+		return errors.Wrap(err, "invalid deadline settings")
+	}
 
-	// set up forwarder
-	fwd, err := forward.New(
-		forward.RoundTripper(httpTp),
-		forward.Rewriter(
-			&forward.HeaderRewriter{
-				Hostname:           httpCfg.Hostname,
-				TrustForwardHeader: fe.trustXFDH || httpCfg.TrustForwardHeader,
-			}),
-		forward.PassHostHeader(httpCfg.PassHostHeader),
-		forward.WebsocketTLSClientConfig(httpTp.TLSClientConfig),
-		forward.Stream(httpCfg.Stream),
-		forward.StreamingFlushInterval(time.Duration(httpCfg.StreamFlushIntervalNanoSecs)*time.Nanosecond),
-		forward.StateListener(fe.listeners.ConnTck))
+	var branches []*branch
+	var shadow *branch
+	for _, be := range fe.backends {
+		b, err := fe.newBranch(be, bCfg)
+		if err != nil {
+			return errors.Wrapf(err, "cannot create handler of backend %v", be.Key().Id)
+		}
+		if fe.cfg.Mirror != nil && be.Key().Id == fe.cfg.Mirror.BackendId {
+			shadow = b
+			continue
+		}
+		branches = append(branches, b)
+	}
 
-	// Add a round-trip metrics collector to the handlers chain.
-	rc, err := rtmcollect.New(fwd)
-	if err != nil {
-		return errors.Wrap(err, "cannot create rtmCollect")
+	// Send requests to all backends of fanout frontends, otherwise split the
+	// traffic between the backends if there are several of them.
+	var lb http.Handler
+	var feCollect *rtmcollect.T
+	if fe.cfg.Type == engine.FanOut {
+		fanOutCfg, err := fe.cfg.FanOutSettings()
+		if err != nil {
+			return errors.Wrap(err, "invalid fanout settings")
+		}
+		fo, err := newFanOut(branches, *fanOutCfg)
+		if err != nil {
+			return errors.Wrap(err, "cannot create fanout")
+		}
+		if feCollect, err = rtmcollect.New(fo); err != nil {
+			return errors.Wrap(err, "cannot create rtmCollect")
+		}
+		lb = feCollect
+	} else if len(branches) == 1 {
+		lb = branches[0].handler
+	} else {
+		lb = newSplitter(branches, fe.cfg.BackendPin)
+	}
+	// Mirror requests that have passed the middlewares.
+	if shadow != nil {
+		lb = newMirror(lb, shadow, *fe.cfg.Mirror)
 	}
 
-	// Add a load balancer to the handlers chain.
-	rr, err := roundrobin.New(rc, roundrobin.RoundRobinRequestRewriteListener(fe.listeners.RrRewriteListener))
+	next, err := fe.chainMiddlewares(lb)
 	if err != nil {
-		return errors.Wrap(err, "cannot create load balancer")
+		return err
+	}
+
+	// stream will retry and replay requests, fix encodings. Requests are
+	// retried by the branches instead if there is a retry policy.
+	if httpCfg.FailoverPredicate == "" {
+		httpCfg.FailoverPredicate = `IsNetworkError() && RequestMethod() == "GET" && Attempts() < 2`
 	}
 
-	// Add a rebalancer to the handlers chain. It will readjust load balancer
-	// weights based on error ratios.
-	rb, err := roundrobin.NewRebalancer(rr, roundrobin.RebalancerRequestRewriteListener(fe.listeners.RbRewriteListener))
+	var topHandler http.Handler
+	if httpCfg.Stream {
+		topHandler, err = stream.New(next)
+	} else if bCfg.retry != nil {
+		topHandler, err = buffer.New(next,
+			buffer.MaxRequestBodyBytes(httpCfg.Limits.MaxBodyBytes),
+			buffer.MemRequestBodyBytes(httpCfg.Limits.MaxMemBodyBytes))
+	} else {
+		topHandler, err = buffer.New(next,
+			buffer.Retry(httpCfg.FailoverPredicate),
+			buffer.MaxRequestBodyBytes(httpCfg.Limits.MaxBodyBytes),
+			buffer.MemRequestBodyBytes(httpCfg.Limits.MaxMemBodyBytes))
+	}
 	if err != nil {
-		return errors.Wrap(err, "cannot create rebalancer")
+		return errors.Wrap(err, "failed to create handler")
 	}
+	if bCfg.deadline != nil {
+		topHandler = &deadline{next: topHandler, cfg: *bCfg.deadline}
+	}
+
+	fe.handler = topHandler
+	fe.branches = branches
+	fe.shadow = shadow
+	fe.feCollect = feCollect
+	return nil
+}
 
-	// create middlewares sorted by priority and chain them
+// chainMiddlewares creates middlewares sorted by priority and chains them in
+// front of the handler.
+func (fe *T) chainMiddlewares(lb http.Handler) (http.Handler, error) {
 	middlewares := fe.sortedMiddlewares()
 	handlers := make([]http.Handler, len(middlewares))
 	for i, mw := range middlewares {
 		var prev http.Handler
 		if i == 0 {
-			prev = rb
+			prev = lb
 		} else {
 			prev = handlers[i-1]
 		}
 		h, err := mw.Middleware.NewHandler(prev)
 		if err != nil {
-			return errors.Wrapf(err, "cannot get middleware %v handler", mw.Id)
+			return nil, errors.Wrapf(err, "cannot get middleware %v handler", mw.Id)
 		}
 		handlers[i] = h
 	}
-
-	var next http.Handler
 	if len(handlers) != 0 {
-		next = handlers[len(handlers)-1]
-	} else {
-		next = rb
+		return handlers[len(handlers)-1], nil
 	}
+	return lb, nil
+}
 
-	// stream will retry and replay requests, fix encodings
-	if httpCfg.FailoverPredicate == "" {
-		httpCfg.FailoverPredicate = `IsNetworkError() && RequestMethod() == "GET" && Attempts() < 2`
+// branchSettings are the parsed frontend settings the branches are built
+// with.
+type branchSettings struct {
+	http     engine.HTTPFrontendSettings
+	hedging  *engine.HedgingSettings
+	retry    *engine.RetrySettings
+	deadline *engine.DeadlineSettings
+}
+
+// newBranch creates the handler chain that sends requests to the servers of
+// the backend.
+func (fe *T) newBranch(be *backend.T, cfg branchSettings) (*branch, error) {
+	httpCfg := cfg.http
+	healthGen := be.HealthGeneration()
+	httpTp, beSrvs := be.Snapshot()
+
+	// set up forwarder
+	fwd, err := forward.New(
+		forward.RoundTripper(httpTp),
+		forward.Rewriter(
+			&forward.HeaderRewriter{
+				Hostname:           httpCfg.Hostname,
+				TrustForwardHeader: fe.trustXFDH || httpCfg.TrustForwardHeader,
+			}),
+		forward.PassHostHeader(httpCfg.PassHostHeader),
+		forward.WebsocketTLSClientConfig(httpTp.TLSClientConfig),
+		forward.Stream(httpCfg.Stream),
+		forward.StreamingFlushInterval(time.Duration(httpCfg.StreamFlushIntervalNanoSecs)*time.Nanosecond),
+		forward.StateListener(fe.listeners.ConnTck))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create forwarder")
 	}
 
-	var topHandler http.Handler
-	if httpCfg.Stream {
-		topHandler, err = stream.New(next)
-	} else {
-		topHandler, err = buffer.New(next,
-			buffer.Retry(httpCfg.FailoverPredicate),
-			buffer.MaxRequestBodyBytes(httpCfg.Limits.MaxBodyBytes),
-			buffer.MemRequestBodyBytes(httpCfg.Limits.MaxMemBodyBytes))
+	// Tell the servers how much time the request has got left.
+	var fwdHandler http.Handler = fwd
+	if cfg.deadline != nil {
+		fwdHandler = &deadlineHeader{next: fwd, header: cfg.deadline.Header}
 	}
+
+	// Add a round-trip metrics collector to the handlers chain.
+	rc, err := rtmcollect.New(fwdHandler)
 	if err != nil {
-		return errors.Wrap(err, "failed to create handler")
+		return nil, errors.Wrap(err, "cannot create rtmCollect")
 	}
 
-	syncServers(rb, beSrvs, rc)
+	// Requests to slow servers are hedged and failed requests are retried
+	// between the load balancer and the metrics collector so that every
+	// attempt is recorded.
+	next := http.Handler(rc)
+	var h *hedger
+	if cfg.hedging != nil {
+		h = newHedger(next, rc, beSrvs, fe.hedges, *cfg.hedging)
+		next = h
+	}
+	var r *retrier
+	if cfg.retry != nil {
+		r = newRetrier(next, beSrvs, fe.retries, *cfg.retry)
+		next = r
+	}
 
-	fe.handler = topHandler
-	fe.rtmCollect = rc
-	return nil
+	// Add a load balancer of the type configured for the backend to the
+	// handlers chain. Round robin is stacked with a rebalancer that readjusts
+	// load balancer weights based on error ratios.
+	lb, err := balancer.New(be.LoadBalancer(), next, rc, fe.listeners)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create load balancer")
+	}
+	syncServers(lb, beSrvs, rc)
+
+	b := &branch{backend: be, handler: lb, lb: lb, rtmCollect: rc, hedger: h, retrier: r, healthGen: healthGen}
+	for _, beRef := range fe.cfg.Backends {
+		if beRef.Id == be.Key().Id {
+			b.weight = beRef.Weight
+		}
+	}
+	return b, nil
 }
 
-// syncServers syncs backend servers and rebalancer state.
-func syncServers(balancer *roundrobin.Rebalancer, beSrvs []backend.Srv, watcher *rtmcollect.T) {
+// syncServers syncs backend servers and load balancer state.
+func syncServers(lb balancer.T, beSrvs []backend.Srv, watcher *rtmcollect.T) {
 	// First, collect and parse servers to add
 	newServers := make(map[backend.SrvURLKey]backend.Srv)
 	for _, newBeSrv := range beSrvs {
@@ -314,14 +544,14 @@ func syncServers(balancer *roundrobin.Rebalancer, beSrvs []backend.Srv, watcher
 
 	// Memorize what endpoints exist in load balancer at the moment
 	oldServers := make(map[backend.SrvURLKey]*url.URL)
-	for _, oldBeSrvURL := range balancer.Servers() {
+	for _, oldBeSrvURL := range lb.Servers() {
 		oldServers[backend.NewSrvURLKey(oldBeSrvURL)] = oldBeSrvURL
 	}
 
 	// First, add endpoints, that should be added and are not in lb
 	for newBeSrvURLKey, newBeSrv := range newServers {
 		if _, ok := oldServers[newBeSrvURLKey]; !ok {
-			if err := balancer.UpsertServer(newBeSrv.URL()); err != nil {
+			if err := lb.UpsertServer(newBeSrv.URL(), newBeSrv.Weight()); err != nil {
 				log.Errorf("Failed to add %v, err: %s", newBeSrv.URL(), err)
 			}
 			watcher.UpsertServer(newBeSrv)
@@ -331,7 +561,7 @@ func syncServers(balancer *roundrobin.Rebalancer, beSrvs []backend.Srv, watcher
 	// Second, remove endpoints that should not be there any more
 	for oldBeSrvURLKey, oldBeSrvURL := range oldServers {
 		if _, ok := newServers[oldBeSrvURLKey]; !ok {
-			if err := balancer.RemoveServer(oldBeSrvURL); err != nil {
+			if err := lb.RemoveServer(oldBeSrvURL); err != nil {
 				log.Errorf("Failed to remove %v, err: %v", oldBeSrvURL, err)
 			}
 			watcher.RemoveServer(oldBeSrvURLKey)
@@ -339,6 +569,18 @@ func syncServers(balancer *roundrobin.Rebalancer, beSrvs []backend.Srv, watcher
 	}
 }
 
+func sameBackends(a, b []*backend.T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 type middlewareSorter struct {
 	ms []engine.Middleware
 }
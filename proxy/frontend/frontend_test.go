@@ -0,0 +1,72 @@
+package frontend
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/proxy/backend"
+	"github.com/vulcand/vulcand/proxy/rtmcollect"
+)
+
+func TestHealthChangeKeepsBranches(t *testing.T) {
+	srvA := newTestServer("a")
+	defer srvA.Close()
+	srvB := newTestServer("b")
+	defer srvB.Close()
+
+	beCfg, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{
+		OutlierDetection: &engine.HTTPBackendOutlierDetection{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be, err := backend.New(*beCfg, proxy.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range []engine.Server{{Id: "a", URL: srvA.URL}, {Id: "b", URL: srvB.URL}} {
+		if _, err := be.UpsertServer(srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	feCfg, err := engine.NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/")`, engine.HTTPFrontendSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := New(*feCfg, []*backend.T{be}, proxy.Options{}, nil, plugin.FrontendListeners{})
+	for i := 0; i < 4; i++ {
+		serve(fe, nil)
+	}
+	b := fe.branches[0]
+
+	// Eject server b, the branch keeps its load balancer and metrics
+	stats := map[backend.SrvURLKey]engine.RoundTripStats{}
+	for u, netErrors := range map[string]int64{srvA.URL: 0, srvB.URL: 50} {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats[backend.NewSrvURLKey(parsed)] = engine.RoundTripStats{
+			LatencyBrackets: []engine.Bracket{{Quantile: 50, Value: time.Millisecond}},
+			Counters:        engine.Counters{Period: 10 * time.Second, NetErrors: netErrors, Total: 100},
+		}
+	}
+	be.EjectOutliers(time.Now(), stats)
+	for i := 0; i < 4; i++ {
+		if w := serve(fe, nil); w.Body.String() != "a" {
+			t.Errorf("request %d: expected a, got %q", i, w.Body.String())
+		}
+	}
+	if fe.branches[0] != b || len(b.lb.Servers()) != 1 {
+		t.Errorf("branch has been rebuilt or not synced, servers %v", b.lb.Servers())
+	}
+	aggregate := rtmcollect.NewRTMetrics()
+	fe.AppendRTMTo(aggregate, be.Key())
+	if aggregate.TotalCount() != 8 {
+		t.Errorf("expected 8 requests, got %d", aggregate.TotalCount())
+	}
+}
@@ -0,0 +1,87 @@
+package frontend
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/proxy/backend"
+	"golang.org/x/net/http2"
+)
+
+func TestGRPCBackend(t *testing.T) {
+	// The server streams the request back and fails like gRPC servers do,
+	// with a 200 response and the status in a trailer.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					body, _ := ioutil.ReadAll(r.Body)
+					w.Header().Set("Content-Type", "application/grpc")
+					w.Write(body)
+					w.(http.Flusher).Flush()
+					w.Header().Set(http.TrailerPrefix+"Grpc-Status", "14")
+					w.Header().Set(http.TrailerPrefix+"Grpc-Message", "unavailable")
+				})})
+		}
+	}()
+
+	beCfg, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{Protocol: engine.BackendH2C})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be, err := backend.New(*beCfg, proxy.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.UpsertServer(engine.Server{Id: "s0", URL: "http://" + l.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	feCfg, err := engine.NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/pkg.Service/Method")`,
+		engine.HTTPFrontendSettings{Stream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := New(*feCfg, []*backend.T{be}, proxy.Options{}, nil, plugin.FrontendListeners{})
+	srv := httptest.NewServer(fe)
+	defer srv.Close()
+
+	rsp, err := http.Post(srv.URL+"/pkg.Service/Method", "application/grpc", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("unexpected response %d %q", rsp.StatusCode, body)
+	}
+	if rsp.Trailer.Get("Grpc-Status") != "14" || rsp.Trailer.Get("Grpc-Message") != "unavailable" {
+		t.Errorf("unexpected trailers %v", rsp.Trailer)
+	}
+
+	// The gRPC status is counted as the matching HTTP status code
+	feCfgWithStats, _, err := fe.CfgWithStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := feCfgWithStats.Stats.Counters.StatusCodes
+	if len(codes) != 1 || codes[0].Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status codes %v", codes)
+	}
+}
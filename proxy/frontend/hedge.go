@@ -0,0 +1,294 @@
+package frontend
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/proxy/backend"
+	"github.com/vulcand/vulcand/proxy/rtmcollect"
+)
+
+// hedgeDelayRefreshPeriod is how long the hedger uses the backend latency
+// percentile before computing it again.
+const hedgeDelayRefreshPeriod = time.Second
+
+// hedger sits between the load balancer and the servers of a backend. If
+// a server has not responded to an idempotent request within the latency
+// percentile of the backend, it sends the request to the next server as
+// well and passes the first response through, cancelling the other request.
+type hedger struct {
+	next      http.Handler
+	latencies *rtmcollect.T
+	budget    *budget
+	cfg       engine.HedgingSettings
+
+	mu          sync.Mutex
+	servers     []*url.URL
+	delay       time.Duration
+	delayOK     bool
+	refreshedAt time.Time
+}
+
+func newHedger(next http.Handler, latencies *rtmcollect.T, beSrvs []backend.Srv, budget *budget,
+	cfg engine.HedgingSettings,
+) *hedger {
+	h := &hedger{next: next, latencies: latencies, budget: budget, cfg: cfg}
+	h.setServers(beSrvs)
+	return h
+}
+
+// setServers replaces the servers the requests are hedged to.
+func (h *hedger) setServers(beSrvs []backend.Srv) {
+	servers := srvURLs(beSrvs)
+	h.mu.Lock()
+	h.servers = servers
+	h.mu.Unlock()
+}
+
+// ServeHTTP implements http.Handler.
+func (h *hedger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.budget.request()
+	delay, servers, ok := h.hedgeDelay()
+	if !ok || len(servers) < 2 || !isHedgeable(req) {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	race := &hedgeRace{w: w}
+	done := make(chan *hedgeWriter, 2)
+	primary, _ := race.join(req.Context())
+	defer primary.cancel()
+	go h.serve(primary, req, req.URL, done)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	if !h.budget.take() {
+		<-done
+		return
+	}
+	// The primary request has started responding in the meantime.
+	hedge, ok := race.join(req.Context())
+	if !ok {
+		<-done
+		return
+	}
+	defer hedge.cancel()
+	go h.serve(hedge, req, nextServer(servers, req.URL), done)
+
+	<-done
+	<-done
+	race.finish()
+}
+
+func (h *hedger) serve(hw *hedgeWriter, req *http.Request, u *url.URL, done chan<- *hedgeWriter) {
+	out := req.WithContext(hw.ctx)
+	out.URL = utils.CopyURL(u)
+	out.Header = cloneHeader(req.Header)
+	// Both requests can not read the same body, hedged requests have none.
+	out.Body = http.NoBody
+	h.next.ServeHTTP(hw, out)
+	hw.finish()
+	done <- hw
+}
+
+// hedgeDelay returns how long to wait for a server before hedging and the
+// servers to hedge to, it returns false until the backend latency is known.
+func (h *hedger) hedgeDelay() (time.Duration, []*url.URL, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now := time.Now(); now.Sub(h.refreshedAt) > hedgeDelayRefreshPeriod {
+		h.delay, h.delayOK = h.latencies.LatencyAtQuantile(h.cfg.Percentile)
+		if h.delay < h.cfg.MinDelay {
+			h.delay = h.cfg.MinDelay
+		}
+		h.refreshedAt = now
+	}
+	return h.delay, h.servers, h.delayOK
+}
+
+// nextServer returns the server following the one in the request URL.
+func nextServer(servers []*url.URL, u *url.URL) *url.URL {
+	key := backend.NewSrvURLKey(u)
+	for i, srvURL := range servers {
+		if backend.NewSrvURLKey(srvURL) == key {
+			return servers[(i+1)%len(servers)]
+		}
+	}
+	return servers[0]
+}
+
+// isHedgeable returns true for requests that are safe to send twice.
+func isHedgeable(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		req.ContentLength == 0 && !forward.IsWebsocketRequest(req)
+}
+
+// hedgeMaxBufferBytes is the largest server error response kept in memory
+// while the other request may still do better, a bigger one is passed
+// through once it goes over the limit.
+const hedgeMaxBufferBytes = 1 << 20
+
+// hedgeRace decides which of the hedged requests writes the response. The
+// first request to respond wins and passes its response through, cancelling
+// the other one. A server error is buffered instead while the other request
+// is still running, it is written only if the other request fails too.
+type hedgeRace struct {
+	w http.ResponseWriter
+
+	mu      sync.Mutex
+	writers []*hedgeWriter
+	winner  *hedgeWriter
+	last    *hedgeWriter
+}
+
+// join adds a request to the race, it returns false once the race is won.
+func (r *hedgeRace) join(ctx context.Context) (*hedgeWriter, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.winner != nil {
+		return nil, false
+	}
+	hw := &hedgeWriter{race: r, header: make(http.Header)}
+	hw.ctx, hw.cancel = context.WithCancel(ctx)
+	r.writers = append(r.writers, hw)
+	return hw, true
+}
+
+// claim makes the request the winner, unless the race is won already or the
+// request has failed with a server error and force is false while the other
+// request is still running.
+func (r *hedgeRace) claim(hw *hedgeWriter, code int, force bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.winner != nil {
+		return false
+	}
+	if code >= http.StatusInternalServerError && !force {
+		for _, o := range r.writers {
+			if o != hw && !o.finished {
+				return false
+			}
+		}
+	}
+	r.winner = hw
+	for _, o := range r.writers {
+		if o != hw {
+			o.cancel()
+		}
+	}
+	return true
+}
+
+// finish writes the buffered server error of the last request if none of
+// the requests has won, it is called once all of them are done.
+func (r *hedgeRace) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.winner == nil && r.last != nil && r.last.rec != nil {
+		r.last.rec.writeTo(r.w)
+	}
+}
+
+// hedgeWriter is the response writer of a hedged request, it passes the
+// response through once the request has won the race.
+type hedgeWriter struct {
+	race   *hedgeRace
+	ctx    context.Context
+	cancel context.CancelFunc
+	header http.Header
+
+	wroteHeader bool
+	won         bool
+	// rec keeps the buffered server error, it is nil if the response is
+	// passed through or dropped.
+	rec *responseRecorder
+	// finished is guarded by the race mutex.
+	finished bool
+}
+
+func (hw *hedgeWriter) Header() http.Header {
+	return hw.header
+}
+
+func (hw *hedgeWriter) WriteHeader(code int) {
+	if hw.wroteHeader {
+		return
+	}
+	hw.wroteHeader = true
+	if hw.race.claim(hw, code, false) {
+		hw.won = true
+		copyHeader(hw.race.w.Header(), hw.header)
+		hw.race.w.WriteHeader(code)
+		return
+	}
+	if code >= http.StatusInternalServerError {
+		hw.rec = newResponseRecorder(hedgeMaxBufferBytes)
+		hw.rec.header = hw.header
+		hw.rec.WriteHeader(code)
+	}
+}
+
+func (hw *hedgeWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if hw.won {
+		return hw.race.w.Write(b)
+	}
+	if hw.rec == nil {
+		return 0, context.Canceled
+	}
+	if n, err := hw.rec.Write(b); err == nil {
+		return n, nil
+	}
+	// The server error is too large to keep, it is passed through unless
+	// the other request has won in the meantime.
+	rec := hw.rec
+	hw.rec = nil
+	if !hw.race.claim(hw, rec.code, true) {
+		return 0, context.Canceled
+	}
+	hw.won = true
+	rec.writeTo(hw.race.w)
+	return hw.race.w.Write(b)
+}
+
+// Flush implements http.Flusher, so streamed responses of the winner are
+// not held back.
+func (hw *hedgeWriter) Flush() {
+	if f, ok := hw.race.w.(http.Flusher); ok && hw.won {
+		f.Flush()
+	}
+}
+
+// finish marks the request done, a request that has written nothing
+// responds with an empty 200 OK.
+func (hw *hedgeWriter) finish() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	hw.race.mu.Lock()
+	hw.finished = true
+	hw.race.last = hw
+	hw.race.mu.Unlock()
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
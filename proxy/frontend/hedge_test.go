@@ -0,0 +1,137 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/proxy/rtmcollect"
+)
+
+func TestHedger(t *testing.T) {
+	cancelled := make(chan struct{}, 10)
+	rc, err := rtmcollect.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "slow" {
+			select {
+			case <-time.After(200 * time.Millisecond):
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+				return
+			}
+		}
+		w.Write([]byte(r.URL.Host))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, beSrvs := newTestBackend(t, "b1", "http://slow", "http://fast").Snapshot()
+	h := newHedger(rc, rc, beSrvs, newBudget(50),
+		engine.HedgingSettings{Percentile: 95, MinDelay: 20 * time.Millisecond})
+
+	send := func(method, host string) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "http://"+host+"/", nil))
+		return w.Body.String()
+	}
+	// Requests are not hedged until the latency of the backend is known
+	h.refreshedAt = time.Time{}
+	if body := send("GET", "fast"); body != "fast" {
+		t.Fatalf("unexpected response %q", body)
+	}
+	h.refreshedAt = time.Time{}
+
+	// The budget allows every other request to be hedged
+	for i, tc := range []struct {
+		method string
+		body   string
+	}{
+		{method: "GET", body: "fast"},
+		{method: "GET", body: "slow"},
+		{method: "GET", body: "fast"},
+		{method: "POST", body: "slow"},
+	} {
+		if body := send(tc.method, "slow"); body != tc.body {
+			t.Errorf("case %d: expected %q, got %q", i, tc.body, body)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the slow request to be cancelled")
+		}
+	}
+}
+
+func TestHedgerPassThrough(t *testing.T) {
+	hedged := make(chan string, 10)
+	rc, err := rtmcollect.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Host {
+		case "stream":
+			// The response starts before the hedge delay and ends after it
+			w.Write([]byte("a"))
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte("b"))
+		case "broken":
+			hedged <- r.URL.Host
+			time.Sleep(40 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("broken"))
+		case "late":
+			hedged <- r.URL.Host
+			time.Sleep(80 * time.Millisecond)
+			w.Write([]byte("late"))
+		default:
+			w.Write([]byte(r.URL.Host))
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, beSrvs := newTestBackend(t, "b1", "http://stream", "http://broken", "http://late").Snapshot()
+	h := newHedger(rc, rc, beSrvs, newBudget(100),
+		engine.HedgingSettings{Percentile: 95, MinDelay: 20 * time.Millisecond})
+
+	send := func(host string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://"+host+"/", nil))
+		return w
+	}
+	h.refreshedAt = time.Time{}
+	send("fast")
+	h.refreshedAt = time.Time{}
+
+	// The response is passed through as soon as it starts, so it is not hedged
+	if w := send("stream"); w.Body.String() != "ab" {
+		t.Fatalf("unexpected response %q", w.Body.String())
+	}
+	select {
+	case host := <-hedged:
+		t.Fatalf("unexpected hedge to %v", host)
+	default:
+	}
+
+	// The server error is held back while the hedged request may do better
+	if w := send("broken"); w.Code != http.StatusOK || w.Body.String() != "late" {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestIsHedgeable(t *testing.T) {
+	for i, tc := range []struct {
+		req       *http.Request
+		hedgeable bool
+	}{
+		{req: httptest.NewRequest("GET", "http://localhost/", nil), hedgeable: true},
+		{req: httptest.NewRequest("HEAD", "http://localhost/", nil), hedgeable: true},
+		{req: httptest.NewRequest("GET", "http://localhost/", strings.NewReader("body"))},
+		{req: httptest.NewRequest("PUT", "http://localhost/", nil)},
+	} {
+		if got := isHedgeable(tc.req); got != tc.hedgeable {
+			t.Errorf("case %d: expected %v, got %v", i, tc.hedgeable, got)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	// DefaultMirrorMaxBodyBytes is the default size of the largest request
+	// body that is mirrored.
+	DefaultMirrorMaxBodyBytes = 1 << 20
+	// DefaultMirrorMaxInFlight is the default number of mirrored requests in
+	// flight.
+	DefaultMirrorMaxInFlight = 100
+)
+
+// mirror passes requests to the next handler and sends copies of some of
+// them to the shadow branch in the background. Responses of the shadow
+// branch are dropped.
+type mirror struct {
+	next         http.Handler
+	shadow       *branch
+	percent      float64
+	maxBodyBytes int64
+	// inFlight holds a token for every mirrored request in flight.
+	inFlight chan struct{}
+	// float64 returns a random number in [0, 1)
+	float64 func() float64
+}
+
+func newMirror(next http.Handler, shadow *branch, cfg engine.FrontendMirror) *mirror {
+	m := &mirror{
+		next:         next,
+		shadow:       shadow,
+		percent:      cfg.Percent,
+		maxBodyBytes: cfg.MaxBodyBytes,
+		float64:      rand.Float64,
+	}
+	if m.maxBodyBytes == 0 {
+		m.maxBodyBytes = DefaultMirrorMaxBodyBytes
+	}
+	maxInFlight := cfg.MaxInFlight
+	if maxInFlight == 0 {
+		maxInFlight = DefaultMirrorMaxInFlight
+	}
+	m.inFlight = make(chan struct{}, maxInFlight)
+	return m
+}
+
+// ServeHTTP implements http.Handler.
+func (m *mirror) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if m.float64()*100 < m.percent && !forward.IsWebsocketRequest(req) {
+		m.mirror(req)
+	}
+	m.next.ServeHTTP(w, req)
+}
+
+// mirror sends a copy of the request to the shadow branch unless the request
+// body is too big or there are too many mirrored requests in flight already.
+func (m *mirror) mirror(req *http.Request) {
+	if req.ContentLength > m.maxBodyBytes {
+		return
+	}
+	body, ok, err := peekBody(req, m.maxBodyBytes)
+	if err != nil {
+		log.Errorf("Failed to read body of request to mirror: %v", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		log.Debugf("Request %v is not mirrored to backend %v, too many requests in flight",
+			req.URL, m.shadow.backend.Key().Id)
+		return
+	}
+	out := req.WithContext(context.Background())
+	out.Header = cloneHeader(req.Header)
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	go func() {
+		defer func() { <-m.inFlight }()
+		m.shadow.handler.ServeHTTP(discardWriter{header: make(http.Header)}, out)
+	}()
+}
+
+// peekBody reads up to max bytes of the request body and puts them back in
+// front of the rest of the body. It returns false if the body is bigger.
+func peekBody(req *http.Request, max int64) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	req.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+	if err != nil {
+		return nil, false, err
+	}
+	return body, int64(len(body)) <= max, nil
+}
+
+func cloneHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// discardWriter is the response writer of mirrored requests.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w discardWriter) WriteHeader(int) {}
@@ -0,0 +1,122 @@
+package frontend
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/proxy/backend"
+)
+
+func TestMirror(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer srv.Close()
+	mirrored := make(chan string, 1)
+	shadowSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadowSrv.Close()
+
+	feCfg, err := engine.NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/")`, engine.HTTPFrontendSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := feCfg.SetMirror(&engine.FrontendMirror{BackendId: "shadow", Percent: 100}); err != nil {
+		t.Fatal(err)
+	}
+	fe := New(*feCfg, []*backend.T{newTestBackend(t, "b1", srv.URL), newTestBackend(t, "shadow", shadowSrv.URL)},
+		proxy.Options{}, nil, plugin.FrontendListeners{})
+
+	w := httptest.NewRecorder()
+	fe.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/", strings.NewReader("hello")))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	select {
+	case req := <-mirrored:
+		if req != "/ hello" {
+			t.Errorf("unexpected mirrored request %q", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the mirrored request")
+	}
+
+	// Mirrored requests are not counted in the frontend stats
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		feCfgWithStats, _, err := fe.CfgWithStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if feCfgWithStats.MirrorStats.Counters.Total == 1 {
+			if feCfgWithStats.Stats.Counters.Total != 1 || feCfgWithStats.MirrorStats.Counters.StatusCodes[0].Code != 500 {
+				t.Errorf("unexpected stats %v, mirror stats %v", feCfgWithStats.Stats, feCfgWithStats.MirrorStats)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the mirror stats")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMirrorLimits(t *testing.T) {
+	shadow := make(chan string, 10)
+	release := make(chan struct{})
+	m := newMirror(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+		}),
+		&branch{backend: newTestBackend(t, "shadow"), handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			shadow <- string(body)
+			<-release
+		})},
+		engine.FrontendMirror{Percent: 50, MaxBodyBytes: 4, MaxInFlight: 1})
+
+	send := func(body string, rnd float64) {
+		m.float64 = func() float64 { return rnd }
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/", strings.NewReader(body)))
+		if w.Body.String() != body {
+			t.Errorf("expected %q, got %q", body, w.Body.String())
+		}
+	}
+	// Requests over the percent or with bigger bodies are not mirrored
+	send("a", 0.5)
+	send("12345", 0)
+	// Neither are requests over the limit of requests in flight
+	send("b", 0)
+	send("c", 0)
+	close(release)
+	for len(m.inFlight) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	send("d", 0.1)
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case body := <-shadow:
+			got = append(got, body)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for mirrored requests, got %v", got)
+		}
+	}
+	if got[0] != "b" || got[1] != "d" {
+		t.Errorf("unexpected mirrored requests %v", got)
+	}
+}
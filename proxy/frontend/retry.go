@@ -0,0 +1,213 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/proxy/backend"
+)
+
+// maxRetryBodyBytes is the size of the largest request body that is kept in
+// memory to be sent again, requests with bigger bodies are not retried.
+const maxRetryBodyBytes = 1 << 20
+
+// retrier sits between the load balancer and the servers of a backend and
+// sends failed requests again to the servers that have not been tried yet.
+// The response of an attempt is passed through unless it is going to be
+// retried, so it works for streaming frontends too.
+type retrier struct {
+	next   http.Handler
+	budget *budget
+	cfg    engine.RetrySettings
+	// int63n returns a random number in [0, n)
+	int63n func(n int64) int64
+
+	mu      sync.Mutex
+	servers []*url.URL
+}
+
+func newRetrier(next http.Handler, beSrvs []backend.Srv, budget *budget, cfg engine.RetrySettings) *retrier {
+	r := &retrier{next: next, budget: budget, cfg: cfg, int63n: rand.Int63n}
+	r.setServers(beSrvs)
+	return r
+}
+
+// setServers replaces the servers the requests are retried on.
+func (r *retrier) setServers(beSrvs []backend.Srv) {
+	servers := srvURLs(beSrvs)
+	r.mu.Lock()
+	r.servers = servers
+	r.mu.Unlock()
+}
+
+func (r *retrier) getServers() []*url.URL {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.servers
+}
+
+// srvURLs returns the URLs of the backend servers.
+func srvURLs(beSrvs []backend.Srv) []*url.URL {
+	servers := make([]*url.URL, 0, len(beSrvs))
+	for _, beSrv := range beSrvs {
+		servers = append(servers, beSrv.URL())
+	}
+	return servers
+}
+
+// ServeHTTP implements http.Handler.
+func (r *retrier) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.budget.request()
+	servers := r.getServers()
+	if !r.cfg.Methods[req.Method] || len(servers) < 2 || forward.IsWebsocketRequest(req) {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+	body, ok, err := peekBody(req, maxRetryBodyBytes)
+	if err != nil {
+		log.Errorf("Failed to read body of request to retry: %v", err)
+		writeResponse(w, http.StatusBadRequest, "text/plain", []byte(http.StatusText(http.StatusBadRequest)))
+		return
+	}
+	if !ok {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+
+	tried := map[backend.SrvURLKey]bool{}
+	u := req.URL
+	for retry := 0; ; retry++ {
+		tried[backend.NewSrvURLKey(u)] = true
+		next := untriedServer(servers, tried)
+		canRetry := retry < r.cfg.Attempts && next != nil
+		code, retried := r.serve(w, req, u, body, canRetry)
+		if !retried {
+			return
+		}
+		log.Debugf("Retrying request %v on %v after status %d, retry %d", req.URL, next, code, retry+1)
+		select {
+		case <-time.After(r.backoff(retry)):
+		case <-req.Context().Done():
+			return
+		}
+		u = next
+	}
+}
+
+// serve sends the request to the server. If canRetry is true, the attempt
+// has failed and the budget allows a retry, the response is dropped and serve
+// returns true.
+func (r *retrier) serve(w http.ResponseWriter, req *http.Request, u *url.URL, body []byte, canRetry bool) (int, bool) {
+	ctx := req.Context()
+	if r.cfg.PerTryTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.PerTryTimeout)
+		defer cancel()
+	}
+	out := req.WithContext(ctx)
+	out.URL = utils.CopyURL(u)
+	out.Header = cloneHeader(req.Header)
+	if req.Body != nil && req.Body != http.NoBody {
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	rw := &retryWriter{w: w, header: make(http.Header)}
+	rw.drop = func(code int) bool {
+		if !canRetry || req.Context().Err() != nil {
+			return false
+		}
+		if !r.cfg.StatusCodes[code] && ctx.Err() != context.DeadlineExceeded {
+			return false
+		}
+		if !r.budget.take() {
+			log.Debugf("Request %v is not retried, the retry budget is exhausted", req.URL)
+			return false
+		}
+		return true
+	}
+	r.next.ServeHTTP(rw, out)
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.code, rw.dropped
+}
+
+// untriedServer returns a server that has not been tried yet or nil if all of
+// them have been.
+func untriedServer(servers []*url.URL, tried map[backend.SrvURLKey]bool) *url.URL {
+	for _, u := range servers {
+		if !tried[backend.NewSrvURLKey(u)] {
+			return u
+		}
+	}
+	return nil
+}
+
+// backoff returns the wait before a retry: the backoff doubles with every
+// retry up to the maximum and its second half is random.
+func (r *retrier) backoff(retry int) time.Duration {
+	d := r.cfg.Backoff << uint(retry)
+	if d > r.cfg.MaxBackoff || d < r.cfg.Backoff {
+		d = r.cfg.MaxBackoff
+	}
+	return d/2 + time.Duration(r.int63n(int64(d/2)+1))
+}
+
+// retryWriter decides on the status code whether the response of an attempt
+// is passed through or dropped.
+type retryWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	drop        func(code int) bool
+	code        int
+	wroteHeader bool
+	dropped     bool
+}
+
+// Header returns the header of the response writer once the response has
+// been passed through, so that trailers get there too.
+func (rw *retryWriter) Header() http.Header {
+	if rw.wroteHeader && !rw.dropped {
+		return rw.w.Header()
+	}
+	return rw.header
+}
+
+func (rw *retryWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.code, rw.wroteHeader = code, true
+	if rw.dropped = rw.drop(code); rw.dropped {
+		return
+	}
+	for k, v := range rw.header {
+		rw.w.Header()[k] = v
+	}
+	rw.w.WriteHeader(code)
+}
+
+func (rw *retryWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.dropped {
+		return len(b), nil
+	}
+	return rw.w.Write(b)
+}
+
+func (rw *retryWriter) Flush() {
+	if f, ok := rw.w.(http.Flusher); ok && rw.wroteHeader && !rw.dropped {
+		f.Flush()
+	}
+}
@@ -0,0 +1,157 @@
+package frontend
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/proxy/backend"
+)
+
+func TestRetrier(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Host {
+		case "failing":
+			w.Header().Set("X-Failed", "true")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("failing"))
+		case "slow":
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusGatewayTimeout)
+		default:
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(r.URL.Host + " " + string(body)))
+		}
+	})
+	newTestRetrier := func(budgetPercent int, retry engine.HTTPFrontendRetry, urls ...string) *retrier {
+		settings := engine.HTTPFrontendSettings{Retry: &retry}
+		cfg, err := settings.RetrySettings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, beSrvs := newTestBackend(t, "b1", urls...).Snapshot()
+		return newRetrier(next, beSrvs, newBudget(budgetPercent), *cfg)
+	}
+
+	for i, tc := range []struct {
+		r      *retrier
+		method string
+		host   string
+		body   string
+		code   int
+		resp   string
+	}{
+		{
+			r:      newTestRetrier(100, engine.HTTPFrontendRetry{}, "http://failing", "http://ok"),
+			method: "GET", host: "failing",
+			code: http.StatusOK, resp: "ok ",
+		},
+		{
+			r:      newTestRetrier(100, engine.HTTPFrontendRetry{}, "http://failing", "http://ok"),
+			method: "POST", host: "failing",
+			code: http.StatusServiceUnavailable, resp: "failing",
+		},
+		{
+			r:      newTestRetrier(100, engine.HTTPFrontendRetry{StatusCodes: []int{500}}, "http://failing", "http://ok"),
+			method: "GET", host: "failing",
+			code: http.StatusServiceUnavailable, resp: "failing",
+		},
+		{
+			// No retries without the budget
+			r:      newTestRetrier(0, engine.HTTPFrontendRetry{}, "http://failing", "http://ok"),
+			method: "GET", host: "failing",
+			code: http.StatusServiceUnavailable, resp: "failing",
+		},
+		{
+			// Retries go to the servers not tried yet only
+			r:      newTestRetrier(100, engine.HTTPFrontendRetry{Attempts: 5}, "http://failing", "http://failing2"),
+			method: "GET", host: "failing",
+			code: http.StatusOK, resp: "failing2 ",
+		},
+		{
+			r:      newTestRetrier(100, engine.HTTPFrontendRetry{PerTryTimeout: "20ms"}, "http://slow", "http://ok"),
+			method: "GET", host: "slow",
+			code: http.StatusOK, resp: "ok ",
+		},
+		{
+			r:      newTestRetrier(100, engine.HTTPFrontendRetry{Methods: []string{"put"}}, "http://failing", "http://ok"),
+			method: "PUT", host: "failing", body: "hello",
+			code: http.StatusOK, resp: "ok hello",
+		},
+	} {
+		w := httptest.NewRecorder()
+		tc.r.ServeHTTP(w, httptest.NewRequest(tc.method, "http://"+tc.host+"/", strings.NewReader(tc.body)))
+		if w.Code != tc.code || w.Body.String() != tc.resp {
+			t.Errorf("case %d: expected %d %q, got %d %q", i, tc.code, tc.resp, w.Code, w.Body.String())
+		}
+		if failed := w.Header().Get("X-Failed") != ""; failed != (tc.code != http.StatusOK) {
+			t.Errorf("case %d: unexpected headers %v", i, w.Header())
+		}
+	}
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	r := &retrier{
+		cfg:    engine.RetrySettings{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond},
+		int63n: func(n int64) int64 { return n - 1 },
+	}
+	for retry, expected := range []time.Duration{
+		10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond,
+	} {
+		if backoff := r.backoff(retry); backoff != expected {
+			t.Errorf("retry %d: expected %v, got %v", retry, expected, backoff)
+		}
+	}
+	r.int63n = func(int64) int64 { return 0 }
+	if backoff := r.backoff(1); backoff != 10*time.Millisecond {
+		t.Errorf("expected %v, got %v", 10*time.Millisecond, backoff)
+	}
+	// The backoff does not overflow after many retries
+	if backoff := r.backoff(100); backoff != 15*time.Millisecond {
+		t.Errorf("expected %v, got %v", 15*time.Millisecond, backoff)
+	}
+}
+
+func TestFrontendRetry(t *testing.T) {
+	var attempts [2]int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts[0]++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts[1]++
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+
+	for _, stream := range []bool{false, true} {
+		attempts = [2]int{}
+		feCfg, err := engine.NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/")`, engine.HTTPFrontendSettings{
+			Stream: stream, Retry: &engine.HTTPFrontendRetry{BudgetPercent: 100}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fe := New(*feCfg, []*backend.T{newTestBackend(t, "b1", failing.URL, ok.URL)}, proxy.Options{}, nil,
+			plugin.FrontendListeners{})
+		for i := 0; i < 4; i++ {
+			if w := serve(fe, nil); w.Code != http.StatusOK || w.Body.String() != "ok" {
+				t.Errorf("stream %v: unexpected response %d %q", stream, w.Code, w.Body.String())
+			}
+		}
+		// Every request has got to the failing server at most once
+		if attempts[1] != 4 || attempts[0] > 4 {
+			t.Errorf("stream %v: unexpected attempts %v", stream, attempts)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package frontend
+
+import (
+	"math/rand"
+	"net/http"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// splitter sends requests to one of the branches, picked by the backend pin
+// or at random according to the branch weights.
+type splitter struct {
+	branches []*branch
+	pin      *engine.BackendPin
+	total    int
+	// intn returns a random number in [0, n)
+	intn func(n int) int
+}
+
+func newSplitter(branches []*branch, pin *engine.BackendPin) *splitter {
+	s := &splitter{branches: branches, pin: pin, intn: rand.Intn}
+	for _, b := range branches {
+		s.total += b.weight
+	}
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *splitter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b := s.pinned(req)
+	if b == nil {
+		b = s.pick()
+		if s.pin != nil && s.pin.Cookie != "" {
+			http.SetCookie(w, &http.Cookie{Name: s.pin.Cookie, Value: b.backend.Key().Id, Path: "/", HttpOnly: true})
+		}
+	}
+	b.handler.ServeHTTP(w, req)
+}
+
+// pinned returns the branch of the backend named by the pin header or
+// cookie, the header takes precedence. It returns nil if the request is not
+// pinned to any of the backends.
+func (s *splitter) pinned(req *http.Request) *branch {
+	if s.pin == nil {
+		return nil
+	}
+	if s.pin.Header != "" {
+		if b := s.branch(req.Header.Get(s.pin.Header)); b != nil {
+			return b
+		}
+	}
+	if s.pin.Cookie != "" {
+		if c, err := req.Cookie(s.pin.Cookie); err == nil {
+			return s.branch(c.Value)
+		}
+	}
+	return nil
+}
+
+func (s *splitter) branch(beID string) *branch {
+	if beID == "" {
+		return nil
+	}
+	for _, b := range s.branches {
+		if b.backend.Key().Id == beID {
+			return b
+		}
+	}
+	return nil
+}
+
+func (s *splitter) pick() *branch {
+	n := s.intn(s.total)
+	for _, b := range s.branches {
+		if n < b.weight {
+			return b
+		}
+		n -= b.weight
+	}
+	return s.branches[len(s.branches)-1]
+}
@@ -0,0 +1,110 @@
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vulcand/route"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/proxy/backend"
+	"github.com/vulcand/vulcand/proxy/rtmcollect"
+)
+
+func TestSplitterWeights(t *testing.T) {
+	branches := []*branch{
+		{backend: newTestBackend(t, "b1"), weight: 3},
+		{backend: newTestBackend(t, "b2"), weight: 0},
+		{backend: newTestBackend(t, "b3"), weight: 1},
+	}
+	s := newSplitter(branches, nil)
+	for n, want := range []string{"b1", "b1", "b1", "b3"} {
+		s.intn = func(int) int { return n }
+		if got := s.pick().backend.Key().Id; got != want {
+			t.Errorf("pick %d: expected %v, got %v", n, want, got)
+		}
+	}
+}
+
+func TestSplitBackends(t *testing.T) {
+	srv1 := newTestServer("b1")
+	defer srv1.Close()
+	srv2 := newTestServer("b2")
+	defer srv2.Close()
+
+	be1 := newTestBackend(t, "b1", srv1.URL)
+	be2 := newTestBackend(t, "b2", srv2.URL)
+	feCfg, err := engine.NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/")`, engine.HTTPFrontendSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = feCfg.SetBackends([]engine.FrontendBackend{{Id: "b1", Weight: 1}, {Id: "b2", Weight: 0}},
+		&engine.BackendPin{Header: "X-Backend", Cookie: "backend"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := New(*feCfg, []*backend.T{be1, be2}, proxy.Options{}, nil, plugin.FrontendListeners{})
+
+	// Requests that are not pinned are split by weight and get the cookie
+	w := serve(fe, nil)
+	if w.Body.String() != "b1" || w.Header().Get("Set-Cookie") == "" {
+		t.Errorf("unexpected response %q, cookie %q", w.Body.String(), w.Header().Get("Set-Cookie"))
+	}
+	for _, pin := range []http.Header{{"X-Backend": {"b2"}}, {"Cookie": {"backend=b2"}}} {
+		if w := serve(fe, pin); w.Body.String() != "b2" || w.Header().Get("Set-Cookie") != "" {
+			t.Errorf("%v: unexpected response %q, cookie %q", pin, w.Body.String(), w.Header().Get("Set-Cookie"))
+		}
+	}
+	if w := serve(fe, http.Header{"X-Backend": {"b3"}}); w.Body.String() != "b1" {
+		t.Errorf("unknown backend: unexpected response %q", w.Body.String())
+	}
+
+	// Stats are split by backend
+	for beID, want := range map[string]int64{"b1": 2, "b2": 2} {
+		aggregate := rtmcollect.NewRTMetrics()
+		fe.AppendRTMTo(aggregate, engine.BackendKey{Id: beID})
+		if aggregate.TotalCount() != want {
+			t.Errorf("backend %v: expected %d requests, got %d", beID, want, aggregate.TotalCount())
+		}
+	}
+	feCfgWithStats, ok, err := fe.CfgWithStats()
+	if err != nil || !ok || feCfgWithStats.Stats.Counters.Total != 4 {
+		t.Errorf("unexpected frontend stats %v, %v, %v", feCfgWithStats.Stats, ok, err)
+	}
+}
+
+func newTestServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+}
+
+func newTestBackend(t *testing.T, id string, urls ...string) *backend.T {
+	beCfg, err := engine.NewHTTPBackend(id, engine.HTTPBackendSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be, err := backend.New(*beCfg, proxy.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, u := range urls {
+		if _, err := be.UpsertServer(engine.Server{Id: fmt.Sprintf("s%d", i), URL: u}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return be
+}
+
+func serve(h http.Handler, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,216 @@
+package frontend
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/proxy/balancer"
+	"github.com/vulcand/vulcand/proxy/rtmcollect"
+)
+
+// connKey is the context key of the client connection of the requests that
+// stand for the connections of tcp frontends.
+type connKey struct{}
+
+// ServeConn proxies a connection accepted by the listener of a tcp frontend.
+// The connection goes through the handler chain as a request, so that the
+// middlewares, the load balancer and the metrics collector of the frontend
+// apply to it, and is closed when the proxying is over.
+func (fe *T) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	w := &connWriter{header: make(http.Header)}
+	fe.getHandler().ServeHTTP(w, newConnRequest(conn))
+	if w.code != http.StatusOK {
+		log.Debugf("Connection from %v to frontend %v closed with status %d", conn.RemoteAddr(), fe.cfg.Id, w.code)
+	}
+}
+
+// rebuildTCP builds the handler chain of tcp frontends: the middlewares, the
+// load balancer, the metrics collector and the forwarder. Connections are
+// neither buffered nor retried.
+func (fe *T) rebuildTCP() error {
+	tcpCfg, err := fe.cfg.TCPSettings()
+	if err != nil {
+		return errors.Wrap(err, "invalid tcp settings")
+	}
+	if len(fe.backends) != 1 {
+		return errors.Errorf("tcp frontends have one backend, got %d", len(fe.backends))
+	}
+	be := fe.backends[0]
+	healthGen := be.HealthGeneration()
+	httpTp, beSrvs := be.Snapshot()
+
+	rc, err := rtmcollect.NewTCP(&tcpForwarder{dial: httpTp.Dial, idleTimeout: tcpCfg.IdleTimeout})
+	if err != nil {
+		return errors.Wrap(err, "cannot create rtmCollect")
+	}
+	lb, err := balancer.New(be.LoadBalancer(), rc, rc, fe.listeners)
+	if err != nil {
+		return errors.Wrap(err, "cannot create load balancer")
+	}
+	syncServers(lb, beSrvs, rc)
+
+	next, err := fe.chainMiddlewares(lb)
+	if err != nil {
+		return err
+	}
+	fe.handler = next
+	fe.branches = []*branch{{backend: be, handler: lb, lb: lb, rtmCollect: rc, healthGen: healthGen}}
+	fe.shadow = nil
+	fe.feCollect = nil
+	return nil
+}
+
+// newConnRequest returns the request standing for the connection: it comes
+// from the client address, is sent to the listener address and carries the
+// connection in its context.
+func newConnRequest(conn net.Conn) *http.Request {
+	host := conn.LocalAddr().String()
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Scheme: "tcp", Host: host},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Host:       host,
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: host,
+	}
+	return req.WithContext(context.WithValue(context.Background(), connKey{}, conn))
+}
+
+// connWriter is the response writer of connection requests, it records the
+// status code the connection has been handled with and drops the body, e.g.
+// the one of a connection limit middleware rejecting the connection.
+type connWriter struct {
+	header http.Header
+	code   int
+}
+
+func (cw *connWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *connWriter) WriteHeader(code int) {
+	if cw.code == 0 {
+		cw.code = code
+	}
+}
+
+func (cw *connWriter) Write(b []byte) (int, error) {
+	cw.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+// tcpForwarder connects the client connection of the request to the server
+// the load balancer has picked. Failed dials are recorded as 502, or 504 if
+// they have timed out, proxied connections as 200.
+type tcpForwarder struct {
+	dial        func(network, addr string) (net.Conn, error)
+	idleTimeout time.Duration
+}
+
+// ServeHTTP implements http.Handler.
+func (f *tcpForwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, ok := req.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		writeResponse(w, http.StatusBadRequest, "text/plain", []byte("not a tcp connection"))
+		return
+	}
+	srvConn, err := f.dial("tcp", req.URL.Host)
+	if err != nil {
+		log.Errorf("Failed to connect %v to %v: %v", conn.RemoteAddr(), req.URL.Host, err)
+		code := http.StatusBadGateway
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			code = http.StatusGatewayTimeout
+		}
+		w.WriteHeader(code)
+		return
+	}
+	defer srvConn.Close()
+
+	w.WriteHeader(http.StatusOK)
+	proxyConns(conn, srvConn, f.idleTimeout)
+}
+
+// proxyConns copies data both ways until both sides have closed their
+// connections, or until neither has sent anything for the idle timeout if it
+// is not 0. The end of data from one side is passed on to the other as a half
+// close if its connection supports it, otherwise both are closed.
+func proxyConns(client, server net.Conn, idleTimeout time.Duration) {
+	var lastActive int64
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+	touch()
+
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			client.Close()
+			server.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	copyConn := func(dst, src net.Conn) {
+		defer wg.Done()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				touch()
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					closeBoth()
+					return
+				}
+			}
+			if err == io.EOF {
+				if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+					return
+				}
+			}
+			if err != nil {
+				closeBoth()
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go copyConn(server, client)
+	go copyConn(client, server)
+
+	done := make(chan struct{})
+	if idleTimeout != 0 {
+		go func() {
+			timer := time.NewTimer(idleTimeout)
+			defer timer.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-timer.C:
+					idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastActive)))
+					if idle >= idleTimeout {
+						log.Debugf("Closing connection from %v idle for %v", client.RemoteAddr(), idle)
+						closeBoth()
+						return
+					}
+					timer.Reset(idleTimeout - idle)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+}
@@ -0,0 +1,159 @@
+package frontend
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/proxy/backend"
+)
+
+func TestTCPProxy(t *testing.T) {
+	// The server echoes the data back and closes the connection once the
+	// client has sent everything.
+	srv := newTestTCPServer(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	defer srv.Close()
+	fe := newTestTCPFrontend(t, "", "tcp://"+srv.Addr().String())
+	addr := serveConns(t, fe)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	body, err := ioutil.ReadAll(conn)
+	if err != nil || string(body) != "hello" {
+		t.Errorf("unexpected response %q, err %v", body, err)
+	}
+	waitStatusCode(t, fe, http.StatusOK)
+
+	// The latency is the time to connect to the server rather than the
+	// lifetime of the connection.
+	if latency, ok := fe.branches[0].rtmCollect.LatencyAtQuantile(100); !ok || latency >= 200*time.Millisecond {
+		t.Errorf("unexpected latency %v", latency)
+	}
+}
+
+func TestTCPProxyDialFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	fe := newTestTCPFrontend(t, "", "tcp://"+addr)
+
+	conn, err := net.Dial("tcp", serveConns(t, fe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if body, _ := ioutil.ReadAll(conn); len(body) != 0 {
+		t.Errorf("unexpected response %q", body)
+	}
+	waitStatusCode(t, fe, http.StatusBadGateway)
+}
+
+func TestTCPProxyIdleTimeout(t *testing.T) {
+	// The server neither sends anything nor closes the connection.
+	srv := newTestTCPServer(t, func(conn net.Conn) {
+		ioutil.ReadAll(conn)
+	})
+	defer srv.Close()
+	fe := newTestTCPFrontend(t, "50ms", "tcp://"+srv.Addr().String())
+
+	conn, err := net.Dial("tcp", serveConns(t, fe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the idle connection to be closed, got %v", err)
+	}
+}
+
+func newTestTCPServer(t *testing.T, handle func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func newTestTCPFrontend(t *testing.T, idleTimeout string, srvURL string) *T {
+	beCfg, err := engine.NewTCPBackend("b1", engine.HTTPBackendSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be, err := backend.New(*beCfg, proxy.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.UpsertServer(engine.Server{Id: "s0", URL: srvURL}); err != nil {
+		t.Fatal(err)
+	}
+	feCfg, err := engine.NewTCPFrontend("f1", "b1", engine.TCPFrontendSettings{ListenerId: "l1", IdleTimeout: idleTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(*feCfg, []*backend.T{be}, proxy.Options{}, nil, plugin.FrontendListeners{})
+}
+
+// serveConns passes the connections of a new listener to the frontend and
+// returns the listener address.
+func serveConns(t *testing.T, fe *T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		fe.ServeConn(conn)
+	}()
+	return l.Addr().String()
+}
+
+// waitStatusCode waits for the connection stats that are recorded after the
+// client connection is closed.
+func waitStatusCode(t *testing.T, fe *T, code int) {
+	for i := 0; i < 100; i++ {
+		feCfg, _, err := fe.CfgWithStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes := feCfg.Stats.Counters.StatusCodes
+		if len(codes) == 1 && codes[0].Code == code {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("status code %d is not recorded", code)
+}
@@ -2,6 +2,7 @@ package mux
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"sort"
 	"strconv"
@@ -25,6 +26,7 @@ import (
 	"github.com/vulcand/vulcand/proxy/rtmcollect"
 	"github.com/vulcand/vulcand/proxy/server"
 	"github.com/vulcand/vulcand/router"
+	"github.com/vulcand/vulcand/secret"
 	"github.com/vulcand/vulcand/stapler"
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -39,8 +41,16 @@ type mux struct {
 
 	backends map[engine.BackendKey]backendEntry
 
+	// deletedBackends are closed once the lock is released, closing waits
+	// for the health checks in progress
+	deletedBackends []*backend.T
+
 	frontends map[engine.FrontendKey]*frontend.T
 
+	// tcpFrontends are the frontends serving the connections of tcp listeners
+	// and the TLS connections of https listeners passed through by SNI
+	tcpFrontends map[tcpRoute]*frontend.T
+
 	hostCfgs map[engine.HostKey]engine.Host
 
 	// Options hold parameters that are used to initialize http servers
@@ -76,6 +86,13 @@ type mux struct {
 	autoCertCache autocert.Cache
 }
 
+// tcpRoute is the listener and the SNI pattern of a tcp frontend, the SNI
+// pattern is empty for tcp listeners.
+type tcpRoute struct {
+	lsnKey engine.ListenerKey
+	sni    string
+}
+
 type backendEntry struct {
 	backend   *backend.T
 	frontends map[engine.FrontendKey]*frontend.T
@@ -111,6 +128,8 @@ func New(id int, st stapler.Stapler, o proxy.Options) (*mux, error) {
 		frontends: make(map[engine.FrontendKey]*frontend.T),
 		hostCfgs:  make(map[engine.HostKey]engine.Host),
 
+		tcpFrontends: make(map[tcpRoute]*frontend.T),
+
 		stapleUpdatesC: make(chan *stapler.StapleUpdated),
 		stopC:          make(chan struct{}),
 		stapler:        st,
@@ -134,11 +153,16 @@ func New(id int, st stapler.Stapler, o proxy.Options) (*mux, error) {
 }
 
 func (m *mux) Init(ss engine.Snapshot) error {
+	hostCfgs := make([]engine.Host, len(ss.Hosts))
+	for i, hostCfg := range ss.Hosts {
+		hostCfgs[i] = m.resolveKeyPair(hostCfg)
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	for _, hostCfg := range ss.Hosts {
-		m.hostCfgs[hostCfg.Key()] = hostCfg
+	for _, hostCfg := range hostCfgs {
+		m.setHost(hostCfg)
 	}
 
 	for _, bes := range ss.BackendSpecs {
@@ -168,7 +192,7 @@ func (m *mux) Init(ss engine.Snapshot) error {
 				return errors.Errorf("%v conflicts with existing %v", lsnCfg.Id, srv.Key())
 			}
 		}
-		srv, err := server.New(lsnCfg, m.router, m.stapler, m.incomingConnTracker, m.autoCertCache, &m.wg)
+		srv, err := server.New(lsnCfg, m.router, m, m.stapler, m.incomingConnTracker, m.autoCertCache, &m.wg)
 		if err != nil {
 			return errors.Wrapf(err, "failed to create server %v", lsnCfg.Id)
 		}
@@ -177,22 +201,27 @@ func (m *mux) Init(ss engine.Snapshot) error {
 
 	for _, fes := range ss.FrontendSpecs {
 		feKey := engine.FrontendKey{fes.Frontend.Id}
-		beEnt, ok := m.backends[engine.BackendKey{Id: fes.Frontend.BackendId}]
-		if !ok {
-			return errors.Errorf("unknown backend %v in frontend %v",
-				fes.Frontend.BackendId, fes.Frontend.Id)
+		bes, err := m.frontendBackends(fes.Frontend)
+		if err != nil {
+			return err
 		}
 		mwCfgs := make(map[engine.MiddlewareKey]engine.Middleware)
 		for _, mw := range fes.Middlewares {
 			mwCfgs[engine.MiddlewareKey{FrontendKey: feKey, Id: mw.Id}] = mw
 		}
-		fe := frontend.New(fes.Frontend, beEnt.backend, m.options, mwCfgs, m.frontendListeners)
-		if err := m.router.Handle(fes.Frontend.Route, fe); err != nil {
+		fe := frontend.New(fes.Frontend, bes, m.options, mwCfgs, m.frontendListeners)
+		if fes.Frontend.Type == engine.TCP {
+			if err := m.bindTCP(fes.Frontend, fe); err != nil {
+				return err
+			}
+		} else if err := m.router.Handle(fes.Frontend.Route, fe); err != nil {
 			return errors.Wrapf(err, "cannot add route %v for frontend %v",
 				fes.Frontend.Route, fes.Frontend.Id)
 		}
 		m.frontends[feKey] = fe
-		beEnt.frontends[feKey] = fe
+		for _, beKey := range fes.Frontend.BackendKeys() {
+			m.backends[beKey].frontends[feKey] = fe
+		}
 	}
 	return nil
 }
@@ -283,6 +312,34 @@ func (m *mux) Start() error {
 		}
 	}()
 
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case <-m.stopC:
+				log.Infof("%v stop refreshing key pairs", m)
+				return
+			case <-time.After(m.options.SecretRefreshPeriod):
+				m.refreshKeyPairs()
+			}
+		}
+	}()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case <-m.stopC:
+				log.Infof("%v stop detecting outliers", m)
+				return
+			case <-time.After(time.Second):
+				m.detectOutliers()
+			}
+		}
+	}()
+
 	m.state = stateActive
 	for _, srv := range m.servers {
 		if err := srv.Start(m.hostCfgs); err != nil {
@@ -307,9 +364,8 @@ func (m *mux) Stop(wait bool) {
 
 func (m *mux) stopServers() {
 	m.mtx.Lock()
-	defer m.mtx.Unlock()
-
 	if m.state == stateShuttingDown {
+		m.mtx.Unlock()
 		log.Infof("%v is already shutting down", m)
 		return
 	}
@@ -318,33 +374,130 @@ func (m *mux) stopServers() {
 	m.state = stateShuttingDown
 	close(m.stopC)
 
+	backends := make([]*backend.T, 0, len(m.backends))
+	for _, beEnt := range m.backends {
+		backends = append(backends, beEnt.backend)
+	}
+
 	// init state has no running servers, no need to close them
-	if prevState == stateInit {
-		return
+	if prevState != stateInit {
+		for _, s := range m.servers {
+			s.Shutdown()
+		}
 	}
+	m.mtx.Unlock()
 
-	for _, s := range m.servers {
-		s.Shutdown()
+	// Stopping health checks waits for the checks in progress, so the lock is
+	// not held meanwhile to let configuration changes and requests through.
+	for _, be := range backends {
+		be.StopHealthChecks()
 	}
 }
 
 func (m *mux) UpsertHost(hostCfg engine.Host) error {
 	log.Infof("%s UpsertHost %s", m, &hostCfg)
+	hostCfg = m.resolveKeyPair(hostCfg)
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	m.hostCfgs[hostCfg.Key()] = hostCfg
+	return m.upsertHost(hostCfg)
+}
+
+// upsertHost expects the referenced key pair of the host to be resolved already.
+func (m *mux) upsertHost(hostCfg engine.Host) error {
+	m.setHost(hostCfg)
 	for _, srv := range m.servers {
 		srv.OnHostsUpdated(m.hostCfgs)
 	}
 	return nil
 }
 
+// resolveKeyPair returns the host with the referenced key pair resolved by the secret provider, or the host as is if
+// the provider fails. Providers may take a while, so it is called without holding the lock.
+func (m *mux) resolveKeyPair(hostCfg engine.Host) engine.Host {
+	kp := hostCfg.Settings.KeyPair
+	if kp == nil || kp.Ref == "" {
+		return hostCfg
+	}
+	resolved, err := m.options.SecretProvider.KeyPair(kp.Ref)
+	if err != nil {
+		log.Errorf("%v failed to resolve key pair %v of %v: %v", m, kp.Ref, hostCfg.Name, err)
+		return hostCfg
+	}
+	resolved.Ref = kp.Ref
+	hostCfg.Settings.KeyPair = resolved
+	return hostCfg
+}
+
+// setHost stores the host. If its referenced key pair has not been resolved, the host keeps the key pair resolved
+// before, if any, and the next refresh tries again.
+func (m *mux) setHost(hostCfg engine.Host) {
+	if kp := hostCfg.Settings.KeyPair; kp != nil && kp.Ref != "" && len(kp.Cert) == 0 {
+		if prev, ok := m.hostCfgs[hostCfg.Key()]; ok && prev.Settings.KeyPair != nil && prev.Settings.KeyPair.Ref == kp.Ref {
+			hostCfg.Settings.KeyPair = prev.Settings.KeyPair
+		}
+	}
+	m.hostCfgs[hostCfg.Key()] = hostCfg
+}
+
+// refreshKeyPairs resolves the referenced key pairs again and reloads TLS config of the servers if any of them changed
+func (m *mux) refreshKeyPairs() {
+	m.mtx.RLock()
+	refs := map[engine.HostKey]string{}
+	for key, hostCfg := range m.hostCfgs {
+		if kp := hostCfg.Settings.KeyPair; kp != nil && kp.Ref != "" {
+			refs[key] = kp.Ref
+		}
+	}
+	m.mtx.RUnlock()
+	if len(refs) == 0 {
+		return
+	}
+
+	// Providers may take a while, so they are called without holding the lock
+	resolved := map[engine.HostKey]*engine.KeyPair{}
+	for key, ref := range refs {
+		kp, err := m.options.SecretProvider.KeyPair(ref)
+		if err != nil {
+			log.Errorf("%v failed to refresh key pair %v of %v: %v", m, ref, key, err)
+			continue
+		}
+		kp.Ref = ref
+		resolved[key] = kp
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	changed := false
+	for key, kp := range resolved {
+		hostCfg, ok := m.hostCfgs[key]
+		// The host might have been updated or deleted meanwhile
+		if !ok || hostCfg.Settings.KeyPair == nil || hostCfg.Settings.KeyPair.Ref != kp.Ref || hostCfg.Settings.KeyPair.Equals(kp) {
+			continue
+		}
+		log.Infof("%v key pair %v of %v has changed", m, kp.Ref, key)
+		hostCfg.Settings.KeyPair = kp
+		m.hostCfgs[key] = hostCfg
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	for _, srv := range m.servers {
+		srv.OnHostsUpdated(m.hostCfgs)
+	}
+}
+
 func (m *mux) DeleteHost(hostKey engine.HostKey) error {
 	log.Infof("%s DeleteHost %v", m, &hostKey)
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteHost(hostKey)
+}
+
+func (m *mux) deleteHost(hostKey engine.HostKey) error {
 	host, ok := m.hostCfgs[hostKey]
 	if !ok {
 		return errors.Errorf("host %v not found", hostKey)
@@ -355,7 +508,7 @@ func (m *mux) DeleteHost(hostKey engine.HostKey) error {
 	m.stapler.DeleteHost(hostKey)
 
 	// If the host has no TLS config then there is no need for server reload.
-	if host.Settings.KeyPair == nil {
+	if host.Settings.KeyPair == nil && host.Settings.ClientAuth == nil {
 		return nil
 	}
 	for _, srv := range m.servers {
@@ -377,6 +530,10 @@ func (m *mux) DeleteListener(lsnKey engine.ListenerKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteListener(lsnKey)
+}
+
+func (m *mux) deleteListener(lsnKey engine.ListenerKey) error {
 	srv, ok := m.servers[lsnKey]
 	if !ok {
 		return errors.Errorf("%v not found", lsnKey)
@@ -396,6 +553,14 @@ func (m *mux) upsertListener(lsnCfg engine.Listener) error {
 		return nil
 	}
 
+	if lsnCfg.Protocol != engine.HTTPS {
+		for route, fe := range m.tcpFrontends {
+			if route.lsnKey == lsnCfg.Key() && route.sni != "" {
+				return errors.Errorf("SNI %v of frontend %v requires an https listener, %v is %v",
+					route.sni, fe.Key().Id, route.lsnKey.Id, lsnCfg.Protocol)
+			}
+		}
+	}
 	// Check if there's a listener with the same address
 	for _, srv := range m.servers {
 		if srv.Address() == lsnCfg.Address {
@@ -404,7 +569,7 @@ func (m *mux) upsertListener(lsnCfg engine.Listener) error {
 	}
 	// Create a new server for the listener.
 	var err error
-	if srv, err = server.New(lsnCfg, m.router, m.stapler, m.incomingConnTracker, m.autoCertCache, &m.wg); err != nil {
+	if srv, err = server.New(lsnCfg, m.router, m, m.stapler, m.incomingConnTracker, m.autoCertCache, &m.wg); err != nil {
 		return errors.Wrapf(err, "cannot create server %v", lsnCfg.Key())
 	}
 	m.servers[lsnCfg.Key()] = srv
@@ -423,9 +588,17 @@ func (m *mux) UpsertBackend(beCfg engine.Backend) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.upsertBackend(beCfg)
+}
+
+func (m *mux) upsertBackend(beCfg engine.Backend) error {
 	beKey := engine.BackendKey{Id: beCfg.Id}
 	beEnt, ok := m.backends[beKey]
 	if ok {
+		if len(beEnt.frontends) != 0 && beEnt.backend.Type() != beCfg.Type {
+			return errors.Errorf("backend %v used by frontends can not change type from %v to %v",
+				beKey.Id, beEnt.backend.Type(), beCfg.Type)
+		}
 		mutated, err := beEnt.backend.Update(beCfg, m.options)
 		if err != nil {
 			return errors.Wrapf(err, "failed to update backend %v", beKey.Id)
@@ -449,8 +622,15 @@ func (m *mux) UpsertBackend(beCfg engine.Backend) error {
 func (m *mux) DeleteBackend(beKey engine.BackendKey) error {
 	log.Infof("%v DeleteBackend %s", m, &beKey)
 	m.mtx.Lock()
-	defer m.mtx.Unlock()
+	err := m.deleteBackend(beKey)
+	deleted := m.takeDeletedBackends()
+	m.mtx.Unlock()
 
+	closeBackends(deleted)
+	return err
+}
+
+func (m *mux) deleteBackend(beKey engine.BackendKey) error {
 	beEnt, ok := m.backends[beKey]
 	if !ok {
 		return errors.Errorf("backend missing %v", beKey.Id)
@@ -465,31 +645,60 @@ func (m *mux) DeleteBackend(beKey engine.BackendKey) error {
 		return errors.Errorf("%v is used by frontends: %v", beEnt.backend.Key(), beEnt.frontends)
 	}
 
-	beEnt.backend.Close()
+	m.deletedBackends = append(m.deletedBackends, beEnt.backend)
 	return nil
 }
 
+// takeDeletedBackends returns the backends deleted since the last call, the
+// caller closes them after releasing the lock.
+func (m *mux) takeDeletedBackends() []*backend.T {
+	deleted := m.deletedBackends
+	m.deletedBackends = nil
+	return deleted
+}
+
+func closeBackends(bes []*backend.T) {
+	for _, be := range bes {
+		be.Close()
+	}
+}
+
 func (m *mux) UpsertFrontend(feCfg engine.Frontend) error {
 	log.Infof("%v UpsertFrontend %v", m, &feCfg)
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	beEnt, ok := m.backends[feCfg.BackendKey()]
-	if !ok {
-		return errors.Errorf("missing backend %v referenced by frontend %v", feCfg.BackendId, feCfg.Id)
+	return m.upsertFrontend(feCfg)
+}
+
+func (m *mux) upsertFrontend(feCfg engine.Frontend) error {
+	bes, err := m.frontendBackends(feCfg)
+	if err != nil {
+		return err
 	}
 
 	feKey := engine.FrontendKey{Id: feCfg.Id}
 	fe, ok := m.frontends[feKey]
+	if ok && (fe.Type() == engine.TCP) != (feCfg.Type == engine.TCP) {
+		return errors.Errorf("frontend %v can not change type from %v to %v", feCfg.Id, fe.Type(), feCfg.Type)
+	}
+	if ok && feCfg.Type == engine.TCP {
+		if err := m.bindTCP(feCfg, fe); err != nil {
+			return err
+		}
+		m.unlinkBackends(fe)
+		for _, beKey := range feCfg.BackendKeys() {
+			m.backends[beKey].frontends[feKey] = fe
+		}
+		if err := fe.Update(feCfg, bes); err != nil {
+			return errors.Wrapf(err, "failed to update fronend %v", feCfg.Key())
+		}
+		return nil
+	}
 	if ok {
-		if feCfg.BackendKey() != fe.BackendKey() {
-			oldBeEnt, ok := m.backends[fe.BackendKey()]
-			if ok {
-				delete(oldBeEnt.frontends, feKey)
-			} else {
-				log.Warnf("Missing backend %v referenced by frontend %v", fe.BackendKey(), feCfg.Key())
-			}
-			beEnt.frontends[feKey] = fe
+		m.unlinkBackends(fe)
+		for _, beKey := range feCfg.BackendKeys() {
+			m.backends[beKey].frontends[feKey] = fe
 		}
 
 		oldRoute := fe.Route()
@@ -499,7 +708,7 @@ func (m *mux) UpsertFrontend(feCfg engine.Frontend) error {
 				log.Errorf("Failed to remove route %v for frontend %v", oldRoute, feCfg.Id)
 			}
 		}
-		if err := fe.Update(feCfg, beEnt.backend); err != nil {
+		if err := fe.Update(feCfg, bes); err != nil {
 			return errors.Wrapf(err, "failed to update fronend %v", feCfg.Key())
 		}
 		if oldRoute != feCfg.Route {
@@ -509,9 +718,25 @@ func (m *mux) UpsertFrontend(feCfg engine.Frontend) error {
 		}
 		return nil
 	}
-	fe = frontend.New(feCfg, beEnt.backend, m.options, nil, m.frontendListeners)
+	return m.addFrontend(feCfg, frontend.New(feCfg, bes, m.options, nil, m.frontendListeners))
+}
+
+// addFrontend routes the requests, or the connections of tcp frontends, to
+// the frontend and links it to its backends, that must exist.
+func (m *mux) addFrontend(feCfg engine.Frontend, fe *frontend.T) error {
+	feKey := feCfg.Key()
+	if feCfg.Type == engine.TCP {
+		if err := m.bindTCP(feCfg, fe); err != nil {
+			return err
+		}
+	}
 	m.frontends[feKey] = fe
-	beEnt.frontends[feKey] = fe
+	for _, beKey := range feCfg.BackendKeys() {
+		m.backends[beKey].frontends[feKey] = fe
+	}
+	if feCfg.Type == engine.TCP {
+		return nil
+	}
 	if err := m.router.Handle(feCfg.Route, fe); err != nil {
 		return errors.Wrapf(err, "cannot add route %v for frontend %v", feCfg.Route, feCfg.Id)
 	}
@@ -523,19 +748,130 @@ func (m *mux) DeleteFrontend(feKey engine.FrontendKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteFrontend(feKey)
+}
+
+func (m *mux) deleteFrontend(feKey engine.FrontendKey) error {
 	fe, ok := m.frontends[feKey]
 	if !ok {
 		return errors.Errorf("missing frontend %v", feKey.Id)
 	}
 
-	m.router.Remove(fe.Route())
+	if fe.Type() == engine.TCP {
+		m.unbindTCP(fe)
+	} else {
+		m.router.Remove(fe.Route())
+	}
 	delete(m.frontends, feKey)
 
-	beEnt, ok := m.backends[fe.BackendKey()]
+	return m.unlinkBackends(fe)
+}
+
+// frontendBackends returns all backends referenced by the frontend config in
+// the order of its backend keys.
+func (m *mux) frontendBackends(feCfg engine.Frontend) ([]*backend.T, error) {
+	beKeys := feCfg.BackendKeys()
+	bes := make([]*backend.T, len(beKeys))
+	for i, beKey := range beKeys {
+		beEnt, ok := m.backends[beKey]
+		if !ok {
+			return nil, errors.Errorf("missing backend %v referenced by frontend %v", beKey.Id, feCfg.Id)
+		}
+		if (beEnt.backend.Type() == engine.TCP) != (feCfg.Type == engine.TCP) {
+			return nil, errors.Errorf("%v backend %v can not be used by %v frontend %v",
+				beEnt.backend.Type(), beKey.Id, feCfg.Type, feCfg.Id)
+		}
+		bes[i] = beEnt.backend
+	}
+	return bes, nil
+}
+
+// bindTCP makes the tcp frontend serve the connections of its listener with
+// the server names matching its SNI, a listener is served by one frontend per
+// SNI pattern.
+func (m *mux) bindTCP(feCfg engine.Frontend, fe *frontend.T) error {
+	tcpCfg, err := feCfg.TCPSettings()
+	if err != nil {
+		return errors.Wrapf(err, "bad tcp settings of frontend %v", feCfg.Id)
+	}
+	route := tcpRoute{lsnKey: tcpCfg.ListenerKey, sni: tcpCfg.SNI}
+	// Only https listeners read the server name of the connections, the
+	// listener is checked again if it is added later.
+	if srv, ok := m.servers[route.lsnKey]; ok && route.sni != "" && srv.Protocol() != engine.HTTPS {
+		return errors.Errorf("SNI %v requires an https listener, %v is %v", route.sni, route.lsnKey.Id, srv.Protocol())
+	}
+	if other, ok := m.tcpFrontends[route]; ok && other != fe {
+		if route.sni != "" {
+			return errors.Errorf("SNI %v of listener %v is served by frontend %v", route.sni, route.lsnKey.Id, other.Key().Id)
+		}
+		return errors.Errorf("listener %v is served by frontend %v", route.lsnKey.Id, other.Key().Id)
+	}
+	m.unbindTCP(fe)
+	m.tcpFrontends[route] = fe
+	return nil
+}
+
+// unbindTCP stops the tcp frontend from serving the connections of its
+// listener.
+func (m *mux) unbindTCP(fe *frontend.T) {
+	for route, other := range m.tcpFrontends {
+		if other == fe {
+			delete(m.tcpFrontends, route)
+		}
+	}
+}
+
+// ServeConn implements server.ConnHandler, it passes the connections accepted
+// by tcp listeners to the frontends serving them.
+func (m *mux) ServeConn(lsnKey engine.ListenerKey, conn net.Conn) {
+	m.mtx.RLock()
+	fe, ok := m.tcpFrontends[tcpRoute{lsnKey: lsnKey}]
+	m.mtx.RUnlock()
+	if !ok {
+		log.Warnf("%v no frontend serves listener %v, closing connection from %v", m, lsnKey.Id, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	fe.ServeConn(conn)
+}
+
+// SNIHandler implements server.ConnHandler, it returns the handler of the
+// frontend passing the TLS connections to the server name through, or nil if
+// the https listener terminates them. Exact SNI patterns are preferred to
+// wildcard ones.
+func (m *mux) SNIHandler(lsnKey engine.ListenerKey, serverName string) func(net.Conn) {
+	serverName = strings.ToLower(serverName)
+	if serverName == "" {
+		return nil
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	fe, ok := m.tcpFrontends[tcpRoute{lsnKey: lsnKey, sni: serverName}]
+	if i := strings.IndexByte(serverName, '.'); !ok && i > 0 {
+		fe, ok = m.tcpFrontends[tcpRoute{lsnKey: lsnKey, sni: "*" + serverName[i:]}]
+	}
 	if !ok {
-		return errors.Errorf("missing backend %v referenced by frontend %v", fe.BackendKey(), fe.Key())
+		return nil
+	}
+	return fe.ServeConn
+}
+
+// unlinkBackends removes the frontend from the entries of all backends it
+// references.
+func (m *mux) unlinkBackends(fe *frontend.T) error {
+	var missing []string
+	for _, beKey := range fe.BackendKeys() {
+		beEnt, ok := m.backends[beKey]
+		if !ok {
+			missing = append(missing, beKey.Id)
+			continue
+		}
+		delete(beEnt.frontends, fe.Key())
+	}
+	if len(missing) != 0 {
+		return errors.Errorf("missing backends %v referenced by frontend %v", missing, fe.Key())
 	}
-	delete(beEnt.frontends, feKey)
 	return nil
 }
 
@@ -544,6 +880,10 @@ func (m *mux) UpsertMiddleware(feKey engine.FrontendKey, mwCfg engine.Middleware
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.upsertMiddleware(feKey, mwCfg)
+}
+
+func (m *mux) upsertMiddleware(feKey engine.FrontendKey, mwCfg engine.Middleware) error {
 	fe, ok := m.frontends[feKey]
 	if !ok {
 		return errors.Errorf("missing frontend %v referenced by middleware %v", feKey.Id, mwCfg.Id)
@@ -557,6 +897,10 @@ func (m *mux) DeleteMiddleware(mwKey engine.MiddlewareKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteMiddleware(mwKey)
+}
+
+func (m *mux) deleteMiddleware(mwKey engine.MiddlewareKey) error {
 	fe, ok := m.frontends[mwKey.FrontendKey]
 	if !ok {
 		return errors.Errorf("missing frontend %v referenced by middleware %v", mwKey.FrontendKey.Id, mwKey.Id)
@@ -570,6 +914,10 @@ func (m *mux) UpsertServer(beKey engine.BackendKey, beSrvCfg engine.Server) erro
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.upsertServer(beKey, beSrvCfg)
+}
+
+func (m *mux) upsertServer(beKey engine.BackendKey, beSrvCfg engine.Server) error {
 	if _, err := url.ParseRequestURI(beSrvCfg.URL); err != nil {
 		return errors.Wrapf(err, "failed to parse %v", beSrvCfg)
 	}
@@ -598,6 +946,10 @@ func (m *mux) DeleteServer(beSrvKey engine.ServerKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteServer(beSrvKey)
+}
+
+func (m *mux) deleteServer(beSrvKey engine.ServerKey) error {
 	beEnt, ok := m.backends[beSrvKey.BackendKey]
 	if !ok {
 		return errors.Errorf("missing backend %v ", beSrvKey.BackendKey.Id)
@@ -610,6 +962,242 @@ func (m *mux) DeleteServer(beSrvKey engine.ServerKey) error {
 	return nil
 }
 
+// ApplyTransaction applies the changes committed in one transaction in one step, holding the lock for the whole
+// batch, so other configuration updates never observe a partially applied transaction. If a change fails,
+// the changes applied before it are rolled back, so the batch is applied either completely or not at all.
+func (m *mux) ApplyTransaction(changes []interface{}) error {
+	log.Infof("%v ApplyTransaction %v", m, changes)
+	resolved := make([]interface{}, len(changes))
+	for i, ch := range changes {
+		if change, ok := ch.(*engine.HostUpserted); ok {
+			ch = &engine.HostUpserted{Host: m.resolveKeyPair(change.Host)}
+		}
+		resolved[i] = ch
+	}
+
+	m.mtx.Lock()
+	var err error
+	var undos []func() error
+	for _, ch := range resolved {
+		undos = append(undos, m.undoChange(ch))
+		if err = m.applyChange(ch); err != nil {
+			err = errors.Wrapf(err, "failed to apply %v", ch)
+			break
+		}
+	}
+	if err != nil {
+		log.Errorf("%v %v, rolling back the transaction", m, err)
+		// The failed change is rolled back too, as it may have been applied in part
+		for i := len(undos) - 1; i >= 0; i-- {
+			if undoErr := undos[i](); undoErr != nil {
+				log.Errorf("%v failed to roll back %v: %v", m, resolved[i], undoErr)
+			}
+		}
+	}
+	deleted := m.takeDeletedBackends()
+	m.mtx.Unlock()
+
+	closeBackends(deleted)
+	return err
+}
+
+// undoChange returns the function restoring the configuration the change is about to modify, it is called before
+// the change is applied. Deleted objects are put back as they were, the backends deleted by the transaction
+// are not closed until it is over.
+func (m *mux) undoChange(ch interface{}) func() error {
+	switch change := ch.(type) {
+	case *engine.HostUpserted:
+		return m.undoHost(change.Host.Key())
+	case *engine.HostDeleted:
+		return m.undoHost(change.HostKey)
+	case *engine.ListenerUpserted:
+		return m.undoListener(change.Listener.Key())
+	case *engine.ListenerDeleted:
+		return m.undoListener(change.ListenerKey)
+	case *engine.FrontendUpserted:
+		return m.undoFrontend(change.Frontend.Key())
+	case *engine.FrontendDeleted:
+		return m.undoFrontend(change.FrontendKey)
+	case *engine.MiddlewareUpserted:
+		return m.undoMiddleware(engine.MiddlewareKey{FrontendKey: change.FrontendKey, Id: change.Middleware.Id})
+	case *engine.MiddlewareDeleted:
+		return m.undoMiddleware(change.MiddlewareKey)
+	case *engine.BackendUpserted:
+		return m.undoBackend(change.Backend.Key())
+	case *engine.BackendDeleted:
+		return m.undoBackend(change.BackendKey)
+	case *engine.ServerUpserted:
+		return m.undoServer(engine.ServerKey{BackendKey: change.BackendKey, Id: change.Server.Id})
+	case *engine.ServerDeleted:
+		return m.undoServer(change.ServerKey)
+	}
+	return func() error { return nil }
+}
+
+func (m *mux) undoHost(hostKey engine.HostKey) func() error {
+	prev, existed := m.hostCfgs[hostKey]
+	return func() error {
+		if existed {
+			return m.upsertHost(prev)
+		}
+		if _, ok := m.hostCfgs[hostKey]; ok {
+			return m.deleteHost(hostKey)
+		}
+		return nil
+	}
+}
+
+func (m *mux) undoListener(lsnKey engine.ListenerKey) func() error {
+	srv, existed := m.servers[lsnKey]
+	var prev engine.Listener
+	if existed {
+		prev = srv.Listener()
+	}
+	return func() error {
+		if existed {
+			return m.upsertListener(prev)
+		}
+		if _, ok := m.servers[lsnKey]; ok {
+			return m.deleteListener(lsnKey)
+		}
+		return nil
+	}
+}
+
+func (m *mux) undoFrontend(feKey engine.FrontendKey) func() error {
+	fe, existed := m.frontends[feKey]
+	var prev engine.Frontend
+	if existed {
+		prev = fe.Cfg()
+	}
+	return func() error {
+		cur, ok := m.frontends[feKey]
+		if !existed {
+			if ok {
+				return m.deleteFrontend(feKey)
+			}
+			return nil
+		}
+		if ok && cur == fe {
+			return m.upsertFrontend(prev)
+		}
+		// The frontend has been deleted, it is put back with its middlewares
+		if _, err := m.frontendBackends(prev); err != nil {
+			return err
+		}
+		return m.addFrontend(prev, fe)
+	}
+}
+
+func (m *mux) undoMiddleware(mwKey engine.MiddlewareKey) func() error {
+	var prev engine.Middleware
+	existed := false
+	if fe, ok := m.frontends[mwKey.FrontendKey]; ok {
+		prev, existed = fe.Middleware(mwKey)
+	}
+	return func() error {
+		if existed {
+			return m.upsertMiddleware(mwKey.FrontendKey, prev)
+		}
+		if _, ok := m.frontends[mwKey.FrontendKey]; ok {
+			return m.deleteMiddleware(mwKey)
+		}
+		return nil
+	}
+}
+
+func (m *mux) undoBackend(beKey engine.BackendKey) func() error {
+	prev, existed := m.backends[beKey]
+	var prevCfg engine.Backend
+	if existed {
+		prevCfg = prev.backend.Cfg()
+	}
+	return func() error {
+		cur, ok := m.backends[beKey]
+		if !existed {
+			if ok {
+				delete(m.backends, beKey)
+				m.deletedBackends = append(m.deletedBackends, cur.backend)
+			}
+			return nil
+		}
+		if ok && cur.backend == prev.backend {
+			return m.upsertBackend(prevCfg)
+		}
+		// The backend has been deleted, it is put back before it is closed
+		m.restoreBackend(prev)
+		return nil
+	}
+}
+
+func (m *mux) undoServer(beSrvKey engine.ServerKey) func() error {
+	var prev engine.Server
+	beEnt, beExisted := m.backends[beSrvKey.BackendKey]
+	existed := false
+	if beExisted {
+		if beSrv, ok := beEnt.backend.Server(beSrvKey); ok {
+			prev, existed = beSrv.Cfg(), true
+		}
+	}
+	return func() error {
+		if existed {
+			return m.upsertServer(beSrvKey.BackendKey, prev)
+		}
+		cur, ok := m.backends[beSrvKey.BackendKey]
+		if !ok {
+			return nil
+		}
+		if !beExisted {
+			// upsertServer has created the backend of the server
+			delete(m.backends, beSrvKey.BackendKey)
+			m.deletedBackends = append(m.deletedBackends, cur.backend)
+			return nil
+		}
+		return m.deleteServer(beSrvKey)
+	}
+}
+
+// restoreBackend puts back the backend deleted by the transaction being rolled back.
+func (m *mux) restoreBackend(beEnt backendEntry) {
+	for i, be := range m.deletedBackends {
+		if be == beEnt.backend {
+			m.deletedBackends = append(m.deletedBackends[:i], m.deletedBackends[i+1:]...)
+			break
+		}
+	}
+	m.backends[beEnt.backend.Key()] = beEnt
+}
+
+func (m *mux) applyChange(ch interface{}) error {
+	switch change := ch.(type) {
+	case *engine.HostUpserted:
+		return m.upsertHost(change.Host)
+	case *engine.HostDeleted:
+		return m.deleteHost(change.HostKey)
+	case *engine.ListenerUpserted:
+		return m.upsertListener(change.Listener)
+	case *engine.ListenerDeleted:
+		return m.deleteListener(change.ListenerKey)
+	case *engine.FrontendUpserted:
+		return m.upsertFrontend(change.Frontend)
+	case *engine.FrontendDeleted:
+		return m.deleteFrontend(change.FrontendKey)
+	case *engine.MiddlewareUpserted:
+		return m.upsertMiddleware(change.FrontendKey, change.Middleware)
+	case *engine.MiddlewareDeleted:
+		return m.deleteMiddleware(change.MiddlewareKey)
+	case *engine.BackendUpserted:
+		return m.upsertBackend(change.Backend)
+	case *engine.BackendDeleted:
+		return m.deleteBackend(change.BackendKey)
+	case *engine.ServerUpserted:
+		return m.upsertServer(change.BackendKey, change.Server)
+	case *engine.ServerDeleted:
+		return m.deleteServer(change.ServerKey)
+	}
+	return errors.Errorf("unsupported change: %#v", ch)
+}
+
 func (m *mux) processStapleUpdate(e *stapler.StapleUpdated) {
 	log.Infof("%v processStapleUpdate event: %v", m, e)
 	m.mtx.Lock()
@@ -690,7 +1278,7 @@ func (m *mux) BackendStats(beKey engine.BackendKey) (*engine.RoundTripStats, err
 
 	aggregate := rtmcollect.NewRTMetrics()
 	for _, fe := range beEnt.frontends {
-		fe.AppendRTMTo(aggregate)
+		fe.AppendRTMTo(aggregate, beKey)
 	}
 	return engine.NewRoundTripStats(aggregate)
 }
@@ -710,11 +1298,58 @@ func (m *mux) ServerStats(beSrvKey engine.ServerKey) (*engine.RoundTripStats, er
 
 	aggregates := rtmcollect.NewRTMetrics()
 	for _, fe := range beEnt.frontends {
-		fe.AppendBeSrvRTMTo(aggregates, beSrv.URLKey())
+		fe.AppendBeSrvRTMTo(aggregates, beSrvKey.BackendKey, beSrv.URLKey())
 	}
 	return engine.NewRoundTripStats(aggregates)
 }
 
+func (m *mux) ServersHealth(beKey engine.BackendKey) (map[string]engine.ServerHealth, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	beEnt, ok := m.backends[beKey]
+	if !ok {
+		return nil, errors.Errorf("backend %v not found", beKey)
+	}
+	return beEnt.backend.ServersHealth(), nil
+}
+
+func (m *mux) OutlierEjections(beKey engine.BackendKey) ([]engine.OutlierEjection, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	beEnt, ok := m.backends[beKey]
+	if !ok {
+		return nil, errors.Errorf("backend %v not found", beKey)
+	}
+	return beEnt.backend.OutlierEjections(), nil
+}
+
+// detectOutliers returns ejected servers whose time is over to load balancing
+// and runs the outlier detection of the backends where it is due, using the
+// server stats aggregated over all frontends of the backend.
+func (m *mux) detectOutliers() {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	now := time.Now().UTC()
+	for beKey, beEnt := range m.backends {
+		beEnt.backend.ReleaseEjected(now)
+		if !beEnt.backend.OutlierDetectionDue(now) {
+			continue
+		}
+		aggregates := make(map[backend.SrvURLKey]rtmcollect.BeSrvEntry)
+		for _, fe := range beEnt.frontends {
+			fe.AppendAllBeSrvRTMsTo(aggregates, &beKey)
+		}
+		stats := make(map[backend.SrvURLKey]engine.RoundTripStats, len(aggregates))
+		for beSrvURLKey, beSrvEnt := range aggregates {
+			stats[beSrvURLKey] = *beSrvEnt.CfgWithStats().Stats
+		}
+		beEnt.backend.EjectOutliers(now, stats)
+	}
+}
+
 // TopFrontends returns locations sorted by criteria (faulty, slow, most used)
 // if hostname or backendId is present, will filter out locations for that host or backendId
 func (m *mux) TopFrontends(beKey *engine.BackendKey) ([]engine.Frontend, error) {
@@ -744,7 +1379,7 @@ func (m *mux) TopServers(beKey *engine.BackendKey) ([]engine.Server, error) {
 
 	aggregates := make(map[backend.SrvURLKey]rtmcollect.BeSrvEntry)
 	for _, fe := range m.filteredFrontends(beKey) {
-		fe.AppendAllBeSrvRTMsTo(aggregates)
+		fe.AppendAllBeSrvRTMsTo(aggregates, beKey)
 	}
 	beSrvCfgs := make([]engine.Server, 0, len(aggregates))
 	for _, beSrvEnt := range aggregates {
@@ -846,5 +1481,11 @@ func setDefaults(o proxy.Options) proxy.Options {
 	if o.CacheProvider == nil {
 		o.CacheProvider = cacheprovider.NoOp()
 	}
+	if o.SecretProvider == nil {
+		o.SecretProvider = secret.NewProvider("")
+	}
+	if o.SecretRefreshPeriod <= 0 {
+		o.SecretRefreshPeriod = proxy.DefaultSecretRefreshPeriod
+	}
 	return o
 }
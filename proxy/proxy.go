@@ -15,8 +15,12 @@ import (
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/plugin/cacheprovider"
 	"github.com/vulcand/vulcand/router"
+	"github.com/vulcand/vulcand/secret"
 )
 
+// DefaultSecretRefreshPeriod is how often the key pairs referenced by hosts are resolved again
+const DefaultSecretRefreshPeriod = time.Minute
+
 type Proxy interface {
 	engine.StatsProvider
 
@@ -40,6 +44,9 @@ type Proxy interface {
 	UpsertServer(engine.BackendKey, engine.Server) error
 	DeleteServer(engine.ServerKey) error
 
+	// ApplyTransaction applies the changes committed in one transaction in one step
+	ApplyTransaction(changes []interface{}) error
+
 	// TakeFiles takes file descriptors representing sockets in listening state to start serving on them
 	// instead of binding. This is nessesary if the child process needs to inherit sockets from the parent
 	// (e.g. for graceful restarts)
@@ -68,6 +75,10 @@ type Options struct {
 	IncomingConnectionTracker conntracker.ConnectionTracker
 	FrontendListeners         plugin.FrontendListeners
 	CacheProvider             cacheprovider.T
+	// SecretProvider resolves the key pairs referenced by hosts, see engine.KeyPair.Ref
+	SecretProvider secret.Provider
+	// SecretRefreshPeriod is how often the referenced key pairs are resolved again to pick up the changes
+	SecretRefreshPeriod time.Duration
 }
 
 type NewProxyFn func(id int) (Proxy, error)
@@ -0,0 +1,50 @@
+package rtmcollect
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// grpcHTTPStatuses maps gRPC status codes to the HTTP status codes with the
+// same meaning.
+var grpcHTTPStatuses = map[int]int{
+	0:  http.StatusOK,                  // OK
+	1:  499,                            // CANCELLED, the client has closed the request
+	2:  http.StatusInternalServerError, // UNKNOWN
+	3:  http.StatusBadRequest,          // INVALID_ARGUMENT
+	4:  http.StatusGatewayTimeout,      // DEADLINE_EXCEEDED
+	5:  http.StatusNotFound,            // NOT_FOUND
+	6:  http.StatusConflict,            // ALREADY_EXISTS
+	7:  http.StatusForbidden,           // PERMISSION_DENIED
+	8:  http.StatusTooManyRequests,     // RESOURCE_EXHAUSTED
+	9:  http.StatusBadRequest,          // FAILED_PRECONDITION
+	10: http.StatusConflict,            // ABORTED
+	11: http.StatusBadRequest,          // OUT_OF_RANGE
+	12: http.StatusNotImplemented,      // UNIMPLEMENTED
+	13: http.StatusInternalServerError, // INTERNAL
+	14: http.StatusServiceUnavailable,  // UNAVAILABLE
+	15: http.StatusInternalServerError, // DATA_LOSS
+	16: http.StatusUnauthorized,        // UNAUTHENTICATED
+}
+
+// grpcStatus returns the HTTP status code matching the gRPC status of a
+// successful gRPC response. The status comes in a trailer or, if the
+// response has no body, in a header.
+func grpcStatus(code int, header http.Header) (int, bool) {
+	if code != http.StatusOK || !strings.HasPrefix(header.Get("Content-Type"), "application/grpc") {
+		return 0, false
+	}
+	v := header.Get("Grpc-Status")
+	if v == "" {
+		v = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	status, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	if httpStatus, ok := grpcHTTPStatuses[status]; ok {
+		return httpStatus, true
+	}
+	return http.StatusInternalServerError, true
+}
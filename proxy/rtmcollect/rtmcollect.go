@@ -1,8 +1,11 @@
 package rtmcollect
 
 import (
+	"context"
 	"net/http"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/mailgun/timetools"
 	"github.com/pkg/errors"
@@ -30,6 +33,8 @@ type T struct {
 	beSrvRTMs map[backend.SrvURLKey]BeSrvEntry
 	clock     timetools.TimeProvider
 	handler   http.Handler
+	// untilHeader makes the round trip end once the status is written.
+	untilHeader bool
 }
 
 // BeSrvEntry used to store a backend server storage config along with
@@ -65,19 +70,55 @@ func New(handler http.Handler) (*T, error) {
 	}, nil
 }
 
+// NewTCP returns a round-trip metrics collector for the connections of tcp
+// frontends. It records the time it has taken to connect to the server, that
+// is until the status is written, rather than the lifetime of the connection.
+func NewTCP(handler http.Handler) (*T, error) {
+	c, err := New(handler)
+	if err != nil {
+		return nil, err
+	}
+	c.untilHeader = true
+	return c, nil
+}
+
 // ServeHTTP implements http.Handler.
 func (c *T) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	start := c.clock.UtcNow()
 	pw := &utils.ProxyWriter{W: w}
+	if c.untilHeader {
+		hw := &headerWriter{ResponseWriter: pw, clock: c.clock}
+		c.handler.ServeHTTP(hw, req)
+		if hw.wroteAt.IsZero() {
+			hw.wroteAt = c.clock.UtcNow()
+		}
+		c.record(req, pw, hw.wroteAt.Sub(start))
+		return
+	}
 	c.handler.ServeHTTP(pw, req)
-	diff := c.clock.UtcNow().Sub(start)
+	c.record(req, pw, c.clock.UtcNow().Sub(start))
+}
+
+func (c *T) record(req *http.Request, pw *utils.ProxyWriter, diff time.Duration) {
+	// Requests cancelled by the client, or by another hedged request that
+	// has won, tell nothing about the server.
+	if req.Context().Err() == context.Canceled {
+		return
+	}
+
+	// gRPC errors come with 200 responses, they are recorded with the
+	// matching HTTP status codes.
+	code := pw.Code
+	if grpcCode, ok := grpcStatus(code, pw.Header()); ok {
+		code = grpcCode
+	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.rtm.Record(pw.Code, diff)
+	c.rtm.Record(code, diff)
 	if beSrvEnt, ok := c.beSrvRTMs[backend.NewSrvURLKey(req.URL)]; ok {
-		beSrvEnt.rtm.Record(pw.Code, diff)
+		beSrvEnt.rtm.Record(code, diff)
 	}
 }
 
@@ -126,6 +167,39 @@ func (c *T) AppendBeSrvRTMTo(aggregate *memmetrics.RTMetrics, beSrvURLKey backen
 	return nil
 }
 
+// ServerLatency returns the median round-trip latency of a backend server. It
+// returns false if no requests to the server have been recorded.
+func (c *T) ServerLatency(u *url.URL) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	beSrvEnt, ok := c.beSrvRTMs[backend.NewSrvURLKey(u)]
+	if !ok || beSrvEnt.rtm.TotalCount() == 0 {
+		return 0, false
+	}
+	h, err := beSrvEnt.rtm.LatencyHistogram()
+	if err != nil {
+		return 0, false
+	}
+	return h.LatencyAtQuantile(50), true
+}
+
+// LatencyAtQuantile returns the round-trip latency of the requests at the
+// quantile, e.g. 95. It returns false if no requests have been recorded.
+func (c *T) LatencyAtQuantile(q float64) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.rtm.TotalCount() == 0 {
+		return 0, false
+	}
+	h, err := c.rtm.LatencyHistogram()
+	if err != nil {
+		return 0, false
+	}
+	return h.LatencyAtQuantile(q), true
+}
+
 // AppendAllBeSrvRTMsTo appends round-trip metrics of all backend servers of
 // the backend associated with the frontend to the respective aggregates. If an
 // aggregate for a server is missing from the map then a new one is created.
@@ -142,3 +216,24 @@ func (c *T) AppendAllBeSrvRTMsTo(aggregates map[backend.SrvURLKey]BeSrvEntry) {
 		aggregate.rtm.Append(beSrvEnt.rtm)
 	}
 }
+
+// headerWriter records the time the status of the response is written.
+type headerWriter struct {
+	http.ResponseWriter
+	clock   timetools.TimeProvider
+	wroteAt time.Time
+}
+
+func (hw *headerWriter) WriteHeader(code int) {
+	if hw.wroteAt.IsZero() {
+		hw.wroteAt = hw.clock.UtcNow()
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	if hw.wroteAt.IsZero() {
+		hw.wroteAt = hw.clock.UtcNow()
+	}
+	return hw.ResponseWriter.Write(b)
+}
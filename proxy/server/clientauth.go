@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// clientAuth authenticates the clients of an https listener by their
+// certificates, with the settings of the host the TLS connection is to if it
+// has any, otherwise with the ones of the listener.
+type clientAuth struct {
+	listener *clientAuthPolicy
+	hosts    map[string]*clientAuthPolicy
+	// headers are the client certificate headers of all the policies, they
+	// are removed from the incoming requests so that clients can not forge
+	// them.
+	headers []string
+}
+
+// clientAuthPolicy is the client authentication of a listener or a host.
+type clientAuthPolicy struct {
+	settings *engine.ClientAuthSettings
+	auth     *engine.ClientAuth
+	crl      *crlFile
+	// config is the TLS config of the connections to the host.
+	config *tls.Config
+}
+
+// newClientAuth returns the client authentication of the listener, or nil if
+// neither the listener nor the hosts have client auth settings.
+func newClientAuth(lsnCfg engine.Listener, hostCfgs map[engine.HostKey]engine.Host) (*clientAuth, error) {
+	ca := &clientAuth{hosts: map[string]*clientAuthPolicy{}}
+	if lsnCfg.Settings != nil && lsnCfg.Settings.ClientAuth != nil {
+		p, err := newClientAuthPolicy(lsnCfg.Settings.ClientAuth)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid client auth of listener %v", lsnCfg.Id)
+		}
+		ca.listener = p
+	}
+	for _, hostCfg := range hostCfgs {
+		if hostCfg.Settings.ClientAuth == nil {
+			continue
+		}
+		p, err := newClientAuthPolicy(hostCfg.Settings.ClientAuth)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid client auth of host %v", hostCfg.Name)
+		}
+		ca.hosts[strings.ToLower(hostCfg.Name)] = p
+	}
+	if ca.listener == nil && len(ca.hosts) == 0 {
+		return nil, nil
+	}
+
+	seen := map[string]bool{}
+	addHeaders := func(p *clientAuthPolicy) {
+		for _, h := range []string{p.auth.Headers.Subject, p.auth.Headers.SANs, p.auth.Headers.Fingerprint} {
+			if !seen[h] {
+				seen[h] = true
+				ca.headers = append(ca.headers, h)
+			}
+		}
+	}
+	if ca.listener != nil {
+		addHeaders(ca.listener)
+	}
+	for _, p := range ca.hosts {
+		addHeaders(p)
+	}
+	return ca, nil
+}
+
+func newClientAuthPolicy(settings *engine.ClientAuthSettings) (*clientAuthPolicy, error) {
+	auth, err := settings.Parse()
+	if err != nil {
+		return nil, err
+	}
+	p := &clientAuthPolicy{settings: settings, auth: auth}
+	if auth.CRL != "" && auth.Type != tls.NoClientCert {
+		if p.crl, err = newCRLFile(auth.CRL); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// configure sets up the client authentication of the listener on the TLS
+// config, and the one of the hosts on copies of it picked by the server name
+// of the connections. It is called once the config is complete.
+func (ca *clientAuth) configure(config *tls.Config) error {
+	ca.listener.apply(config)
+	for _, p := range ca.hosts {
+		p.config = config.Clone()
+		p.apply(p.config)
+		// Sessions are resumed only with the config they have been
+		// authenticated with, as the configs trust different CAs.
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return errors.Wrap(err, "failed to generate session ticket key")
+		}
+		p.config.SetSessionTicketKeys([][32]byte{key})
+	}
+	if len(ca.hosts) != 0 {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if p := ca.hostPolicy(hello.ServerName); p != nil {
+				return p.config, nil
+			}
+			return nil, nil
+		}
+	}
+	return nil
+}
+
+// apply sets the client authentication of the policy on the TLS config, nil
+// policies authenticate no one.
+func (p *clientAuthPolicy) apply(config *tls.Config) {
+	config.ClientAuth = tls.NoClientCert
+	config.ClientCAs = nil
+	config.VerifyConnection = nil
+	if p == nil {
+		return
+	}
+	config.ClientAuth = p.auth.Type
+	config.ClientCAs = p.auth.CAs
+	if p.crl != nil {
+		config.VerifyConnection = p.crl.verify
+	}
+}
+
+// hostPolicy returns the policy of the host with the server name, exact names
+// are preferred over wildcard ones, or nil if there is none.
+func (ca *clientAuth) hostPolicy(serverName string) *clientAuthPolicy {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if p, ok := ca.hosts[serverName]; ok {
+		return p
+	}
+	if i := strings.IndexByte(serverName, '.'); i > 0 {
+		if p, ok := ca.hosts["*"+serverName[i:]]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// policy returns the policy the connections to the server name are
+// authenticated with.
+func (ca *clientAuth) policy(serverName string) *clientAuthPolicy {
+	if p := ca.hostPolicy(serverName); p != nil {
+		return p
+	}
+	return ca.listener
+}
+
+// handler passes the verified client certificate of the connection to the
+// next handler in the request headers. Requests to hosts authenticated
+// otherwise than the connection they are sent over are misdirected, e.g. the
+// ones to a host requiring client certificates sent over a connection to a
+// host that does not.
+func (ca *clientAuth) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, h := range ca.headers {
+			req.Header.Del(h)
+		}
+		if req.TLS == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		p := ca.policy(req.TLS.ServerName)
+		if !p.equals(ca.policy(hostname(req.Host))) {
+			log.Debugf("Request to %v over a connection to %q is misdirected", req.Host, req.TLS.ServerName)
+			http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			return
+		}
+		if p != nil && len(req.TLS.VerifiedChains) != 0 {
+			setClientCertHeaders(req.Header, p.auth.Headers, req.TLS.VerifiedChains[0][0])
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (p *clientAuthPolicy) equals(o *clientAuthPolicy) bool {
+	if p == nil || o == nil {
+		return p == o
+	}
+	return p.settings.Equals(o.settings)
+}
+
+// setClientCertHeaders sets the subject, the subject alternative names and the
+// SHA-256 fingerprint of the certificate in the headers.
+func setClientCertHeaders(header http.Header, names engine.ClientCertHeaders, cert *x509.Certificate) {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	header.Set(names.Subject, cert.Subject.String())
+	if len(sans) != 0 {
+		header.Set(names.SANs, strings.Join(sans, ", "))
+	}
+	header.Set(names.Fingerprint, hex.EncodeToString(fingerprint[:]))
+}
+
+// hostname returns the host of the request without the port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// crlFile is a certificate revocation list read from a local file, the file
+// is read again when it changes.
+type crlFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	list    *x509.RevocationList
+	revoked map[string]bool
+	lastErr string
+}
+
+func newCRLFile(path string) (*crlFile, error) {
+	f := &crlFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads the file if it has changed since it has been read.
+func (f *crlFile) reload() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read CRL")
+	}
+	if f.list != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read CRL")
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse CRL %v", f.path)
+	}
+	revoked := make(map[string]bool, len(list.RevokedCertificateEntries))
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	f.modTime, f.size, f.list, f.revoked = fi.ModTime(), fi.Size(), list, revoked
+	log.Infof("Read CRL %v with %d revoked certificates", f.path, len(revoked))
+	return nil
+}
+
+// verify fails the TLS handshakes of the clients whose certificate chain has
+// a certificate revoked by the issuer of the list. If the file can not be
+// read again, the list read before is used.
+func (f *crlFile) verify(cs tls.ConnectionState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.reload(); err != nil {
+		if msg := err.Error(); msg != f.lastErr {
+			f.lastErr = msg
+			log.Warningf("Using the CRL read before: %v", err)
+		}
+	} else {
+		f.lastErr = ""
+	}
+	for _, chain := range cs.VerifiedChains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			if !bytes.Equal(issuer.RawSubject, f.list.RawIssuer) {
+				continue
+			}
+			if err := f.list.CheckSignatureFrom(issuer); err != nil {
+				return errors.Wrapf(err, "invalid CRL %v", f.path)
+			}
+			if f.revoked[cert.SerialNumber.String()] {
+				return errors.Errorf("certificate of %v has been revoked", cert.Subject)
+			}
+		}
+	}
+	return nil
+}
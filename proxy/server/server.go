@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 
 	proxyproto "github.com/armon/go-proxyproto"
@@ -25,25 +26,48 @@ import (
 
 type getCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 
-// T contains all that is necessary to run the HTTP(s) server. Note that it is
-// not thread safe and therefore requires external synchronization.
+// ConnHandler serves the connections accepted by tcp listeners and the TLS
+// connections of https listeners that are passed through.
+type ConnHandler interface {
+	ServeConn(lsnKey engine.ListenerKey, conn net.Conn)
+	// SNIHandler returns the handler of the TLS connections to the server
+	// name that are passed through, or nil if they are terminated.
+	SNIHandler(lsnKey engine.ListenerKey, serverName string) func(net.Conn)
+}
+
+// gracefulServer is a graceful.Server of an HTTP(s) listener or a
+// graceful.ConnServer of a tcp one.
+type gracefulServer interface {
+	ListenAndServe() error
+	Close() bool
+	GetFile() (*os.File, error)
+}
+
+// T contains all that is necessary to run the HTTP(s) server, or the server
+// of a tcp listener. Note that it is not thread safe and therefore requires
+// external synchronization.
 type T struct {
-	lsnCfg  engine.Listener
-	router  http.Handler
-	stapler stapler.Stapler
-	connTck conntracker.ConnectionTracker
-	serveWg *sync.WaitGroup
+	lsnCfg      engine.Listener
+	router      http.Handler
+	connHandler ConnHandler
+	stapler     stapler.Stapler
+	connTck     conntracker.ConnectionTracker
+	serveWg     *sync.WaitGroup
 
 	autoCertCache autocert.Cache
 
-	srv          *graceful.Server
+	srv          gracefulServer
 	scopedRouter http.Handler
-	options      proxy.Options
-	state        int
+	// clientAuth is the client authentication of the TLS config built last,
+	// the HTTP server built next passes the client certificates on with it.
+	clientAuth *clientAuth
+	options    proxy.Options
+	state      int
 }
 
-// New creates a new server instance.
-func New(lsnCfg engine.Listener, router http.Handler, stapler stapler.Stapler,
+// New creates a new server instance. The connections of tcp listeners are
+// passed to the connection handler, the requests of others to the router.
+func New(lsnCfg engine.Listener, router http.Handler, connHandler ConnHandler, stapler stapler.Stapler,
 	connTck conntracker.ConnectionTracker, autoCertCache autocert.Cache, wg *sync.WaitGroup,
 ) (*T, error) {
 	scopedRouter, err := newScopeRouter(lsnCfg.Scope, router)
@@ -51,8 +75,9 @@ func New(lsnCfg engine.Listener, router http.Handler, stapler stapler.Stapler,
 		return nil, err
 	}
 	return &T{
-		lsnCfg: lsnCfg,
-		router: router,
+		lsnCfg:      lsnCfg,
+		router:      router,
+		connHandler: connHandler,
 
 		stapler:       stapler,
 		connTck:       connTck,
@@ -71,6 +96,14 @@ func (s *T) Address() engine.Address {
 	return s.lsnCfg.Address
 }
 
+func (s *T) Listener() engine.Listener {
+	return s.lsnCfg
+}
+
+func (s *T) Protocol() string {
+	return s.lsnCfg.Protocol
+}
+
 func (s *T) GetFile() (*proxy.FileDescriptor, error) {
 	if !s.hasListeners() || s.srv == nil {
 		return nil, nil
@@ -113,14 +146,9 @@ func (s *T) Start(hostCfgs map[engine.HostKey]engine.Host) error {
 			if err != nil {
 				return err
 			}
-			lsn = graceful.NewTLSListener(lsn, config)
+			lsn = s.newTLSListener(lsn, config)
 		}
-		s.srv = graceful.NewWithOptions(
-			graceful.Options{
-				Server:       s.newHTTPServer(),
-				Listener:     lsn,
-				StateHandler: s.connTck.RegisterStateChange,
-			})
+		s.srv = s.newServer(lsn)
 		s.state = srvStateActive
 		s.serveWg.Add(1)
 		go s.serve(s.srv)
@@ -189,15 +217,10 @@ func (s *T) TakeFile(fd *proxy.FileDescriptor, hostCfgs map[engine.HostKey]engin
 		if err != nil {
 			return errors.Wrap(err, "failed to create TLS config")
 		}
-		lsn = graceful.NewTLSListener(lsn, config)
+		lsn = s.newTLSListener(lsn, config)
 	}
 
-	s.srv = graceful.NewWithOptions(
-		graceful.Options{
-			Server:       s.newHTTPServer(),
-			Listener:     lsn,
-			StateHandler: s.connTck.RegisterStateChange,
-		})
+	s.srv = s.newServer(lsn)
 	s.state = srvStateHijacked
 	return nil
 }
@@ -218,29 +241,44 @@ func (s *T) reloadTLSCfg(hostCfgs map[engine.HostKey]engine.Host) error {
 		return nil
 	}
 
-	gracefulServer, err := s.srv.HijackListener(
-		s.newHTTPServer(),
-		func(lsn net.Listener) (net.Listener, error) {
-			lsn = &graceful.TCPKeepAliveListener{TCPListener: lsn.(*net.TCPListener)}
+	// The TLS config is built before the HTTP server that depends on its
+	// client authentication.
+	var tlsCfg *tls.Config
+	if s.isTLS() {
+		var err error
+		if tlsCfg, err = s.newTLSCfg(hostCfgs); err != nil {
+			return errors.Wrap(err, "failed to create TLS config")
+		}
+	}
+	mutate := func(lsn net.Listener) (net.Listener, error) {
+		lsn = &graceful.TCPKeepAliveListener{TCPListener: lsn.(*net.TCPListener)}
 
-			if s.isProxyProto() {
-				lsn = &proxyproto.Listener{
-					Listener:           lsn,
-					ProxyHeaderTimeout: s.options.ReadTimeout,
-				}
+		if s.isProxyProto() {
+			lsn = &proxyproto.Listener{
+				Listener:           lsn,
+				ProxyHeaderTimeout: s.options.ReadTimeout,
 			}
+		}
 
-			if s.isTLS() {
-				tlsCfg, err := s.newTLSCfg(hostCfgs)
-				if err != nil {
-					return nil, errors.Wrap(err, "failed to create TLS config")
-				}
-				lsn = graceful.NewTLSListener(lsn, tlsCfg)
-			}
-			return lsn, nil
-		})
-	if err != nil {
-		return err
+		if tlsCfg != nil {
+			lsn = s.newTLSListener(lsn, tlsCfg)
+		}
+		return lsn, nil
+	}
+	var gracefulServer gracefulServer
+	switch srv := s.srv.(type) {
+	case *graceful.ConnServer:
+		connSrv, err := srv.HijackListener(mutate)
+		if err != nil {
+			return err
+		}
+		gracefulServer = connSrv
+	case *graceful.Server:
+		httpSrv, err := srv.HijackListener(s.newHTTPServer(), mutate)
+		if err != nil {
+			return err
+		}
+		gracefulServer = httpSrv
 	}
 	s.serveWg.Add(1)
 	go s.serve(gracefulServer)
@@ -250,9 +288,30 @@ func (s *T) reloadTLSCfg(hostCfgs map[engine.HostKey]engine.Host) error {
 	return nil
 }
 
+// newServer returns the graceful server of the listener: connections of tcp
+// listeners are passed to the connection handler as they are.
+func (s *T) newServer(lsn net.Listener) gracefulServer {
+	if s.isTCP() {
+		lsnKey := s.lsnCfg.Key()
+		return graceful.NewConnServer(lsn, func(conn net.Conn) {
+			s.connHandler.ServeConn(lsnKey, conn)
+		}, s.connTck.RegisterStateChange)
+	}
+	return graceful.NewWithOptions(
+		graceful.Options{
+			Server:       s.newHTTPServer(),
+			Listener:     lsn,
+			StateHandler: s.connTck.RegisterStateChange,
+		})
+}
+
 func (s *T) newHTTPServer() *http.Server {
+	handler := s.scopedRouter
+	if s.isTLS() && s.clientAuth != nil {
+		handler = s.clientAuth.handler(handler)
+	}
 	return &http.Server{
-		Handler:        s.scopedRouter,
+		Handler:        handler,
 		ReadTimeout:    s.options.ReadTimeout,
 		WriteTimeout:   s.options.WriteTimeout,
 		MaxHeaderBytes: s.options.MaxHeaderBytes,
@@ -263,6 +322,20 @@ func (s *T) isTLS() bool {
 	return s.lsnCfg.Protocol == engine.HTTPS
 }
 
+// newTLSListener returns the listener of an https listener, it terminates the
+// TLS connections to the server names that are not passed through to tcp
+// frontends.
+func (s *T) newTLSListener(lsn net.Listener, config *tls.Config) net.Listener {
+	lsnKey := s.lsnCfg.Key()
+	return graceful.NewSNIListener(lsn, config, func(serverName string) func(net.Conn) {
+		return s.connHandler.SNIHandler(lsnKey, serverName)
+	}, s.connTck.RegisterStateChange, s.options.ReadTimeout)
+}
+
+func (s *T) isTCP() bool {
+	return s.lsnCfg.Protocol == engine.TCP
+}
+
 func (s *T) isProxyProto() bool {
 	return s.lsnCfg.ProxyProtocol == engine.PROXY_PROTO_V1
 }
@@ -332,6 +405,17 @@ func (s *T) newTLSCfg(hostCfgs map[engine.HostKey]engine.Host) (*tls.Config, err
 	// Generate an aggergate GetCertificate that calls individual host's GetCertificate generated above.
 	config.GetCertificate = getCertFuncAggregate(getCertFuncs)
 
+	clientAuth, err := newClientAuth(s.lsnCfg, hostCfgs)
+	if err != nil {
+		return nil, err
+	}
+	if clientAuth != nil {
+		if err := clientAuth.configure(config); err != nil {
+			return nil, err
+		}
+	}
+	s.clientAuth = clientAuth
+
 	return config, nil
 }
 
@@ -339,7 +423,7 @@ func (s *T) hasListeners() bool {
 	return s.state == srvStateActive || s.state == srvStateHijacked
 }
 
-func (s *T) serve(srv *graceful.Server) {
+func (s *T) serve(srv gracefulServer) {
 	defer s.serveWg.Done()
 	log.Infof("%s serve", s)
 	srv.ListenAndServe()
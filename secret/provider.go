@@ -0,0 +1,130 @@
+package secret
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// DefaultExecTimeout is the time the helper of exec:// references has to print the key pair
+const DefaultExecTimeout = 10 * time.Second
+
+// Provider resolves the references to the key pairs kept outside of vulcand configuration, see engine.KeyPair.Ref
+type Provider interface {
+	// KeyPair returns the certificate and the private key the reference points to
+	KeyPair(ref string) (*engine.KeyPair, error)
+}
+
+// NewProvider returns the provider resolving file:// references, and exec:// references to the helpers in execDir
+// if it is not empty. Exec references are off by default, as anyone able to change the configuration could run
+// commands on the proxy hosts otherwise.
+func NewProvider(execDir string) Provider {
+	p := Providers{
+		"file": &FileProvider{},
+	}
+	if execDir != "" {
+		p["exec"] = &ExecProvider{Dir: execDir, Timeout: DefaultExecTimeout}
+	}
+	return p
+}
+
+// Providers passes the references to the providers registered for their schemes
+type Providers map[string]Provider
+
+func (p Providers) KeyPair(ref string) (*engine.KeyPair, error) {
+	scheme, _, err := splitRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	provider, ok := p[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key pair reference %q", ref)
+	}
+	return provider.KeyPair(ref)
+}
+
+// FileProvider reads the PEM encoded certificate chain and private key from a file, e.g. file:///etc/certs/x.pem
+type FileProvider struct {
+}
+
+func (*FileProvider) KeyPair(ref string) (*engine.KeyPair, error) {
+	_, path, err := splitRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return keyPairFromPEM(data)
+}
+
+// ExecProvider runs a local helper and reads the PEM encoded certificate chain and private key from its output,
+// e.g. exec://helper get x runs "<Dir>/helper get x". Only the helpers in Dir can be run.
+type ExecProvider struct {
+	Dir     string
+	Timeout time.Duration
+}
+
+func (p *ExecProvider) KeyPair(ref string) (*engine.KeyPair, error) {
+	_, command, err := splitRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing command in %q", ref)
+	}
+	if p.Dir == "" {
+		return nil, fmt.Errorf("exec key pair references are not enabled")
+	}
+	if args[0] != filepath.Base(args[0]) || args[0] == "." || args[0] == ".." {
+		return nil, fmt.Errorf("helper %q should be the name of a file in %v", args[0], p.Dir)
+	}
+	path := filepath.Join(p.Dir, args[0])
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, args[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v failed: %v", args[0], err)
+	}
+	return keyPairFromPEM(out)
+}
+
+func splitRef(ref string) (string, string, error) {
+	idx := strings.Index(ref, "://")
+	if idx <= 0 {
+		return "", "", fmt.Errorf("key pair reference %q should be in form scheme://location", ref)
+	}
+	return ref[:idx], ref[idx+len("://"):], nil
+}
+
+// keyPairFromPEM collects the certificates and the private key from PEM blocks
+func keyPairFromPEM(data []byte) (*engine.KeyPair, error) {
+	var cert, key []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert = append(cert, pem.EncodeToMemory(block)...)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			key = pem.EncodeToMemory(block)
+		}
+	}
+	return engine.NewKeyPair(cert, key)
+}
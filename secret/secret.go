@@ -2,9 +2,11 @@ package secret
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"strings"
 
 	"golang.org/x/crypto/nacl/secretbox"
 )
@@ -25,25 +27,76 @@ func KeyFromString(key string) (*[keyLength]byte, error) {
 	return decodeKey(bytes)
 }
 
+// KeyId returns the identifier of the key stored along with the values sealed by it,
+// it is derived from the key and does not reveal it
+func KeyId(key *[keyLength]byte) string {
+	sum := sha256.Sum256(key[:])
+	return hex.EncodeToString(sum[:keyIdLength])
+}
+
+// Box is a keyring sealing the values with the newest key and opening them with any of its keys,
+// so the seal key can be rotated without re-sealing all values at once.
 type Box struct {
-	key *[32]byte
+	keys []boxKey
+}
+
+type boxKey struct {
+	id  string
+	key *[keyLength]byte
 }
 
 type SealedBytes struct {
 	Val   []byte
 	Nonce []byte
+	// KeyId identifies the key the value has been sealed with, it is empty for the values sealed before key rotation was supported
+	KeyId string `json:",omitempty"`
 }
 
+// NewBoxFromKeyString returns the box with the keys from the comma separated list, the newest key first
 func NewBoxFromKeyString(keyS string) (*Box, error) {
-	key, err := KeyFromString(keyS)
-	if err != nil {
-		return nil, err
+	keys := []*[keyLength]byte{}
+	for _, k := range strings.Split(keyS, ",") {
+		key, err := KeyFromString(strings.TrimSpace(k))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
 	}
-	return NewBox(key)
+	return NewKeyring(keys...)
 }
 
 func NewBox(bytes *[keyLength]byte) (*Box, error) {
-	return &Box{key: bytes}, nil
+	return NewKeyring(bytes)
+}
+
+// NewKeyring returns the box sealing with the first key and opening with any of the keys
+func NewKeyring(keys ...*[keyLength]byte) (*Box, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keyring needs at least one key")
+	}
+	b := &Box{}
+	for _, key := range keys {
+		id := KeyId(key)
+		if b.find(id) != nil {
+			return nil, fmt.Errorf("duplicate key %v", id)
+		}
+		b.keys = append(b.keys, boxKey{id: id, key: key})
+	}
+	return b, nil
+}
+
+// KeyId returns the identifier of the key used for sealing
+func (b *Box) KeyId() string {
+	return b.keys[0].id
+}
+
+func (b *Box) find(id string) *boxKey {
+	for i := range b.keys {
+		if b.keys[i].id == id {
+			return &b.keys[i]
+		}
+	}
+	return nil
 }
 
 func (b *Box) Seal(value []byte) (*SealedBytes, error) {
@@ -53,25 +106,34 @@ func (b *Box) Seal(value []byte) (*SealedBytes, error) {
 		return nil, fmt.Errorf("unable to generate random string: %v", err)
 	}
 	var encrypted []byte
-	encrypted = secretbox.Seal(encrypted[:0], value, &nonce, b.key)
+	encrypted = secretbox.Seal(encrypted[:0], value, &nonce, b.keys[0].key)
 	return &SealedBytes{
 		Val:   encrypted,
 		Nonce: nonce[:],
+		KeyId: b.keys[0].id,
 	}, nil
 }
 
+// Open decrypts the value with the key it has been sealed with, values without key id are tried with all keys
 func (b *Box) Open(e *SealedBytes) ([]byte, error) {
 	nonce, err := decodeNonce(e.Nonce)
 	if err != nil {
 		return nil, err
 	}
-	var decrypted []byte
-	var ok bool
-	decrypted, ok = secretbox.Open(decrypted[:0], e.Val, nonce, b.key)
-	if !ok {
-		return nil, fmt.Errorf("unable to decrypt message")
+	keys := b.keys
+	if e.KeyId != "" {
+		k := b.find(e.KeyId)
+		if k == nil {
+			return nil, fmt.Errorf("value is sealed with key %v missing from the keyring", e.KeyId)
+		}
+		keys = []boxKey{*k}
+	}
+	for _, k := range keys {
+		if decrypted, ok := secretbox.Open(nil, e.Val, nonce, k.key); ok {
+			return decrypted, nil
+		}
 	}
-	return decrypted, nil
+	return nil, fmt.Errorf("unable to decrypt message")
 }
 
 func decodeNonce(bytes []byte) (*[nonceLength]byte, error) {
@@ -104,4 +166,6 @@ func newKey() ([]byte, error) {
 const (
 	nonceLength = 24
 	keyLength   = 32
+	// keyIdLength is the number of bytes of the key hash used as the key id
+	keyIdLength = 4
 )
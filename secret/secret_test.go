@@ -1,8 +1,15 @@
 package secret
 
 import (
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/testutils"
 	. "gopkg.in/check.v1"
 )
 
@@ -58,3 +65,109 @@ func (s *SecretSuite) TestEncryptDecryptJSON(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(out, DeepEquals, message)
 }
+
+func (s *SecretSuite) TestKeyring(c *C) {
+	oldS, err := NewKeyString()
+	c.Assert(err, IsNil)
+	newS, err := NewKeyString()
+	c.Assert(err, IsNil)
+
+	old, err := NewBoxFromKeyString(oldS)
+	c.Assert(err, IsNil)
+	keyring, err := NewBoxFromKeyString(newS + "," + oldS)
+	c.Assert(err, IsNil)
+	c.Assert(keyring.KeyId(), Not(Equals), old.KeyId())
+
+	message := []byte("hello, box!")
+	sealedOld, err := old.Seal(message)
+	c.Assert(err, IsNil)
+	c.Assert(sealedOld.KeyId, Equals, old.KeyId())
+
+	// Values sealed with the old key are opened by the keyring
+	out, err := keyring.Open(sealedOld)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, message)
+
+	// The keyring seals with the newest key, that the old box does not have
+	sealedNew, err := keyring.Seal(message)
+	c.Assert(err, IsNil)
+	c.Assert(sealedNew.KeyId, Equals, keyring.KeyId())
+	_, err = old.Open(sealedNew)
+	c.Assert(err, NotNil)
+
+	// Values sealed before key ids were stored are tried with every key
+	sealedOld.KeyId = ""
+	out, err = keyring.Open(sealedOld)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, message)
+
+	_, err = NewBoxFromKeyString(oldS + "," + oldS)
+	c.Assert(err, NotNil)
+}
+
+func (s *SecretSuite) TestFileProvider(c *C) {
+	keyPair := testutils.NewTestKeyPair()
+	f, err := ioutil.TempFile("", "vulcand")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	f.Write(keyPair.Cert)
+	f.Write([]byte("\n"))
+	f.Write(keyPair.Key)
+	f.Close()
+
+	out, err := NewProvider("").KeyPair("file://" + f.Name())
+	c.Assert(err, IsNil)
+	assertSamePEM(c, out, keyPair)
+
+	_, err = NewProvider("").KeyPair("file:///does/not/exist.pem")
+	c.Assert(err, NotNil)
+}
+
+func (s *SecretSuite) TestExecProvider(c *C) {
+	keyPair := testutils.NewTestKeyPair()
+	f, err := ioutil.TempFile("", "vulcand")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	f.Write(keyPair.Key)
+	f.Write([]byte("\n"))
+	f.Write(keyPair.Cert)
+	f.Close()
+
+	dir, err := ioutil.TempDir("", "vulcand")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	cat, err := exec.LookPath("cat")
+	c.Assert(err, IsNil)
+	c.Assert(os.Symlink(cat, filepath.Join(dir, "cat")), IsNil)
+
+	out, err := NewProvider(dir).KeyPair("exec://cat " + f.Name())
+	c.Assert(err, IsNil)
+	assertSamePEM(c, out, keyPair)
+
+	// Exec references are off by default
+	_, err = NewProvider("").KeyPair("exec://cat " + f.Name())
+	c.Assert(err, NotNil)
+
+	// Only the helpers in the directory can be run
+	for _, ref := range []string{"exec://false", "exec://" + cat + " " + f.Name(), "exec://../cat " + f.Name(), "exec://.. x"} {
+		_, err = NewProvider(dir).KeyPair(ref)
+		c.Assert(err, NotNil, Commentf("ref: %v", ref))
+	}
+}
+
+func (s *SecretSuite) TestProviderBadRef(c *C) {
+	_, err := NewProvider("").KeyPair("vault://secret/x")
+	c.Assert(err, NotNil)
+	_, err = NewProvider("").KeyPair("/etc/certs/x.pem")
+	c.Assert(err, NotNil)
+}
+
+// assertSamePEM compares the PEM blocks of the key pairs, re-encoded blocks may differ in trailing whitespace
+func assertSamePEM(c *C, a, b *engine.KeyPair) {
+	for _, pair := range [][2][]byte{{a.Cert, b.Cert}, {a.Key, b.Key}} {
+		ba, _ := pem.Decode(pair[0])
+		bb, _ := pem.Decode(pair[1])
+		c.Assert(ba, NotNil)
+		c.Assert(ba, DeepEquals, bb)
+	}
+}
@@ -10,6 +10,12 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	EngineEtcd  = "etcd"
+	EngineFiles = "files"
+	EngineLocal = "local"
+)
+
 type Options struct {
 	ApiPort      int
 	ApiInterface string
@@ -20,6 +26,11 @@ type Options struct {
 	Interface string
 	CertPath  string
 
+	Engine            string
+	FilesDir          string
+	FilesPollInterval time.Duration
+	LocalPath         string
+
 	EtcdApiVersion          int
 	EtcdNodes               listOptions
 	EtcdKey                 string
@@ -41,6 +52,10 @@ type Options struct {
 	EndpointReadTimeout time.Duration
 
 	SealKey string
+	// SecretRefreshPeriod is how often the key pairs referenced by hosts, e.g. file:///etc/certs/x.pem, are reloaded
+	SecretRefreshPeriod time.Duration
+	// SecretExecDir is the directory of the helpers exec:// key pair references can run, they are rejected if empty
+	SecretExecDir string
 
 	StatsdAddr    string
 	StatsdPrefix  string
@@ -87,6 +102,19 @@ func (o *listOptions) Set(value string) error {
 }
 
 func validateOptions(o Options) (Options, error) {
+	switch o.Engine {
+	case "", EngineEtcd:
+	case EngineFiles:
+		if o.FilesDir == "" {
+			return o, fmt.Errorf("filesDir is required when engine is %q", EngineFiles)
+		}
+	case EngineLocal:
+		if o.LocalPath == "" {
+			return o, fmt.Errorf("localPath is required when engine is %q", EngineLocal)
+		}
+	default:
+		return o, fmt.Errorf("unsupported engine %q, expected one of %q, %q or %q", o.Engine, EngineEtcd, EngineFiles, EngineLocal)
+	}
 	if o.EndpointDialTimeout+o.EndpointReadTimeout >= o.ServerWriteTimeout {
 		fmt.Printf("!!!!!! WARN: serverWriteTimout(%s) should be > endpointDialTimeout(%s) + endpointReadTimeout(%s)\n\n",
 			o.ServerWriteTimeout, o.EndpointDialTimeout, o.EndpointReadTimeout)
@@ -103,6 +131,10 @@ func validateOptions(o Options) (Options, error) {
 }
 
 func ParseCommandLine() (options Options, err error) {
+	flag.StringVar(&options.Engine, "engine", EngineEtcd, "Configuration storage engine (etcd, files or local)")
+	flag.StringVar(&options.FilesDir, "filesDir", "", "Directory with configuration files, used by the files engine")
+	flag.DurationVar(&options.FilesPollInterval, "filesPollInterval", time.Second, "How often the files engine checks the directory for changes")
+	flag.StringVar(&options.LocalPath, "localPath", "", "Path to the configuration file, used by the local engine")
 	flag.Var(&options.EtcdNodes, "etcd", "Etcd discovery service API endpoints")
 	flag.IntVar(&options.EtcdApiVersion, "etcdApiVer", 2, "Etcd Client API version (When 3, Etcd 3.x API is used. All other values default to v2.)")
 	flag.StringVar(&options.EtcdKey, "etcdKey", "vulcand", "Etcd key for storing configuration")
@@ -131,7 +163,9 @@ func ParseCommandLine() (options Options, err error) {
 	flag.DurationVar(&options.EndpointDialTimeout, "endpointDialTimeout", time.Duration(5)*time.Second, "Endpoint dial timeout")
 	flag.DurationVar(&options.EndpointReadTimeout, "endpointReadTimeout", time.Duration(50)*time.Second, "Endpoint read timeout")
 
-	flag.StringVar(&options.SealKey, "sealKey", "", "Seal key used to store encrypted data in the backend")
+	flag.StringVar(&options.SealKey, "sealKey", "", "Seal key used to store encrypted data in the backend, comma separated keys with the newest first to rotate the key")
+	flag.DurationVar(&options.SecretRefreshPeriod, "secretRefreshPeriod", time.Minute, "How often to reload the key pairs referenced by hosts")
+	flag.StringVar(&options.SecretExecDir, "secretExecDir", "", "Directory of the helpers exec:// key pair references can run, exec references are rejected if empty")
 
 	flag.StringVar(&options.StatsdPrefix, "statsdPrefix", "", "Statsd prefix will be appended to the metrics emitted by this instance")
 	flag.StringVar(&options.StatsdAddr, "statsdAddr", "", "Statsd address in form of 'host:port'")
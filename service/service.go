@@ -24,6 +24,8 @@ import (
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/engine/etcdv2ng"
 	"github.com/vulcand/vulcand/engine/etcdv3ng"
+	"github.com/vulcand/vulcand/engine/filesng"
+	"github.com/vulcand/vulcand/engine/localng"
 	"github.com/vulcand/vulcand/graceful"
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/plugin/cacheprovider"
@@ -340,11 +342,7 @@ func (s *Service) newBox() (*secret.Box, error) {
 	if s.options.SealKey == "" {
 		return nil, nil
 	}
-	key, err := secret.KeyFromString(s.options.SealKey)
-	if err != nil {
-		return nil, err
-	}
-	return secret.NewBox(key)
+	return secret.NewBoxFromKeyString(s.options.SealKey)
 }
 
 func (s *Service) newEngine() error {
@@ -354,7 +352,22 @@ func (s *Service) newEngine() error {
 	}
 	var ng engine.Engine
 
-	if s.options.EtcdApiVersion == 3 {
+	if s.options.Engine == EngineFiles {
+		ng, err = filesng.New(
+			s.options.FilesDir,
+			s.registry,
+			filesng.Options{
+				PollInterval: s.options.FilesPollInterval,
+				Box:          box,
+			})
+	} else if s.options.Engine == EngineLocal {
+		ng, err = localng.New(
+			s.options.LocalPath,
+			s.registry,
+			localng.Options{
+				Box: box,
+			})
+	} else if s.options.EtcdApiVersion == 3 {
 		ng, err = etcdv3ng.New(
 			s.options.EtcdNodes,
 			s.options.EtcdKey,
@@ -365,7 +378,8 @@ func (s *Service) newEngine() error {
 				EtcdKeyFile:             s.options.EtcdKeyFile,
 				EtcdConsistency:         s.options.EtcdConsistency,
 				EtcdSyncIntervalSeconds: s.options.EtcdSyncIntervalSeconds,
-				Box: box,
+				Box:                     box,
+				MetricsClient:           s.metricsClient,
 			})
 	} else {
 		ng, err = etcdv2ng.New(
@@ -425,6 +439,8 @@ func (s *Service) newProxy(id int) (proxy.Proxy, error) {
 		IncomingConnectionTracker: s.registry.GetIncomingConnectionTracker(),
 		FrontendListeners:         s.registry.GetFrontendListeners(),
 		CacheProvider:             cacheProvider,
+		SecretRefreshPeriod:       s.options.SecretRefreshPeriod,
+		SecretProvider:            secret.NewProvider(s.options.SecretExecDir),
 	})
 }
 
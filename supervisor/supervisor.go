@@ -126,6 +126,22 @@ func (s *Supervisor) TopFrontends(key *engine.BackendKey) ([]engine.Frontend, er
 	return nil, fmt.Errorf("no current proxy")
 }
 
+func (s *Supervisor) ServersHealth(key engine.BackendKey) (map[string]engine.ServerHealth, error) {
+	p := s.getCurrentProxy()
+	if p != nil {
+		return p.ServersHealth(key)
+	}
+	return nil, fmt.Errorf("no current proxy")
+}
+
+func (s *Supervisor) OutlierEjections(key engine.BackendKey) ([]engine.OutlierEjection, error) {
+	p := s.getCurrentProxy()
+	if p != nil {
+		return p.OutlierEjections(key)
+	}
+	return nil, fmt.Errorf("no current proxy")
+}
+
 // TopServers returns endpoints sorted by criteria (faulty, slow, mos used)
 // if backendId is not empty, will filter out endpoints for that backendId.
 func (s *Supervisor) TopServers(key *engine.BackendKey) ([]engine.Server, error) {
@@ -326,6 +342,9 @@ func processChange(p proxy.Proxy, ch interface{}) error {
 		return p.UpsertServer(change.BackendKey, change.Server)
 	case *engine.ServerDeleted:
 		return p.DeleteServer(change.ServerKey)
+
+	case *engine.TransactionCommitted:
+		return p.ApplyTransaction(change.Changes)
 	}
 	return fmt.Errorf("unsupported change: %#v", ch)
 }
@@ -15,9 +15,10 @@ func NewBackendCommand(cmd *Command) cli.Command {
 				Usage:  "Update or insert a new backend to vulcan",
 				Action: cmd.upsertBackendAction,
 				Flags: append(append([]cli.Flag{
-					cli.StringFlag{Name: "id", Usage: "backend id"}},
+					cli.StringFlag{Name: "id", Usage: "backend id"},
+					cli.StringFlag{Name: "type", Usage: "backend type, http (default) or tcp for the servers of tcp frontends"}},
 					backendOptions()...),
-					getTLSFlags()...),
+					append(getTLSFlags(), getBackendTLSFlags()...)...),
 			},
 			{
 				Name:   "rm",
@@ -40,6 +41,15 @@ func NewBackendCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "backend id"},
 				},
 			},
+			{
+				Name:   "ejections",
+				Usage:  "Show servers recently ejected by the outlier detection",
+				Action: cmd.printEjectionsAction,
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "id", Usage: "backend id"},
+					cli.IntFlag{Name: "limit", Value: 20, Usage: "maximum number of the most recent ejections to show, 0 shows all"},
+				},
+			},
 		},
 	}
 }
@@ -49,7 +59,14 @@ func (cmd *Command) upsertBackendAction(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	b, err := engine.NewHTTPBackend(c.String("id"), settings)
+	var b *engine.Backend
+	if c.String("type") == engine.TCP {
+		// Connections to the servers of tcp backends are not encrypted
+		settings.TLS = nil
+		b, err = engine.NewTCPBackend(c.String("id"), settings)
+	} else {
+		b, err = engine.NewHTTPBackend(c.String("id"), settings)
+	}
 	if err != nil {
 		return err
 	}
@@ -79,6 +96,15 @@ func (cmd *Command) printBackendAction(c *cli.Context) error {
 	return nil
 }
 
+func (cmd *Command) printEjectionsAction(c *cli.Context) error {
+	ejections, err := cmd.client.GetOutlierEjections(engine.BackendKey{Id: c.String("id")}, c.Int("limit"))
+	if err != nil {
+		return err
+	}
+	cmd.printEjections(ejections)
+	return nil
+}
+
 func (cmd *Command) listBackendsAction(c *cli.Context) error {
 	out, err := cmd.client.GetBackends()
 	if err != nil {
@@ -98,10 +124,51 @@ func getBackendSettings(c *cli.Context) (engine.HTTPBackendSettings, error) {
 	s.KeepAlive.Period = c.Duration("keepAlivePeriod").String()
 	s.KeepAlive.MaxIdleConnsPerHost = c.Int("maxIdleConns")
 
+	s.Protocol = c.String("protocol")
+
+	s.LoadBalancer.Type = c.String("lb")
+	s.LoadBalancer.Variable = c.String("lbVariable")
+	s.LoadBalancer.LoadFactor = c.Float64("lbLoadFactor")
+	s.LoadBalancer.Cookie = c.String("lbCookie")
+
+	if c.String("healthPath") != "" {
+		s.HealthCheck = &engine.HTTPBackendHealthCheck{
+			Path:               c.String("healthPath"),
+			ExpectedStatus:     c.Int("healthStatus"),
+			HealthyThreshold:   c.Int("healthyThreshold"),
+			UnhealthyThreshold: c.Int("unhealthyThreshold"),
+		}
+		if c.Duration("healthInterval") != 0 {
+			s.HealthCheck.Interval = c.Duration("healthInterval").String()
+		}
+		if c.Duration("healthTimeout") != 0 {
+			s.HealthCheck.Timeout = c.Duration("healthTimeout").String()
+		}
+	}
+
+	if c.Bool("outlierDetection") {
+		s.OutlierDetection = &engine.HTTPBackendOutlierDetection{
+			MaxEjectedPercent: c.Int("maxEjectedPercent"),
+			MinRequests:       c.Int("outlierMinRequests"),
+		}
+		if c.Duration("outlierInterval") != 0 {
+			s.OutlierDetection.Interval = c.Duration("outlierInterval").String()
+		}
+		if c.Duration("baseEjectionTime") != 0 {
+			s.OutlierDetection.BaseEjectionTime = c.Duration("baseEjectionTime").String()
+		}
+		if c.Duration("maxEjectionTime") != 0 {
+			s.OutlierDetection.MaxEjectionTime = c.Duration("maxEjectionTime").String()
+		}
+	}
+
 	tlsSettings, err := getTLSSettings(c)
 	if err != nil {
 		return s, err
 	}
+	if err := setBackendTLSSettings(c, tlsSettings); err != nil {
+		return s, err
+	}
 	s.TLS = tlsSettings
 	return s, nil
 }
@@ -116,5 +183,30 @@ func backendOptions() []cli.Flag {
 		// Keep-alive parameters
 		cli.StringFlag{Name: "keepAlivePeriod", Usage: "keep-alive period"},
 		cli.IntFlag{Name: "maxIdleConns", Usage: "maximum idle connections per host"},
+
+		// Protocol
+		cli.StringFlag{Name: "protocol", Usage: "protocol to talk to servers: http/1.1 (default), h2 or h2c"},
+
+		// Load balancing
+		cli.StringFlag{Name: "lb", Usage: "load balancer: roundrobin (default), leastconn, leastlatency, tworandom, consistenthash or sticky"},
+		cli.StringFlag{Name: "lbVariable", Usage: "variable to hash by consistenthash: client.ip, request.host, request.header.<name> or request.cookie.<name>"},
+		cli.Float64Flag{Name: "lbLoadFactor", Usage: "maximum load of a server relative to the average for consistenthash, defaults to 1.25"},
+		cli.StringFlag{Name: "lbCookie", Usage: "sticky session cookie name, defaults to vulcand_sticky"},
+
+		// Health checks
+		cli.StringFlag{Name: "healthPath", Usage: "path to check servers health at, health checks are disabled if empty"},
+		cli.DurationFlag{Name: "healthInterval", Usage: "interval between health checks, defaults to 10s"},
+		cli.DurationFlag{Name: "healthTimeout", Usage: "health check timeout, defaults to 2s"},
+		cli.IntFlag{Name: "healthStatus", Usage: "response code of a healthy server, defaults to 200"},
+		cli.IntFlag{Name: "healthyThreshold", Usage: "passed checks to consider an unhealthy server healthy, defaults to 2"},
+		cli.IntFlag{Name: "unhealthyThreshold", Usage: "failed checks to consider a server unhealthy, defaults to 3"},
+
+		// Outlier detection
+		cli.BoolFlag{Name: "outlierDetection", Usage: "eject servers whose latency or error rates stand out"},
+		cli.DurationFlag{Name: "outlierInterval", Usage: "interval between outlier detections, defaults to 10s"},
+		cli.DurationFlag{Name: "baseEjectionTime", Usage: "time of the first ejection, doubles on repeated ejections, defaults to 30s"},
+		cli.DurationFlag{Name: "maxEjectionTime", Usage: "maximum ejection time, defaults to 5m"},
+		cli.IntFlag{Name: "maxEjectedPercent", Usage: "maximum percent of servers ejected at the same time, defaults to 10"},
+		cli.IntFlag{Name: "outlierMinRequests", Usage: "recent requests a server needs to be evaluated, defaults to 10"},
 	}
 }
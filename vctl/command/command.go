@@ -50,6 +50,10 @@ func (cmd *Command) Run(args []string) error {
 		NewFrontendCommand(cmd),
 		NewServerCommand(cmd),
 		NewListenerCommand(cmd),
+		NewApplyCommand(cmd),
+		NewExportCommand(cmd),
+		NewHistoryCommand(cmd),
+		NewRollbackCommand(cmd),
 	}
 	app.Commands = append(app.Commands, NewMiddlewareCommands(cmd)...)
 	return app.Run(args)
@@ -109,9 +113,9 @@ func readKeyPair(certPath, keyPath string) (*engine.KeyPair, error) {
 }
 
 func readBox(key string) (*secret.Box, error) {
-	keyB, err := secret.KeyFromString(key)
+	box, err := secret.NewBoxFromKeyString(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read encryption key: %s", err)
 	}
-	return secret.NewBox(keyB)
+	return box, nil
 }
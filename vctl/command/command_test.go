@@ -3,15 +3,21 @@ package command
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/vulcand/vulcand/api"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/localng"
 	"github.com/vulcand/vulcand/engine/memng"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/proxy"
@@ -145,6 +151,35 @@ func (s *CmdSuite) TestHTTPSListenerCRUD(c *C) {
 	c.Assert(s.run("listener", "rm", "-id", l), Matches, OK)
 }
 
+func (s *CmdSuite) TestClientAuth(c *C) {
+	fCA, err := ioutil.TempFile("", "vulcand")
+	c.Assert(err, IsNil)
+	defer fCA.Close()
+	ca := testutils.NewTestKeyPair().Cert
+	fCA.Write(ca)
+
+	l := "l1"
+	c.Assert(s.run("listener", "upsert", "-id", l, "-proto", "https", "-addr", "localhost:11300",
+		"-clientAuth", "require", "-clientCA", fCA.Name(), "-clientCRL", "/etc/vulcand/clients.crl",
+		"-clientSubjectHeader", "X-Client-Dn"), Matches, OK)
+	out, err := s.ng.GetListener(engine.ListenerKey{Id: l})
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.ClientAuth, DeepEquals, &engine.ClientAuthSettings{
+		Type:    engine.ClientAuthRequire,
+		CA:      ca,
+		CRL:     "/etc/vulcand/clients.crl",
+		Headers: engine.ClientCertHeaders{Subject: "X-Client-Dn"},
+	})
+
+	host := "public.example.com"
+	c.Assert(s.run("host", "upsert", "-name", host, "-clientAuth", "none"), Matches, OK)
+	h, err := s.ng.GetHost(engine.HostKey{Name: host})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.ClientAuth, DeepEquals, &engine.ClientAuthSettings{Type: engine.ClientAuthNone})
+
+	c.Assert(s.run("listener", "rm", "-id", l), Matches, OK)
+}
+
 func (s *CmdSuite) TestBackendCRUD(c *C) {
 	b := "bk1"
 	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
@@ -217,6 +252,107 @@ func (s *CmdSuite) TestBackendSessionCacheCRUD(c *C) {
 	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
 }
 
+func (s *CmdSuite) TestBackendTLS(c *C) {
+	keyPair := testutils.NewTestKeyPair()
+
+	fKey, err := ioutil.TempFile("", "vulcand")
+	c.Assert(err, IsNil)
+	defer fKey.Close()
+	fKey.Write(keyPair.Key)
+
+	fCert, err := ioutil.TempFile("", "vulcand")
+	c.Assert(err, IsNil)
+	defer fCert.Close()
+	fCert.Write(keyPair.Cert)
+
+	pin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b,
+		"-tlsCert", fCert.Name(), "-tlsKey", fKey.Name(), "-tlsRootCAs", fCert.Name(),
+		"-tlsServerName", "backend.example.com", "-tlsPinSPKI", pin), Matches, OK)
+
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	o := val.HTTPSettings()
+	c.Assert(o.TLS.KeyPair, DeepEquals, keyPair)
+	c.Assert(o.TLS.RootCAs, DeepEquals, keyPair.Cert)
+	c.Assert(o.TLS.ServerName, Equals, "backend.example.com")
+	c.Assert(o.TLS.PinnedSPKI, DeepEquals, []string{pin})
+	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
+}
+
+func (s *CmdSuite) TestBackendLoadBalancer(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	c.Assert(s.run("backend", "ls"), Matches, ".*bk1\\s+http\\s+roundrobin.*")
+
+	c.Assert(s.run("backend", "upsert", "-id", b, "-lb", "leastconn"), Matches, OK)
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().LoadBalancer.Type, Equals, engine.LBLeastConn)
+	c.Assert(s.run("backend", "ls"), Matches, ".*bk1\\s+http\\s+leastconn.*")
+
+	c.Assert(s.run("backend", "upsert", "-id", b, "-lb", "consistenthash", "-lbVariable", "request.header.X-User", "-lbLoadFactor", "1.5"), Matches, OK)
+	val, err = s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().LoadBalancer, DeepEquals, engine.HTTPBackendLoadBalancer{
+		Type: engine.LBConsistentHash, Variable: "request.header.X-User", LoadFactor: 1.5})
+}
+
+func (s *CmdSuite) TestBackendProtocol(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-protocol", "h2c"), Matches, OK)
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().Protocol, Equals, engine.BackendH2C)
+
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	val, err = s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().Protocol, Equals, "")
+}
+
+func (s *CmdSuite) TestBackendHealthCheck(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b,
+		"-healthPath", "/health", "-healthInterval", "10ms", "-unhealthyThreshold", "1"), Matches, OK)
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().HealthCheck, DeepEquals, &engine.HTTPBackendHealthCheck{
+		Path: "/health", Interval: "10ms", UnhealthyThreshold: 1})
+
+	c.Assert(s.run("server", "upsert", "-id", "srv1", "-url", srv.URL, "-b", b), Matches, OK)
+	for i := 0; i < 100; i++ {
+		if strings.Contains(s.run("server", "ls", "-b", b), "unhealthy") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.run("server", "ls", "-b", b), Matches, ".*srv1.*unhealthy \\(got status 503, expected 200\\).*")
+}
+
+func (s *CmdSuite) TestBackendOutlierDetection(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b,
+		"-outlierDetection", "-baseEjectionTime", "1m", "-maxEjectedPercent", "50"), Matches, OK)
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().OutlierDetection, DeepEquals, &engine.HTTPBackendOutlierDetection{
+		BaseEjectionTime: "1m0s", MaxEjectedPercent: 50})
+
+	c.Assert(s.run("backend", "ejections", "-id", b), Matches, "(?s).*Time.*Server.*Reason.*")
+
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	val, err = s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().OutlierDetection, IsNil)
+}
+
 func (s *CmdSuite) TestServerCRUD(c *C) {
 	b := "bk1"
 	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
@@ -230,6 +366,17 @@ func (s *CmdSuite) TestServerCRUD(c *C) {
 	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
 }
 
+func (s *CmdSuite) TestServerWeight(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	c.Assert(s.run("server", "upsert", "-id", "srv1", "-url", "http://localhost:5000", "-weight", "4", "-b", b), Matches, OK)
+
+	srv, err := s.ng.GetServer(engine.ServerKey{BackendKey: engine.BackendKey{Id: b}, Id: "srv1"})
+	c.Assert(err, IsNil)
+	c.Assert(srv.Weight, Equals, 4)
+	c.Assert(s.run("server", "ls", "-b", b), Matches, ".*http://localhost:5000\\s+4.*")
+}
+
 func (s *CmdSuite) TestFrontendCRUD(c *C) {
 	b := "bk1"
 	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
@@ -268,6 +415,166 @@ func (s *CmdSuite) TestFrontendCRUD(c *C) {
 	c.Assert(s.run("frontend", "rm", "-id", f), Matches, OK)
 }
 
+func (s *CmdSuite) TestFrontendSplit(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "stable"), Matches, OK)
+	c.Assert(s.run("backend", "upsert", "-id", "canary"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-route", `Path("/path")`,
+		"-split", "stable=95,canary=5", "-pinCookie", "release"), Matches, OK)
+
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.BackendId, Equals, "stable")
+	c.Assert(fr.Backends, DeepEquals, []engine.FrontendBackend{{Id: "stable", Weight: 95}, {Id: "canary", Weight: 5}})
+	c.Assert(fr.BackendPin, DeepEquals, &engine.BackendPin{Cookie: "release"})
+
+	c.Assert(s.run("frontend", "show", "-id", f), Matches, ".*stable=95,canary=5.*")
+	c.Assert(s.run("frontend", "rm", "-id", f), Matches, OK)
+}
+
+func (s *CmdSuite) TestFrontendMirror(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "bk1"), Matches, OK)
+	c.Assert(s.run("backend", "upsert", "-id", "shadow"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "bk1", "-route", `Path("/path")`,
+		"-mirror", "shadow", "-mirrorPercent", "2.5", "-mirrorMaxBodyKB", "8"), Matches, OK)
+
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.Mirror, DeepEquals, &engine.FrontendMirror{BackendId: "shadow", Percent: 2.5, MaxBodyBytes: 8 * 1024})
+
+	c.Assert(s.run("frontend", "show", "-id", f), Matches, "(?s).*shadow=2.5%.*")
+	c.Assert(s.run("frontend", "rm", "-id", f), Matches, OK)
+}
+
+func (s *CmdSuite) TestFrontendHedging(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "bk1"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "bk1", "-route", `Path("/path")`,
+		"-hedge", "-hedgeMinDelay", "20ms", "-hedgeBudgetPercent", "5"), Matches, OK)
+
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.HTTPSettings().Hedging, DeepEquals, &engine.HTTPFrontendHedging{MinDelay: "20ms", BudgetPercent: 5})
+
+	c.Assert(s.run("frontend", "rm", "-id", f), Matches, OK)
+}
+
+func (s *CmdSuite) TestFrontendRetry(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "bk1"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "bk1", "-route", `Path("/path")`, "-retry",
+		"-retryOn", "502", "-retryOn", "503", "-retryMethod", "GET", "-retryPerTryTimeout", "1s"), Matches, OK)
+
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.HTTPSettings().Retry, DeepEquals, &engine.HTTPFrontendRetry{
+		StatusCodes: []int{502, 503}, Methods: []string{"GET"}, PerTryTimeout: "1s"})
+	c.Assert(s.run("frontend", "rm", "-id", f), Matches, OK)
+}
+
+func (s *CmdSuite) TestFrontendDeadline(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "bk1"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "bk1", "-route", `Path("/path")`, "-timeout", "3s"), Matches, OK)
+
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.HTTPSettings().Deadline, DeepEquals, &engine.HTTPFrontendDeadline{Timeout: "3s"})
+	c.Assert(s.run("frontend", "rm", "-id", f), Matches, OK)
+}
+
+func (s *CmdSuite) TestFrontendFanOut(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "users"), Matches, OK)
+	c.Assert(s.run("backend", "upsert", "-id", "orders"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-route", `Path("/path")`,
+		"-fanOut", "users:user:2s,orders:orders", "-onPartialFailure", "ignore"), Matches, OK)
+
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.Type, Equals, engine.FanOut)
+	c.Assert(fr.BackendId, Equals, "users")
+	c.Assert(fr.Settings, DeepEquals, engine.FanOutFrontendSettings{
+		Branches: []engine.FanOutBranch{
+			{BackendId: "users", Key: "user", Timeout: "2s"}, {BackendId: "orders", Key: "orders"}},
+		OnPartialFailure: engine.FanOutIgnore,
+	})
+
+	c.Assert(s.run("frontend", "show", "-id", f), Matches, "(?s).*json\\(users,orders\\).*")
+	c.Assert(s.run("frontend", "rm", "-id", f), Matches, OK)
+}
+
+func (s *CmdSuite) TestFrontendTCP(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	c.Assert(s.run("listener", "upsert", "-id", "l1", "-proto", "tcp", "-addr", "localhost:11301"), Matches, OK)
+	c.Assert(s.run("backend", "upsert", "-id", "bk1", "-type", "tcp"), Matches, OK)
+	c.Assert(s.run("server", "upsert", "-id", "srv1", "-url", "tcp://"+l.Addr().String(), "-b", "bk1"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "bk1", "-listener", "l1", "-idleTimeout", "1h"), Matches, OK)
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.Type, Equals, engine.TCP)
+	c.Assert(fr.Settings, DeepEquals, engine.TCPFrontendSettings{ListenerId: "l1", IdleTimeout: "1h0m0s"})
+	c.Assert(s.run("frontend", "ls"), Matches, ".*listener\\(l1\\).*")
+
+	// The connections of the listener are proxied to the echo server
+	var body []byte
+	for i := 0; i < 100; i++ {
+		if body = echo("localhost:11301", "hello"); string(body) == "hello" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(s.run("frontend", "rm", "-id", f), Matches, OK)
+}
+
+func (s *CmdSuite) TestFrontendSNI(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "bk1", "-type", "tcp"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "bk1", "-listener", "l1", "-sni", "*.example.com"), Matches, OK)
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.Settings, DeepEquals, engine.TCPFrontendSettings{ListenerId: "l1", SNI: "*.example.com"})
+	c.Assert(s.run("frontend", "ls"), Matches, ".*listener\\(l1\\) sni\\(\\*\\.example\\.com\\).*")
+}
+
+func echo(addr, msg string) []byte {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	conn.Write([]byte(msg))
+	conn.(*net.TCPConn).CloseWrite()
+	body, _ := ioutil.ReadAll(conn)
+	return body
+}
+
 func (s *CmdSuite) TestLimitsCRUD(c *C) {
 	b := "bk1"
 	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
@@ -344,3 +651,169 @@ func (s *CmdSuite) TestNewKey(c *C) {
 	_, err = secret.NewBoxFromKeyString(string(bytes))
 	c.Assert(err, IsNil)
 }
+
+func (s *CmdSuite) TestSecretRotate(c *C) {
+	keyPair := testutils.NewTestKeyPair()
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "localhost", Settings: engine.HostSettings{KeyPair: keyPair}}), IsNil)
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "example.com"}), IsNil)
+	c.Assert(s.ng.UpsertBackend(engine.Backend{Id: "bk1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{
+		TLS: &engine.TLSSettings{KeyPair: keyPair},
+	}}), IsNil)
+
+	c.Assert(s.run("secret", "rotate"), Matches, ".*2 key pairs and 0 client auth settings re-sealed.*")
+
+	h, err := s.ng.GetHost(engine.HostKey{Name: "localhost"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.KeyPair, DeepEquals, keyPair)
+}
+
+func (s *CmdSuite) TestSecretRotateRemovesOldKey(c *C) {
+	oldKey, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	newKey, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	path := filepath.Join(c.MkDir(), "vulcand.log")
+
+	keyPair := testutils.NewTestKeyPair()
+	clientAuth := &engine.ClientAuthSettings{Type: engine.ClientAuthRequire, CA: keyPair.Cert}
+	hosts := []engine.Host{
+		{Name: "a.example.com", Settings: engine.HostSettings{KeyPair: keyPair}},
+		{Name: "b.example.com", Settings: engine.HostSettings{KeyPair: keyPair, ClientAuth: clientAuth}},
+		{Name: "c.example.com", Settings: engine.HostSettings{ClientAuth: clientAuth}},
+		{Name: "d.example.com", Settings: engine.HostSettings{
+			KeyPair: &engine.KeyPair{Ref: "file:///etc/vulcand/d.pem"}, ClientAuth: clientAuth}},
+	}
+	listener := engine.Listener{Id: "l1", Protocol: engine.HTTPS,
+		Address:  engine.Address{Network: "tcp", Address: "127.0.0.1:0"},
+		Settings: &engine.HTTPSListenerSettings{ClientAuth: clientAuth}}
+	backend := engine.Backend{Id: "bk1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{
+		TLS: &engine.TLSSettings{KeyPair: keyPair}}}
+
+	openEngine := func(keys string) engine.Engine {
+		box, err := secret.NewBoxFromKeyString(keys)
+		c.Assert(err, IsNil)
+		ng, err := localng.New(path, registry.GetRegistry(), localng.Options{Box: box})
+		c.Assert(err, IsNil)
+		return ng
+	}
+
+	ng := openEngine(oldKey)
+	for _, h := range hosts {
+		c.Assert(ng.UpsertHost(h), IsNil)
+	}
+	c.Assert(ng.UpsertListener(listener), IsNil)
+	c.Assert(ng.UpsertBackend(backend), IsNil)
+	ng.Close()
+
+	// Seal with the new key and rotate, the old key is still needed to open the stored values
+	ng = openEngine(newKey + "," + oldKey)
+	router := mux.NewRouter()
+	api.InitProxyController(ng, supervisor.New(nil, ng, supervisor.Options{}), router)
+	server := httptest.NewServer(router)
+	out := &bytes.Buffer{}
+	cmd := &Command{registry: registry.GetRegistry(), out: out, vulcanUrl: server.URL}
+	cmd.Run([]string{"vctl", "secret", "rotate", "--vulcan=" + server.URL})
+	server.Close()
+	ng.Close()
+	c.Assert(out.String(), Matches, "(?s).*3 key pairs and 4 client auth settings re-sealed.*")
+
+	// Every value can be opened once the old key is dropped
+	ng = openEngine(newKey)
+	defer ng.Close()
+	for _, h := range hosts {
+		out, err := ng.GetHost(h.Key())
+		c.Assert(err, IsNil)
+		c.Assert(out, DeepEquals, &h)
+	}
+	l, err := ng.GetListener(listener.Key())
+	c.Assert(err, IsNil)
+	c.Assert(l, DeepEquals, &listener)
+	b, err := ng.GetBackend(backend.Key())
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, &backend)
+}
+
+func (s *CmdSuite) TestApplyExport(c *C) {
+	keyPair := testutils.NewTestKeyPair()
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "localhost", Settings: engine.HostSettings{KeyPair: keyPair}}), IsNil)
+
+	b := "bk1"
+	tlsBackend := engine.Backend{Id: b, Type: engine.HTTP, Settings: engine.HTTPBackendSettings{
+		TLS: &engine.TLSSettings{KeyPair: keyPair},
+	}}
+	c.Assert(s.ng.UpsertBackend(tlsBackend), IsNil)
+	c.Assert(s.run("server", "upsert", "-id", "srv1", "-url", "http://localhost:5000", "-b", b), Matches, OK)
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", b, "-route", `Path("/path")`), Matches, OK)
+	c.Assert(s.run("connlimit", "upsert", "-f", f, "-id", "cl1", "-connections", "10", "-variable", "client.ip"), Matches, OK)
+
+	key, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+
+	file, err := ioutil.TempFile("", "vulcand")
+	c.Assert(err, IsNil)
+	file.Close()
+
+	s.run("export", "-f", file.Name(), "-sealKey", key)
+	data, err := ioutil.ReadFile(file.Name())
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), "BEGIN"), Equals, false)
+
+	c.Assert(s.run("apply", "-f", file.Name(), "-sealKey", key), Matches, ".*up to date.*")
+
+	// Make some changes that apply should revert
+	fk := engine.FrontendKey{Id: f}
+	c.Assert(s.ng.DeleteFrontend(fk), IsNil)
+	c.Assert(s.ng.DeleteHost(engine.HostKey{Name: "localhost"}), IsNil)
+	c.Assert(s.run("backend", "upsert", "-id", "bk2"), Matches, OK)
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+
+	out := s.run("apply", "-f", file.Name(), "-sealKey", key, "-dry-run")
+	c.Assert(out, Matches, ".*\\+ host localhost.*\\+ frontend fr1.*\\+ middleware fr1.cl1.*")
+	_, err = s.ng.GetFrontend(fk)
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	c.Assert(s.run("apply", "-f", file.Name(), "-sealKey", key), Matches, ".*4 changes applied.*")
+	h, err := s.ng.GetHost(engine.HostKey{Name: "localhost"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.KeyPair, DeepEquals, keyPair)
+	be, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(be.HTTPSettings().TLS.KeyPair, DeepEquals, keyPair)
+	_, err = s.ng.GetMiddleware(engine.MiddlewareKey{FrontendKey: fk, Id: "cl1"})
+	c.Assert(err, IsNil)
+	_, err = s.ng.GetBackend(engine.BackendKey{Id: "bk2"})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.run("apply", "-f", file.Name(), "-sealKey", key, "-prune"), Matches, ".*- backend bk2.*1 changes applied.*")
+	_, err = s.ng.GetBackend(engine.BackendKey{Id: "bk2"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *CmdSuite) TestHistoryRollback(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", b, "-route", `Path("/v1")`), Matches, OK)
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", b, "-route", `Path("/v2")`), Matches, OK)
+	c.Assert(s.run("backend", "upsert", "-id", "bk2"), Matches, OK)
+
+	revisions, err := s.ng.GetHistory(engine.HistoryQuery{Key: engine.FrontendKey{Id: f}})
+	c.Assert(err, IsNil)
+	c.Assert(len(revisions), Equals, 2)
+
+	c.Assert(s.run("history"), Matches, ".*frontend fr1.*v1.*frontend fr1.*v2.*backend bk2.*")
+	c.Assert(s.run("history", "-kind", "frontend", "-id", f), Not(Matches), ".*bk2.*")
+
+	to := fmt.Sprintf("%d", revisions[0].Index)
+	c.Assert(s.run("rollback", "-to", to, "-kind", "frontend", "-id", f), Matches, ".*~ frontend fr1.*1 changes applied.*")
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.Route, Equals, `Path("/v1")`)
+	_, err = s.ng.GetBackend(engine.BackendKey{Id: "bk2"})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.run("rollback", "-to", to), Matches, ".*- backend bk2.*1 changes applied.*")
+	_, err = s.ng.GetBackend(engine.BackendKey{Id: "bk2"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
@@ -0,0 +1,243 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/codegangsta/cli"
+	"github.com/ghodss/yaml"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/secret"
+)
+
+func NewApplyCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:   "apply",
+		Usage:  "Apply configuration from a file, changing only the objects that differ from the running configuration",
+		Action: cmd.applyAction,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "file, f", Usage: "YAML or JSON file with the configuration, as produced by export"},
+			cli.BoolFlag{Name: "dry-run", Usage: "Print the changes without applying them"},
+			cli.BoolFlag{Name: "prune", Usage: "Remove objects missing from the file"},
+			cli.StringFlag{Name: "sealKey", Usage: "Seal key - used to open sealed key pairs"},
+		},
+	}
+}
+
+func NewExportCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:   "export",
+		Usage:  "Export the running configuration in the format accepted by apply",
+		Action: cmd.exportAction,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "file, f", Usage: "File to write to"},
+			cli.StringFlag{Name: "format", Value: "yaml", Usage: "Output format, yaml or json"},
+			cli.StringFlag{Name: "sealKey", Usage: "Seal key - used to seal host and backend key pairs, they are exported in plain text if omitted"},
+		},
+	}
+}
+
+// configDocument is the format of the files produced by export and consumed by apply,
+// it is a snapshot with host and backend key pairs optionally sealed and moved to SealedKeyPairs
+// and SealedBackendKeyPairs.
+type configDocument struct {
+	engine.Snapshot
+	// SealedKeyPairs maps hostnames to their sealed key pairs
+	SealedKeyPairs map[string]json.RawMessage `json:",omitempty"`
+	// SealedBackendKeyPairs maps backend ids to their sealed TLS client key pairs
+	SealedBackendKeyPairs map[string]json.RawMessage `json:",omitempty"`
+}
+
+func (cmd *Command) applyAction(c *cli.Context) error {
+	if c.String("file") == "" {
+		return fmt.Errorf("provide a configuration file with --file")
+	}
+	data, err := ioutil.ReadFile(c.String("file"))
+	if err != nil {
+		return err
+	}
+	desired, err := cmd.readConfig(data, c.String("sealKey"))
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", c.String("file"), err)
+	}
+	current, err := cmd.client.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	plan, err := engine.DiffSnapshots(current, desired, c.Bool("prune"))
+	if err != nil {
+		return err
+	}
+	return cmd.applyPlan(plan, c.Bool("dry-run"))
+}
+
+// applyPlan prints the plan and commits it in one transaction unless it is a dry run
+func (cmd *Command) applyPlan(plan *engine.Plan, dryRun bool) error {
+	if plan.Empty() {
+		cmd.printOk("configuration is up to date")
+		return nil
+	}
+	cmd.printPlan(plan)
+	if dryRun {
+		cmd.printInfo("dry run, no changes have been applied")
+		return nil
+	}
+	tx := plan.Transaction()
+	if err := cmd.client.Commit(tx); err != nil {
+		return err
+	}
+	cmd.printOk("%d changes applied", len(tx.Changes))
+	return nil
+}
+
+func (cmd *Command) exportAction(c *cli.Context) error {
+	snapshot, err := cmd.client.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	doc := configDocument{Snapshot: *snapshot}
+	if c.String("sealKey") != "" {
+		box, err := readBox(c.String("sealKey"))
+		if err != nil {
+			return err
+		}
+		doc.SealedKeyPairs = map[string]json.RawMessage{}
+		for i, h := range doc.Hosts {
+			if h.Settings.KeyPair == nil || h.Settings.KeyPair.Ref != "" {
+				continue
+			}
+			sealed, err := secret.SealKeyPairToJSON(box, h.Settings.KeyPair)
+			if err != nil {
+				return fmt.Errorf("failed to seal key pair of %v: %v", h.Name, err)
+			}
+			doc.SealedKeyPairs[h.Name] = sealed
+			doc.Hosts[i].Settings.KeyPair = nil
+		}
+		doc.SealedBackendKeyPairs = map[string]json.RawMessage{}
+		for i, bs := range doc.BackendSpecs {
+			settings := bs.Backend.HTTPSettings()
+			if settings.TLS == nil || settings.TLS.KeyPair == nil {
+				continue
+			}
+			sealed, err := secret.SealKeyPairToJSON(box, settings.TLS.KeyPair)
+			if err != nil {
+				return fmt.Errorf("failed to seal key pair of backend %v: %v", bs.Backend.Id, err)
+			}
+			doc.SealedBackendKeyPairs[bs.Backend.Id] = sealed
+			tlsSettings := *settings.TLS
+			tlsSettings.KeyPair = nil
+			settings.TLS = &tlsSettings
+			doc.BackendSpecs[i].Backend.Settings = settings
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	switch c.String("format") {
+	case "json":
+	case "yaml":
+		if data, err = yaml.JSONToYAML(data); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported format %q, use yaml or json", c.String("format"))
+	}
+
+	stream, closer, err := getStream(c)
+	if err != nil {
+		return err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+	if _, err := stream.Write(data); err != nil {
+		return fmt.Errorf("failed writing to output stream, error %s", err)
+	}
+	return nil
+}
+
+// readConfig parses the configuration document and opens the sealed key pairs
+func (cmd *Command) readConfig(data []byte, sealKey string) (*engine.Snapshot, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := engine.SnapshotFromJSON(cmd.registry.GetRouter(), data, cmd.registry.GetSpec)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		SealedKeyPairs        map[string]json.RawMessage
+		SealedBackendKeyPairs map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.SealedKeyPairs) == 0 && len(doc.SealedBackendKeyPairs) == 0 {
+		return snapshot, nil
+	}
+	if sealKey == "" {
+		return nil, fmt.Errorf("configuration has sealed key pairs, provide the seal key with --sealKey")
+	}
+	box, err := readBox(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range snapshot.Hosts {
+		raw, ok := doc.SealedKeyPairs[h.Name]
+		if !ok {
+			continue
+		}
+		keyPair, err := openKeyPair(box, raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open key pair of %v: %v", h.Name, err)
+		}
+		snapshot.Hosts[i].Settings.KeyPair = keyPair
+		delete(doc.SealedKeyPairs, h.Name)
+	}
+	for name := range doc.SealedKeyPairs {
+		return nil, fmt.Errorf("sealed key pair of %v does not match any host", name)
+	}
+	for i, bs := range snapshot.BackendSpecs {
+		raw, ok := doc.SealedBackendKeyPairs[bs.Backend.Id]
+		if !ok {
+			continue
+		}
+		keyPair, err := openKeyPair(box, raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open key pair of backend %v: %v", bs.Backend.Id, err)
+		}
+		settings := bs.Backend.HTTPSettings()
+		tlsSettings := engine.TLSSettings{}
+		if settings.TLS != nil {
+			tlsSettings = *settings.TLS
+		}
+		tlsSettings.KeyPair = keyPair
+		settings.TLS = &tlsSettings
+		if _, err := settings.TransportSettings(); err != nil {
+			return nil, fmt.Errorf("invalid TLS settings of backend %v: %v", bs.Backend.Id, err)
+		}
+		snapshot.BackendSpecs[i].Backend.Settings = settings
+		delete(doc.SealedBackendKeyPairs, bs.Backend.Id)
+	}
+	for id := range doc.SealedBackendKeyPairs {
+		return nil, fmt.Errorf("sealed key pair of backend %v does not match any backend", id)
+	}
+	return snapshot, nil
+}
+
+// openKeyPair opens the key pair sealed by SealKeyPairToJSON
+func openKeyPair(box *secret.Box, raw json.RawMessage) (*engine.KeyPair, error) {
+	sealed, err := secret.SealedValueFromJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := box.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return engine.KeyPairFromJSON(bytes)
+}
@@ -1,6 +1,10 @@
 package command
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/codegangsta/cli"
 	"github.com/vulcand/route"
 	"github.com/vulcand/vulcand/engine"
@@ -32,7 +36,22 @@ func NewFrontendCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "id, autogenerated if empty"},
 					cli.StringFlag{Name: "route", Usage: "roue, will be matched against request's path"},
 					cli.DurationFlag{Name: "ttl", Usage: "time to live duration, persistent if omitted"},
-					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
+					cli.StringFlag{Name: "backend, b", Usage: "backend id, defaults to the first of the split backends"},
+					cli.StringFlag{Name: "split", Usage: "backends splitting the traffic by weight, e.g. stable=95,canary=5"},
+					cli.StringFlag{Name: "pinHeader", Usage: "header naming the backend of the split to send the request to"},
+					cli.StringFlag{Name: "pinCookie", Usage: "cookie naming the backend of the split to send the request to, set on responses"},
+					cli.StringFlag{Name: "mirror", Usage: "shadow backend id to send copies of the requests to"},
+					cli.Float64Flag{Name: "mirrorPercent", Usage: "percent of the requests to mirror", Value: 100},
+					cli.IntFlag{Name: "mirrorMaxBodyKB", Usage: "maximum request size to mirror, in KB"},
+					cli.IntFlag{Name: "mirrorMaxInFlight", Usage: "maximum number of mirrored requests in flight"},
+					cli.StringFlag{Name: "fanOut", Usage: "backends to send every request to, as backend[:key[:timeout]], e.g. users:user:2s,orders:orders"},
+					cli.StringFlag{Name: "merge", Usage: "fanout merge of the responses: json, first or quorum"},
+					cli.IntFlag{Name: "quorum", Usage: "number of the same responses the quorum merge returns, majority by default"},
+					cli.StringFlag{Name: "onPartialFailure", Usage: "what the json merge does if some backends fail: fail or ignore"},
+					cli.IntFlag{Name: "fanOutMaxResponseKB", Usage: "maximum fanout backend response size to merge, in KB"},
+					cli.StringFlag{Name: "listener", Usage: "tcp listener id, makes a tcp frontend proxying the listener connections"},
+					cli.StringFlag{Name: "sni", Usage: "server name of the TLS connections of an https listener passed through by the tcp frontend, e.g. *.example.com"},
+					cli.DurationFlag{Name: "idleTimeout", Usage: "time after which idle connections of tcp frontends are closed, never if omitted"},
 				}, frontendOptions()...),
 				Action: cmd.upsertFrontendAction,
 			},
@@ -77,10 +96,60 @@ func (cmd *Command) upsertFrontendAction(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	f, err := engine.NewHTTPFrontend(route.NewMux(), c.String("id"), c.String("b"), c.String("route"), settings)
+	backends, err := parseSplit(c.String("split"))
 	if err != nil {
 		return err
 	}
+	var f *engine.Frontend
+	if c.String("listener") != "" {
+		tcpSettings := engine.TCPFrontendSettings{ListenerId: c.String("listener"), SNI: c.String("sni")}
+		if c.Duration("idleTimeout") != 0 {
+			tcpSettings.IdleTimeout = c.Duration("idleTimeout").String()
+		}
+		f, err = engine.NewTCPFrontend(c.String("id"), c.String("b"), tcpSettings)
+		if err != nil {
+			return err
+		}
+	} else if c.String("fanOut") != "" {
+		f, err = engine.NewFanOutFrontend(route.NewMux(), c.String("id"), c.String("route"), engine.FanOutFrontendSettings{
+			HTTPFrontendSettings: settings,
+			Branches:             parseFanOut(c.String("fanOut")),
+			Merge:                c.String("merge"),
+			Quorum:               c.Int("quorum"),
+			OnPartialFailure:     c.String("onPartialFailure"),
+			MaxResponseBytes:     int64(c.Int("fanOutMaxResponseKB") * 1024),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		beID := c.String("b")
+		if beID == "" && len(backends) != 0 {
+			beID = backends[0].Id
+		}
+		f, err = engine.NewHTTPFrontend(route.NewMux(), c.String("id"), beID, c.String("route"), settings)
+		if err != nil {
+			return err
+		}
+	}
+	var pin *engine.BackendPin
+	if c.String("pinHeader") != "" || c.String("pinCookie") != "" {
+		pin = &engine.BackendPin{Header: c.String("pinHeader"), Cookie: c.String("pinCookie")}
+	}
+	if err := f.SetBackends(backends, pin); err != nil {
+		return err
+	}
+	if c.String("mirror") != "" {
+		err := f.SetMirror(&engine.FrontendMirror{
+			BackendId:    c.String("mirror"),
+			Percent:      c.Float64("mirrorPercent"),
+			MaxBodyBytes: int64(c.Int("mirrorMaxBodyKB") * 1024),
+			MaxInFlight:  c.Int("mirrorMaxInFlight"),
+		})
+		if err != nil {
+			return err
+		}
+	}
 	if err := cmd.client.UpsertFrontend(*f, c.Duration("ttl")); err != nil {
 		return err
 	}
@@ -97,6 +166,43 @@ func (cmd *Command) deleteFrontendAction(c *cli.Context) error {
 	return nil
 }
 
+// parseSplit parses comma separated backend weights, e.g. stable=95,canary=5
+func parseSplit(v string) ([]engine.FrontendBackend, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var out []engine.FrontendBackend
+	for _, p := range strings.Split(v, ",") {
+		vals := strings.SplitN(p, "=", 2)
+		if len(vals) != 2 {
+			return nil, fmt.Errorf("expected backend=weight, got %q", p)
+		}
+		weight, err := strconv.Atoi(vals[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad weight of backend %v: %v", vals[0], err)
+		}
+		out = append(out, engine.FrontendBackend{Id: vals[0], Weight: weight})
+	}
+	return out, nil
+}
+
+// parseFanOut parses comma separated fanout branches, e.g. users:user:2s,orders
+func parseFanOut(v string) []engine.FanOutBranch {
+	var out []engine.FanOutBranch
+	for _, p := range strings.Split(v, ",") {
+		vals := strings.SplitN(p, ":", 3)
+		b := engine.FanOutBranch{BackendId: vals[0]}
+		if len(vals) > 1 {
+			b.Key = vals[1]
+		}
+		if len(vals) > 2 {
+			b.Timeout = vals[2]
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
 func getFrontendSettings(c *cli.Context) (engine.HTTPFrontendSettings, error) {
 	s := engine.HTTPFrontendSettings{}
 
@@ -108,6 +214,27 @@ func getFrontendSettings(c *cli.Context) (engine.HTTPFrontendSettings, error) {
 	s.TrustForwardHeader = c.Bool("trustForwardHeader")
 	s.PassHostHeader = c.Bool("passHostHeader")
 
+	if c.Bool("hedge") {
+		s.Hedging = &engine.HTTPFrontendHedging{
+			Percentile:    c.Float64("hedgePercentile"),
+			MinDelay:      c.String("hedgeMinDelay"),
+			BudgetPercent: c.Int("hedgeBudgetPercent"),
+		}
+	}
+	if c.Bool("retry") {
+		s.Retry = &engine.HTTPFrontendRetry{
+			Attempts:      c.Int("retryAttempts"),
+			StatusCodes:   c.IntSlice("retryOn"),
+			Methods:       c.StringSlice("retryMethod"),
+			PerTryTimeout: c.String("retryPerTryTimeout"),
+			Backoff:       c.String("retryBackoff"),
+			MaxBackoff:    c.String("retryMaxBackoff"),
+			BudgetPercent: c.Int("retryBudgetPercent"),
+		}
+	}
+	if c.String("timeout") != "" {
+		s.Deadline = &engine.HTTPFrontendDeadline{Timeout: c.String("timeout"), Header: c.String("deadlineHeader")}
+	}
 	return s, nil
 }
 
@@ -122,5 +249,25 @@ func frontendOptions() []cli.Flag {
 		cli.StringFlag{Name: "forwardHost", Usage: "hostname to set when forwarding a request"},
 		cli.BoolFlag{Name: "trustForwardHeader", Usage: "allows copying X-Forwarded-For header value from the original request"},
 		cli.BoolFlag{Name: "passHostHeader", Usage: "allows passing custom headers to the backend servers"},
+
+		// Hedging
+		cli.BoolFlag{Name: "hedge", Usage: "sends GET and HEAD requests to another server if the first one is slow"},
+		cli.Float64Flag{Name: "hedgePercentile", Usage: "percentile of the backend latency to wait for before hedging, 95 by default"},
+		cli.StringFlag{Name: "hedgeMinDelay", Usage: "shortest wait before hedging, e.g. 10ms"},
+		cli.IntFlag{Name: "hedgeBudgetPercent", Usage: "maximum percent of the requests to hedge, 10 by default"},
+
+		// Retry policy
+		cli.BoolFlag{Name: "retry", Usage: "retries failed requests on other servers of the backend"},
+		cli.IntFlag{Name: "retryAttempts", Usage: "maximum number of retries of a request, 2 by default"},
+		cli.IntSliceFlag{Name: "retryOn", Usage: "status code of the responses to retry, 502, 503 and 504 by default", Value: &cli.IntSlice{}},
+		cli.StringSliceFlag{Name: "retryMethod", Usage: "method of the requests to retry, GET, HEAD and OPTIONS by default", Value: &cli.StringSlice{}},
+		cli.StringFlag{Name: "retryPerTryTimeout", Usage: "timeout of every attempt, e.g. 1s"},
+		cli.StringFlag{Name: "retryBackoff", Usage: "wait before the first retry, doubled with every retry, e.g. 25ms"},
+		cli.StringFlag{Name: "retryMaxBackoff", Usage: "longest wait before a retry, e.g. 250ms"},
+		cli.IntFlag{Name: "retryBudgetPercent", Usage: "maximum percent of the requests to retry, 20 by default"},
+
+		// Request deadline
+		cli.StringFlag{Name: "timeout", Usage: "total time of a request including the retries, e.g. 5s"},
+		cli.StringFlag{Name: "deadlineHeader", Usage: "header with the milliseconds left to the servers, X-Request-Deadline by default"},
 	}
 }
@@ -0,0 +1,123 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/engine"
+)
+
+func NewHistoryCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:   "history",
+		Usage:  "Show configuration changes, optionally limited to a single object",
+		Action: cmd.printHistoryAction,
+		Flags: append([]cli.Flag{
+			cli.IntFlag{Name: "limit", Value: 20, Usage: "maximum number of the most recent changes to show, 0 shows all"},
+		}, objectFlags()...),
+	}
+}
+
+func NewRollbackCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:   "rollback",
+		Usage:  "Restore the configuration or a single object as of the given revision",
+		Action: cmd.rollbackAction,
+		Flags: append([]cli.Flag{
+			cli.IntFlag{Name: "to", Usage: "revision to restore, see vctl history"},
+			cli.BoolFlag{Name: "dry-run", Usage: "Print the changes without applying them"},
+		}, objectFlags()...),
+	}
+}
+
+func objectFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "kind", Usage: "object kind: host, listener, backend, server, frontend or middleware"},
+		cli.StringFlag{Name: "id", Usage: "object id, or hostname for hosts"},
+		cli.StringFlag{Name: "backend, b", Usage: "backend id, for servers"},
+		cli.StringFlag{Name: "frontend, f", Usage: "frontend id, for middlewares"},
+	}
+}
+
+func (cmd *Command) printHistoryAction(c *cli.Context) error {
+	key, err := getObjectKey(c)
+	if err != nil {
+		return err
+	}
+	revisions, err := cmd.client.GetHistory(engine.HistoryQuery{Key: key, Limit: c.Int("limit")})
+	if err != nil {
+		return err
+	}
+	cmd.printHistory(revisions)
+	return nil
+}
+
+func (cmd *Command) rollbackAction(c *cli.Context) error {
+	if c.Int("to") <= 0 {
+		return fmt.Errorf("provide the revision to restore with --to")
+	}
+	key, err := getObjectKey(c)
+	if err != nil {
+		return err
+	}
+	target, err := cmd.client.GetSnapshotAt(uint64(c.Int("to")))
+	if err != nil {
+		return err
+	}
+	current, err := cmd.client.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	plan, err := engine.DiffSnapshots(current, target, true)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		plan = filterPlan(plan, key)
+	}
+	return cmd.applyPlan(plan, c.Bool("dry-run"))
+}
+
+// filterPlan leaves only the changes of the object with the given key
+func filterPlan(p *engine.Plan, key interface{}) *engine.Plan {
+	q := engine.HistoryQuery{Key: key}
+	out := &engine.Plan{}
+	for _, ch := range p.Added {
+		if q.Matches(ch) {
+			out.Added = append(out.Added, ch)
+		}
+	}
+	for _, ch := range p.Changed {
+		if q.Matches(ch) {
+			out.Changed = append(out.Changed, ch)
+		}
+	}
+	for _, ch := range p.Removed {
+		if q.Matches(ch) {
+			out.Removed = append(out.Removed, ch)
+		}
+	}
+	return out
+}
+
+// getObjectKey returns the key of the object selected by the flags, or nil if no object is selected
+func getObjectKey(c *cli.Context) (interface{}, error) {
+	id := c.String("id")
+	switch c.String("kind") {
+	case "":
+		return nil, nil
+	case "host":
+		return engine.HostKey{Name: id}, nil
+	case "listener":
+		return engine.ListenerKey{Id: id}, nil
+	case "backend":
+		return engine.BackendKey{Id: id}, nil
+	case "server":
+		return engine.ServerKey{BackendKey: engine.BackendKey{Id: c.String("backend")}, Id: id}, nil
+	case "frontend":
+		return engine.FrontendKey{Id: id}, nil
+	case "middleware":
+		return engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: c.String("frontend")}, Id: id}, nil
+	}
+	return nil, fmt.Errorf("unsupported kind %q", c.String("kind"))
+}
@@ -29,16 +29,17 @@ func NewHostCommand(cmd *Command) cli.Command {
 			},
 			{
 				Name: "upsert",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					cli.StringFlag{Name: "name", Usage: "hostname"},
 					cli.StringFlag{Name: "privateKey", Usage: "Path to a private key"},
 					cli.StringFlag{Name: "cert", Usage: "Path to a certificate"},
+					cli.StringFlag{Name: "keyPairRef", Usage: "Reference to a key pair kept outside of vulcand, e.g. file:///etc/certs/x.pem or exec://helper get x"},
 
 					cli.BoolFlag{Name: "ocsp", Usage: "Turn OCSP on"},
 					cli.BoolFlag{Name: "ocspSkipCheck", Usage: "Insecure: skip signature checking for the OCSP certificate"},
 					cli.DurationFlag{Name: "ocspPeriod", Usage: "optional OCSP period", Value: time.Hour},
 					cli.StringSliceFlag{Name: "ocspResponder", Usage: "Optional list of OCSP responders", Value: &cli.StringSlice{}},
-				},
+				}, getClientAuthFlags()...),
 				Usage:  "Update or insert a new host to vulcan proxy",
 				Action: cmd.upsertHostAction,
 			},
@@ -84,12 +85,25 @@ func (cmd *Command) upsertHostAction(c *cli.Context) error {
 		}
 		host.Settings.KeyPair = keyPair
 	}
+	if c.String("keyPairRef") != "" {
+		if host.Settings.KeyPair != nil {
+			return fmt.Errorf("provide either a certificate and a private key or a key pair reference")
+		}
+		keyPair, err := engine.NewKeyPairRef(c.String("keyPairRef"))
+		if err != nil {
+			return err
+		}
+		host.Settings.KeyPair = keyPair
+	}
 	host.Settings.OCSP = engine.OCSPSettings{
 		Enabled:            c.Bool("ocsp"),
 		SkipSignatureCheck: c.Bool("ocspSkipCheck"),
 		Period:             c.Duration("ocspPeriod").String(),
 		Responders:         c.StringSlice("ocspResponder"),
 	}
+	if host.Settings.ClientAuth, err = getClientAuthSettings(c); err != nil {
+		return err
+	}
 	if err := cmd.client.UpsertHost(*host); err != nil {
 		return err
 	}
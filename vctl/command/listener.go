@@ -29,12 +29,12 @@ func NewListenerCommand(cmd *Command) cli.Command {
 				Usage: "Update or insert a listener",
 				Flags: append([]cli.Flag{
 					cli.StringFlag{Name: "id", Usage: "id"},
-					cli.StringFlag{Name: "proto", Usage: "protocol, either http or https"},
+					cli.StringFlag{Name: "proto", Usage: "protocol, either http, https or tcp"},
 					cli.StringFlag{Name: "net", Value: "tcp", Usage: "network, tcp or unix"},
 					cli.StringFlag{Name: "addr", Value: "tcp", Usage: "address to bind to, e.g. 'localhost:31000'"},
 					cli.StringFlag{Name: "scope", Usage: "scope expression limits the listener, e.g. 'Hostname(`myhost`)'"},
 					cli.StringFlag{Name: "proxy-header", Value: "none", Usage: "none or PROXY_V1"},
-				}, getTLSFlags()...),
+				}, append(getTLSFlags(), getClientAuthFlags()...)...),
 				Action: cmd.upsertListenerAction,
 			},
 			{
@@ -56,7 +56,11 @@ func (cmd *Command) upsertListenerAction(c *cli.Context) error {
 		if err != nil {
 			return err
 		}
-		settings = &engine.HTTPSListenerSettings{TLS: *s}
+		clientAuth, err := getClientAuthSettings(c)
+		if err != nil {
+			return err
+		}
+		settings = &engine.HTTPSListenerSettings{TLS: *s, ClientAuth: clientAuth}
 	}
 	listener, err := engine.NewListener(c.String("id"), c.String("proto"), c.String("net"), c.String("addr"), c.String("scope"), c.String("proxy-header"), settings)
 	if err != nil {
@@ -36,11 +36,17 @@ func serversOverview(servers []engine.Server) string {
 }
 
 func frontendOverview(w io.Writer, l engine.Frontend) {
-	s := l.Stats
+	statsOverview(w, l.Id, l.Route, l.Stats)
+	// Mirrored requests go right below the frontend to compare them easily
+	if l.Mirror != nil && l.MirrorStats != nil {
+		statsOverview(w, fmt.Sprintf("%s (mirror %s)", l.Id, l.Mirror.BackendId), l.Route, l.MirrorStats)
+	}
+}
 
+func statsOverview(w io.Writer, id, route string, s *engine.RoundTripStats) {
 	fmt.Fprintf(w, "%s\t%s\t%0.1f\t%0.2f\t%0.2f\t%0.2f\t%s\t%s\n",
-		l.Id,
-		l.Route,
+		id,
+		route,
 		s.RequestsPerSecond(),
 		latencyAtQuantile(50.0, s),
 		latencyAtQuantile(95.0, s),
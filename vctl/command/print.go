@@ -103,6 +103,30 @@ func (cmd *Command) printFrontend(f *engine.Frontend, ms []engine.Middleware) {
 	writeS(cmd.out, middlewaresView(ms))
 }
 
+func (cmd *Command) printHistory(rs []engine.Revision) {
+	fmt.Fprintf(cmd.out, "\n[History]\n")
+	writeS(cmd.out, historyView(rs))
+}
+
+func (cmd *Command) printEjections(es []engine.OutlierEjection) {
+	fmt.Fprintf(cmd.out, "\n[Ejections]\n")
+	writeS(cmd.out, ejectionsView(es))
+}
+
+func (cmd *Command) printPlan(p *engine.Plan) {
+	fmt.Fprintf(cmd.out, "\n[Plan]\n")
+	for _, ch := range p.Added {
+		fmt.Fprintf(cmd.out, "+ %s\n", changeTarget(ch))
+	}
+	for _, ch := range p.Changed {
+		fmt.Fprintf(cmd.out, "~ %s\n", changeTarget(ch))
+	}
+	for _, ch := range p.Removed {
+		fmt.Fprintf(cmd.out, "- %s\n", changeTarget(ch))
+	}
+	fmt.Fprintf(cmd.out, "\n%d to add, %d to change, %d to remove\n", len(p.Added), len(p.Changed), len(p.Removed))
+}
+
 func writeS(w io.Writer, v string) {
 	w.Write([]byte(v))
 }
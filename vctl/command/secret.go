@@ -33,6 +33,11 @@ func NewKeyCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "cert", Usage: "Path to a certificate"},
 				},
 			},
+			{
+				Name:   "rotate",
+				Usage:  "Re-seal all stored key pairs with the newest seal key of vulcand",
+				Action: cmd.rotateKeyAction,
+			},
 		},
 	}
 }
@@ -56,6 +61,60 @@ func (cmd *Command) generateKeyAction(c *cli.Context) error {
 	return nil
 }
 
+// rotateKeyAction upserts every host, listener and backend with a sealed key pair or client authentication settings,
+// so the engine seals them again with the newest key of its keyring. Vulcand keeps serving the hosts while they are
+// re-sealed, because every key in the keyring can open the values.
+func (cmd *Command) rotateKeyAction(c *cli.Context) error {
+	hosts, err := cmd.client.GetHosts()
+	if err != nil {
+		return err
+	}
+	keyPairs, clientAuths := 0, 0
+	for _, h := range hosts {
+		sealedKeyPair := h.Settings.KeyPair != nil && h.Settings.KeyPair.Ref == ""
+		if !sealedKeyPair && h.Settings.ClientAuth == nil {
+			continue
+		}
+		if err := cmd.client.UpsertHost(h); err != nil {
+			return fmt.Errorf("failed to re-seal host %v: %v", h.Name, err)
+		}
+		if sealedKeyPair {
+			keyPairs++
+		}
+		if h.Settings.ClientAuth != nil {
+			clientAuths++
+		}
+	}
+	listeners, err := cmd.client.GetListeners()
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		if l.Settings == nil || l.Settings.ClientAuth == nil {
+			continue
+		}
+		if err := cmd.client.UpsertListener(l); err != nil {
+			return fmt.Errorf("failed to re-seal listener %v: %v", l.Id, err)
+		}
+		clientAuths++
+	}
+	backends, err := cmd.client.GetBackends()
+	if err != nil {
+		return err
+	}
+	for _, b := range backends {
+		if tls := b.HTTPSettings().TLS; tls == nil || tls.KeyPair == nil {
+			continue
+		}
+		if err := cmd.client.UpsertBackend(b); err != nil {
+			return fmt.Errorf("failed to re-seal key pair of backend %v: %v", b.Id, err)
+		}
+		keyPairs++
+	}
+	cmd.printOk("%d key pairs and %d client auth settings re-sealed", keyPairs, clientAuths)
+	return nil
+}
+
 func (cmd *Command) sealKeyPairAction(c *cli.Context) error {
 	// Read the key and get a box
 	box, err := readBox(c.String("sealKey"))
@@ -91,7 +150,7 @@ func (cmd *Command) sealKeyPairAction(c *cli.Context) error {
 
 func getStream(c *cli.Context) (io.Writer, io.Closer, error) {
 	if c.String("file") != "" {
-		file, err := os.OpenFile(c.String("file"), os.O_WRONLY|os.O_CREATE, 0600)
+		file, err := os.OpenFile(c.String("file"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to open file %s, error: %s", c.String("file"), err)
 		}
@@ -35,6 +35,7 @@ func NewServerCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "server id"},
 					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
 					cli.StringFlag{Name: "url", Usage: "url in form <scheme>://<host>:<port>"},
+					cli.IntFlag{Name: "weight", Usage: "relative share of requests the server gets, 0 means the default weight of 1"},
 					cli.DurationFlag{Name: "ttl", Usage: "ttl"},
 				},
 			},
@@ -52,7 +53,7 @@ func NewServerCommand(cmd *Command) cli.Command {
 }
 
 func (cmd *Command) upsertServerAction(c *cli.Context) error {
-	s, err := engine.NewServer(c.String("id"), c.String("url"))
+	s, err := engine.NewWeightedServer(c.String("id"), c.String("url"), c.Int("weight"))
 	if err != nil {
 		return err
 	}
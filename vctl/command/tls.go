@@ -1,6 +1,9 @@
 package command
 
 import (
+	"fmt"
+	"io/ioutil"
+
 	"github.com/codegangsta/cli"
 	"github.com/vulcand/vulcand/engine"
 )
@@ -38,3 +41,73 @@ func getTLSSettings(c *cli.Context) (*engine.TLSSettings, error) {
 	}
 	return s, nil
 }
+
+func getBackendTLSFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "tlsCert", Usage: "path to the client certificate presented to the servers"},
+		cli.StringFlag{Name: "tlsKey", Usage: "path to the private key of the client certificate"},
+		cli.StringFlag{Name: "tlsRootCAs", Usage: "path to the PEM bundle of the CAs server certificates are verified against, system CAs by default"},
+		cli.StringFlag{Name: "tlsServerName", Usage: "server name sent in SNI and verified in server certificates, the server host by default"},
+		cli.StringSliceFlag{Name: "tlsPinSPKI", Usage: "base64 SHA-256 hash of a pinned server public key", Value: &cli.StringSlice{}},
+	}
+}
+
+// setBackendTLSSettings sets the TLS settings supported by backends only.
+func setBackendTLSSettings(c *cli.Context, s *engine.TLSSettings) error {
+	if c.String("tlsCert") != "" || c.String("tlsKey") != "" {
+		keyPair, err := readKeyPair(c.String("tlsCert"), c.String("tlsKey"))
+		if err != nil {
+			return fmt.Errorf("failed to read client key pair: %s", err)
+		}
+		s.KeyPair = keyPair
+	}
+	if path := c.String("tlsRootCAs"); path != "" {
+		rootCAs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read root CA bundle: %s", err)
+		}
+		s.RootCAs = rootCAs
+	}
+	s.ServerName = c.String("tlsServerName")
+	s.PinnedSPKI = c.StringSlice("tlsPinSPKI")
+	_, err := engine.NewTLSConfig(s)
+	return err
+}
+
+func getClientAuthFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "clientAuth", Usage: "client certificate authentication: none, request or require"},
+		cli.StringFlag{Name: "clientCA", Usage: "path to the PEM bundle of the CAs client certificates are verified against"},
+		cli.StringFlag{Name: "clientCRL", Usage: "optional path to the client certificate revocation list on the proxy hosts"},
+		cli.StringFlag{Name: "clientSubjectHeader", Usage: "header passing the client certificate subject, default X-Client-Cert-Subject"},
+		cli.StringFlag{Name: "clientSANsHeader", Usage: "header passing the client certificate SANs, default X-Client-Cert-Sans"},
+		cli.StringFlag{Name: "clientFingerprintHeader", Usage: "header passing the client certificate fingerprint, default X-Client-Cert-Fingerprint"},
+	}
+}
+
+// getClientAuthSettings returns the client auth settings, or nil if the client auth type is not set.
+func getClientAuthSettings(c *cli.Context) (*engine.ClientAuthSettings, error) {
+	if c.String("clientAuth") == "" {
+		return nil, nil
+	}
+	s := &engine.ClientAuthSettings{
+		Type: c.String("clientAuth"),
+		CRL:  c.String("clientCRL"),
+		Headers: engine.ClientCertHeaders{
+			Subject:     c.String("clientSubjectHeader"),
+			SANs:        c.String("clientSANsHeader"),
+			Fingerprint: c.String("clientFingerprintHeader"),
+		},
+	}
+	if path := c.String("clientCA"); path != "" {
+		ca, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA bundle: %s", err)
+		}
+		s.CA = ca
+	}
+	if _, err := s.Parse(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
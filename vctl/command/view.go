@@ -1,8 +1,11 @@
 package command
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/buger/goterm"
 	"github.com/vulcand/vulcand/engine"
@@ -44,7 +47,7 @@ func listenerView(l *engine.Listener) string {
 
 func frontendsView(fs []engine.Frontend) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tRoute\tBackend\tType\n")
+	fmt.Fprint(t, "Id\tRoute\tBackend\tMirror\tType\n")
 
 	if len(fs) == 0 {
 		return t.String()
@@ -56,12 +59,48 @@ func frontendsView(fs []engine.Frontend) string {
 }
 
 func frontendView(f *engine.Frontend) string {
-	return fmt.Sprintf("%s\t%s\t%s\t%s\n", f.Id, f.Route, f.BackendId, f.Type)
+	mirror := ""
+	if f.Mirror != nil {
+		mirror = fmt.Sprintf("%s=%g%%", f.Mirror.BackendId, f.Mirror.Percent)
+	}
+	route := f.Route
+	// tcp frontends serve the connections of a listener instead
+	if s, ok := f.Settings.(engine.TCPFrontendSettings); ok {
+		route = fmt.Sprintf("listener(%s)", s.ListenerId)
+		if s.SNI != "" {
+			route = fmt.Sprintf("listener(%s) sni(%s)", s.ListenerId, s.SNI)
+		}
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", f.Id, route, frontendBackendsView(f), mirror, f.Type)
+}
+
+// frontendBackendsView shows the backend of the frontend, the backends
+// splitting its traffic with their weights or the fanout backends.
+func frontendBackendsView(f *engine.Frontend) string {
+	if s, ok := f.Settings.(engine.FanOutFrontendSettings); ok {
+		vals := make([]string, len(s.Branches))
+		for i, b := range s.Branches {
+			vals[i] = b.BackendId
+		}
+		merge := s.Merge
+		if merge == "" {
+			merge = engine.FanOutMergeJSON
+		}
+		return fmt.Sprintf("%s(%s)", merge, strings.Join(vals, ","))
+	}
+	if len(f.Backends) == 0 {
+		return f.BackendId
+	}
+	vals := make([]string, len(f.Backends))
+	for i, b := range f.Backends {
+		vals[i] = fmt.Sprintf("%s=%d", b.Id, b.Weight)
+	}
+	return strings.Join(vals, ",")
 }
 
 func backendsView(bs []engine.Backend) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tType\n")
+	fmt.Fprint(t, "Id\tType\tLoadBalancer\n")
 
 	if len(bs) == 0 {
 		return t.String()
@@ -73,12 +112,16 @@ func backendsView(bs []engine.Backend) string {
 }
 
 func backendView(b *engine.Backend) string {
-	return fmt.Sprintf("%s\t%s\n", b.Id, b.Type)
+	lb := b.HTTPSettings().LoadBalancer.Type
+	if lb == "" {
+		lb = engine.LBRoundRobin
+	}
+	return fmt.Sprintf("%s\t%s\t%s\n", b.Id, b.Type, lb)
 }
 
 func serversView(srvs []engine.Server) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tURL\n")
+	fmt.Fprint(t, "Id\tURL\tWeight\tHealth\n")
 	if len(srvs) == 0 {
 		return t.String()
 	}
@@ -89,7 +132,18 @@ func serversView(srvs []engine.Server) string {
 }
 
 func serverView(s *engine.Server) string {
-	return fmt.Sprintf("%s\t%s\n", s.Id, s.URL)
+	weight := s.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	health := "-"
+	if s.Health != nil {
+		health = "healthy"
+		if !s.Health.Healthy {
+			health = fmt.Sprintf("unhealthy (%v)", s.Health.Error)
+		}
+	}
+	return fmt.Sprintf("%s\t%s\t%d\t%s\n", s.Id, s.URL, weight, health)
 }
 
 func middlewaresView(ms []engine.Middleware) string {
@@ -128,3 +182,95 @@ func (s *middlewareSorter) Swap(i, j int) {
 func (s *middlewareSorter) Less(i, j int) bool {
 	return s.ms[i].Priority < s.ms[j].Priority
 }
+
+func historyView(rs []engine.Revision) string {
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Revision\tTime\tChange\tDetails\n")
+
+	if len(rs) == 0 {
+		return t.String()
+	}
+	for _, r := range rs {
+		fmt.Fprint(t, revisionView(r))
+	}
+	return t.String()
+}
+
+func ejectionsView(es []engine.OutlierEjection) string {
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Time\tServer\tURL\tUntil\tReason\n")
+
+	if len(es) == 0 {
+		return t.String()
+	}
+	for _, e := range es {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\n", e.EjectedAt.Local().Format(time.RFC3339), e.ServerId, e.URL,
+			e.Until.Local().Format(time.RFC3339), e.Reason)
+	}
+	return t.String()
+}
+
+func revisionView(r engine.Revision) string {
+	ts := "-"
+	if !r.Time.IsZero() {
+		ts = r.Time.Local().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%d\t%s\t%s\t%s\n", r.Index, ts, changeTarget(r.Change), changeDetails(r.Change))
+}
+
+// changeDetails returns the upserted object, hosts are shown without key pairs
+func changeDetails(ch interface{}) string {
+	var v interface{}
+	switch c := ch.(type) {
+	case *engine.HostUpserted:
+		return c.Host.String()
+	case *engine.ListenerUpserted:
+		v = c.Listener
+	case *engine.BackendUpserted:
+		v = c.Backend
+	case *engine.ServerUpserted:
+		v = c.Server
+	case *engine.FrontendUpserted:
+		v = c.Frontend
+	case *engine.MiddlewareUpserted:
+		v = c.Middleware
+	default:
+		return "deleted"
+	}
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	return string(bytes)
+}
+
+// changeTarget returns a short description of the object affected by the change
+func changeTarget(ch interface{}) string {
+	switch c := ch.(type) {
+	case *engine.HostUpserted:
+		return fmt.Sprintf("host %v", c.Host.Key())
+	case *engine.HostDeleted:
+		return fmt.Sprintf("host %v", c.HostKey)
+	case *engine.ListenerUpserted:
+		return fmt.Sprintf("listener %v", c.Listener.Key())
+	case *engine.ListenerDeleted:
+		return fmt.Sprintf("listener %v", c.ListenerKey)
+	case *engine.BackendUpserted:
+		return fmt.Sprintf("backend %v", c.Backend.Key())
+	case *engine.BackendDeleted:
+		return fmt.Sprintf("backend %v", c.BackendKey)
+	case *engine.ServerUpserted:
+		return fmt.Sprintf("server %v", engine.ServerKey{BackendKey: c.BackendKey, Id: c.Server.Id})
+	case *engine.ServerDeleted:
+		return fmt.Sprintf("server %v", c.ServerKey)
+	case *engine.FrontendUpserted:
+		return fmt.Sprintf("frontend %v", c.Frontend.Key())
+	case *engine.FrontendDeleted:
+		return fmt.Sprintf("frontend %v", c.FrontendKey)
+	case *engine.MiddlewareUpserted:
+		return fmt.Sprintf("middleware %v", engine.MiddlewareKey{FrontendKey: c.FrontendKey, Id: c.Middleware.Id})
+	case *engine.MiddlewareDeleted:
+		return fmt.Sprintf("middleware %v", c.MiddlewareKey)
+	}
+	return fmt.Sprintf("%v", ch)
+}